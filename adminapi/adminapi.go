@@ -0,0 +1,133 @@
+// Package adminapi is a client for the management API of a running plugin
+// daemon, used by the subcommands which act on its volumes
+package adminapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client calls the management API
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// NewClient returns a client for the management API at addr, a unix socket
+// path or an http(s) url
+func NewClient(addr, token string) *Client {
+	c := &Client{base: strings.TrimSuffix(addr, "/"), token: token, http: &http.Client{Timeout: 5 * time.Minute}}
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "unix://") {
+		path := strings.TrimPrefix(addr, "unix://")
+		c.base = "http://admin"
+		c.http.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}}
+	}
+	return c
+}
+
+// StatusError is a non 2xx response of the management API
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("management api: %d: %s", e.Code, e.Message)
+}
+
+// IsStatus reports whether err is a response with the status code
+func IsStatus(err error, code int) bool {
+	es, ok := err.(*StatusError)
+	return ok && es.Code == code
+}
+
+// Call sends body as json and decodes the json response into out, either may be nil
+func (c *Client) Call(method, path string, body, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct{ Error string }
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &e) != nil {
+			e.Error = strings.TrimSpace(string(b))
+		}
+		return &StatusError{Code: resp.StatusCode, Message: e.Error}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// RunJob posts body to path as a background job and waits for it to finish,
+// decoding its result into out. Running jobs are polled every interval and
+// their progress, between 0 and 1, is passed to progress, which may be nil.
+func (c *Client) RunJob(path string, body, out interface{}, interval time.Duration, progress func(float64)) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	var job struct {
+		ID       string          `json:"id"`
+		State    string          `json:"state"`
+		Progress float64         `json:"progress"`
+		Error    string          `json:"error"`
+		Result   json.RawMessage `json:"result"`
+	}
+	if err := c.Call(http.MethodPost, path+sep+"async=true", body, &job); err != nil {
+		return err
+	}
+	for job.State == "running" {
+		if progress != nil {
+			progress(job.Progress)
+		}
+		time.Sleep(interval)
+		if err := c.Call(http.MethodGet, "/v1/jobs?id="+job.ID, nil, &job); err != nil {
+			return err
+		}
+	}
+	if job.State != "succeeded" {
+		return fmt.Errorf("job %s %s: %s", job.ID, job.State, job.Error)
+	}
+	if out != nil && len(job.Result) > 0 {
+		return json.Unmarshal(job.Result, out)
+	}
+	return nil
+}
+
+// Volume is a volume as the management API returns it
+type Volume struct {
+	Name       string
+	Mountpoint string
+	Status     map[string]interface{}
+}
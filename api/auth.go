@@ -0,0 +1,165 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Scopes a token can be granted. A route requires exactly one scope.
+const (
+	ScopeRead  = "read"  // inspect volumes, pools and metrics
+	ScopeWrite = "write" // create volumes and snapshots, change properties
+	ScopeAdmin = "admin" // destructive operations such as rollback and destroy
+	scopeAll   = "*"
+)
+
+// Roles bundle the scopes needed by common clients
+const (
+	RoleReadOnly = "read-only" // monitoring, may inspect but never change anything
+	RoleOperator = "operator"  // automation creating volumes and snapshots
+	RoleAdmin    = "admin"     // full access including destructive operations
+)
+
+var roles = map[string][]string{
+	RoleReadOnly: {ScopeRead},
+	RoleOperator: {ScopeRead, ScopeWrite},
+	RoleAdmin:    {ScopeRead, ScopeWrite, ScopeAdmin},
+}
+
+// TokenEnv is the environment variable tokens can be provided in, entries
+// are separated by semicolons and use the same format as the token file.
+const TokenEnv = "ZFS_PLUGIN_ADMIN_TOKENS"
+
+// Token is an API token and the scopes it grants
+type Token struct {
+	Name   string
+	hash   [sha256.Size]byte
+	scopes map[string]bool
+}
+
+// HasScope returns true if the token grants scope
+func (t *Token) HasScope(scope string) bool {
+	return t.scopes[scope] || t.scopes[scopeAll]
+}
+
+// Tokens is the set of tokens accepted by the management API
+type Tokens struct {
+	tokens []*Token
+}
+
+// LoadTokens reads tokens from a file and the TokenEnv environment variable.
+// Each entry has the form "<token> <grant>[,<grant>...] [<name>]" where a
+// grant is a role or a scope, lines starting with # are ignored. The admin
+// role includes the read and write scopes.
+func LoadTokens(file string) (*Tokens, error) {
+	ts := &Tokens{}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := ts.parse(f, file); err != nil {
+			return nil, err
+		}
+	}
+	if env := os.Getenv(TokenEnv); env != "" {
+		if err := ts.parse(strings.NewReader(strings.Replace(env, ";", "\n", -1)), TokenEnv); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+func (ts *Tokens) parse(r io.Reader, src string) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 2 || len(f) > 3 {
+			return fmt.Errorf("%s:%d: expected \"<token> <grants> [<name>]\"", src, n)
+		}
+		t := &Token{Name: fmt.Sprintf("%s:%d", src, n), hash: sha256.Sum256([]byte(f[0])), scopes: make(map[string]bool)}
+		if len(f) == 3 {
+			t.Name = f[2]
+		}
+		for _, grant := range strings.Split(f[1], ",") {
+			if scopes, ok := roles[grant]; ok {
+				for _, scope := range scopes {
+					t.scopes[scope] = true
+				}
+				continue
+			}
+			switch grant {
+			case ScopeRead, ScopeWrite, scopeAll:
+				t.scopes[grant] = true
+			default:
+				return fmt.Errorf("%s:%d: unknown role or scope %q", src, n, grant)
+			}
+		}
+		ts.tokens = append(ts.tokens, t)
+	}
+	return sc.Err()
+}
+
+// Enabled returns true if any tokens are configured
+func (ts *Tokens) Enabled() bool {
+	return ts != nil && len(ts.tokens) > 0
+}
+
+func (ts *Tokens) lookup(secret string) *Token {
+	h := sha256.Sum256([]byte(secret))
+	var found *Token
+	for _, t := range ts.tokens {
+		if subtle.ConstantTimeCompare(h[:], t.hash[:]) == 1 && found == nil {
+			found = t
+		}
+	}
+	return found
+}
+
+type tokenKey struct{}
+
+// TokenFromContext returns the token a request was authenticated with
+func TokenFromContext(ctx context.Context) *Token {
+	t, _ := ctx.Value(tokenKey{}).(*Token)
+	return t
+}
+
+// authenticate checks the bearer token of r against scope, it writes an
+// error and returns nil when the request may not proceed
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request, scope string) *http.Request {
+	if !s.cfg.Tokens.Enabled() {
+		return r
+	}
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing bearer token")
+		return nil
+	}
+	t := s.cfg.Tokens.lookup(strings.TrimPrefix(h, "Bearer "))
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return nil
+	}
+	if !t.HasScope(scope) {
+		log.WithFields(log.Fields{"token": t.Name, "scope": scope, "path": r.URL.Path}).Warn("Management API request denied")
+		writeError(w, http.StatusForbidden, fmt.Sprintf("token %s lacks the %s scope", t.Name, scope))
+		return nil
+	}
+	return r.WithContext(context.WithValue(r.Context(), tokenKey{}, t))
+}
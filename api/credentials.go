@@ -0,0 +1,51 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/credentials"
+)
+
+func (s *Server) listCredentials(w http.ResponseWriter, r *http.Request) {
+	infos, err := s.cfg.Credentials.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"credentials": infos})
+}
+
+func (s *Server) putCredential(w http.ResponseWriter, r *http.Request) {
+	var c credentials.Credential
+	if !decode(w, r, &c) {
+		return
+	}
+	if err := s.cfg.Credentials.Put(&c); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, credentials.ErrUnencrypted) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteCredential(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	ok, err := s.cfg.Credentials.Delete(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no stored credential named "+name)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	zfsdriver "github.com/TrilliumIT/docker-zfs-plugin/zfs"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// The CSI controller RPCs are served as JSON with the field names of the CSI
+// spec's protobuf JSON mapping, so a CSI sidecar shim only has to forward
+// them. Volume ids are volume names, snapshot ids are volume@snapshot.
+
+// csiCapabilities are the controller capabilities of ControllerGetCapabilities
+var csiCapabilities = []string{"CREATE_DELETE_VOLUME", "CREATE_DELETE_SNAPSHOT", "LIST_SNAPSHOTS", "CLONE_VOLUME"}
+
+type csiSnapshot struct {
+	SizeBytes      int64  `json:"size_bytes"`
+	SnapshotID     string `json:"snapshot_id"`
+	SourceVolumeID string `json:"source_volume_id"`
+	CreationTime   string `json:"creation_time"`
+	ReadyToUse     bool   `json:"ready_to_use"`
+}
+
+type csiContentSource struct {
+	Snapshot *struct {
+		SnapshotID string `json:"snapshot_id"`
+	} `json:"snapshot,omitempty"`
+	Volume *struct {
+		VolumeID string `json:"volume_id"`
+	} `json:"volume,omitempty"`
+}
+
+// csiError writes a CSI status code with the http status it maps to
+func csiError(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, map[string]string{"code": code, "message": msg})
+}
+
+// csiDriverError maps a driver error to a CSI status code by its category
+func csiDriverError(w http.ResponseWriter, err error) {
+	status, code := http.StatusInternalServerError, "INTERNAL"
+	switch zfsdriver.ErrorCategory(err) {
+	case zfsdriver.ErrCategoryBusy:
+		status, code = http.StatusTooManyRequests, "RESOURCE_EXHAUSTED"
+	case zfsdriver.ErrCategoryTimeout:
+		status, code = http.StatusGatewayTimeout, "DEADLINE_EXCEEDED"
+	case zfsdriver.ErrCategoryNotFound:
+		status, code = http.StatusNotFound, "NOT_FOUND"
+	case zfsdriver.ErrCategoryPolicy:
+		status, code = http.StatusConflict, "FAILED_PRECONDITION"
+	case zfsdriver.ErrCategoryUnavailable, zfsdriver.ErrCategorySuspended:
+		status, code = http.StatusServiceUnavailable, "UNAVAILABLE"
+	}
+	csiError(w, status, code, err.Error())
+}
+
+func notFound(err error) bool {
+	return zfsdriver.ErrorCategory(err) == zfsdriver.ErrCategoryNotFound
+}
+
+// parseSnapshotID splits a snapshot id into its volume and snapshot name
+func parseSnapshotID(id string) (string, string, bool) {
+	i := strings.LastIndex(id, "@")
+	if i <= 0 || i == len(id)-1 {
+		return "", "", false
+	}
+	return id[:i], id[i+1:], true
+}
+
+func toCSISnapshot(s zfsdriver.Snapshot) csiSnapshot {
+	return csiSnapshot{SnapshotID: s.Volume + "@" + s.Name, SourceVolumeID: s.Volume,
+		CreationTime: s.Created.UTC().Format(time.RFC3339Nano), ReadyToUse: true}
+}
+
+func (s *Server) csiCapabilities(w http.ResponseWriter, r *http.Request) {
+	caps := make([]interface{}, 0, len(csiCapabilities))
+	for _, c := range csiCapabilities {
+		caps = append(caps, map[string]interface{}{"rpc": map[string]string{"type": c}})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"capabilities": caps})
+}
+
+// csiCreateVolume creates a volume, a clone if a content source is given.
+// The capacity becomes its quota. Creating a volume which exists returns it.
+func (s *Server) csiCreateVolume(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name          string `json:"name"`
+		CapacityRange *struct {
+			RequiredBytes int64 `json:"required_bytes"`
+			LimitBytes    int64 `json:"limit_bytes"`
+		} `json:"capacity_range,omitempty"`
+		Parameters          map[string]string `json:"parameters,omitempty"`
+		VolumeContentSource *csiContentSource `json:"volume_content_source,omitempty"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		csiError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "name is required")
+		return
+	}
+	opts := make(map[string]string, len(req.Parameters)+2)
+	for k, v := range req.Parameters {
+		opts[k] = v
+	}
+	var capacity int64
+	if cr := req.CapacityRange; cr != nil {
+		capacity = cr.RequiredBytes
+		if capacity == 0 {
+			capacity = cr.LimitBytes
+		}
+		if capacity > 0 {
+			opts["quota"] = strconv.FormatInt(capacity, 10)
+		}
+	}
+	if src := req.VolumeContentSource; src != nil {
+		switch {
+		case src.Snapshot != nil:
+			vol, snap, ok := parseSnapshotID(src.Snapshot.SnapshotID)
+			if !ok {
+				csiError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid snapshot id "+src.Snapshot.SnapshotID)
+				return
+			}
+			opts[zfsdriver.OptFrom], opts[zfsdriver.OptSnapshot] = vol, snap
+		case src.Volume != nil:
+			opts[zfsdriver.OptFrom] = src.Volume.VolumeID
+		}
+	}
+	if _, err := s.cfg.Driver.Get(&volume.GetRequest{Name: req.Name}); err != nil {
+		if !notFound(err) {
+			csiDriverError(w, err)
+			return
+		}
+		if err := s.cfg.Driver.Create(&volume.CreateRequest{Name: req.Name, Options: opts}); err != nil {
+			csiDriverError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"volume": map[string]interface{}{
+		"volume_id": req.Name, "capacity_bytes": capacity, "content_source": req.VolumeContentSource}})
+}
+
+// csiDeleteVolume removes a volume, a volume which does not exist is deleted
+func (s *Server) csiDeleteVolume(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		VolumeID string `json:"volume_id"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.VolumeID == "" {
+		csiError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "volume_id is required")
+		return
+	}
+	if err := s.cfg.Driver.Remove(&volume.RemoveRequest{Name: req.VolumeID}); err != nil && !notFound(err) {
+		csiDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// csiCreateSnapshot snapshots a volume. Creating a snapshot which exists on
+// the same volume returns it.
+func (s *Server) csiCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SourceVolumeID string `json:"source_volume_id"`
+		Name           string `json:"name"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.SourceVolumeID == "" || req.Name == "" {
+		csiError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "source_volume_id and name are required")
+		return
+	}
+	snaps, err := s.cfg.Driver.ListSnapshots(req.SourceVolumeID)
+	if err != nil {
+		csiDriverError(w, err)
+		return
+	}
+	for _, sn := range snaps {
+		if sn.Name == req.Name {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"snapshot": toCSISnapshot(sn)})
+			return
+		}
+	}
+	sn, err := s.cfg.Driver.CreateSnapshot(req.SourceVolumeID, req.Name)
+	if err != nil {
+		csiDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"snapshot": toCSISnapshot(*sn)})
+}
+
+// csiDeleteSnapshot destroys a snapshot, a snapshot which does not exist is deleted
+func (s *Server) csiDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SnapshotID string `json:"snapshot_id"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	vol, snap, ok := parseSnapshotID(req.SnapshotID)
+	if !ok {
+		csiError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid snapshot id "+req.SnapshotID)
+		return
+	}
+	if err := s.cfg.Driver.DeleteSnapshot(vol, snap); err != nil && !notFound(err) {
+		csiDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// csiListSnapshots lists the snapshots of one volume, or of all volumes,
+// ordered by id. The token is the offset of the next entry.
+func (s *Server) csiListSnapshots(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MaxEntries     int    `json:"max_entries"`
+		StartingToken  string `json:"starting_token"`
+		SourceVolumeID string `json:"source_volume_id"`
+		SnapshotID     string `json:"snapshot_id"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	start := 0
+	if req.StartingToken != "" {
+		n, err := strconv.Atoi(req.StartingToken)
+		if err != nil || n < 0 {
+			csiError(w, http.StatusGone, "ABORTED", "invalid starting_token "+req.StartingToken)
+			return
+		}
+		start = n
+	}
+	var vols []string
+	var only string
+	switch {
+	case req.SnapshotID != "":
+		vol, snap, ok := parseSnapshotID(req.SnapshotID)
+		if !ok || (req.SourceVolumeID != "" && vol != req.SourceVolumeID) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"entries": []interface{}{}})
+			return
+		}
+		vols, only = []string{vol}, snap
+	case req.SourceVolumeID != "":
+		vols = []string{req.SourceVolumeID}
+	default:
+		res, err := s.cfg.Driver.List()
+		if err != nil {
+			csiDriverError(w, err)
+			return
+		}
+		for _, v := range res.Volumes {
+			vols = append(vols, v.Name)
+		}
+	}
+	entries := []csiSnapshot{}
+	for _, v := range vols {
+		snaps, err := s.cfg.Driver.ListSnapshots(v)
+		if err != nil {
+			if notFound(err) || len(vols) > 1 {
+				continue
+			}
+			csiDriverError(w, err)
+			return
+		}
+		for _, sn := range snaps {
+			if only == "" || sn.Name == only {
+				entries = append(entries, toCSISnapshot(sn))
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].SnapshotID < entries[j].SnapshotID })
+	if start > len(entries) {
+		csiError(w, http.StatusGone, "ABORTED", "starting_token "+req.StartingToken+" is past the last snapshot")
+		return
+	}
+	entries = entries[start:]
+	next := ""
+	if req.MaxEntries > 0 && len(entries) > req.MaxEntries {
+		entries = entries[:req.MaxEntries]
+		next = strconv.Itoa(start + req.MaxEntries)
+	}
+	out := make([]interface{}, len(entries))
+	for i, e := range entries {
+		out[i] = map[string]interface{}{"snapshot": e}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": out, "next_token": next})
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/jobs"
+)
+
+// async reports whether a long operation is asked to run as a background job
+func async(r *http.Request) bool {
+	return r.URL.Query().Get("async") == "true"
+}
+
+// startJob runs fn as a background job and answers with the new job. The
+// rate limit only applies to starting it, so the jobs of a kind running at
+// once are limited as well.
+func (s *Server) startJob(w http.ResponseWriter, kind, target string, fn jobs.Func) {
+	j, ok := s.jobs.StartLimited(kind, target, s.cfg.MaxJobs, fn)
+	if !ok {
+		w.Header().Set("Retry-After", "60")
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("%d %s jobs are running already, retry when one has finished", s.cfg.MaxJobs, kind))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+func (s *Server) getJobs(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"jobs": s.jobs.List()})
+		return
+	}
+	j, ok := s.jobs.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such job: "+id)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+func (s *Server) cancelJob(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !s.jobs.Cancel(id) {
+		writeError(w, http.StatusNotFound, "no such job: "+id)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
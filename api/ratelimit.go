@@ -0,0 +1,106 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit limits how often a single client may call expensive operations
+type RateLimit struct {
+	// PerMinute is the sustained number of expensive calls allowed per client, 0 disables limiting
+	PerMinute float64
+	// Burst is the number of calls a client may make back to back
+	Burst int
+}
+
+type limiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rl RateLimit) *limiter {
+	if rl.PerMinute <= 0 {
+		return nil
+	}
+	burst := float64(rl.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: rl.PerMinute / 60, burst: burst, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the client's bucket, when the bucket is empty it
+// returns false and the time until the next token is available
+func (l *limiter) allow(client string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+const maxBuckets = 4096
+
+// prune forgets clients whose buckets have refilled completely
+func (l *limiter) prune(now time.Time) {
+	for c, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, c)
+		}
+	}
+}
+
+// clientID identifies the caller of r for rate limiting, preferring the
+// token name, then the client certificate and finally the remote address
+func clientID(r *http.Request) string {
+	if t := TokenFromContext(r.Context()); t != nil {
+		return "token:" + t.Name
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "addr:" + r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+func (s *Server) rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	if s.limiter == nil {
+		return false
+	}
+	ok, wait := s.limiter.allow(clientID(r))
+	if ok {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "rate limit exceeded for expensive operations")
+	return true
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+
+	zfsdriver "github.com/TrilliumIT/docker-zfs-plugin/zfs"
+)
+
+func (s *Server) getSchedules(w http.ResponseWriter, r *http.Request) {
+	set, err := s.cfg.Driver.Schedules()
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, set)
+}
+
+func (s *Server) applySchedules(w http.ResponseWriter, r *http.Request) {
+	var set zfsdriver.ScheduleSet
+	if !decode(w, r, &set) {
+		return
+	}
+	rep, err := s.cfg.Driver.ApplySchedules(&set, dryRun(r))
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
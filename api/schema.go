@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// openAPI builds an OpenAPI 3 description of the registered routes
+func (s *Server) openAPI() map[string]interface{} {
+	paths := make(map[string]interface{})
+	for path, methods := range s.routes {
+		ops := make(map[string]interface{})
+		for method, rt := range methods {
+			op := map[string]interface{}{
+				"summary":     rt.summary,
+				"operationId": operationID(method, path),
+				"x-scope":     rt.scope,
+				"responses":   responses(rt),
+			}
+			if s.cfg.Tokens.Enabled() {
+				op["security"] = []map[string][]string{{"bearer": {}}}
+			}
+			if rt.expensive {
+				op["x-rate-limited"] = true
+			}
+			ops[strings.ToLower(method)] = op
+		}
+		paths[path] = ops
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "docker-zfs-plugin management API",
+			"version": s.cfg.Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func responses(rt route) map[string]interface{} {
+	ct := "application/json"
+	if rt.contentType != "" {
+		ct = rt.contentType
+	}
+	return map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "success",
+			"content":     map[string]interface{}{ct: map[string]interface{}{}},
+		},
+		"default": map[string]interface{}{
+			"description": "error",
+			"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"error": map[string]string{"type": "string"}},
+			}}},
+		},
+	}
+}
+
+// operationID derives a stable operation id such as getV1PoolsIostat
+func operationID(method, path string) string {
+	parts := strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '-' || r == '.' || r == '_' })
+	id := strings.ToLower(method)
+	for _, p := range parts {
+		id += strings.ToUpper(p[:1]) + p[1:]
+	}
+	return id
+}
+
+func (s *Server) schema(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.openAPI())
+}
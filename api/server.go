@@ -0,0 +1,308 @@
+// Package api implements the management API of the zfs plugin
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/credentials"
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/jobs"
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/webhook"
+	zfsdriver "github.com/TrilliumIT/docker-zfs-plugin/zfs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config holds the components exposed by the management API
+type Config struct {
+	//Version is the plugin version reported in the API schema
+	Version  string
+	Driver   *zfsdriver.ZfsDriver
+	Iostat   *zfsdriver.IostatCollector
+	Events   *events.Bus
+	Webhooks *webhook.Dispatcher
+	//Credentials are the named secrets of backup and replication jobs
+	Credentials *credentials.Store
+	//Tokens authenticate requests, all requests are allowed when no tokens are configured
+	Tokens *Tokens
+	//RateLimit limits expensive operations per client
+	RateLimit RateLimit
+	//MaxJobs limits the background jobs of each kind running at once, 0 is unlimited
+	MaxJobs int
+}
+
+// Server is the management API server
+type Server struct {
+	cfg     Config
+	routes  map[string]map[string]route
+	limiter *limiter
+	srv     *http.Server
+	jobs    *jobs.Manager
+	// done is closed on shutdown to end long running streams
+	done chan struct{}
+}
+
+// jobRetention is how long finished jobs can still be fetched
+const jobRetention = time.Hour
+
+type route struct {
+	method  string
+	path    string
+	summary string
+	scope   string
+	// contentType of successful responses, application/json if empty
+	contentType string
+	// expensive routes are subject to the per client rate limit
+	expensive bool
+	handler   http.HandlerFunc
+}
+
+// NewServer returns a management API server
+func NewServer(cfg Config) *Server {
+	s := &Server{cfg: cfg, routes: make(map[string]map[string]route), limiter: newLimiter(cfg.RateLimit),
+		jobs: jobs.NewManager(jobRetention), done: make(chan struct{})}
+	s.handle(route{method: http.MethodGet, path: "/metrics", summary: "Prometheus metrics",
+		scope: ScopeRead, contentType: "text/plain", handler: metrics.Handler().ServeHTTP})
+	s.handle(route{method: http.MethodGet, path: "/healthz", summary: "State of the pools and their devices, 503 if any pool is not online or owned by another node or a volume mount is inconsistent",
+		scope: ScopeRead, handler: s.healthz})
+	s.handle(route{method: http.MethodGet, path: "/v1/openapi.json", summary: "OpenAPI description of this API",
+		scope: ScopeRead, handler: s.schema})
+	s.handle(route{method: http.MethodGet, path: "/v1/pools/iostat", summary: "Latest zpool iostat sample per pool",
+		scope: ScopeRead, handler: s.poolIostat})
+	s.handle(route{method: http.MethodGet, path: "/v1/capacity/forecast", summary: "Growth and days until full of every volume and pool, fitted to their usage history",
+		scope: ScopeRead, handler: s.capacityForecast})
+	s.handle(route{method: http.MethodGet, path: "/v1/compliance", summary: "Volume properties which differed from their create options or violated a compliance rule at the last audit",
+		scope: ScopeRead, handler: s.compliance})
+	s.handle(route{method: http.MethodPost, path: "/v1/compliance/audit", summary: "Audit the volumes now, remediating violations if enabled",
+		scope: ScopeWrite, handler: s.compliance})
+	s.handle(route{method: http.MethodGet, path: "/v1/volumes", summary: "The volume given by the name query parameter, or all volumes filtered by the class query parameter",
+		scope: ScopeRead, handler: s.getVolume})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes", summary: "Create a volume with the same options and policies as docker volume create",
+		scope: ScopeWrite, handler: s.createVolume})
+	s.handle(route{method: http.MethodDelete, path: "/v1/volumes", summary: "Remove the volume given by the name query parameter, with dry_run=true list what would be destroyed instead",
+		scope: ScopeAdmin, handler: s.removeVolume})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/adopt", summary: "Record an existing dataset as a volume with create options read from its properties",
+		scope: ScopeAdmin, handler: s.adoptVolume})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/swap", summary: "Swap the datasets of two unmounted volumes after snapshotting both",
+		scope: ScopeAdmin, handler: s.swapVolumes})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/layout", summary: "Move unmounted volumes between the flat and hierarchical dataset layouts, with async=true as a background job",
+		scope: ScopeAdmin, expensive: true, handler: s.migrateLayout})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/bulk", summary: "Snapshot, set properties on or back up all volumes matching a selector, with async=true as a background job",
+		scope: ScopeWrite, expensive: true, handler: s.bulkVolumes})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/inspect", summary: "Properties, usage, snapshots and mounts of the volumes named or matching a selector, or of all volumes",
+		scope: ScopeRead, expensive: true, handler: s.inspectVolumes})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/properties", summary: "Validate and set zfs properties on a volume",
+		scope: ScopeWrite, handler: s.setProperties})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/verify", summary: "Read every block of a volume to verify its checksums, with async=true as a background job",
+		scope: ScopeWrite, expensive: true, handler: s.verifyVolume})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/archive", summary: "Send an unmounted volume to the archive directory and destroy its dataset, leaving a stub, with async=true as a background job",
+		scope: ScopeAdmin, expensive: true, handler: s.archiveVolume})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/restore", summary: "Receive an archived volume from its archive file, with async=true as a background job",
+		scope: ScopeWrite, expensive: true, handler: s.restoreArchive})
+	s.handle(route{method: http.MethodGet, path: "/v1/volumes/idle", summary: "Volumes without IO for at least the min query parameter duration, the longest idle first, filtered by the class query parameter",
+		scope: ScopeRead, handler: s.idleVolumes})
+	s.handle(route{method: http.MethodGet, path: "/v1/volumes/history", summary: "Recorded events of the volume given by the volume query parameter, the oldest first, kept for a while after it is removed",
+		scope: ScopeRead, handler: s.volumeHistory})
+	s.handle(route{method: http.MethodGet, path: "/v1/volumes/snapshots", summary: "Snapshots of the volume given by the volume query parameter",
+		scope: ScopeRead, handler: s.listSnapshots})
+	s.handle(route{method: http.MethodGet, path: "/v1/volumes/snapshot-space", summary: "Space held by the snapshots of every volume, or per snapshot of the volume query parameter with what destroying the comma separated prune snapshots would free",
+		scope: ScopeRead, handler: s.snapshotSpace})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/snapshots", summary: "Take a named snapshot of a volume",
+		scope: ScopeWrite, expensive: true, handler: s.createSnapshot})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/quiesce-snapshot", summary: "Sync a group of volumes, hold their writes and snapshot them together in one transaction group",
+		scope: ScopeWrite, expensive: true, handler: s.quiesceSnapshot})
+	s.handle(route{method: http.MethodDelete, path: "/v1/volumes/snapshots", summary: "Destroy the snapshot given by the volume and snapshot query parameters, with dry_run=true list what would be destroyed instead",
+		scope: ScopeAdmin, handler: s.deleteSnapshot})
+	s.handle(route{method: http.MethodPost, path: "/v1/csi/ControllerGetCapabilities", summary: "CSI controller capabilities",
+		scope: ScopeRead, handler: s.csiCapabilities})
+	s.handle(route{method: http.MethodPost, path: "/v1/csi/CreateVolume", summary: "CSI CreateVolume, a clone of the snapshot or volume content source if given",
+		scope: ScopeWrite, handler: s.csiCreateVolume})
+	s.handle(route{method: http.MethodPost, path: "/v1/csi/DeleteVolume", summary: "CSI DeleteVolume",
+		scope: ScopeAdmin, handler: s.csiDeleteVolume})
+	s.handle(route{method: http.MethodPost, path: "/v1/csi/CreateSnapshot", summary: "CSI CreateSnapshot of a volume, snapshot ids are volume@snapshot",
+		scope: ScopeWrite, handler: s.csiCreateSnapshot})
+	s.handle(route{method: http.MethodPost, path: "/v1/csi/DeleteSnapshot", summary: "CSI DeleteSnapshot",
+		scope: ScopeAdmin, handler: s.csiDeleteSnapshot})
+	s.handle(route{method: http.MethodPost, path: "/v1/csi/ListSnapshots", summary: "CSI ListSnapshots of one or all volumes, paginated by max_entries and starting_token",
+		scope: ScopeRead, handler: s.csiListSnapshots})
+	s.handle(route{method: http.MethodGet, path: "/v1/volumes/holds", summary: "Holds of the plugin on the snapshots of the volume given by the volume query parameter",
+		scope: ScopeRead, handler: s.listHolds})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/holds", summary: "Hold a snapshot of a volume with a tag, keeping it and the volume from being destroyed",
+		scope: ScopeWrite, handler: s.holdSnapshot})
+	s.handle(route{method: http.MethodDelete, path: "/v1/volumes/holds", summary: "Release the hold given by the volume, snapshot and tag query parameters",
+		scope: ScopeAdmin, handler: s.releaseHold})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/delegate", summary: "Zone the delegated dataset of a volume created with delegate=true into the user namespace of a container process",
+		scope: ScopeAdmin, handler: s.delegateVolume})
+	s.handle(route{method: http.MethodDelete, path: "/v1/volumes/delegate", summary: "Revoke the delegation of the volume given by the volume query parameter",
+		scope: ScopeAdmin, handler: s.revokeDelegation})
+	s.handle(route{method: http.MethodGet, path: "/v1/volumes/branches", summary: "Branches of the volume given by the volume query parameter",
+		scope: ScopeRead, handler: s.listBranches})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/branches", summary: "Create a branch of a volume as a clone of its current or from branch",
+		scope: ScopeWrite, expensive: true, handler: s.createBranch})
+	s.handle(route{method: http.MethodPost, path: "/v1/volumes/checkout", summary: "Switch an unmounted volume to another branch",
+		scope: ScopeWrite, handler: s.checkoutBranch})
+	s.handle(route{method: http.MethodDelete, path: "/v1/volumes/branches", summary: "Destroy the branch given by the volume and branch query parameters",
+		scope: ScopeAdmin, handler: s.deleteBranch})
+	s.handle(route{method: http.MethodGet, path: "/v1/schedules", summary: "The declared snapshot schedules, in the form PUT accepts",
+		scope: ScopeRead, handler: s.getSchedules})
+	s.handle(route{method: http.MethodPut, path: "/v1/schedules", summary: "Replace the declared snapshot schedules, with dry_run=true only report the changes",
+		scope: ScopeAdmin, handler: s.applySchedules})
+	s.handle(route{method: http.MethodGet, path: "/v1/jobs", summary: "Background jobs, or the job given by the id query parameter including its log",
+		scope: ScopeRead, handler: s.getJobs})
+	s.handle(route{method: http.MethodDelete, path: "/v1/jobs", summary: "Cancel the job given by the id query parameter",
+		scope: ScopeWrite, handler: s.cancelJob})
+	if cfg.Events != nil {
+		s.handle(route{method: http.MethodGet, path: "/v1/events", summary: "Stream of lifecycle events as server sent events, filtered by the type and volume query parameters",
+			scope: ScopeRead, contentType: "text/event-stream", handler: s.eventStream})
+	}
+	if cfg.Webhooks != nil {
+		s.handle(route{method: http.MethodGet, path: "/v1/webhooks/dead-letters", summary: "Webhook deliveries which exhausted their retries",
+			scope: ScopeRead, handler: s.deadLetters})
+		s.handle(route{method: http.MethodPost, path: "/v1/webhooks/dead-letters/requeue", summary: "Retry the dead letter given by the id query parameter",
+			scope: ScopeWrite, handler: s.requeueDeadLetter})
+		s.handle(route{method: http.MethodDelete, path: "/v1/webhooks/dead-letters", summary: "Discard the dead letter given by the id query parameter",
+			scope: ScopeAdmin, handler: s.discardDeadLetter})
+	}
+	if cfg.Credentials != nil {
+		s.handle(route{method: http.MethodGet, path: "/v1/credentials", summary: "Names, types and fields of the credentials, without their secrets",
+			scope: ScopeAdmin, handler: s.listCredentials})
+		s.handle(route{method: http.MethodPost, path: "/v1/credentials", summary: "Store a credential in the state database, replacing a stored one of the same name",
+			scope: ScopeAdmin, handler: s.putCredential})
+		s.handle(route{method: http.MethodDelete, path: "/v1/credentials", summary: "Remove the stored credential given by the name query parameter",
+			scope: ScopeAdmin, handler: s.deleteCredential})
+	}
+	s.srv = &http.Server{Handler: s}
+	return s
+}
+
+func (s *Server) handle(rt route) {
+	if s.routes[rt.path] == nil {
+		s.routes[rt.path] = make(map[string]route)
+	}
+	s.routes[rt.path][rt.method] = rt
+}
+
+// ServeHTTP dispatches a request to the handler registered for its path and method
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{"method": r.Method, "path": r.URL.Path}).Debug("Management API request")
+	methods, ok := s.routes[r.URL.Path]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	rt, ok := methods[r.Method]
+	if !ok {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r = s.authenticate(w, r, rt.scope); r == nil {
+		return
+	}
+	if rt.expensive && s.rateLimited(w, r) {
+		return
+	}
+	rt.handler(w, r)
+}
+
+// Serve serves the management API on the listener
+func (s *Server) Serve(l net.Listener) error {
+	return s.srv.Serve(l)
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	close(s.done)
+	if err := s.jobs.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("Background jobs did not stop in time")
+	}
+	return s.srv.Shutdown(ctx)
+}
+
+// Listen opens a listener for addr, which is either a host:port or a unix socket path
+func Listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "/") && !strings.HasPrefix(addr, "unix://") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix://")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (s *Server) poolIostat(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Iostat == nil {
+		writeError(w, http.StatusNotFound, "iostat collection is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pools": s.cfg.Iostat.Latest()})
+}
+
+func (s *Server) capacityForecast(w http.ResponseWriter, r *http.Request) {
+	fc, err := s.cfg.Driver.Forecast()
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, fc)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Failed to write management API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	if reason := s.cfg.Driver.Unavailable(); reason != "" {
+		writeError(w, http.StatusServiceUnavailable, "zfs is unavailable, "+reason+", volumes are answered from cache")
+		return
+	}
+	pools, t, err := s.cfg.Driver.Health(r.Context())
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	status := http.StatusOK
+	for _, p := range pools {
+		if p.State != "ONLINE" || (p.Multihost != nil && !p.Multihost.Owned) {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	body := map[string]interface{}{"pools": pools, "checked_at": t.UTC().Format(time.RFC3339)}
+	if d := s.cfg.Driver.PropertyDrift(); len(d) > 0 {
+		body["root_property_drift"] = d
+	}
+	if rc := s.cfg.Driver.RenameConflicts(); len(rc) > 0 {
+		body["rename_conflicts"] = rc
+	}
+	if sp := s.cfg.Driver.SuspendedPools(); len(sp) > 0 {
+		status = http.StatusServiceUnavailable
+		body["suspended"] = sp
+	}
+	if issues := s.cfg.Driver.MountIssues(); len(issues) > 0 {
+		status = http.StatusServiceUnavailable
+		body["mount_issues"] = issues
+	}
+	writeJSON(w, status, body)
+}
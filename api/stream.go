@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const streamKeepalive = 15 * time.Second
+
+// eventStream streams events as server sent events. The type and volume
+// query parameters take comma separated lists to filter on.
+func (s *Server) eventStream(w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	types := filterSet(r.URL.Query().Get("type"))
+	vols := filterSet(r.URL.Query().Get("volume"))
+
+	evs, cancel := s.cfg.Events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	ka := time.NewTicker(streamKeepalive)
+	defer ka.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case <-ka.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e := <-evs:
+			if !match(types, e.Type) || !match(vols, e.Volume) {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return
+			}
+		}
+		fl.Flush()
+	}
+}
+
+func filterSet(v string) map[string]bool {
+	if v == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, s := range strings.Split(v, ",") {
+		set[strings.TrimSpace(s)] = true
+	}
+	return set
+}
+
+func match(set map[string]bool, v string) bool {
+	return set == nil || set[v]
+}
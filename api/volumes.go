@@ -0,0 +1,541 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/jobs"
+	zfsdriver "github.com/TrilliumIT/docker-zfs-plugin/zfs"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func (s *Server) getVolume(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		s.listVolumes(w, r)
+		return
+	}
+	res, err := s.cfg.Driver.Get(&volume.GetRequest{Name: name})
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res.Volume)
+}
+
+// listVolumes lists the volumes, only those of the storage class given by
+// the class query parameter if it is set
+func (s *Server) listVolumes(w http.ResponseWriter, r *http.Request) {
+	res, err := s.cfg.Driver.List()
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	class := r.URL.Query().Get("class")
+	vols := []*volume.Volume{}
+	for _, v := range res.Volumes {
+		if class == "" || v.Status["class"] == class {
+			vols = append(vols, v)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"volumes": vols})
+}
+
+func (s *Server) createVolume(w http.ResponseWriter, r *http.Request) {
+	var req volume.CreateRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if err := s.cfg.Driver.Create(&req); err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	res, err := s.cfg.Driver.Get(&volume.GetRequest{Name: req.Name})
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, res.Volume)
+}
+
+func (s *Server) removeVolume(w http.ResponseWriter, r *http.Request) {
+	if dryRun(r) {
+		plan, err := s.cfg.Driver.RemovePlan(r.URL.Query().Get("name"))
+		if err != nil {
+			writeDriverError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
+	if err := s.cfg.Driver.Remove(&volume.RemoveRequest{Name: r.URL.Query().Get("name")}); err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) adoptVolume(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string `json:"name"`
+		Dataset string `json:"dataset"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Dataset == "" {
+		writeError(w, http.StatusBadRequest, "dataset is required")
+		return
+	}
+	res, err := s.cfg.Driver.Adopt(req.Name, req.Dataset)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) swapVolumes(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		A string `json:"a"`
+		B string `json:"b"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.A == "" || req.B == "" {
+		writeError(w, http.StatusBadRequest, "a and b are required")
+		return
+	}
+	res, err := s.cfg.Driver.Swap(req.A, req.B)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) migrateLayout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Volumes []string `json:"volumes"`
+		Layout  string   `json:"layout"`
+		DryRun  bool     `json:"dry_run"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if len(req.Volumes) == 0 {
+		writeError(w, http.StatusBadRequest, "volumes are required")
+		return
+	}
+	if req.Layout != zfsdriver.LayoutFlat && req.Layout != zfsdriver.LayoutHierarchical {
+		writeError(w, http.StatusBadRequest, "layout must be flat or hierarchical")
+		return
+	}
+	if !async(r) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"moves": s.cfg.Driver.MigrateLayout(req.Volumes, req.Layout, req.DryRun)})
+		return
+	}
+	s.startJob(w, "migrate-layout", req.Layout, func(ctx context.Context, rep *jobs.Reporter) (interface{}, error) {
+		moves := make([]zfsdriver.LayoutMove, 0, len(req.Volumes))
+		for i, name := range req.Volumes {
+			if err := ctx.Err(); err != nil {
+				return map[string]interface{}{"moves": moves}, err
+			}
+			m := s.cfg.Driver.MigrateLayout([]string{name}, req.Layout, req.DryRun)[0]
+			if m.Error != "" {
+				rep.Logf("%s: %s", m.Volume, m.Error)
+			} else if m.Moved {
+				rep.Logf("%s: moved %s to %s", m.Volume, m.From, m.To)
+			}
+			moves = append(moves, m)
+			rep.Progress(int64(i+1), int64(len(req.Volumes)))
+		}
+		return map[string]interface{}{"moves": moves}, nil
+	})
+}
+
+func (s *Server) bulkVolumes(w http.ResponseWriter, r *http.Request) {
+	var req zfsdriver.BulkRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := s.cfg.Driver.ValidateBulk(req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if async(r) {
+		s.startJob(w, "bulk-"+req.Operation, "", func(ctx context.Context, rep *jobs.Reporter) (interface{}, error) {
+			res, err := s.cfg.Driver.Bulk(ctx, req, rep.Progress)
+			if err != nil {
+				return nil, err
+			}
+			rep.Logf("%d of %d volumes failed", res.Failed, res.Selected)
+			return res, ctx.Err()
+		})
+		return
+	}
+	rep, err := s.cfg.Driver.Bulk(r.Context(), req, nil)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+func (s *Server) inspectVolumes(w http.ResponseWriter, r *http.Request) {
+	var req zfsdriver.InspectRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	rep, err := s.cfg.Driver.InspectVolumes(r.Context(), req)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// dryRun reports whether a destructive request only asks what it would do
+func dryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
+}
+
+// writeDriverError maps a driver error to an http status by its category
+func writeDriverError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch zfsdriver.ErrorCategory(err) {
+	case zfsdriver.ErrCategoryBusy:
+		status = http.StatusTooManyRequests
+	case zfsdriver.ErrCategoryTimeout:
+		status = http.StatusGatewayTimeout
+	case zfsdriver.ErrCategoryNotFound:
+		status = http.StatusNotFound
+	case zfsdriver.ErrCategoryPolicy:
+		status = http.StatusConflict
+	case zfsdriver.ErrCategoryUnavailable, zfsdriver.ErrCategorySuspended:
+		status = http.StatusServiceUnavailable
+	}
+	writeError(w, status, err.Error())
+}
+
+type branchRequest struct {
+	Volume string `json:"volume"`
+	Branch string `json:"branch"`
+	From   string `json:"from,omitempty"`
+}
+
+func (s *Server) listBranches(w http.ResponseWriter, r *http.Request) {
+	br, err := s.cfg.Driver.ListBranches(r.URL.Query().Get("volume"))
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, br)
+}
+
+func (s *Server) createBranch(w http.ResponseWriter, r *http.Request) {
+	var req branchRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	br, err := s.cfg.Driver.CreateBranch(req.Volume, req.Branch, req.From)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, br)
+}
+
+func (s *Server) checkoutBranch(w http.ResponseWriter, r *http.Request) {
+	var req branchRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	br, err := s.cfg.Driver.Checkout(req.Volume, req.Branch)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, br)
+}
+
+func (s *Server) deleteBranch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	br, err := s.cfg.Driver.DeleteBranch(q.Get("volume"), q.Get("branch"))
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, br)
+}
+
+func (s *Server) setProperties(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Volume     string            `json:"volume"`
+		Properties map[string]string `json:"properties"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := s.cfg.Driver.SetProperties(req.Volume, req.Properties); err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) verifyVolume(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Volume string `json:"volume"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if async(r) {
+		s.startJob(w, "verify", req.Volume, func(ctx context.Context, rep *jobs.Reporter) (interface{}, error) {
+			res, err := s.cfg.Driver.Verify(ctx, req.Volume, rep.Progress)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range res.Errors {
+				rep.Logf("%s", e)
+			}
+			return res, nil
+		})
+		return
+	}
+	res, err := s.cfg.Driver.Verify(r.Context(), req.Volume, nil)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) archiveVolume(w http.ResponseWriter, r *http.Request) {
+	s.archiveJob(w, r, "archive", s.cfg.Driver.Archive)
+}
+
+func (s *Server) restoreArchive(w http.ResponseWriter, r *http.Request) {
+	s.archiveJob(w, r, "restore-archive", s.cfg.Driver.RestoreArchive)
+}
+
+func (s *Server) archiveJob(w http.ResponseWriter, r *http.Request, kind string,
+	fn func(context.Context, string, zfsdriver.Progress) (*zfsdriver.ArchiveResult, error)) {
+	var req struct {
+		Volume string `json:"volume"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if async(r) {
+		s.startJob(w, kind, req.Volume, func(ctx context.Context, rep *jobs.Reporter) (interface{}, error) {
+			return fn(ctx, req.Volume, rep.Progress)
+		})
+		return
+	}
+	res, err := fn(r.Context(), req.Volume, nil)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	snaps, err := s.cfg.Driver.ListSnapshots(r.URL.Query().Get("volume"))
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"snapshots": snaps})
+}
+
+func (s *Server) volumeHistory(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("volume")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "volume is required")
+		return
+	}
+	h, err := s.cfg.Driver.History(name)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"volume": name, "events": h})
+}
+
+func (s *Server) snapshotSpace(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("volume") == "" {
+		res, err := s.cfg.Driver.SnapshotSpaces()
+		if err != nil {
+			writeDriverError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"volumes": res})
+		return
+	}
+	var prune []string
+	if p := q.Get("prune"); p != "" {
+		prune = strings.Split(p, ",")
+	}
+	res, err := s.cfg.Driver.SnapshotSpace(q.Get("volume"), prune)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Volume   string `json:"volume"`
+		Snapshot string `json:"snapshot"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	snap, err := s.cfg.Driver.CreateSnapshot(req.Volume, req.Snapshot)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, snap)
+}
+
+func (s *Server) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if dryRun(r) {
+		plan, err := s.cfg.Driver.DeleteSnapshotPlan(q.Get("volume"), q.Get("snapshot"))
+		if err != nil {
+			writeDriverError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, plan)
+		return
+	}
+	if err := s.cfg.Driver.DeleteSnapshot(q.Get("volume"), q.Get("snapshot")); err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listHolds(w http.ResponseWriter, r *http.Request) {
+	hs, err := s.cfg.Driver.ListHolds(r.URL.Query().Get("volume"))
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"holds": hs})
+}
+
+func (s *Server) quiesceSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req zfsdriver.QuiesceRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	res, err := s.cfg.Driver.QuiesceSnapshot(r.Context(), req)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) holdSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Volume   string `json:"volume"`
+		Snapshot string `json:"snapshot"`
+		Tag      string `json:"tag"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := s.cfg.Driver.HoldSnapshot(req.Volume, req.Snapshot, req.Tag); err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) releaseHold(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if err := s.cfg.Driver.ReleaseHold(q.Get("volume"), q.Get("snapshot"), q.Get("tag")); err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) delegateVolume(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Volume string `json:"volume"`
+		PID    int    `json:"pid"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	d, err := s.cfg.Driver.Delegate(req.Volume, req.PID)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+func (s *Server) revokeDelegation(w http.ResponseWriter, r *http.Request) {
+	if err := s.cfg.Driver.Revoke(r.URL.Query().Get("volume")); err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) compliance(w http.ResponseWriter, r *http.Request) {
+	report, err := s.cfg.Driver.Compliance(r.Context(), r.Method == http.MethodPost)
+	if err != nil {
+		writeDriverError(w, err)
+		return
+	}
+	if report == nil {
+		report = &zfsdriver.ComplianceReport{Violations: []zfsdriver.ComplianceViolation{}}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) idleVolumes(w http.ResponseWriter, r *http.Request) {
+	var min time.Duration
+	if v := r.URL.Query().Get("min"); v != "" {
+		var err error
+		if min, err = time.ParseDuration(v); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid min duration: "+err.Error())
+			return
+		}
+	}
+	class := r.URL.Query().Get("class")
+	vols := []zfsdriver.VolumeActivity{}
+	for _, a := range s.cfg.Driver.IdleVolumes(min) {
+		if class == "" || a.Class == class {
+			vols = append(vols, a)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"volumes": vols})
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net/http"
+)
+
+func (s *Server) deadLetters(w http.ResponseWriter, r *http.Request) {
+	dls, err := s.cfg.Webhooks.DeadLetters()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deliveries": dls})
+}
+
+func (s *Server) requeueDeadLetter(w http.ResponseWriter, r *http.Request) {
+	s.deadLetterOp(w, r, s.cfg.Webhooks.Requeue)
+}
+
+func (s *Server) discardDeadLetter(w http.ResponseWriter, r *http.Request) {
+	s.deadLetterOp(w, r, s.cfg.Webhooks.Discard)
+}
+
+func (s *Server) deadLetterOp(w http.ResponseWriter, r *http.Request, op func(string) (bool, error)) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "id is required")
+		return
+	}
+	ok, err := op(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no dead letter with id "+id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
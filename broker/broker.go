@@ -0,0 +1,106 @@
+// Package broker forwards lifecycle and health events to a message bus
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	log "github.com/sirupsen/logrus"
+)
+
+const dialTimeout = 10 * time.Second
+
+// conn is a connection to a message bus
+type conn interface {
+	publish(topic string, payload []byte) error
+	close() error
+}
+
+// Publisher publishes events to a NATS or MQTT server, reconnecting as needed
+type Publisher struct {
+	url    *url.URL
+	prefix string
+	dial   func(u *url.URL) (conn, error)
+	topic  func(prefix, eventType string) string
+
+	mu sync.Mutex
+	c  conn
+}
+
+// NewPublisher returns a publisher for a nats:// or mqtt:// url. Events are
+// published to the subject or topic derived from prefix and the event type.
+func NewPublisher(rawurl, prefix string) (*Publisher, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	p := &Publisher{url: u, prefix: prefix}
+	switch u.Scheme {
+	case "nats":
+		p.dial = dialNATS
+		p.topic = func(prefix, t string) string { return prefix + "." + t }
+	case "mqtt", "tcp":
+		p.dial = dialMQTT
+		p.topic = func(prefix, t string) string { return prefix + "/" + strings.Replace(t, ".", "/", -1) }
+	default:
+		return nil, fmt.Errorf("unsupported message bus url scheme %q", u.Scheme)
+	}
+	return p, nil
+}
+
+// Run publishes all events from bus until ctx is canceled
+func (p *Publisher) Run(ctx context.Context, bus *events.Bus) {
+	evs, cancel := bus.Subscribe()
+	defer cancel()
+	defer p.close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-evs:
+			if err := p.Publish(e); err != nil {
+				log.WithError(err).WithFields(log.Fields{"url": p.url.Redacted(), "event": e.Type}).Error("Failed to publish event")
+			}
+		}
+	}
+}
+
+// Publish sends a single event, connecting first if there is no connection
+func (p *Publisher) Publish(e events.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// retry once on a fresh connection in case the old one went stale
+	for i := 0; i < 2; i++ {
+		if p.c == nil {
+			if p.c, err = p.dial(p.url); err != nil {
+				p.c = nil
+				return err
+			}
+		}
+		if err = p.c.publish(p.topic(p.prefix, e.Type), b); err == nil {
+			return nil
+		}
+		_ = p.c.close()
+		p.c = nil
+	}
+	return err
+}
+
+func (p *Publisher) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.c != nil {
+		_ = p.c.close()
+		p.c = nil
+	}
+}
@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	mqttConnect  = 0x10
+	mqttConnack  = 0x20
+	mqttPublish  = 0x30
+	mqttPingreq  = 0xc0
+	mqttKeepSecs = 60
+)
+
+// mqttConn is a minimal MQTT 3.1.1 client publishing at QoS 0
+type mqttConn struct {
+	nc   net.Conn
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func dialMQTT(u *url.URL) (conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	nc, err := net.DialTimeout("tcp", host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var vh bytes.Buffer
+	writeString(&vh, "MQTT")
+	vh.WriteByte(4)     // protocol level 3.1.1
+	flags := byte(0x02) // clean session
+	var payload bytes.Buffer
+	writeString(&payload, fmt.Sprintf("docker-zfs-plugin-%d", time.Now().UnixNano()))
+	if u.User != nil {
+		flags |= 0x80
+		writeString(&payload, u.User.Username())
+		if pass, ok := u.User.Password(); ok {
+			flags |= 0x40
+			writeString(&payload, pass)
+		}
+	}
+	vh.WriteByte(flags)
+	_ = binary.Write(&vh, binary.BigEndian, uint16(mqttKeepSecs))
+	vh.Write(payload.Bytes())
+
+	_ = nc.SetDeadline(time.Now().Add(dialTimeout))
+	if err := writePacket(nc, mqttConnect, vh.Bytes()); err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(nc, ack); err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	if ack[0] != mqttConnack || ack[3] != 0 {
+		_ = nc.Close()
+		return nil, fmt.Errorf("mqtt connection refused, return code %d", ack[3])
+	}
+	_ = nc.SetDeadline(time.Time{})
+
+	c := &mqttConn{nc: nc, done: make(chan struct{})}
+	go c.keepalive()
+	go c.drain()
+	return c, nil
+}
+
+func (c *mqttConn) keepalive() {
+	t := time.NewTicker(mqttKeepSecs / 2 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			c.mu.Lock()
+			_, err := c.nc.Write([]byte{mqttPingreq, 0})
+			c.mu.Unlock()
+			if err != nil {
+				c.setErr(err)
+				return
+			}
+		}
+	}
+}
+
+// drain discards PINGRESPs and notices when the server closes the connection
+func (c *mqttConn) drain() {
+	_, err := io.Copy(ioutil.Discard, c.nc)
+	if err == nil {
+		err = errors.New("mqtt connection closed by server")
+	}
+	c.setErr(err)
+}
+
+func (c *mqttConn) setErr(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+func (c *mqttConn) publish(topic string, payload []byte) error {
+	var b bytes.Buffer
+	writeString(&b, topic)
+	b.Write(payload)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	_ = c.nc.SetWriteDeadline(time.Now().Add(dialTimeout))
+	return writePacket(c.nc, mqttPublish, b.Bytes())
+}
+
+func (c *mqttConn) close() error {
+	close(c.done)
+	return c.nc.Close()
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	_ = binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// writePacket writes a packet with the mqtt variable length encoding of its size
+func writePacket(w io.Writer, typ byte, body []byte) error {
+	hdr := []byte{typ}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		hdr = append(hdr, d)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(hdr, body...))
+	return err
+}
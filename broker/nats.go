@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsConn speaks the minimal subset of the NATS client protocol needed to
+// publish: CONNECT, PUB and answering PINGs
+type natsConn struct {
+	nc net.Conn
+
+	mu  sync.Mutex
+	err error
+}
+
+func dialNATS(u *url.URL) (conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	nc, err := net.DialTimeout("tcp", host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(nc)
+	_ = nc.SetReadDeadline(time.Now().Add(dialTimeout))
+	info, err := r.ReadString('\n')
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		_ = nc.Close()
+		return nil, fmt.Errorf("unexpected nats greeting %q", strings.TrimSpace(info))
+	}
+	_ = nc.SetReadDeadline(time.Time{})
+
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "docker-zfs-plugin"}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts["user"] = u.User.Username()
+			opts["pass"] = pass
+		} else {
+			opts["auth_token"] = u.User.Username()
+		}
+	}
+	b, err := json.Marshal(opts)
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(nc, "CONNECT %s\r\nPING\r\n", b); err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	c := &natsConn{nc: nc}
+	go c.read(r)
+	return c, nil
+}
+
+// read answers server PINGs and records protocol errors
+func (c *natsConn) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.setErr(err)
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			c.mu.Lock()
+			_, err = fmt.Fprint(c.nc, "PONG\r\n")
+			c.mu.Unlock()
+			if err != nil {
+				c.setErr(err)
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			c.setErr(fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+		}
+	}
+}
+
+func (c *natsConn) setErr(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+func (c *natsConn) publish(subject string, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	_ = c.nc.SetWriteDeadline(time.Now().Add(dialTimeout))
+	_, err := fmt.Fprintf(c.nc, "PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+	return err
+}
+
+func (c *natsConn) close() error {
+	return c.nc.Close()
+}
@@ -0,0 +1,197 @@
+// Package consul is a minimal client for the consul session and key value
+// APIs, enough for leases and locks
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds a request to the agent, blocking queries get their
+// wait on top of it
+const requestTimeout = 10 * time.Second
+
+// Client talks to a consul agent
+type Client struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+// KVPair is a key of the consul key value store
+type KVPair struct {
+	Key         string
+	Value       []byte
+	Session     string
+	ModifyIndex uint64
+}
+
+// NewClient returns a client for the agent at addr, such as http://127.0.0.1:8500
+func NewClient(addr, token string) *Client {
+	return &Client{addr: strings.TrimSuffix(addr, "/"), token: token, http: &http.Client{}}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte, out interface{}) (http.Header, error) {
+	u := c.addr + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, rd)
+	if err != nil {
+		return nil, err
+	}
+	timeout := requestTimeout
+	if w, err := time.ParseDuration(query.Get("wait")); err == nil {
+		// consul adds up to a sixteenth of the wait as jitter
+		timeout += w + w/16
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return resp.Header, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("consul %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
+
+var errNotFound = fmt.Errorf("not found")
+
+// CreateSession creates a session which expires unless renewed within ttl.
+// Locks held by the session are released when it expires.
+func (c *Client) CreateSession(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"Name":      name,
+		"TTL":       ttl.String(),
+		"Behavior":  "release",
+		"LockDelay": "5s",
+	})
+	var res struct{ ID string }
+	if _, err := c.do(ctx, http.MethodPut, "/v1/session/create", nil, body, &res); err != nil {
+		return "", err
+	}
+	return res.ID, nil
+}
+
+// RenewSession extends the ttl of a session
+func (c *Client) RenewSession(ctx context.Context, id string) error {
+	var res []json.RawMessage
+	if _, err := c.do(ctx, http.MethodPut, "/v1/session/renew/"+id, nil, nil, &res); err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return fmt.Errorf("consul session %s expired", id)
+	}
+	return nil
+}
+
+// DestroySession ends a session and releases its locks
+func (c *Client) DestroySession(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodPut, "/v1/session/destroy/"+id, nil, nil, nil)
+	return err
+}
+
+// Acquire locks key for session and sets its value, it returns false if
+// another session holds the lock
+func (c *Client) Acquire(ctx context.Context, key, session string, value []byte) (bool, error) {
+	var ok bool
+	_, err := c.do(ctx, http.MethodPut, "/v1/kv/"+key, url.Values{"acquire": {session}}, value, &ok)
+	return ok, err
+}
+
+// Release unlocks key if it is held by session
+func (c *Client) Release(ctx context.Context, key, session string) error {
+	_, err := c.do(ctx, http.MethodPut, "/v1/kv/"+key, url.Values{"release": {session}}, nil, nil)
+	return err
+}
+
+// Put sets the value of key
+func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+	_, err := c.do(ctx, http.MethodPut, "/v1/kv/"+key, nil, value, nil)
+	return err
+}
+
+// PutCAS sets key to value only if its modify index is still index, 0 if
+// the key must not exist yet. It reports whether the key was set.
+func (c *Client) PutCAS(ctx context.Context, key string, value []byte, index uint64) (bool, error) {
+	var ok bool
+	_, err := c.do(ctx, http.MethodPut, "/v1/kv/"+key, url.Values{"cas": {strconv.FormatUint(index, 10)}}, value, &ok)
+	return ok, err
+}
+
+// Delete removes key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/v1/kv/"+key, nil, nil, nil)
+	return err
+}
+
+// Get returns key, or nil if it does not exist
+func (c *Client) Get(ctx context.Context, key string) (*KVPair, error) {
+	p, _, err := c.Wait(ctx, key, 0)
+	return p, err
+}
+
+// Wait returns key once its modify index is past index, or after consul's
+// blocking query timeout. It also returns the index to wait on next.
+func (c *Client) Wait(ctx context.Context, key string, index uint64) (*KVPair, uint64, error) {
+	return c.WaitFor(ctx, key, index, time.Minute)
+}
+
+// WaitFor is Wait with a blocking query timeout of at most wait, for callers
+// which have to renew a session in between
+func (c *Client) WaitFor(ctx context.Context, key string, index uint64, wait time.Duration) (*KVPair, uint64, error) {
+	q := url.Values{}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", strconv.FormatInt(int64(wait/time.Second), 10)+"s")
+	}
+	var res []KVPair
+	h, err := c.do(ctx, http.MethodGet, "/v1/kv/"+key, q, nil, &res)
+	next, _ := strconv.ParseUint(h.Get("X-Consul-Index"), 10, 64)
+	if err == errNotFound {
+		return nil, next, nil
+	}
+	if err != nil || len(res) == 0 {
+		return nil, next, err
+	}
+	return &res[0], next, nil
+}
+
+// List returns the keys below prefix
+func (c *Client) List(ctx context.Context, prefix string) ([]KVPair, error) {
+	var res []KVPair
+	_, err := c.do(ctx, http.MethodGet, "/v1/kv/"+prefix, url.Values{"recurse": {""}}, nil, &res)
+	if err == errNotFound {
+		return nil, nil
+	}
+	return res, err
+}
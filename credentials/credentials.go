@@ -0,0 +1,272 @@
+// Package credentials holds the secrets backup and replication jobs use, such
+// as the ssh keys of mirror volumes. Jobs reference a credential by name, so
+// secrets never appear in volume options or the plugin's command line.
+// Credentials are read from files in a directory, such as mounted docker or
+// kubernetes secrets, or stored through the management API in the state
+// database, which must then be encrypted.
+package credentials
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+)
+
+const bucket = "credentials"
+
+// Credential types and the fields they require
+const (
+	// SSHKey is a private key used to reach other hosts over ssh, with the
+	// fields private_key and optionally known_hosts
+	SSHKey = "ssh-key"
+)
+
+var required = map[string][]string{
+	SSHKey: {"private_key"},
+}
+
+// Sources of credentials
+const (
+	SourceFile  = "file"
+	SourceState = "state"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// ErrNotFound is returned for names no credential is known by
+var ErrNotFound = errors.New("credential not found")
+
+// ErrUnencrypted is returned when a credential is stored in a state database
+// which is not encrypted, where the secret would be written in plain text
+var ErrUnencrypted = errors.New("state file is not encrypted, set --state-key-file or --state-key-command to store credentials")
+
+// Credential is a named secret
+type Credential struct {
+	Name string            `json:"name"`
+	Type string            `json:"type"`
+	Data map[string]string `json:"data"`
+}
+
+// Info describes a credential without revealing its secrets
+type Info struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Source string   `json:"source"`
+	Fields []string `json:"fields"`
+}
+
+// Validate checks the name, type and required fields of c
+func (c *Credential) Validate() error {
+	if !validName.MatchString(c.Name) {
+		return fmt.Errorf("invalid credential name %q", c.Name)
+	}
+	fields, ok := required[c.Type]
+	if !ok {
+		return fmt.Errorf("invalid credential type %q, expected %s", c.Type, SSHKey)
+	}
+	for _, f := range fields {
+		if c.Data[f] == "" {
+			return fmt.Errorf("credential %s of type %s requires the field %s", c.Name, c.Type, f)
+		}
+	}
+	return nil
+}
+
+func (c *Credential) info(source string) Info {
+	fields := make([]string, 0, len(c.Data))
+	for k := range c.Data {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	return Info{Name: c.Name, Type: c.Type, Source: source, Fields: fields}
+}
+
+// Store resolves credentials by name, files in the directory take precedence
+// over credentials stored in the state database
+type Store struct {
+	dir string
+	db  *state.DB
+
+	mu  sync.Mutex
+	tmp string
+}
+
+// NewStore returns a store of the credentials in dir, which may be empty,
+// and in db
+func NewStore(dir string, db *state.DB) *Store {
+	return &Store{dir: dir, db: db}
+}
+
+// readFile reads the credential file name. A file holding a PEM block is an
+// ssh key, any other file is a json object with the type and data fields.
+func (s *Store) readFile(name string) (*Credential, bool, error) {
+	if s.dir == "" || !validName.MatchString(name) {
+		return nil, false, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	c := &Credential{Name: name}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+		c.Type, c.Data = SSHKey, map[string]string{"private_key": string(b)}
+	} else if err := json.Unmarshal(b, c); err != nil {
+		return nil, false, fmt.Errorf("invalid credential file %s: %w", name, err)
+	}
+	c.Name = name
+	return c, true, c.Validate()
+}
+
+// Get returns the credential name
+func (s *Store) Get(name string) (*Credential, error) {
+	c, ok, err := s.readFile(name)
+	if err != nil || ok {
+		return c, err
+	}
+	c = &Credential{}
+	if ok, err := s.db.Get(bucket, name, c); err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("%s: %w", name, ErrNotFound)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// List describes every credential, sorted by name
+func (s *Store) List() ([]Info, error) {
+	seen := make(map[string]bool)
+	infos := []Info{}
+	if s.dir != "" {
+		fis, err := ioutil.ReadDir(s.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				continue
+			}
+			c, ok, err := s.readFile(fi.Name())
+			if err != nil || !ok {
+				continue
+			}
+			seen[c.Name] = true
+			infos = append(infos, c.info(SourceFile))
+		}
+	}
+	for _, name := range s.db.Keys(bucket) {
+		var c Credential
+		if ok, err := s.db.Get(bucket, name, &c); err != nil || !ok || seen[name] {
+			continue
+		}
+		infos = append(infos, c.info(SourceState))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// Put stores c in the state database, replacing a stored credential of the
+// same name. The database must be encrypted. Credentials read from files can
+// not be replaced.
+func (s *Store) Put(c *Credential) error {
+	if !s.db.Encrypted() {
+		return ErrUnencrypted
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if _, ok, _ := s.readFile(c.Name); ok {
+		return fmt.Errorf("credential %s is read from a file and can not be replaced", c.Name)
+	}
+	return s.db.Put(bucket, c.Name, c)
+}
+
+// Delete removes the stored credential name, it returns false if there is none
+func (s *Store) Delete(name string) (bool, error) {
+	var c Credential
+	if ok, err := s.db.Get(bucket, name, &c); err != nil || !ok {
+		return false, err
+	}
+	return true, s.db.Delete(bucket, name)
+}
+
+// SSHArgs returns the ssh arguments authenticating with the ssh key name.
+// The key, and its known hosts if it has them, are written to private files
+// which are kept until Close.
+func (s *Store) SSHArgs(name string) ([]string, error) {
+	c, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if c.Type != SSHKey {
+		return nil, fmt.Errorf("credential %s is of type %s, expected %s", name, c.Type, SSHKey)
+	}
+	key, err := s.writeTemp(name+".key", c.Data["private_key"])
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-i", key, "-o", "IdentitiesOnly=yes"}
+	if kh := c.Data["known_hosts"]; kh != "" {
+		f, err := s.writeTemp(name+".known_hosts", kh)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-o", "UserKnownHostsFile="+f, "-o", "StrictHostKeyChecking=yes")
+	}
+	return args, nil
+}
+
+// writeTemp atomically writes data to the private file name, so a running
+// command never reads a partly written key
+func (s *Store) writeTemp(name, data string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tmp == "" {
+		dir, err := ioutil.TempDir("", "docker-zfs-plugin-credentials")
+		if err != nil {
+			return "", err
+		}
+		s.tmp = dir
+	}
+	path := filepath.Join(s.tmp, name)
+	if b, err := ioutil.ReadFile(path); err == nil && string(b) == data {
+		return path, nil
+	}
+	f, err := ioutil.TempFile(s.tmp, name+".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(data); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(f.Name(), path)
+}
+
+// Close removes the files written for commands
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tmp == "" {
+		return nil
+	}
+	err := os.RemoveAll(s.tmp)
+	s.tmp = ""
+	return err
+}
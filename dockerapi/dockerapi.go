@@ -0,0 +1,88 @@
+// Package dockerapi is a minimal client for the docker engine api socket
+package dockerapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to the docker engine api over its unix socket
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client for the engine api socket at path
+func NewClient(path string) *Client {
+	tr := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}}
+	return &Client{http: &http.Client{Transport: tr, Timeout: 30 * time.Second}}
+}
+
+// Call sends body as json and decodes the json response into out, either may be nil
+func (c *Client) Call(ctx context.Context, method, path string, body, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://docker"+path, rd)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("docker %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// VolumeContainers returns the names of all containers, running or not,
+// which reference volume
+func (c *Client) VolumeContainers(ctx context.Context, volume string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{"volume": {volume}})
+	if err != nil {
+		return nil, err
+	}
+	var cs []struct {
+		ID    string `json:"Id"`
+		Names []string
+	}
+	if err := c.Call(ctx, http.MethodGet, "/containers/json?all=1&filters="+url.QueryEscape(string(filters)), nil, &cs); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(cs))
+	for _, ct := range cs {
+		if len(ct.Names) > 0 {
+			names = append(names, strings.TrimPrefix(ct.Names[0], "/"))
+		} else {
+			names = append(names, ct.ID)
+		}
+	}
+	return names, nil
+}
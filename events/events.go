@@ -0,0 +1,156 @@
+// Package events distributes volume lifecycle events to subscribers such as
+// webhooks
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types
+const (
+	VolumeCreate  = "volume.create"
+	VolumeRemove  = "volume.remove"
+	VolumeMount   = "volume.mount"
+	VolumeUnmount = "volume.unmount"
+	// VolumeSwap is published when two volumes exchange their datasets
+	VolumeSwap = "volume.swap"
+	// VolumeRename is published when the mapping of a volume follows its
+	// dataset after it was renamed outside the plugin
+	VolumeRename = "volume.rename"
+	// VolumeBranch is published when a branch is created, checked out or deleted
+	VolumeBranch = "volume.branch"
+	// VolumeArchive is published when a volume is archived to a file or restored from it
+	VolumeArchive = "volume.archive"
+	// VolumeSnapshot is published when the plugin snapshots a volume
+	VolumeSnapshot = "volume.snapshot"
+	// VolumeBackupFailed is published when a scheduled backup of a volume,
+	// or its backup before it is removed, fails
+	VolumeBackupFailed = "volume.backup_failed"
+	// VolumeQuotaExhausted is published when a volume's usage crosses the quota alert threshold
+	VolumeQuotaExhausted = "volume.quota_exhausted"
+	// VolumeQuotaFull is published when a volume fills its quota, with the
+	// action taken to remediate it
+	VolumeQuotaFull = "volume.quota_full"
+	// VolumeNonCompliant is published when an audit finds a volume property
+	// which differs from its create option or violates a policy rule
+	VolumeNonCompliant = "volume.noncompliant"
+	// VolumeCompliant is published when a non compliant volume passes an audit again
+	VolumeCompliant = "volume.compliant"
+	// VolumeDelegate is published when the delegated dataset of a volume is
+	// handed to or revoked from a container's user namespace
+	VolumeDelegate = "volume.delegate"
+	PoolDegraded   = "pool.degraded"
+	PoolRecovered  = "pool.recovered"
+)
+
+// Event is a single lifecycle event
+type Event struct {
+	Type    string            `json:"type"`
+	Time    time.Time         `json:"time"`
+	Volume  string            `json:"volume,omitempty"`
+	Dataset string            `json:"dataset,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Bus fans events out to subscribers. A nil *Bus discards all events.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*subscriber]struct{}
+}
+
+// subscriber is one subscription. Events for a durable subscriber wait for
+// room in its buffer, the others are dropped and counted when it is full.
+type subscriber struct {
+	ch      chan Event
+	done    chan struct{}
+	durable bool
+	// dropping is set while events are dropped, so only the first drop of
+	// a run is logged
+	dropping int32
+}
+
+// subscriberBuffer is the number of events buffered per subscriber before
+// events are dropped for that subscriber, or publishing waits for it
+const subscriberBuffer = 256
+
+var eventsDropped = metrics.NewCounterVec("zfs_plugin_events_dropped_total",
+	"Number of events dropped for subscribers which did not keep up", "type")
+
+func init() {
+	metrics.MustRegister(eventsDropped)
+}
+
+// NewBus returns a new event bus
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*subscriber]struct{})}
+}
+
+// Publish sends an event to all subscribers, the time is set if empty. It
+// waits for durable subscribers with a full buffer and drops the event for
+// the others.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if s.durable {
+			select {
+			case s.ch <- e:
+			case <-s.done:
+			}
+			continue
+		}
+		select {
+		case s.ch <- e:
+			atomic.StoreInt32(&s.dropping, 0)
+		default:
+			eventsDropped.Inc(e.Type)
+			if atomic.CompareAndSwapInt32(&s.dropping, 0, 1) {
+				log.WithFields(log.Fields{"event": e.Type, "volume": e.Volume}).
+					Warn("Event subscriber is not keeping up, dropping events")
+			}
+		}
+	}
+}
+
+// Subscribe returns a channel receiving all future events, and a function
+// which cancels the subscription and closes the channel. Events are dropped
+// while the channel is full.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	return b.subscribe(false)
+}
+
+// SubscribeDurable subscribes like Subscribe, except that no event is
+// dropped, publishing waits while the channel is full. It is for
+// subscribers which record every event and do not block.
+func (b *Bus) SubscribeDurable() (<-chan Event, func()) {
+	return b.subscribe(true)
+}
+
+func (b *Bus) subscribe(durable bool) (<-chan Event, func()) {
+	s := &subscriber{ch: make(chan Event, subscriberBuffer), done: make(chan struct{}), durable: durable}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			// release publishers waiting for a durable subscriber
+			close(s.done)
+			b.mu.Lock()
+			delete(b.subs, s)
+			b.mu.Unlock()
+			close(s.ch)
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Package ha implements active/standby failover of the plugin between hosts
+// sharing the same pools, coordinated by a lease in consul
+package ha
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/consul"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config configures the lease
+type Config struct {
+	// Prefix of the consul keys, the lease is <prefix>/leader and the
+	// replicated state <prefix>/state
+	Prefix string
+	// TTL after which the lease of a failed leader expires
+	TTL time.Duration
+	// ReplicateInterval is how often the leader copies its state db to consul
+	ReplicateInterval time.Duration
+}
+
+// Lease is the leadership lease of this node
+type Lease struct {
+	cfg     Config
+	client  *consul.Client
+	node    string
+	session string
+	// replicated is the state last written to consul
+	replicated []byte
+}
+
+// NewLease returns a lease for this node
+func NewLease(cfg Config, client *consul.Client) *Lease {
+	return &Lease{cfg: cfg, client: client, node: hostname()}
+}
+
+func hostname() string {
+	node, _ := os.Hostname()
+	return node
+}
+
+func (l *Lease) key(k string) string {
+	return l.cfg.Prefix + "/" + k
+}
+
+// Acquire blocks until this node holds the lease or ctx is canceled
+func (l *Lease) Acquire(ctx context.Context) error {
+	id, err := l.client.CreateSession(ctx, "docker-zfs-plugin "+l.node, l.cfg.TTL)
+	if err != nil {
+		return err
+	}
+	l.session = id
+
+	var index uint64
+	for {
+		ok, err := l.client.Acquire(ctx, l.key("leader"), id, []byte(l.node))
+		if err != nil {
+			return err
+		}
+		if ok {
+			log.WithField("node", l.node).Info("Acquired leadership")
+			return nil
+		}
+		// renew while waiting, the session must outlive the standby period,
+		// so a wait is at most half the ttl
+		if err := l.client.RenewSession(ctx, id); err != nil {
+			return err
+		}
+		var p *consul.KVPair
+		p, index, err = l.client.WaitFor(ctx, l.key("leader"), index, l.standbyWait())
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.WithError(err).Warn("Failed to watch leader lease")
+			time.Sleep(time.Second)
+			continue
+		}
+		if p != nil && p.Session != "" {
+			log.WithField("leader", string(p.Value)).Info("Standing by")
+		}
+	}
+}
+
+// standbyWait is how long a standby blocks on the lease between renewals of
+// its session
+func (l *Lease) standbyWait() time.Duration {
+	if w := l.cfg.TTL / 2; w >= 2*time.Second {
+		return w - time.Second
+	}
+	return time.Second
+}
+
+// Hold renews the lease and replicates db until ctx is canceled. It returns
+// an error as soon as the lease is lost, from then on another node may
+// import the pools and the caller must stop serving.
+func (l *Lease) Hold(ctx context.Context, db *state.DB) error {
+	renew := time.NewTicker(l.cfg.TTL / 3)
+	defer renew.Stop()
+	var replicate <-chan time.Time
+	if l.cfg.ReplicateInterval > 0 {
+		t := time.NewTicker(l.cfg.ReplicateInterval)
+		defer t.Stop()
+		replicate = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-renew.C:
+			if err := l.client.RenewSession(ctx, l.session); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("lost leadership lease: %w", err)
+			}
+		case <-replicate:
+			if err := l.replicate(ctx, db); err != nil {
+				log.WithError(err).Warn("Failed to replicate state")
+			}
+		}
+	}
+}
+
+func (l *Lease) replicate(ctx context.Context, db *state.DB) error {
+	b, err := db.Dump()
+	if err != nil || bytes.Equal(b, l.replicated) {
+		return err
+	}
+	if err := l.client.Put(ctx, l.key("state"), b); err != nil {
+		return err
+	}
+	l.replicated = b
+	return nil
+}
+
+// Release replicates db a last time and gives up the lease, so a standby
+// takes over without waiting for the ttl. Hold must have returned before,
+// and must not have reported the lease lost.
+func (l *Lease) Release(ctx context.Context, db *state.DB) {
+	if err := l.replicate(ctx, db); err != nil {
+		log.WithError(err).Warn("Failed to replicate state")
+	}
+	if err := l.client.DestroySession(ctx, l.session); err != nil {
+		log.WithError(err).Warn("Failed to release leadership lease")
+	}
+}
+
+// RestoreState replaces the local state db at path with the state last
+// replicated by the previous leader, if there is any
+func (l *Lease) RestoreState(ctx context.Context, path string) error {
+	p, err := l.client.Get(ctx, l.key("state"))
+	if err != nil || p == nil {
+		return err
+	}
+	log.WithField("bytes", len(p.Value)).Info("Restoring replicated state")
+	return state.Restore(path, p.Value)
+}
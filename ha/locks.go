@@ -0,0 +1,180 @@
+package ha
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/consul"
+	log "github.com/sirupsen/logrus"
+)
+
+// VolumeLocks are per volume locks in consul, held by this node's session
+// while the volume is mounted. If the node dies its session expires and its
+// locks are released.
+type VolumeLocks struct {
+	cfg    Config
+	client *consul.Client
+	node   string
+
+	mu      sync.Mutex
+	session string
+	// held are the volumes locked by this node, they are locked again when
+	// the session is lost
+	held map[string]bool
+	// relocking is set while some held volumes are not locked again yet
+	relocking bool
+}
+
+// NewVolumeLocks returns the volume locks of this node
+func NewVolumeLocks(cfg Config, client *consul.Client) *VolumeLocks {
+	return &VolumeLocks{cfg: cfg, client: client, node: hostname(), held: make(map[string]bool)}
+}
+
+func (vl *VolumeLocks) key(volume string) string {
+	return vl.cfg.Prefix + "/locks/" + url.PathEscape(volume)
+}
+
+// Run renews the session of the locks until ctx is canceled. When the
+// session is lost it locks the held volumes again on a new one.
+func (vl *VolumeLocks) Run(ctx context.Context) {
+	t := time.NewTicker(vl.cfg.TTL / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		vl.mu.Lock()
+		id := vl.session
+		vl.mu.Unlock()
+		if id != "" {
+			if err := vl.client.RenewSession(ctx, id); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.WithError(err).Error("Lost the session of the volume locks")
+				vl.mu.Lock()
+				if vl.session == id {
+					vl.session = ""
+				}
+				vl.relocking = true
+				vl.mu.Unlock()
+			}
+		}
+		vl.mu.Lock()
+		relocking := vl.relocking
+		vl.mu.Unlock()
+		if relocking {
+			vl.relock(ctx)
+		}
+	}
+}
+
+// relock takes the locks of the held volumes on a new session. If any of
+// them fails it is tried again on the next renewal, taking a lock the
+// session already holds again succeeds.
+func (vl *VolumeLocks) relock(ctx context.Context) {
+	vl.mu.Lock()
+	volumes := make([]string, 0, len(vl.held))
+	for v := range vl.held {
+		volumes = append(volumes, v)
+	}
+	vl.mu.Unlock()
+	if len(volumes) == 0 {
+		vl.mu.Lock()
+		vl.relocking = false
+		vl.mu.Unlock()
+		return
+	}
+	id, err := vl.getSession(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to create a session for the volume locks")
+		return
+	}
+	failed := false
+	for _, v := range volumes {
+		ok, err := vl.client.Acquire(ctx, vl.key(v), id, []byte(vl.node))
+		switch {
+		case err != nil:
+			log.WithError(err).WithField("volume", v).Error("Failed to lock mounted volume again")
+			failed = true
+		case !ok:
+			holder, _ := vl.Holder(ctx, v)
+			log.WithFields(log.Fields{"volume": v, "holder": holder}).Error("Mounted volume was locked by another node while the session was lost")
+		}
+	}
+	vl.mu.Lock()
+	vl.relocking = failed
+	vl.mu.Unlock()
+}
+
+func (vl *VolumeLocks) getSession(ctx context.Context) (string, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if vl.session != "" {
+		return vl.session, nil
+	}
+	id, err := vl.client.CreateSession(ctx, "docker-zfs-plugin volumes "+vl.node, vl.cfg.TTL)
+	if err != nil {
+		return "", err
+	}
+	vl.session = id
+	return id, nil
+}
+
+// Lock takes the lock of volume, it returns the node holding it if that is
+// another node
+func (vl *VolumeLocks) Lock(ctx context.Context, volume string) (string, error) {
+	id, err := vl.getSession(ctx)
+	if err != nil {
+		return "", err
+	}
+	ok, err := vl.client.Acquire(ctx, vl.key(volume), id, []byte(vl.node))
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		vl.mu.Lock()
+		vl.held[volume] = true
+		vl.mu.Unlock()
+		return "", nil
+	}
+	holder, err := vl.Holder(ctx, volume)
+	if err != nil {
+		return "", err
+	}
+	if holder == "" {
+		// released in the meantime, report the lock delay as a holder
+		holder = "unknown"
+	}
+	return holder, nil
+}
+
+// Unlock releases the lock of volume
+func (vl *VolumeLocks) Unlock(ctx context.Context, volume string) error {
+	vl.mu.Lock()
+	id := vl.session
+	delete(vl.held, volume)
+	vl.mu.Unlock()
+	if id == "" {
+		return nil
+	}
+	return vl.client.Release(ctx, vl.key(volume), id)
+}
+
+// Holder returns the node holding the lock of volume, empty if it is free
+func (vl *VolumeLocks) Holder(ctx context.Context, volume string) (string, error) {
+	p, err := vl.client.Get(ctx, vl.key(volume))
+	if err != nil || p == nil || p.Session == "" {
+		return "", err
+	}
+	return string(p.Value), nil
+}
+
+// Node returns the name this node holds locks as
+func (vl *VolumeLocks) Node() string {
+	return vl.node
+}
@@ -0,0 +1,104 @@
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/consul"
+	zfsdriver "github.com/TrilliumIT/docker-zfs-plugin/zfs"
+)
+
+// Registry keeps the node hosting each volume in consul under <prefix>/registry
+type Registry struct {
+	cfg    Config
+	client *consul.Client
+	node   string
+}
+
+// NewRegistry returns the volume registry
+func NewRegistry(cfg Config, client *consul.Client) *Registry {
+	return &Registry{cfg: cfg, client: client, node: hostname()}
+}
+
+func (r *Registry) prefix() string {
+	return r.cfg.Prefix + "/registry/"
+}
+
+// Register records the node hosting volume. It only replaces an entry of
+// the same node, with a check-and-set on its index, so of two nodes creating
+// the same volume at once only one registers it. The other gets the node
+// which did.
+func (r *Registry) Register(ctx context.Context, volume string, e zfsdriver.RegistryEntry) (string, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	key := r.prefix() + url.PathEscape(volume)
+	p, err := r.client.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	var index uint64
+	if p != nil {
+		var cur zfsdriver.RegistryEntry
+		if json.Unmarshal(p.Value, &cur) == nil && cur.Node != e.Node {
+			return cur.Node, nil
+		}
+		index = p.ModifyIndex
+	}
+	ok, err := r.client.PutCAS(ctx, key, b, index)
+	if err != nil || ok {
+		return "", err
+	}
+	cur, err := r.Lookup(ctx, volume)
+	if err != nil {
+		return "", err
+	}
+	if cur == nil || cur.Node == e.Node {
+		// changed in the meantime, report the race as a holder
+		return "unknown", nil
+	}
+	return cur.Node, nil
+}
+
+// Deregister removes volume from the registry
+func (r *Registry) Deregister(ctx context.Context, volume string) error {
+	return r.client.Delete(ctx, r.prefix()+url.PathEscape(volume))
+}
+
+// Lookup returns the registry entry of volume, nil if it is not registered
+func (r *Registry) Lookup(ctx context.Context, volume string) (*zfsdriver.RegistryEntry, error) {
+	p, err := r.client.Get(ctx, r.prefix()+url.PathEscape(volume))
+	if err != nil || p == nil {
+		return nil, err
+	}
+	var e zfsdriver.RegistryEntry
+	return &e, json.Unmarshal(p.Value, &e)
+}
+
+// List returns all registered volumes
+func (r *Registry) List(ctx context.Context) (map[string]zfsdriver.RegistryEntry, error) {
+	ps, err := r.client.List(ctx, r.prefix())
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]zfsdriver.RegistryEntry, len(ps))
+	for _, p := range ps {
+		name, err := url.PathUnescape(strings.TrimPrefix(p.Key, r.prefix()))
+		if err != nil {
+			continue
+		}
+		var e zfsdriver.RegistryEntry
+		if json.Unmarshal(p.Value, &e) == nil {
+			entries[name] = e
+		}
+	}
+	return entries, nil
+}
+
+// Node returns the name this node registers volumes as
+func (r *Registry) Node() string {
+	return r.node
+}
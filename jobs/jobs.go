@@ -0,0 +1,250 @@
+// Package jobs runs long operations of the management API in the background,
+// so callers poll their progress and logs instead of holding a request open
+// for minutes. Jobs live in memory only, they do not survive a restart.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+)
+
+// States of a job
+const (
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Canceled  = "canceled"
+)
+
+// maxLog is the number of log lines kept per job, older lines are dropped
+const maxLog = 1000
+
+var jobsTotal = metrics.NewCounterVec("zfs_plugin_jobs_total",
+	"Finished background jobs by kind and state.", "kind", "state")
+
+var jobsRunning = metrics.NewGaugeVec("zfs_plugin_jobs_running",
+	"Background jobs currently running by kind.", "kind")
+
+func init() {
+	metrics.MustRegister(jobsTotal, jobsRunning)
+}
+
+// Job is the state of a job at one point in time
+type Job struct {
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	Target   string      `json:"target,omitempty"`
+	State    string      `json:"state"`
+	Progress float64     `json:"progress"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	Log      []string    `json:"log,omitempty"`
+}
+
+// Func is the work of a job. It should return soon after ctx is canceled.
+type Func func(ctx context.Context, r *Reporter) (interface{}, error)
+
+// Reporter records the progress and log of a running job
+type Reporter struct {
+	mu     sync.Mutex
+	job    Job
+	cancel context.CancelFunc
+}
+
+// Progress sets the completion of the job to done of total units
+func (r *Reporter) Progress(done, total int64) {
+	if total <= 0 {
+		return
+	}
+	p := float64(done) * 100 / float64(total)
+	if p > 100 {
+		p = 100
+	}
+	r.mu.Lock()
+	r.job.Progress = p
+	r.mu.Unlock()
+}
+
+// Logf appends a timestamped line to the log of the job
+func (r *Reporter) Logf(format string, args ...interface{}) {
+	l := time.Now().UTC().Format(time.RFC3339) + " " + fmt.Sprintf(format, args...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.job.Log) >= maxLog {
+		r.job.Log = append(r.job.Log[:0], r.job.Log[1:]...)
+	}
+	r.job.Log = append(r.job.Log, l)
+}
+
+func (r *Reporter) snapshot(withLog bool) Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j := r.job
+	j.Log = nil
+	if withLog {
+		j.Log = append([]string(nil), r.job.Log...)
+	}
+	return j
+}
+
+func (r *Reporter) finish(res interface{}, err error, canceled bool) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.job.Finished = &now
+	r.job.Result = res
+	switch {
+	case canceled:
+		r.job.State = Canceled
+		if err != nil {
+			r.job.Error = err.Error()
+		}
+	case err != nil:
+		r.job.State = Failed
+		r.job.Error = err.Error()
+	default:
+		r.job.State = Succeeded
+		r.job.Progress = 100
+	}
+	jobsTotal.Inc(r.job.Kind, r.job.State)
+	jobsRunning.Add(-1, r.job.Kind)
+}
+
+// Manager runs jobs and keeps finished ones for a while
+type Manager struct {
+	keep time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*Reporter
+	wg   sync.WaitGroup
+}
+
+// NewManager returns a manager forgetting finished jobs after keep
+func NewManager(keep time.Duration) *Manager {
+	return &Manager{keep: keep, jobs: make(map[string]*Reporter)}
+}
+
+// Start runs fn in the background as a job of kind on target
+func (m *Manager) Start(kind, target string, fn Func) Job {
+	j, _ := m.StartLimited(kind, target, 0, fn)
+	return j
+}
+
+// StartLimited is Start unless limit jobs of kind are running already, it
+// reports whether the job was started. A limit of 0 or less is unlimited.
+func (m *Manager) StartLimited(kind, target string, limit int, fn Func) (Job, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Reporter{cancel: cancel, job: Job{ID: newID(), Kind: kind, Target: target, State: Running, Started: time.Now()}}
+	m.mu.Lock()
+	m.prune()
+	if limit > 0 && m.running(kind) >= limit {
+		m.mu.Unlock()
+		cancel()
+		return Job{}, false
+	}
+	m.jobs[r.job.ID] = r
+	m.mu.Unlock()
+	jobsRunning.Add(1, kind)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		res, err := fn(ctx, r)
+		r.finish(res, err, ctx.Err() != nil)
+	}()
+	return r.snapshot(false), true
+}
+
+// running counts the running jobs of kind, m.mu must be held
+func (m *Manager) running(kind string) int {
+	n := 0
+	for _, r := range m.jobs {
+		if j := r.snapshot(false); j.Kind == kind && j.State == Running {
+			n++
+		}
+	}
+	return n
+}
+
+// Get returns the job id including its log
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	r, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return Job{}, false
+	}
+	return r.snapshot(true), true
+}
+
+// List returns all known jobs without their logs, newest first
+func (m *Manager) List() []Job {
+	m.mu.Lock()
+	m.prune()
+	js := make([]Job, 0, len(m.jobs))
+	for _, r := range m.jobs {
+		js = append(js, r.snapshot(false))
+	}
+	m.mu.Unlock()
+	sort.Slice(js, func(i, j int) bool { return js[i].Started.After(js[j].Started) })
+	return js
+}
+
+// Cancel asks the job id to stop, it reports whether the job is known
+func (m *Manager) Cancel(id string) bool {
+	m.mu.Lock()
+	r, ok := m.jobs[id]
+	m.mu.Unlock()
+	if ok {
+		r.cancel()
+	}
+	return ok
+}
+
+// Shutdown cancels all running jobs and waits for them until ctx is done
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	for _, r := range m.jobs {
+		r.cancel()
+	}
+	m.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// prune forgets jobs which finished more than keep ago, m.mu must be held
+func (m *Manager) prune() {
+	for id, r := range m.jobs {
+		j := r.snapshot(false)
+		if j.Finished != nil && time.Since(*j.Finished) > m.keep {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
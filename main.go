@@ -1,15 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/TrilliumIT/docker-zfs-plugin/adminapi"
+	"github.com/TrilliumIT/docker-zfs-plugin/api"
+	"github.com/TrilliumIT/docker-zfs-plugin/broker"
+	"github.com/TrilliumIT/docker-zfs-plugin/consul"
+	"github.com/TrilliumIT/docker-zfs-plugin/credentials"
+	"github.com/TrilliumIT/docker-zfs-plugin/dockerapi"
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/ha"
+	"github.com/TrilliumIT/docker-zfs-plugin/migrate"
+	"github.com/TrilliumIT/docker-zfs-plugin/namecodec"
+	"github.com/TrilliumIT/docker-zfs-plugin/nomad"
+	"github.com/TrilliumIT/docker-zfs-plugin/notify"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	"github.com/TrilliumIT/docker-zfs-plugin/swarm"
+	"github.com/TrilliumIT/docker-zfs-plugin/webhook"
 	zfsdriver "github.com/TrilliumIT/docker-zfs-plugin/zfs"
 	"github.com/coreos/go-systemd/activation"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -20,6 +41,7 @@ import (
 const (
 	version         = "1.0.5"
 	shutdownTimeout = 10 * time.Second
+	schedulerTick   = 5 * time.Second
 )
 
 func main() {
@@ -34,6 +56,381 @@ func main() {
 			Name:  "dataset-name",
 			Usage: "Name of the ZFS dataset to be used. It will be created if it doesn't exist.",
 		},
+		cli.IntFlag{
+			Name:  "max-concurrent-ops",
+			Value: 8,
+			Usage: "Maximum number of zfs commands executing at once. 0 is unlimited.",
+		},
+		cli.IntFlag{
+			Name:  "max-concurrent-streams",
+			Value: 2,
+			Usage: "Maximum number of zfs sends and receives, such as verify, archive or mirror, executing at once. They do not take the slots of --max-concurrent-ops. 0 is unlimited.",
+		},
+		cli.IntFlag{
+			Name:  "max-queued-ops",
+			Value: 64,
+			Usage: "Maximum number of zfs commands waiting for a worker before backpressure is applied. 0 is unlimited.",
+		},
+		cli.StringFlag{
+			Name:  "backpressure",
+			Value: zfsdriver.BackpressureReject,
+			Usage: "Behavior when the operation queue is full: reject fails immediately, delay waits up to --backpressure-delay.",
+		},
+		cli.DurationFlag{
+			Name:  "backpressure-delay",
+			Value: 5 * time.Second,
+			Usage: "How long an operation waits for room in a full queue when --backpressure=delay.",
+		},
+		cli.DurationFlag{
+			Name:  "slow-op-threshold",
+			Value: 5 * time.Second,
+			Usage: "Log a warning for zfs operations taking longer than this. 0 disables.",
+		},
+		cli.DurationFlag{
+			Name:  "command-timeout",
+			Usage: "Abort zfs commands running longer than this. 0 disables the timeout.",
+		},
+		cli.DurationFlag{
+			Name:  "stream-timeout",
+			Value: 12 * time.Hour,
+			Usage: "Abort zfs sends and receives running longer than this. 0 disables the timeout.",
+		},
+		cli.StringSliceFlag{
+			Name:  "op-timeout",
+			Usage: "Override the command timeout of one operation, such as get=10s or destroy=30m, 0 disables it. Operations are named like in slow operation logs. May be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "fault-injection",
+			Usage: "For testing only: inject faults into zfs commands, such as \"delay=0.1:2s,busy=0.05,partial=0.01\" for a 10% chance of up to 2s delay, 5% of failing as busy and 1% of failing after running.",
+		},
+		cli.StringFlag{
+			Name:  "command-prefix",
+			Usage: "Run every zfs and zpool command through this wrapper, such as \"sudo -n\" or \"doas -n\", so the plugin itself can run unprivileged.",
+		},
+		cli.BoolFlag{
+			Name:  "no-json-output",
+			Usage: "Parse the text output of zfs and zpool even where they print JSON, as OpenZFS 2.3 and later do with -j.",
+		},
+		cli.BoolFlag{
+			Name:  "self-test",
+			Usage: "Create, mount, write, snapshot and destroy a temporary dataset under each root dataset, check encryption, zstd and delegation, print the results and exit, failing if the storage path does not work.",
+		},
+		cli.StringSliceFlag{
+			Name:  "self-test-require",
+			Usage: "Capability which fails --self-test if it is missing: encryption, zstd or delegation. May be repeated.",
+		},
+		cli.DurationFlag{
+			Name:  "log-sample-interval",
+			Value: time.Minute,
+			Usage: "Log repeated List, Get and Path debug messages at most once per interval. 0 logs every call.",
+		},
+		cli.StringFlag{
+			Name:  "default-mode",
+			Usage: "Octal mode applied to the mountpoint of new volumes, e.g. 2775 for a setgid group directory.",
+		},
+		cli.StringFlag{
+			Name:  "default-owner",
+			Usage: "uid:gid owning the mountpoint of new volumes.",
+		},
+		cli.StringSliceFlag{
+			Name:  "default-acl",
+			Usage: "ACL entry in setfacl syntax applied to the mountpoint of new volumes, e.g. d:g:1000:rwx. May be repeated. Enables acltype=posixacl.",
+		},
+		cli.BoolFlag{
+			Name:  "default-xattr-sa",
+			Usage: "Create volumes with xattr=sa unless -o xattr is given. Much faster for workloads with many small files.",
+		},
+		cli.StringFlag{
+			Name:  "default-backup",
+			Usage: "Backup tier of volumes created without -o backup: none, daily or hourly.",
+		},
+		cli.StringSliceFlag{
+			Name:  "root-property",
+			Usage: "Property=value expected on every root dataset, e.g. compression=lz4. Differences are logged at startup. May be repeated.",
+		},
+		cli.BoolFlag{
+			Name:  "enforce-root-properties",
+			Usage: "Set root dataset properties which differ from --root-property at startup instead of only reporting them.",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow-unsafe-sync",
+			Usage: "Volume name pattern allowed sync=disabled without -o force-unsafe=true. May be repeated.",
+		},
+		cli.StringSliceFlag{
+			Name:  "extra-socket",
+			Usage: "Additional unix socket serving the volume plugin protocol, e.g. /run/podman/plugins/zfs.sock for podman. May be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "state-file",
+			Value: "/var/lib/docker-zfs-plugin/state.json",
+			Usage: "File the plugin persists its state in.",
+		},
+		cli.StringFlag{
+			Name:  "history-dir",
+			Value: "/var/lib/docker-zfs-plugin/history",
+			Usage: "Directory the event history of every volume is kept in, a file per volume. It is not replicated with the state file. History is not recorded if empty.",
+		},
+		cli.StringFlag{
+			Name:  "state-key-file",
+			Usage: "File holding the 32 byte key (raw, hex or base64) the state file is encrypted with. An existing plain state file is encrypted on startup.",
+		},
+		cli.StringFlag{
+			Name:  "state-key-command",
+			Usage: "Command printing the state file key, e.g. to fetch or unwrap it from a KMS. Alternative to --state-key-file.",
+		},
+		cli.StringSliceFlag{
+			Name:  "webhook-url",
+			Usage: "URL to POST volume lifecycle events to. May be repeated.",
+		},
+		cli.IntFlag{
+			Name:  "webhook-max-attempts",
+			Value: 10,
+			Usage: "Delivery attempts before a webhook is moved to the dead letter queue.",
+		},
+		cli.DurationFlag{
+			Name:  "webhook-backoff",
+			Value: 5 * time.Second,
+			Usage: "Delay before the first webhook retry, doubled for every further attempt.",
+		},
+		cli.StringFlag{
+			Name:  "broker-url",
+			Usage: "nats://[user:pass@]host[:port] or mqtt://[user:pass@]host[:port] to publish lifecycle and health events to.",
+		},
+		cli.StringFlag{
+			Name:  "broker-topic",
+			Value: "docker-zfs-plugin",
+			Usage: "Prefix of the NATS subject or MQTT topic events are published to, followed by the event type.",
+		},
+		cli.DurationFlag{
+			Name:  "health-interval",
+			Value: time.Minute,
+			Usage: "Interval at which pool health and volume quota usage are checked.",
+		},
+		cli.Float64Flag{
+			Name:  "quota-alert-threshold",
+			Value: 0.95,
+			Usage: "Fraction of its quota a volume may use before an alert is raised. 0 disables quota alerts.",
+		},
+		cli.StringFlag{
+			Name:  "quota-action",
+			Value: zfsdriver.QuotaNotify,
+			Usage: "Action when a volume fills its quota: notify, freeze to set it read only, or grow:<percent>%[:<max size>] to raise the quota. Empty disables it. Volumes override it with -o quota-action.",
+		},
+		cli.BoolFlag{
+			Name:  "mount-check",
+			Usage: "Verify on every health check that mounted volumes are mounted on their mountpoint and not shadowed.",
+		},
+		cli.BoolFlag{
+			Name:  "mount-verify",
+			Usage: "Before returning a mountpoint to docker, verify it exists and is the mount of the volume's dataset.",
+		},
+		cli.BoolFlag{
+			Name:  "mount-verify-writable",
+			Usage: "With --mount-verify, also require the mountpoints of writable datasets to be writable.",
+		},
+		cli.BoolFlag{
+			Name:  "mount-repair",
+			Usage: "Mount datasets of mounted volumes again when the mount check finds them unmounted.",
+		},
+		cli.DurationFlag{
+			Name:  "compliance-interval",
+			Value: time.Hour,
+			Usage: "Interval at which volume properties are audited against their create options and the compliance rules. 0 disables audits.",
+		},
+		cli.StringSliceFlag{
+			Name:  "compliance-rule",
+			Usage: "Site policy on a property of every volume, property=value or property!=value, e.g. sync!=disabled. May be repeated.",
+		},
+		cli.BoolFlag{
+			Name:  "compliance-remediate",
+			Usage: "Set properties found in violation back to their create option or the value a rule requires, inheriting locally set forbidden values.",
+		},
+		cli.StringFlag{
+			Name:   "slack-webhook-url",
+			EnvVar: "ZFS_PLUGIN_SLACK_WEBHOOK_URL",
+			Usage:  "Slack incoming webhook to notify about degraded pools and exhausted quotas.",
+		},
+		cli.StringFlag{
+			Name:  "smtp-addr",
+			Usage: "host:port of the mail server to send notifications through.",
+		},
+		cli.StringFlag{
+			Name:  "smtp-from",
+			Usage: "Sender address of email notifications.",
+		},
+		cli.StringSliceFlag{
+			Name:  "smtp-to",
+			Usage: "Recipient of email notifications. May be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "smtp-user",
+			Usage: "User to authenticate to the mail server as.",
+		},
+		cli.StringFlag{
+			Name:   "smtp-password",
+			EnvVar: "ZFS_PLUGIN_SMTP_PASSWORD",
+			Usage:  "Password for --smtp-user.",
+		},
+		cli.StringFlag{
+			Name:  "admin-listen",
+			Usage: "Address (host:port or unix socket path) to serve the management API and metrics on. Disabled if empty.",
+		},
+		cli.StringFlag{
+			Name:  "admin-token-file",
+			Usage: "File of management API tokens, one \"<token> <role|scope>[,...] [<name>]\" per line. Roles are read-only, operator and admin. Tokens are also read from $" + api.TokenEnv + ".",
+		},
+		cli.StringFlag{
+			Name:  "admin-tls-cert",
+			Usage: "Certificate to serve the management API over TLS with. Requires --admin-tls-key.",
+		},
+		cli.StringFlag{
+			Name:  "admin-tls-key",
+			Usage: "Private key for --admin-tls-cert.",
+		},
+		cli.StringFlag{
+			Name:  "admin-tls-client-ca",
+			Usage: "CA bundle used to verify management API client certificates. Clients without a valid certificate are rejected.",
+		},
+		cli.Float64Flag{
+			Name:  "admin-rate-limit",
+			Value: 30,
+			Usage: "Expensive management API operations (snapshots, diffs, backups) allowed per client per minute. 0 disables limiting.",
+		},
+		cli.IntFlag{
+			Name:  "admin-rate-burst",
+			Value: 5,
+			Usage: "Number of expensive management API operations a client may issue back to back.",
+		},
+		cli.IntFlag{
+			Name:  "admin-max-jobs",
+			Value: 2,
+			Usage: "Number of management API background jobs of each kind, such as verify or archive, running at once. Further jobs are refused with 429. 0 is unlimited.",
+		},
+		cli.DurationFlag{
+			Name:  "iostat-interval",
+			Value: 10 * time.Second,
+			Usage: "Interval of the zpool iostat samples exposed by the management API. 0 disables sampling.",
+		},
+		cli.StringFlag{
+			Name:  "consul-addr",
+			Usage: "Consul agent for clustered deployments, e.g. http://127.0.0.1:8500.",
+		},
+		cli.StringFlag{
+			Name:   "consul-token",
+			Usage:  "Consul ACL token.",
+			EnvVar: "ZFS_PLUGIN_CONSUL_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "consul-prefix",
+			Value: "docker-zfs-plugin",
+			Usage: "Consul key prefix shared by the nodes of a cluster.",
+		},
+		cli.BoolFlag{
+			Name:  "ha",
+			Usage: "Run active/standby, waiting for the leadership lease in consul before importing the pools and serving.",
+		},
+		cli.StringFlag{
+			Name:  "scope",
+			Value: "local",
+			Usage: "Volume scope reported to docker, local or global. global keeps a registry of the node hosting each volume in consul.",
+		},
+		cli.BoolFlag{
+			Name:  "volume-locks",
+			Usage: "Lock volumes in consul while mounted, so two nodes never mount the same dataset at once.",
+		},
+		cli.DurationFlag{
+			Name:  "ha-ttl",
+			Value: 15 * time.Second,
+			Usage: "Time after which the lease of a failed leader expires.",
+		},
+		cli.DurationFlag{
+			Name:  "ha-replicate-interval",
+			Value: 10 * time.Second,
+			Usage: "How often the leader replicates its state file to consul.",
+		},
+		cli.BoolFlag{
+			Name:  "remove-check",
+			Usage: "Before destroying a volume, ask the docker api whether any container, running or stopped, references it and refuse if one does.",
+		},
+		cli.Int64Flag{
+			Name:  "prewarm-max-bytes",
+			Value: 1 << 30,
+			Usage: "Most bytes read into the cache when a volume created with prewarm=true is mounted. 0 is unlimited.",
+		},
+		cli.Int64Flag{
+			Name:  "prewarm-rate",
+			Value: 128 << 20,
+			Usage: "Bytes per second read when priming the cache of a volume. 0 is unlimited.",
+		},
+		cli.DurationFlag{
+			Name:  "prewarm-timeout",
+			Value: 30 * time.Second,
+			Usage: "Longest a mount is delayed to prime the cache of a volume. 0 is unlimited.",
+		},
+		cli.StringSliceFlag{
+			Name:  "replica-dataset",
+			Usage: "Dataset other hosts replicate into, its leaf datasets are registered as read only volumes. May be repeated.",
+		},
+		cli.StringFlag{
+			Name:  "replica-suffix",
+			Value: zfsdriver.DefaultReplicaSuffix,
+			Usage: "Suffix of the volume names of replicas.",
+		},
+		cli.StringFlag{
+			Name:  "archive-dir",
+			Usage: "Directory archived volumes are sent to, such as an nfs mount. Archiving is disabled if empty.",
+		},
+		cli.BoolFlag{
+			Name:  "backup-on-remove",
+			Usage: "Send volumes with all their snapshots to the archive directory before removing them, unless created with remove-backup=false. A failed backup keeps the volume.",
+		},
+		cli.DurationFlag{
+			Name:  "backup-on-remove-timeout",
+			Value: 50 * time.Second,
+			Usage: "Fail the remove of a volume whose backup takes longer than this, docker gives up on a remove after a minute. Larger volumes can be archived before they are removed.",
+		},
+		cli.BoolFlag{
+			Name:  "adopt-unmapped",
+			Usage: "At startup, record every dataset below the root datasets without a volume mapping under its dataset name, with create options read from its properties.",
+		},
+		cli.StringFlag{
+			Name:  "name-delimiter",
+			Value: namecodec.DefaultDelimiter,
+			Usage: "Separator of the levels of volume names which are nested as datasets, such as __ for org__project__volume.",
+		},
+		cli.IntFlag{
+			Name:  "name-depth",
+			Value: namecodec.DefaultDepth,
+			Usage: "Most levels a volume name is nested into, the last level keeps any further separators.",
+		},
+		cli.IntFlag{
+			Name:  "bulk-parallelism",
+			Value: 4,
+			Usage: "How many volumes a bulk operation of the management api works on at once.",
+		},
+		cli.StringFlag{
+			Name:  "mirror-ssh",
+			Usage: "Command used to reach the source hosts of mirror volumes, such as \"ssh -i /etc/docker-zfs-plugin/id_ed25519 -o BatchMode=yes\". Mirror volumes are disabled if empty.",
+		},
+		cli.StringFlag{
+			Name:  "credentials-dir",
+			Value: "/etc/docker-zfs-plugin/credentials",
+			Usage: "Directory of named credentials, one file per credential: a PEM ssh private key or a json object with type and data. Credentials can also be stored in the state file through the management API.",
+		},
+		cli.BoolFlag{
+			Name:  "swarm-labels",
+			Usage: "Publish swarm node labels describing the pools, their free space and the volumes of this node. Requires a swarm manager.",
+		},
+		cli.StringFlag{
+			Name:  "docker-socket",
+			Value: "/var/run/docker.sock",
+			Usage: "Docker engine api socket used for swarm node labels and remove checks.",
+		},
+		cli.DurationFlag{
+			Name:  "swarm-label-interval",
+			Value: time.Minute,
+			Usage: "How often the swarm node labels are updated.",
+		},
 		cli.BoolFlag{
 			Name:        "verbose",
 			Usage:       "verbose output",
@@ -41,6 +438,190 @@ func main() {
 		},
 	}
 	app.Action = Run
+	app.Commands = []cli.Command{
+		{
+			Name:      "nomad",
+			Usage:     "Act as a nomad dynamic host volume plugin, creating volumes through the management api of the running daemon",
+			ArgsUsage: "fingerprint|create|delete",
+			Flags:     adminFlags,
+			Action: func(c *cli.Context) error {
+				p := &nomad.Plugin{Client: adminapi.NewClient(c.String("admin-addr"), c.String("admin-token")), Version: version, Out: os.Stdout}
+				return p.Run(c.Args().First(), nomad.FromEnviron())
+			},
+		},
+		{
+			Name:      "import-local",
+			Usage:     "Copy volumes of docker's local driver into new zfs volumes of the same name through the management api of the running daemon",
+			ArgsUsage: "VOLUME...",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "remove",
+					Usage: "Remove each local volume once its data is copied, so docker uses the zfs volume.",
+				},
+				cli.StringSliceFlag{
+					Name:  "opt, o",
+					Usage: "Option key=value for the new volumes, as for docker volume create. May be repeated.",
+				},
+				cli.StringFlag{
+					Name:  "rsync",
+					Value: strings.Join(migrate.DefaultRsync, " "),
+					Usage: "Command copying the data.",
+				},
+				cli.StringFlag{
+					Name:  "docker-socket",
+					Value: "/var/run/docker.sock",
+					Usage: "Docker engine api socket.",
+				},
+			}, adminFlags...),
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return fmt.Errorf("no volumes given")
+				}
+				opts := make(map[string]string)
+				for _, kv := range c.StringSlice("opt") {
+					i := strings.Index(kv, "=")
+					if i <= 0 {
+						return fmt.Errorf("invalid option %q, expected key=value", kv)
+					}
+					opts[kv[:i]] = kv[i+1:]
+				}
+				im := &migrate.LocalImporter{
+					Docker:  dockerapi.NewClient(c.String("docker-socket")),
+					Admin:   adminapi.NewClient(c.String("admin-addr"), c.String("admin-token")),
+					Options: opts,
+					Remove:  c.Bool("remove"),
+					Rsync:   strings.Fields(c.String("rsync")),
+					Out:     os.Stdout,
+				}
+				for _, name := range c.Args() {
+					if err := im.Import(context.Background(), name); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "migrate-layout",
+			Usage:     "Rename the datasets of unmounted volumes into the flat or hierarchical layout through the management api of the running daemon",
+			ArgsUsage: "VOLUME...",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "layout",
+					Value: zfsdriver.LayoutHierarchical,
+					Usage: "Target layout, hierarchical nests project_volume as project/volume, flat keeps it as project_volume.",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only print the renames.",
+				},
+			}, adminFlags...),
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					return fmt.Errorf("no volumes given")
+				}
+				req := map[string]interface{}{"volumes": []string(c.Args()), "layout": c.String("layout"), "dry_run": c.Bool("dry-run")}
+				var res struct {
+					Moves []zfsdriver.LayoutMove `json:"moves"`
+				}
+				if err := adminapi.NewClient(c.String("admin-addr"), c.String("admin-token")).Call(http.MethodPost, "/v1/volumes/layout", req, &res); err != nil {
+					return err
+				}
+				failed := 0
+				for _, m := range res.Moves {
+					switch {
+					case m.Error != "":
+						failed++
+						fmt.Printf("%s: %s\n", m.Volume, m.Error)
+					case m.Moved:
+						fmt.Printf("%s: %s -> %s\n", m.Volume, m.From, m.To)
+					case m.From == m.To:
+						fmt.Printf("%s: already %s\n", m.Volume, c.String("layout"))
+					default:
+						fmt.Printf("%s: would move %s -> %s\n", m.Volume, m.From, m.To)
+					}
+				}
+				if failed > 0 {
+					return fmt.Errorf("%d of %d volumes not moved", failed, len(res.Moves))
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "apply-schedules",
+			Usage:     "Replace the snapshot schedules of the running daemon with those declared in a json file, applying the same file again changes nothing",
+			ArgsUsage: "FILE",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only print the changes.",
+				},
+			}, adminFlags...),
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("expected one file")
+				}
+				f, err := os.Open(c.Args().First())
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				var set zfsdriver.ScheduleSet
+				dec := json.NewDecoder(f)
+				dec.DisallowUnknownFields()
+				if err := dec.Decode(&set); err != nil {
+					return fmt.Errorf("invalid schedule file: %w", err)
+				}
+				path := "/v1/schedules"
+				if c.Bool("dry-run") {
+					path += "?dry_run=true"
+				}
+				var res zfsdriver.ScheduleReport
+				if err := adminapi.NewClient(c.String("admin-addr"), c.String("admin-token")).Call(http.MethodPut, path, &set, &res); err != nil {
+					return err
+				}
+				for _, ch := range res.Changes {
+					fmt.Printf("%s: %s %s\n", ch.Schedule, ch.Change, strings.Join(ch.Volumes, " "))
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "export-schedules",
+			Usage: "Print the snapshot schedules of the running daemon as a json file apply-schedules accepts",
+			Flags: adminFlags,
+			Action: func(c *cli.Context) error {
+				var set json.RawMessage
+				if err := adminapi.NewClient(c.String("admin-addr"), c.String("admin-token")).Call(http.MethodGet, "/v1/schedules", nil, &set); err != nil {
+					return err
+				}
+				var out bytes.Buffer
+				if err := json.Indent(&out, set, "", "  "); err != nil {
+					return err
+				}
+				fmt.Println(out.String())
+				return nil
+			},
+		},
+		{
+			Name:      "archive",
+			Usage:     "Send an unmounted volume to a file in the archive directory of the running daemon and destroy its dataset",
+			ArgsUsage: "VOLUME",
+			Flags:     adminFlags,
+			Action: func(c *cli.Context) error {
+				return archiveJob(c, "/v1/volumes/archive", "archived to")
+			},
+		},
+		{
+			Name:      "restore-archive",
+			Usage:     "Receive an archived volume from its archive file through the running daemon",
+			ArgsUsage: "VOLUME",
+			Flags:     adminFlags,
+			Action: func(c *cli.Context) error {
+				return archiveJob(c, "/v1/volumes/restore", "restored from")
+			},
+		},
+	}
 	app.Before = func(c *cli.Context) error {
 		if verbose {
 			log.SetLevel(log.DebugLevel)
@@ -53,55 +634,468 @@ func main() {
 	}
 }
 
+// adminFlags locate the management api for the subcommands using it
+var adminFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "admin-addr",
+		Value:  "/run/docker-zfs-plugin/admin.sock",
+		Usage:  "Management api socket path or url.",
+		EnvVar: "ZFS_PLUGIN_ADMIN_ADDR",
+	},
+	cli.StringFlag{
+		Name:   "admin-token",
+		Usage:  "Management api bearer token with the write and admin scopes.",
+		EnvVar: "ZFS_PLUGIN_ADMIN_TOKEN",
+	},
+}
+
+// archiveJob runs an archive or restore job for the volume argument
+func archiveJob(c *cli.Context, path, done string) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected one volume")
+	}
+	var res zfsdriver.ArchiveResult
+	err := adminapi.NewClient(c.String("admin-addr"), c.String("admin-token")).RunJob(path,
+		map[string]string{"volume": c.Args().First()}, &res, time.Second, func(p float64) {
+			fmt.Fprintf(os.Stderr, "\r%3.0f%%", p*100)
+		})
+	fmt.Fprint(os.Stderr, "\r")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s %s (%d bytes, sha256 %s)\n", res.Volume, done, res.File, res.Size, res.SHA256)
+	return nil
+}
+
+// selfTest runs the self test of the driver and prints one line per check
+func selfTest(ctx context.Context, d *zfsdriver.ZfsDriver, require []string) error {
+	report, err := d.SelfTest(ctx, require)
+	if err != nil {
+		return err
+	}
+	for _, c := range report.Checks {
+		result := "PASS"
+		switch {
+		case c.Passed:
+		case c.Capability && !stringIn(c.Check, require):
+			result = "MISSING"
+		default:
+			result = "FAIL"
+		}
+		fmt.Printf("%-7s %s %s (%s)", result, c.Dataset, c.Check, c.Duration)
+		if c.Error != "" {
+			fmt.Printf(": %s", c.Error)
+		}
+		fmt.Println()
+	}
+	if !report.Passed {
+		// exit with 1 instead of panicking, so deployments can gate on it
+		return cli.NewExitError("self test failed", 1)
+	}
+	return nil
+}
+
+func stringIn(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Run runs the driver
 func Run(ctx *cli.Context) error {
 	if ctx.String("dataset-name") == "" {
 		return fmt.Errorf("zfs dataset name is a required field")
 	}
 
-	d, err := zfsdriver.NewZfsDriver(ctx.StringSlice("dataset-name")...)
+	tmpl, err := mountTemplate(ctx)
+	if err != nil {
+		return err
+	}
+
+	defaults := make(map[string]string)
+	if ctx.Bool("default-xattr-sa") {
+		defaults["xattr"] = "sa"
+	}
+	switch tier := ctx.String("default-backup"); tier {
+	case "":
+	case zfsdriver.BackupNone, zfsdriver.BackupDaily, zfsdriver.BackupHourly:
+		defaults["docker-zfs-plugin:backup"] = tier
+	default:
+		return fmt.Errorf("invalid default backup tier %q, expected none, daily or hourly", tier)
+	}
+
+	rootProps := make(map[string]string)
+	for _, kv := range ctx.StringSlice("root-property") {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return fmt.Errorf("invalid root property %q, expected property=value", kv)
+		}
+		rootProps[kv[:i]] = kv[i+1:]
+	}
+
+	bgCtx, bgCancel := context.WithCancel(context.Background())
+	defer bgCancel()
+
+	var cc *consul.Client
+	if addr := ctx.String("consul-addr"); addr != "" {
+		cc = consul.NewClient(addr, ctx.String("consul-token"))
+	} else if ctx.Bool("ha") || ctx.Bool("volume-locks") || ctx.String("scope") == "global" {
+		return fmt.Errorf("--ha, --volume-locks and --scope global require --consul-addr")
+	}
+	haCfg := ha.Config{
+		Prefix:            ctx.String("consul-prefix"),
+		TTL:               ctx.Duration("ha-ttl"),
+		ReplicateInterval: ctx.Duration("ha-replicate-interval"),
+	}
+
+	//the self test only checks the storage path, it neither takes over nor changes the cluster state
+	selfTesting := ctx.Bool("self-test")
+	var lease *ha.Lease
+	if ctx.Bool("ha") && !selfTesting {
+		lease = ha.NewLease(haCfg, cc)
+		log.Info("Waiting for the leadership lease")
+		if err = lease.Acquire(bgCtx); err != nil {
+			return err
+		}
+		if err = lease.RestoreState(bgCtx, ctx.String("state-file")); err != nil {
+			return err
+		}
+		if err = zfsdriver.ImportPools(bgCtx, ctx.StringSlice("dataset-name"), strings.Fields(ctx.String("command-prefix")), true); err != nil {
+			return err
+		}
+	}
+
+	key, err := stateKey(ctx)
+	if err != nil {
+		return err
+	}
+	db, err := state.Open(ctx.String("state-file"), key)
+	if err != nil {
+		return err
+	}
+	bus := events.NewBus()
+	creds := credentials.NewStore(ctx.String("credentials-dir"), db)
+	defer creds.Close()
+
+	var faults *zfsdriver.Faults
+	if spec := ctx.String("fault-injection"); spec != "" {
+		if faults, err = zfsdriver.ParseFaults(spec); err != nil {
+			return err
+		}
+	}
+
+	opTimeouts, err := zfsdriver.ParseOpTimeouts(ctx.StringSlice("op-timeout"))
+	if err != nil {
+		return err
+	}
+
+	dcfg := zfsdriver.Config{
+		Datasets:              ctx.StringSlice("dataset-name"),
+		MaxConcurrentOps:      ctx.Int("max-concurrent-ops"),
+		MaxConcurrentStreams:  ctx.Int("max-concurrent-streams"),
+		MaxQueuedOps:          ctx.Int("max-queued-ops"),
+		Backpressure:          ctx.String("backpressure"),
+		BackpressureDelay:     ctx.Duration("backpressure-delay"),
+		SlowOpThreshold:       ctx.Duration("slow-op-threshold"),
+		CommandTimeout:        ctx.Duration("command-timeout"),
+		StreamTimeout:         ctx.Duration("stream-timeout"),
+		OpTimeouts:            opTimeouts,
+		CommandPrefix:         strings.Fields(ctx.String("command-prefix")),
+		LogSampleInterval:     ctx.Duration("log-sample-interval"),
+		Events:                bus,
+		State:                 db,
+		MountTemplate:         tmpl,
+		DefaultProperties:     defaults,
+		RootProperties:        rootProps,
+		EnforceRootProperties: ctx.Bool("enforce-root-properties"),
+		UnsafeSyncAllow:       ctx.StringSlice("allow-unsafe-sync"),
+		Scope:                 ctx.String("scope"),
+		MirrorSSH:             strings.Fields(ctx.String("mirror-ssh")),
+		Credentials:           creds,
+		Faults:                faults,
+		VerifyMounts:          ctx.Bool("mount-verify"),
+		VerifyWritable:        ctx.Bool("mount-verify-writable"),
+		Prewarm: zfsdriver.PrewarmConfig{
+			MaxBytes: ctx.Int64("prewarm-max-bytes"),
+			Rate:     ctx.Int64("prewarm-rate"),
+			Timeout:  ctx.Duration("prewarm-timeout"),
+		},
+		BulkParallelism:     ctx.Int("bulk-parallelism"),
+		NameDelimiter:       ctx.String("name-delimiter"),
+		NameDepth:           ctx.Int("name-depth"),
+		ReplicaDatasets:     ctx.StringSlice("replica-dataset"),
+		ReplicaSuffix:       ctx.String("replica-suffix"),
+		ArchiveDir:          ctx.String("archive-dir"),
+		HistoryDir:          ctx.String("history-dir"),
+		RemoveBackup:        ctx.Bool("backup-on-remove"),
+		RemoveBackupTimeout: ctx.Duration("backup-on-remove-timeout"),
+		NoJSONOutput:        ctx.Bool("no-json-output"),
+		SelfTest:            selfTesting,
+	}
+	if ctx.Bool("remove-check") {
+		dcfg.Containers = dockerapi.NewClient(ctx.String("docker-socket"))
+	}
+	switch dcfg.Scope {
+	case "local":
+	case "global":
+		dcfg.Registry = ha.NewRegistry(haCfg, cc)
+	default:
+		return fmt.Errorf("invalid scope %q, expected local or global", dcfg.Scope)
+	}
+	if ctx.Bool("volume-locks") && !selfTesting {
+		locks := ha.NewVolumeLocks(haCfg, cc)
+		go locks.Run(bgCtx)
+		dcfg.Locker = locks
+	}
+	d, err := zfsdriver.NewZfsDriver(dcfg)
 	if err != nil {
 		return err
 	}
+	if selfTesting {
+		return selfTest(bgCtx, d, ctx.StringSlice("self-test-require"))
+	}
+	if ctx.Bool("adopt-unmapped") {
+		d.AdoptUnmapped()
+	}
 	h := volume.NewHandler(d)
-	errCh := make(chan error)
+
+	haErr := make(chan error, 1)
+	holdCtx, holdCancel := context.WithCancel(bgCtx)
+	defer holdCancel()
+	if lease != nil {
+		go func() { haErr <- lease.Hold(holdCtx, db) }()
+	}
+
+	var hooks *webhook.Dispatcher
+	if urls := ctx.StringSlice("webhook-url"); len(urls) > 0 {
+		hooks = webhook.NewDispatcher(webhook.Config{
+			URLs:        urls,
+			MaxAttempts: ctx.Int("webhook-max-attempts"),
+			Backoff:     ctx.Duration("webhook-backoff"),
+			Timeout:     10 * time.Second,
+		}, db)
+		go hooks.Run(bgCtx, bus)
+	}
+
+	go d.NewScheduler(schedulerTick).Run(bgCtx)
+	go d.RecordHistory(bgCtx)
+
+	if iv := ctx.Duration("health-interval"); iv > 0 {
+		hcfg := zfsdriver.HealthConfig{
+			Interval:       iv,
+			QuotaThreshold: ctx.Float64("quota-alert-threshold"),
+			MountCheck:     ctx.Bool("mount-check"),
+			MountRepair:    ctx.Bool("mount-repair"),
+		}
+		if v := ctx.String("quota-action"); v != "" {
+			if hcfg.QuotaAction, err = zfsdriver.ParseQuotaAction(v); err != nil {
+				return err
+			}
+		}
+		go d.MonitorHealth(bgCtx, hcfg)
+	}
+
+	if iv := ctx.Duration("compliance-interval"); iv > 0 {
+		ccfg := zfsdriver.ComplianceConfig{Interval: iv, Remediate: ctx.Bool("compliance-remediate")}
+		for _, v := range ctx.StringSlice("compliance-rule") {
+			rule, rErr := zfsdriver.ParseComplianceRule(v)
+			if rErr != nil {
+				return rErr
+			}
+			ccfg.Rules = append(ccfg.Rules, rule)
+		}
+		go d.MonitorCompliance(bgCtx, ccfg)
+	}
+
+	hostname, _ := os.Hostname()
+	if n := notify.NewNotifier(notify.Config{
+		SlackWebhookURL: ctx.String("slack-webhook-url"),
+		SMTP: notify.SMTP{
+			Addr:     ctx.String("smtp-addr"),
+			From:     ctx.String("smtp-from"),
+			To:       ctx.StringSlice("smtp-to"),
+			User:     ctx.String("smtp-user"),
+			Password: ctx.String("smtp-password"),
+		},
+	}, hostname); n != nil {
+		go n.Run(bgCtx, bus)
+	}
+
+	if bu := ctx.String("broker-url"); bu != "" {
+		pub, pErr := broker.NewPublisher(bu, ctx.String("broker-topic"))
+		if pErr != nil {
+			return pErr
+		}
+		go pub.Run(bgCtx, bus)
+	}
+
+	if ctx.Bool("swarm-labels") {
+		go swarm.NewPublisher(swarm.Config{Socket: ctx.String("docker-socket"), Interval: ctx.Duration("swarm-label-interval")}, d).Run(bgCtx)
+	}
+
+	var admin *api.Server
+	if addr := ctx.String("admin-listen"); addr != "" {
+		tokens, tErr := api.LoadTokens(ctx.String("admin-token-file"))
+		if tErr != nil {
+			return tErr
+		}
+		if !tokens.Enabled() {
+			log.Warn("no management api tokens configured, the management api is unauthenticated")
+		}
+		cfg := api.Config{
+			Version:     version,
+			Driver:      d,
+			Events:      bus,
+			Webhooks:    hooks,
+			Credentials: creds,
+			Tokens:      tokens,
+			RateLimit:   api.RateLimit{PerMinute: ctx.Float64("admin-rate-limit"), Burst: ctx.Int("admin-rate-burst")},
+			MaxJobs:     ctx.Int("admin-max-jobs"),
+		}
+		if iv := ctx.Duration("iostat-interval"); iv > 0 {
+			cfg.Iostat = zfsdriver.NewIostatCollector(d.Pools(), iv, strings.Fields(ctx.String("command-prefix")))
+			go cfg.Iostat.Run(bgCtx)
+		}
+		al, aErr := api.Listen(addr)
+		if aErr != nil {
+			return aErr
+		}
+		if cert := ctx.String("admin-tls-cert"); cert != "" {
+			tlsCfg, tErr := api.TLSConfig(cert, ctx.String("admin-tls-key"), ctx.String("admin-tls-client-ca"))
+			if tErr != nil {
+				_ = al.Close()
+				return tErr
+			}
+			al = tls.NewListener(al, tlsCfg)
+		} else if ctx.String("admin-tls-client-ca") != "" {
+			_ = al.Close()
+			return fmt.Errorf("--admin-tls-client-ca requires --admin-tls-cert")
+		}
+		admin = api.NewServer(cfg)
+		log.WithField("listener", al.Addr().String()).Debug("launching management api")
+		go func() {
+			if aErr := admin.Serve(al); aErr != nil && !errors.Is(aErr, http.ErrServerClosed) {
+				log.WithError(aErr).Error("error running management api")
+			}
+		}()
+	}
 
 	listeners, _ := activation.Listeners() // wtf coreos, this funciton never returns errors
-	if len(listeners) > 1 {
-		log.Warn("driver does not support multiple sockets")
+	activated := len(listeners) > 0
+	for _, path := range ctx.StringSlice("extra-socket") {
+		l, lErr := api.Listen(path)
+		if lErr != nil {
+			return lErr
+		}
+		listeners = append(listeners, l)
+	}
+	// one handler serves every socket, so docker and podman share the volumes
+	serving := len(listeners)
+	if !activated {
+		serving++
 	}
-	if len(listeners) == 0 {
+	errCh := make(chan error, serving)
+	if !activated {
 		log.Debug("launching volume handler.")
 		go func() { errCh <- h.ServeUnix("zfs", 0) }()
-	} else {
-		l := listeners[0]
+	}
+	for _, l := range listeners {
+		l := l
 		log.WithField("listener", l.Addr().String()).Debug("launching volume handler")
 		go func() { errCh <- h.Serve(l) }()
 	}
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	defer close(c)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
 
+	leader := lease != nil
 	select {
 	case err = <-errCh:
 		log.WithError(err).Error("error running handler")
-		close(errCh)
+		serving--
+	case err = <-haErr:
+		log.WithError(err).Error("stopping, another node may take over the pools")
+		leader = false
+		// background work stops changing the pools right away
+		bgCancel()
 	case <-c:
 	}
 
 	toCtx, toCtxCancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer toCtxCancel()
+	if admin != nil {
+		if sErr := admin.Shutdown(toCtx); sErr != nil {
+			log.WithError(sErr).Error("error shutting down management api")
+		}
+	}
 	if sErr := h.Shutdown(toCtx); sErr != nil {
 		err = sErr
 		log.WithError(err).Error("error shutting down handler")
 	}
 
-	if hErr := <-errCh; hErr != nil && !errors.Is(hErr, http.ErrServerClosed) {
-		err = hErr
-		log.WithError(err).Error("error in handler after shutdown")
+	for ; serving > 0; serving-- {
+		if hErr := <-errCh; hErr != nil && !errors.Is(hErr, http.ErrServerClosed) {
+			err = hErr
+			log.WithError(err).Error("error in handler after shutdown")
+		}
+	}
+	if leader {
+		// Hold replicates the state as well, it has to stop before the last replication
+		holdCancel()
+		if hErr := <-haErr; hErr != nil {
+			log.WithError(hErr).Error("lost leadership lease while stopping")
+		} else {
+			lease.Release(toCtx, db)
+		}
+	} else if lease != nil {
+		zfsdriver.ExportPools(toCtx, d.Pools(), strings.Fields(ctx.String("command-prefix")))
 	}
 
 	return err
 }
+
+// stateKey returns the key of the state file from --state-key-file or the
+// output of --state-key-command, nil if neither is given
+func stateKey(ctx *cli.Context) ([]byte, error) {
+	file, command := ctx.String("state-key-file"), ctx.String("state-key-command")
+	var b []byte
+	var err error
+	switch {
+	case file != "" && command != "":
+		return nil, errors.New("--state-key-file and --state-key-command are exclusive")
+	case file != "":
+		b, err = ioutil.ReadFile(file)
+	case command != "":
+		argv := strings.Fields(command)
+		b, err = exec.Command(argv[0], argv[1:]...).Output()
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state key: %w", err)
+	}
+	return state.ParseKey(b)
+}
+
+func mountTemplate(ctx *cli.Context) (*zfsdriver.MountTemplate, error) {
+	mode, owner, acl := ctx.String("default-mode"), ctx.String("default-owner"), ctx.StringSlice("default-acl")
+	if mode == "" && owner == "" && len(acl) == 0 {
+		return nil, nil
+	}
+	t := &zfsdriver.MountTemplate{ACL: acl}
+	var err error
+	if mode != "" {
+		if t.Mode, err = zfsdriver.ParseMode(mode); err != nil {
+			return nil, err
+		}
+	}
+	if t.UID, t.GID, err = zfsdriver.ParseOwner(owner); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
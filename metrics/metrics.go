@@ -0,0 +1,205 @@
+// Package metrics is a minimal registry exposing metrics in the prometheus
+// text exposition format
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric is a metric family which can be written to the /metrics endpoint
+type Metric interface {
+	write(w io.Writer)
+}
+
+// Collector refreshes metric values, it is called before every scrape
+type Collector func()
+
+// Registry holds a set of metric families
+type Registry struct {
+	mu         sync.Mutex
+	metrics    []Metric
+	collectors []Collector
+}
+
+// Default is the registry served by Handler
+var Default = &Registry{}
+
+// MustRegister registers metrics with the default registry
+func MustRegister(ms ...Metric) {
+	Default.MustRegister(ms...)
+}
+
+// MustRegister registers metrics with the registry
+func (r *Registry) MustRegister(ms ...Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, ms...)
+}
+
+// RegisterCollector registers a collector with the default registry
+func RegisterCollector(c Collector) {
+	Default.RegisterCollector(c)
+}
+
+// RegisterCollector registers a collector to run before every scrape
+func (r *Registry) RegisterCollector(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Handler returns an http.Handler for the default registry
+func Handler() http.Handler {
+	return Default
+}
+
+// ServeHTTP writes all registered metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	ms := make([]Metric, len(r.metrics))
+	copy(ms, r.metrics)
+	cs := make([]Collector, len(r.collectors))
+	copy(cs, r.collectors)
+	r.mu.Unlock()
+
+	for _, c := range cs {
+		c()
+	}
+
+	var buf bytes.Buffer
+	for _, m := range ms {
+		m.write(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write(buf.Bytes())
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+func (d *desc) key(lvs []string) string {
+	if len(lvs) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", d.name, len(d.labels), len(lvs)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+func (d *desc) sample(w io.Writer, key string, v float64) {
+	fmt.Fprintf(w, "%s%s %s\n", d.name, d.labelString(key), formatFloat(v))
+}
+
+func (d *desc) labelString(key string) string {
+	if len(d.labels) == 0 {
+		return ""
+	}
+	lvs := strings.Split(key, "\xff")
+	pairs := make([]string, len(d.labels))
+	for i, l := range d.labels {
+		pairs[i] = fmt.Sprintf("%s=%q", l, lvs[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type vec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.header(w)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v.sample(w, k, v.values[k])
+	}
+}
+
+// CounterVec is a set of counters partitioned by labels
+type CounterVec struct {
+	vec
+}
+
+// NewCounterVec returns a new counter family
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec{desc: desc{name: name, help: help, typ: "counter", labels: labels}, values: map[string]float64{}}}
+}
+
+// Inc increments the counter for the label values by one
+func (c *CounterVec) Inc(lvs ...string) {
+	c.Add(1, lvs...)
+}
+
+// Add adds v to the counter for the label values
+func (c *CounterVec) Add(v float64, lvs ...string) {
+	k := c.key(lvs)
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+// GaugeVec is a set of gauges partitioned by labels
+type GaugeVec struct {
+	vec
+}
+
+// NewGaugeVec returns a new gauge family
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, values: map[string]float64{}}}
+}
+
+// Set sets the gauge for the label values
+func (g *GaugeVec) Set(v float64, lvs ...string) {
+	k := g.key(lvs)
+	g.mu.Lock()
+	g.values[k] = v
+	g.mu.Unlock()
+}
+
+// Add adds v to the gauge for the label values
+func (g *GaugeVec) Add(v float64, lvs ...string) {
+	k := g.key(lvs)
+	g.mu.Lock()
+	g.values[k] += v
+	g.mu.Unlock()
+}
+
+// Reset removes all label values from the gauge
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	g.values = map[string]float64{}
+	g.mu.Unlock()
+}
@@ -0,0 +1,102 @@
+// Package migrate moves existing docker volumes onto the zfs plugin
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/adminapi"
+	"github.com/TrilliumIT/docker-zfs-plugin/dockerapi"
+)
+
+// DefaultRsync copies a volume preserving hard links, ACLs, extended
+// attributes and numeric ownership
+var DefaultRsync = []string{"rsync", "-aHAX", "--numeric-ids"}
+
+// LocalImporter copies volumes of docker's local driver into new plugin
+// volumes of the same name
+type LocalImporter struct {
+	Docker *dockerapi.Client
+	Admin  *adminapi.Client
+	// Options are passed to the create of every new volume
+	Options map[string]string
+	// Remove removes the original local volume once its data is copied
+	Remove bool
+	// Rsync is the copy command, DefaultRsync if empty
+	Rsync []string
+	Out   io.Writer
+}
+
+type dockerVolume struct {
+	Name       string
+	Driver     string
+	Mountpoint string
+}
+
+// Import copies the local volume name into a new plugin volume. The original
+// must not be referenced by any container, so the copy is consistent. If the
+// copy fails, the new volume is removed again.
+func (im *LocalImporter) Import(ctx context.Context, name string) error {
+	var v dockerVolume
+	if err := im.Docker.Call(ctx, http.MethodGet, "/volumes/"+url.PathEscape(name), nil, &v); err != nil {
+		return err
+	}
+	if v.Driver != "local" {
+		return fmt.Errorf("volume %s uses the %s driver, only local volumes can be imported", name, v.Driver)
+	}
+	cs, err := im.Docker.VolumeContainers(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(cs) > 0 {
+		return fmt.Errorf("volume %s is used by %s, remove them first", name, strings.Join(cs, ", "))
+	}
+
+	var nv adminapi.Volume
+	opts := im.Options
+	if opts == nil {
+		opts = map[string]string{}
+	}
+	if err := im.Admin.Call(http.MethodPost, "/v1/volumes", map[string]interface{}{"Name": name, "Opts": opts}, &nv); err != nil {
+		return fmt.Errorf("failed to create zfs volume %s: %w", name, err)
+	}
+	fmt.Fprintf(im.Out, "Copying %s to %s\n", v.Mountpoint, nv.Mountpoint)
+	if err := im.copy(ctx, v.Mountpoint, nv.Mountpoint); err != nil {
+		if rErr := im.Admin.Call(http.MethodDelete, "/v1/volumes?name="+url.QueryEscape(name), nil, nil); rErr != nil {
+			fmt.Fprintf(im.Out, "Failed to remove the incomplete zfs volume %s: %v\n", name, rErr)
+		}
+		return fmt.Errorf("failed to copy volume %s: %w", name, err)
+	}
+
+	if !im.Remove {
+		fmt.Fprintf(im.Out, "Imported %s, remove the local volume with docker volume rm so docker uses the zfs one\n", name)
+		return nil
+	}
+	if err := im.Docker.Call(ctx, http.MethodDelete, "/volumes/"+url.PathEscape(name), nil, nil); err != nil {
+		return fmt.Errorf("imported %s but failed to remove the local volume: %w", name, err)
+	}
+	fmt.Fprintf(im.Out, "Imported %s and removed the local volume\n", name)
+	return nil
+}
+
+func (im *LocalImporter) copy(ctx context.Context, src, dst string) error {
+	argv := im.Rsync
+	if len(argv) == 0 {
+		argv = DefaultRsync
+	}
+	args := append(append([]string{}, argv[1:]...), strings.TrimSuffix(src, "/")+"/", strings.TrimSuffix(dst, "/")+"/")
+	var stderr bytes.Buffer
+	c := exec.CommandContext(ctx, argv[0], args...)
+	c.Stdout = im.Out
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("%s: %v: %s", argv[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Package namecodec maps docker volume names to the zfs datasets the plugin
+// creates for them, so backup scripts and fleet tooling can compute the same
+// dataset names as the driver
+package namecodec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The naming of docker compose, which names volumes project_volume
+const (
+	DefaultDelimiter = "_"
+	DefaultDepth     = 2
+)
+
+// Codec maps volume names to datasets below a root dataset
+type Codec struct {
+	// Root is the root dataset new volumes are created in
+	Root string
+	// Delimiter separates the levels of a volume name, DefaultDelimiter if empty
+	Delimiter string
+	// Depth is the most levels a name is split into, the last level keeps
+	// any further delimiters. DefaultDepth if 0.
+	Depth int
+}
+
+// Validate checks the delimiter and depth of the codec
+func (c Codec) Validate() error {
+	if strings.Contains(c.Delimiter, "/") {
+		return fmt.Errorf("invalid name delimiter %q, it must not contain a slash", c.Delimiter)
+	}
+	if c.Depth != 0 && c.Depth < 2 {
+		return fmt.Errorf("invalid name depth %d, expected at least 2", c.Depth)
+	}
+	return nil
+}
+
+func (c Codec) delimiter() string {
+	if c.Delimiter == "" {
+		return DefaultDelimiter
+	}
+	return c.Delimiter
+}
+
+func (c Codec) depth() int {
+	if c.Depth == 0 {
+		return DefaultDepth
+	}
+	return c.Depth
+}
+
+// Parts returns the levels of name, such as org, project and volume of
+// org__project__volume with delimiter __ and depth 3. ok is false for names
+// with a single level or an empty level.
+func (c Codec) Parts(name string) (parts []string, ok bool) {
+	parts = strings.SplitN(name, c.delimiter(), c.depth())
+	if len(parts) < 2 {
+		return nil, false
+	}
+	for _, p := range parts {
+		if p == "" {
+			return nil, false
+		}
+	}
+	return parts, true
+}
+
+// Split returns the project and volume parts of a docker compose volume name,
+// which compose names project_volume. ok is false for names without an
+// underscore or with an empty part.
+func Split(name string) (project, volume string, ok bool) {
+	parts, ok := Codec{}.Parts(name)
+	if !ok {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Dataset returns the dataset a new volume named name is created as. Names
+// with several levels are nested as root/level/..., so a project can be
+// snapshotted recursively. Other names are used as the dataset name as is.
+func (c Codec) Dataset(name string) string {
+	parts, ok := c.Parts(name)
+	if !ok || c.Root == "" {
+		return name
+	}
+	return c.Root + "/" + strings.Join(parts, "/")
+}
+
+// Volume returns the volume name of a dataset created by Dataset. ok is
+// false if the dataset is not nested below root as Dataset nests a name.
+func (c Codec) Volume(dataset string) (name string, ok bool) {
+	if c.Root == "" || !strings.HasPrefix(dataset, c.Root+"/") {
+		return "", false
+	}
+	parts := strings.Split(dataset[len(c.Root)+1:], "/")
+	if len(parts) < 2 || len(parts) > c.depth() {
+		return "", false
+	}
+	name = strings.Join(parts, c.delimiter())
+	got, ok := c.Parts(name)
+	if !ok || len(got) != len(parts) {
+		return "", false
+	}
+	for i := range got {
+		if got[i] != parts[i] {
+			return "", false
+		}
+	}
+	return name, true
+}
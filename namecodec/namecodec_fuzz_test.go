@@ -0,0 +1,80 @@
+//go:build go1.18
+// +build go1.18
+
+package namecodec
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, s := range []string{"web_data", "db", "a_b_c", "_x", "x_", "tank/docker/legacy", "p_v/w", "p/q_v"} {
+		f.Add("tank/docker", s, "", uint8(0))
+	}
+	for _, s := range []string{"org__project__volume", "org__project", "a___b", "a____b", "x__y__z__w"} {
+		f.Add("tank/docker", s, "__", uint8(3))
+	}
+	f.Fuzz(func(t *testing.T, root, name, delim string, depth uint8) {
+		c := Codec{Root: root, Delimiter: delim, Depth: int(depth % 5)}
+		if c.Validate() != nil {
+			return
+		}
+		ds := c.Dataset(name)
+		parts, nested := c.Parts(name)
+		if !nested || root == "" {
+			if ds != name {
+				t.Fatalf("Dataset(%q) = %q, want the name unchanged", name, ds)
+			}
+			return
+		}
+		if want := root + "/" + strings.Join(parts, "/"); ds != want {
+			t.Fatalf("Dataset(%q) = %q, want %q", name, ds, want)
+		}
+		if strings.Contains(name, "/") {
+			return
+		}
+		if got, ok := c.Volume(ds); !ok || got != name {
+			t.Fatalf("Volume(%q) = %q, %v, want %q", ds, got, ok, name)
+		}
+	})
+}
+
+func FuzzVolume(f *testing.F) {
+	for _, s := range []string{"tank/docker/web/data", "tank/docker/web", "tank/other/a/b", "tank/docker/a_b/c"} {
+		f.Add("tank/docker", s, "", uint8(0))
+	}
+	for _, s := range []string{"tank/docker/org/project/volume", "tank/docker/org/pro__ject", "tank/docker/a_/_b"} {
+		f.Add("tank/docker", s, "__", uint8(3))
+	}
+	f.Fuzz(func(t *testing.T, root, ds, delim string, depth uint8) {
+		c := Codec{Root: root, Delimiter: delim, Depth: int(depth % 5)}
+		if c.Validate() != nil {
+			return
+		}
+		name, ok := c.Volume(ds)
+		if !ok {
+			return
+		}
+		if got := c.Dataset(name); got != ds {
+			t.Fatalf("Dataset(Volume(%q)) = %q", ds, got)
+		}
+	})
+}
+
+func FuzzSplit(f *testing.F) {
+	for _, s := range []string{"web_data", "db", "a_b_c", "_x", "x_"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		project, volume, ok := Split(name)
+		i := strings.Index(name, "_")
+		want := i > 0 && i < len(name)-1
+		if ok != want {
+			t.Fatalf("Split(%q) ok = %v, want %v", name, ok, want)
+		}
+		if ok && (project != name[:i] || volume != name[i+1:]) {
+			t.Fatalf("Split(%q) = %q, %q", name, project, volume)
+		}
+	})
+}
@@ -0,0 +1,109 @@
+// Package nomad implements a nomad dynamic host volume plugin backed by the
+// management API of a running plugin daemon, so nomad volumes share the
+// mapping store, options and policies of docker volumes
+package nomad
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/adminapi"
+)
+
+// Env is the environment nomad passes to dynamic host volume plugins
+type Env map[string]string
+
+// FromEnviron returns the DHV_ variables of the process environment
+func FromEnviron() Env {
+	env := make(Env)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv, "DHV_") {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env
+}
+
+// Plugin runs the operations nomad invokes the plugin with
+type Plugin struct {
+	Client  *adminapi.Client
+	Version string
+	Out     io.Writer
+}
+
+// Run executes operation, one of fingerprint, create or delete
+func (p *Plugin) Run(operation string, env Env) error {
+	switch operation {
+	case "fingerprint":
+		return json.NewEncoder(p.Out).Encode(map[string]string{"version": p.Version})
+	case "create":
+		return p.create(env)
+	case "delete":
+		return p.delete(env)
+	}
+	return fmt.Errorf("unknown operation %q", operation)
+}
+
+// volumeName names the volume after the nomad volume so it can be found
+// again, namespaced unless it is in the default namespace
+func volumeName(env Env) (string, error) {
+	name := env["DHV_VOLUME_NAME"]
+	if name == "" {
+		return "", fmt.Errorf("DHV_VOLUME_NAME is not set")
+	}
+	if ns := env["DHV_NAMESPACE"]; ns != "" && ns != "default" {
+		name = ns + "-" + name
+	}
+	return "nomad-" + name, nil
+}
+
+func (p *Plugin) create(env Env) error {
+	name, err := volumeName(env)
+	if err != nil {
+		return err
+	}
+	var v adminapi.Volume
+	err = p.Client.Call(http.MethodGet, "/v1/volumes?name="+url.QueryEscape(name), nil, &v)
+	if adminapi.IsStatus(err, http.StatusNotFound) {
+		opts := make(map[string]string)
+		if params := env["DHV_PARAMETERS"]; params != "" {
+			if err := json.Unmarshal([]byte(params), &opts); err != nil {
+				return fmt.Errorf("invalid DHV_PARAMETERS, expected a map of volume options: %w", err)
+			}
+		}
+		if max := env["DHV_CAPACITY_MAX_BYTES"]; max != "" && max != "0" {
+			if _, ok := opts["refquota"]; !ok {
+				opts["refquota"] = max
+			}
+		}
+		err = p.Client.Call(http.MethodPost, "/v1/volumes", map[string]interface{}{"Name": name, "Opts": opts}, &v)
+	}
+	if err != nil {
+		return err
+	}
+	res := map[string]interface{}{"path": v.Mountpoint}
+	if q, ok := v.Status["quota"].(float64); ok && q > 0 {
+		res["bytes"] = int64(q)
+	} else if max, err := strconv.ParseInt(env["DHV_CAPACITY_MAX_BYTES"], 10, 64); err == nil && max > 0 {
+		res["bytes"] = max
+	}
+	return json.NewEncoder(p.Out).Encode(res)
+}
+
+func (p *Plugin) delete(env Env) error {
+	name, err := volumeName(env)
+	if err != nil {
+		return err
+	}
+	err = p.Client.Call(http.MethodDelete, "/v1/volumes?name="+url.QueryEscape(name), nil, nil)
+	if adminapi.IsStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+// Package notify sends alerts about failures to chat and email so problems
+// are noticed without a monitoring stack
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	log "github.com/sirupsen/logrus"
+)
+
+// alerts are the events worth waking someone up for
+var alerts = map[string]string{
+	events.PoolDegraded:         "Pool degraded",
+	events.PoolRecovered:        "Pool recovered",
+	events.VolumeQuotaExhausted: "Volume quota nearly exhausted",
+	events.VolumeQuotaFull:      "Volume quota full",
+	events.VolumeBackupFailed:   "Volume backup failed",
+}
+
+// SMTP configures email notifications
+type SMTP struct {
+	Addr     string
+	From     string
+	To       []string
+	User     string
+	Password string
+}
+
+// Config configures the notifiers, unset notifiers are disabled
+type Config struct {
+	SlackWebhookURL string
+	SMTP            SMTP
+}
+
+// Notifier sends alert events to slack and email
+type Notifier struct {
+	cfg      Config
+	client   *http.Client
+	hostname string
+}
+
+// NewNotifier returns a notifier, or nil if no notifier is configured
+func NewNotifier(cfg Config, hostname string) *Notifier {
+	if cfg.SlackWebhookURL == "" && cfg.SMTP.Addr == "" {
+		return nil
+	}
+	return &Notifier{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}, hostname: hostname}
+}
+
+// Run notifies about alert events on bus until ctx is canceled
+func (n *Notifier) Run(ctx context.Context, bus *events.Bus) {
+	evs, cancel := bus.Subscribe()
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-evs:
+			title, ok := alerts[e.Type]
+			if !ok {
+				continue
+			}
+			n.send(ctx, title, message(e))
+		}
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, title, msg string) {
+	subject := fmt.Sprintf("[docker-zfs-plugin %s] %s", n.hostname, title)
+	if n.cfg.SlackWebhookURL != "" {
+		if err := n.slack(ctx, subject, msg); err != nil {
+			log.WithError(err).Error("Failed to send slack notification")
+		}
+	}
+	if n.cfg.SMTP.Addr != "" {
+		if err := n.mail(subject, msg); err != nil {
+			log.WithError(err).Error("Failed to send email notification")
+		}
+	}
+}
+
+func message(e events.Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s at %s\n", e.Type, e.Time.Format(time.RFC3339))
+	if e.Volume != "" {
+		fmt.Fprintf(&b, "volume: %s\n", e.Volume)
+	}
+	keys := make([]string, 0, len(e.Details))
+	for k := range e.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %s\n", k, e.Details[k])
+	}
+	return b.String()
+}
+
+func (n *Notifier) slack(ctx context.Context, subject, msg string) error {
+	body, err := json.Marshal(map[string]string{"text": fmt.Sprintf("*%s*\n```%s```", subject, msg)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.SlackWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) mail(subject, msg string) error {
+	c := n.cfg.SMTP
+	var auth smtp.Auth
+	if c.User != "" {
+		host, _, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", c.User, c.Password, host)
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		c.From, strings.Join(c.To, ", "), subject, time.Now().Format(time.RFC1123Z), strings.Replace(msg, "\n", "\r\n", -1))
+	return smtp.SendMail(c.Addr, auth, c.From, c.To, []byte(body))
+}
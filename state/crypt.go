@@ -0,0 +1,86 @@
+package state
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeySize is the size of the AES-256 keys the database is encrypted with
+const KeySize = 32
+
+// encMagic starts every encrypted database file, it is followed by the
+// nonce and the sealed json. Plain databases start with a brace.
+const encMagic = "docker-zfs-plugin-state-aes256gcm\n"
+
+// ErrKeyRequired is returned when an encrypted database is opened without a key
+var ErrKeyRequired = errors.New("state file is encrypted, a key is required")
+
+// ParseKey decodes a key given as KeySize raw bytes, hex or base64.
+// Surrounding whitespace, such as the newline of a key file, is ignored.
+func ParseKey(b []byte) ([]byte, error) {
+	if len(b) == KeySize {
+		return b, nil
+	}
+	s := string(bytes.TrimSpace(b))
+	if k, err := hex.DecodeString(s); err == nil && len(k) == KeySize {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(s); err == nil && len(k) == KeySize {
+		return k, nil
+	}
+	return nil, fmt.Errorf("invalid state key, expected %d bytes raw, hex or base64", KeySize)
+}
+
+func encrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(encMagic))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plain with key under a random nonce
+func seal(key, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(encMagic)+gcm.NonceSize(), len(encMagic)+gcm.NonceSize()+len(plain)+gcm.Overhead())
+	copy(out, encMagic)
+	nonce := out[len(encMagic):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(out, nonce, plain, []byte(encMagic)), nil
+}
+
+// unseal decrypts a file written by seal. The magic is authenticated too.
+func unseal(key, b []byte) ([]byte, error) {
+	if key == nil {
+		return nil, ErrKeyRequired
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	b = b[len(encMagic):]
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("state file is truncated")
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], []byte(encMagic))
+	if err != nil {
+		return nil, errors.New("failed to decrypt state file, the key is wrong or the file is corrupt")
+	}
+	return plain, nil
+}
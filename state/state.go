@@ -0,0 +1,246 @@
+// Package state is a small persistent key value store for plugin state that
+// does not belong on the datasets themselves
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DB is a json file backed store of buckets of keys
+type DB struct {
+	path string
+	key  []byte
+
+	mu      sync.Mutex
+	buckets map[string]map[string]json.RawMessage
+}
+
+// Open loads the database at path, creating it if it does not exist. With a
+// key the file is encrypted with AES-256-GCM. A plain file opened with a key
+// is encrypted right away, an encrypted file can not be opened without one.
+func Open(path string, key []byte) (*DB, error) {
+	if key != nil && len(key) != KeySize {
+		return nil, fmt.Errorf("invalid state key of %d bytes, expected %d", len(key), KeySize)
+	}
+	db := &DB{path: path, key: key, buckets: make(map[string]map[string]json.RawMessage)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain := !encrypted(b)
+	if !plain {
+		if b, err = unseal(key, b); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &db.buckets); err != nil {
+			return nil, err
+		}
+	}
+	if plain && key != nil {
+		if err := db.save(); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Get decodes the value of key in bucket into v, it returns false if the key does not exist
+func (db *DB) Get(bucket, key string, v interface{}) (bool, error) {
+	db.mu.Lock()
+	raw, ok := db.buckets[bucket][key]
+	db.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Put stores v as key in bucket
+func (db *DB) Put(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.buckets[bucket] == nil {
+		db.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	db.buckets[bucket][key] = raw
+	return db.save()
+}
+
+// Delete removes key from bucket
+func (db *DB) Delete(bucket, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.buckets[bucket][key]; !ok {
+		return nil
+	}
+	delete(db.buckets[bucket], key)
+	return db.save()
+}
+
+// Tx is a set of changes applied atomically by Update
+type Tx struct {
+	db      *DB
+	changed bool
+}
+
+// Get decodes the value of key in bucket into v
+func (tx *Tx) Get(bucket, key string, v interface{}) (bool, error) {
+	raw, ok := tx.db.buckets[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Put stores v as key in bucket
+func (tx *Tx) Put(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if tx.db.buckets[bucket] == nil {
+		tx.db.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	tx.db.buckets[bucket][key] = raw
+	tx.changed = true
+	return nil
+}
+
+// Delete removes key from bucket
+func (tx *Tx) Delete(bucket, key string) {
+	if _, ok := tx.db.buckets[bucket][key]; ok {
+		delete(tx.db.buckets[bucket], key)
+		tx.changed = true
+	}
+}
+
+// Encrypted reports whether the database file is encrypted, which it is when
+// the database was opened with a key
+func (db *DB) Encrypted() bool {
+	return db.key != nil
+}
+
+// Keys returns the sorted keys of bucket
+func (tx *Tx) Keys(bucket string) []string {
+	keys := make([]string, 0, len(tx.db.buckets[bucket]))
+	for k := range tx.db.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Update runs fn with exclusive access to the database and saves its changes
+// at once. If fn returns an error, none of its changes are applied.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	snapshot := make(map[string]map[string]json.RawMessage, len(db.buckets))
+	for b, keys := range db.buckets {
+		snapshot[b] = make(map[string]json.RawMessage, len(keys))
+		for k, v := range keys {
+			snapshot[b][k] = v
+		}
+	}
+	tx := &Tx{db: db}
+	if err := fn(tx); err != nil {
+		db.buckets = snapshot
+		return err
+	}
+	if !tx.changed {
+		return nil
+	}
+	if err := db.save(); err != nil {
+		db.buckets = snapshot
+		return err
+	}
+	return nil
+}
+
+// Keys returns the sorted keys of bucket
+func (db *DB) Keys(bucket string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	keys := make([]string, 0, len(db.buckets[bucket]))
+	for k := range db.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Dump returns the contents of the database as they are written to its
+// file, encrypted if the database has a key
+func (db *DB) Dump() ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.encode()
+}
+
+// Restore replaces the database file at path with the contents of a Dump,
+// it must be called before the database is opened. An encrypted dump is
+// written as is, Open checks it can be decrypted with the local key.
+func Restore(path string, b []byte) error {
+	if !encrypted(b) {
+		var buckets map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(b, &buckets); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFile(path, b)
+}
+
+func (db *DB) encode() ([]byte, error) {
+	b, err := json.Marshal(db.buckets)
+	if err != nil || db.key == nil {
+		return b, err
+	}
+	return seal(db.key, b)
+}
+
+// save atomically replaces the database file, db.mu must be held
+func (db *DB) save() error {
+	b, err := db.encode()
+	if err != nil {
+		return err
+	}
+	return writeFile(db.path, b)
+}
+
+func writeFile(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
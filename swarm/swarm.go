@@ -0,0 +1,149 @@
+// Package swarm publishes docker swarm node labels describing the pools and
+// volumes of this node, so services can be constrained to the node holding
+// their data
+package swarm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/dockerapi"
+	zfsdriver "github.com/TrilliumIT/docker-zfs-plugin/zfs"
+	log "github.com/sirupsen/logrus"
+)
+
+// LabelPrefix prefixes every label the publisher manages
+const LabelPrefix = "zfs."
+
+// freeUnit is what the free space of a pool is rounded down to, so the
+// labels, and with them the node spec, only change when it changes notably
+const freeUnit = 1 << 30
+
+// Config configures the label publisher
+type Config struct {
+	// Socket is the path of the docker engine api socket
+	Socket   string
+	Interval time.Duration
+}
+
+// Publisher keeps the swarm labels of this node up to date
+type Publisher struct {
+	cfg    Config
+	driver *zfsdriver.ZfsDriver
+	docker *dockerapi.Client
+}
+
+// NewPublisher returns a label publisher. The node must be a swarm manager,
+// workers cannot update node labels.
+func NewPublisher(cfg Config, d *zfsdriver.ZfsDriver) *Publisher {
+	return &Publisher{cfg: cfg, driver: d, docker: dockerapi.NewClient(cfg.Socket)}
+}
+
+// Run publishes the labels every interval until ctx is canceled
+func (p *Publisher) Run(ctx context.Context) {
+	t := time.NewTicker(p.cfg.Interval)
+	defer t.Stop()
+	for {
+		if err := p.publish(ctx); err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("Failed to publish swarm node labels")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// labels describes the pools, their free space and the volumes of this node
+func (p *Publisher) labels(ctx context.Context) (map[string]string, error) {
+	caps, err := p.driver.PoolCapacities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vols, err := p.driver.List()
+	if err != nil {
+		return nil, err
+	}
+	l := make(map[string]string)
+	var pools []string
+	for pool, c := range caps {
+		pools = append(pools, pool)
+		l[LabelPrefix+"pool."+pool+".free"] = strconv.FormatUint(c.Free/freeUnit*freeUnit, 10)
+	}
+	sort.Strings(pools)
+	l[LabelPrefix+"pools"] = strings.Join(pools, ",")
+	for _, v := range vols.Volumes {
+		if _, remote := v.Status["node"]; !remote {
+			l[LabelPrefix+"volume."+v.Name] = "true"
+		}
+	}
+	return l, nil
+}
+
+type nodeSpec map[string]interface{}
+
+type node struct {
+	ID      string
+	Version struct{ Index uint64 }
+	Spec    nodeSpec
+}
+
+func (p *Publisher) publish(ctx context.Context) error {
+	want, err := p.labels(ctx)
+	if err != nil {
+		return err
+	}
+	var info struct {
+		Swarm struct {
+			NodeID           string
+			ControlAvailable bool
+		}
+	}
+	if err := p.docker.Call(ctx, http.MethodGet, "/info", nil, &info); err != nil {
+		return err
+	}
+	if info.Swarm.NodeID == "" {
+		return fmt.Errorf("this node is not part of a swarm")
+	}
+	if !info.Swarm.ControlAvailable {
+		return fmt.Errorf("this node is not a swarm manager")
+	}
+	var n node
+	if err := p.docker.Call(ctx, http.MethodGet, "/nodes/"+info.Swarm.NodeID, nil, &n); err != nil {
+		return err
+	}
+
+	cur, _ := n.Spec["Labels"].(map[string]interface{})
+	labels := make(map[string]string)
+	for k, v := range cur {
+		if s, ok := v.(string); ok && !strings.HasPrefix(k, LabelPrefix) {
+			labels[k] = s
+		}
+	}
+	for k, v := range want {
+		labels[k] = v
+	}
+	if equal(cur, labels) {
+		return nil
+	}
+	n.Spec["Labels"] = labels
+	return p.docker.Call(ctx, http.MethodPost, fmt.Sprintf("/nodes/%s/update?version=%d", n.ID, n.Version.Index), n.Spec, nil)
+}
+
+func equal(cur map[string]interface{}, labels map[string]string) bool {
+	if len(cur) != len(labels) {
+		return false
+	}
+	for k, v := range labels {
+		if cur[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,242 @@
+// Package webhook delivers lifecycle events to http endpoints. Deliveries are
+// persisted in the state database and retried with exponential backoff until
+// they succeed or are moved to the dead letter queue.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pendingBucket = "webhook-pending"
+	deadBucket    = "webhook-dead"
+	maxBackoff    = time.Hour
+)
+
+// Config configures webhook delivery
+type Config struct {
+	URLs []string
+	// MaxAttempts before a delivery is moved to the dead letter queue
+	MaxAttempts int
+	// Backoff is the delay before the first retry, it doubles with every attempt
+	Backoff time.Duration
+	Timeout time.Duration
+}
+
+// Delivery is a single event queued for an endpoint
+type Delivery struct {
+	ID        string       `json:"id"`
+	URL       string       `json:"url"`
+	Event     events.Event `json:"event"`
+	Attempts  int          `json:"attempts"`
+	LastError string       `json:"last_error,omitempty"`
+	NextTry   time.Time    `json:"next_try"`
+}
+
+// Dispatcher delivers events from a bus to the configured urls
+type Dispatcher struct {
+	cfg    Config
+	db     *state.DB
+	client *http.Client
+
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+// NewDispatcher returns a dispatcher persisting deliveries in db
+func NewDispatcher(cfg Config, db *state.DB) *Dispatcher {
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	return &Dispatcher{
+		cfg:      cfg,
+		db:       db,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		inflight: make(map[string]bool),
+	}
+}
+
+// Run queues all events published on bus and retries pending deliveries
+// until ctx is canceled
+func (d *Dispatcher) Run(ctx context.Context, bus *events.Bus) {
+	evs, cancel := bus.SubscribeDurable()
+	defer cancel()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-evs:
+			d.enqueue(ctx, e)
+		case <-tick.C:
+			d.retryDue(ctx)
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(ctx context.Context, e events.Event) {
+	for _, u := range d.cfg.URLs {
+		dl := &Delivery{ID: newID(), URL: u, Event: e, NextTry: time.Now()}
+		if err := d.db.Put(pendingBucket, dl.ID, dl); err != nil {
+			log.WithError(err).WithField("url", u).Error("Failed to persist webhook delivery")
+		}
+		d.attempt(ctx, dl)
+	}
+}
+
+func (d *Dispatcher) retryDue(ctx context.Context) {
+	now := time.Now()
+	for _, id := range d.db.Keys(pendingBucket) {
+		var dl Delivery
+		if ok, err := d.db.Get(pendingBucket, id, &dl); !ok || err != nil {
+			continue
+		}
+		if dl.NextTry.After(now) {
+			continue
+		}
+		d.attempt(ctx, &dl)
+	}
+}
+
+// attempt delivers dl in the background unless it is already being delivered
+func (d *Dispatcher) attempt(ctx context.Context, dl *Delivery) {
+	d.mu.Lock()
+	if d.inflight[dl.ID] {
+		d.mu.Unlock()
+		return
+	}
+	d.inflight[dl.ID] = true
+	d.mu.Unlock()
+
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			delete(d.inflight, dl.ID)
+			d.mu.Unlock()
+		}()
+		d.deliver(ctx, dl)
+	}()
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, dl *Delivery) {
+	err := d.post(ctx, dl)
+	if ctx.Err() != nil {
+		return
+	}
+	l := log.WithFields(log.Fields{"url": dl.URL, "id": dl.ID, "event": dl.Event.Type})
+	if err == nil {
+		l.Debug("Delivered webhook")
+		if err := d.db.Delete(pendingBucket, dl.ID); err != nil {
+			l.WithError(err).Error("Failed to remove delivered webhook")
+		}
+		return
+	}
+
+	dl.Attempts++
+	dl.LastError = err.Error()
+	if dl.Attempts >= d.cfg.MaxAttempts {
+		l.WithError(err).Error("Webhook delivery failed permanently, moving to dead letter queue")
+		if err := d.db.Put(deadBucket, dl.ID, dl); err != nil {
+			l.WithError(err).Error("Failed to persist dead webhook")
+			return
+		}
+		if err := d.db.Delete(pendingBucket, dl.ID); err != nil {
+			l.WithError(err).Error("Failed to remove dead webhook from queue")
+		}
+		return
+	}
+	backoff := d.cfg.Backoff << uint(dl.Attempts-1)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	dl.NextTry = time.Now().Add(backoff)
+	l.WithError(err).WithField("retry_in", backoff.String()).Warn("Webhook delivery failed")
+	if err := d.db.Put(pendingBucket, dl.ID, dl); err != nil {
+		l.WithError(err).Error("Failed to persist webhook retry")
+	}
+}
+
+func (d *Dispatcher) post(ctx context.Context, dl *Delivery) error {
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Delivery-ID", dl.ID)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
+
+// DeadLetters returns the deliveries which exhausted their attempts
+func (d *Dispatcher) DeadLetters() ([]Delivery, error) {
+	var dls []Delivery
+	for _, id := range d.db.Keys(deadBucket) {
+		var dl Delivery
+		ok, err := d.db.Get(deadBucket, id, &dl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			dls = append(dls, dl)
+		}
+	}
+	return dls, nil
+}
+
+// Requeue moves a dead delivery back to the pending queue with its attempts reset
+func (d *Dispatcher) Requeue(id string) (bool, error) {
+	var dl Delivery
+	ok, err := d.db.Get(deadBucket, id, &dl)
+	if !ok || err != nil {
+		return ok, err
+	}
+	dl.Attempts = 0
+	dl.NextTry = time.Now()
+	if err := d.db.Put(pendingBucket, id, &dl); err != nil {
+		return true, err
+	}
+	return true, d.db.Delete(deadBucket, id)
+}
+
+// Discard removes a dead delivery
+func (d *Dispatcher) Discard(id string) (bool, error) {
+	var dl Delivery
+	ok, err := d.db.Get(deadBucket, id, &dl)
+	if !ok || err != nil {
+		return ok, err
+	}
+	return true, d.db.Delete(deadBucket, id)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,221 @@
+package zfsdriver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+const activityBucket = "activity"
+
+// kstatRoot holds the objset kstats of every imported pool, one file per
+// loaded dataset
+var kstatRoot = "/proc/spl/kstat/zfs"
+
+var volumeIdle = metrics.NewGaugeVec("zfs_plugin_volume_idle_seconds",
+	"Seconds since IO was last seen on the volume, or since its activity is tracked", "volume")
+
+func init() {
+	metrics.MustRegister(volumeIdle)
+}
+
+// objsetCounters are the IO counters of a dataset since it was loaded
+type objsetCounters struct {
+	reads, writes, nread, nwritten uint64
+}
+
+// activityRecord is persisted per volume. Since is when IO was last seen on
+// the volume if Active, otherwise when tracking began without any IO seen.
+type activityRecord struct {
+	Since  time.Time `json:"since"`
+	Active bool      `json:"active,omitempty"`
+}
+
+type activityState struct {
+	mu       sync.Mutex
+	counters map[string]objsetCounters
+	failed   bool
+}
+
+// VolumeActivity tells how long a volume has been idle
+type VolumeActivity struct {
+	Volume  string `json:"volume"`
+	Dataset string `json:"dataset"`
+	Class   string `json:"class,omitempty"`
+	// LastActive is when IO was last seen, nil if none was since IdleSince
+	LastActive  *time.Time `json:"last_active,omitempty"`
+	IdleSince   time.Time  `json:"idle_since"`
+	IdleSeconds float64    `json:"idle_seconds"`
+	Mounted     bool       `json:"mounted"`
+}
+
+// readObjsetKstats returns the IO counters of every loaded dataset of pools
+func readObjsetKstats(pools []string) (map[string]objsetCounters, error) {
+	stats := make(map[string]objsetCounters)
+	for _, pool := range pools {
+		files, err := filepath.Glob(filepath.Join(kstatRoot, pool, "objset-0x*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			var ds string
+			var c objsetCounters
+			for _, l := range strings.Split(string(b), "\n") {
+				fs := strings.Fields(l)
+				if len(fs) != 3 {
+					continue
+				}
+				v, _ := strconv.ParseUint(fs[2], 10, 64)
+				switch fs[0] {
+				case "dataset_name":
+					ds = fs[2]
+				case "reads":
+					c.reads = v
+				case "writes":
+					c.writes = v
+				case "nread":
+					c.nread = v
+				case "nwritten":
+					c.nwritten = v
+				}
+			}
+			if ds != "" {
+				stats[ds] = c
+			}
+		}
+	}
+	return stats, nil
+}
+
+// grew reports whether any counter of c is larger than in prev. Counters
+// start over when a dataset is loaded again, which is not counted as IO.
+func (c objsetCounters) grew(prev objsetCounters) bool {
+	if c.reads < prev.reads || c.writes < prev.writes {
+		return false
+	}
+	return c != prev
+}
+
+// sampleActivity compares the IO counters of the volumes with the previous
+// sample and records when IO was last seen on each. Datasets which are not
+// loaded, such as unmounted ones, have no IO. Without objset kstats, as on
+// older zfs releases, mounted volumes are considered active.
+func (zd *ZfsDriver) sampleActivity(now time.Time) {
+	stats, err := readObjsetKstats(zd.Pools())
+	as := &zd.activity
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	failed := err != nil || len(stats) == 0
+	if failed && !as.failed {
+		log.WithError(err).WithField("path", kstatRoot).Debug("No objset kstats, mounted volumes are considered active")
+	}
+	as.failed = failed
+	if as.counters == nil {
+		as.counters = make(map[string]objsetCounters)
+	}
+	err = zd.db.Update(func(tx *state.Tx) error {
+		for _, name := range tx.Keys(activityBucket) {
+			if ok, _ := tx.Get(mappingBucket, name, &mapping{}); !ok {
+				tx.Delete(activityBucket, name)
+			}
+		}
+		for _, name := range tx.Keys(mappingBucket) {
+			var m mapping
+			if _, err := tx.Get(mappingBucket, name, &m); err != nil {
+				return err
+			}
+			var rec activityRecord
+			found, err := tx.Get(activityBucket, name, &rec)
+			if err != nil {
+				return err
+			}
+			c, loaded := stats[m.Dataset]
+			prev, seen := as.counters[m.Dataset]
+			if loaded {
+				as.counters[m.Dataset] = c
+			} else {
+				delete(as.counters, m.Dataset)
+			}
+			var ids []string
+			_, _ = tx.Get(mountBucket, name, &ids)
+			switch {
+			case (loaded && seen && c.grew(prev)) || (as.failed && len(ids) > 0):
+				rec = activityRecord{Since: now, Active: true}
+			case !found:
+				rec = activityRecord{Since: now}
+			default:
+				continue
+			}
+			if err := tx.Put(activityBucket, name, &rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to record volume activity")
+		return
+	}
+	volumeIdle.Reset()
+	for _, a := range zd.activityOf(now) {
+		volumeIdle.Set(a.IdleSeconds, a.Volume)
+	}
+}
+
+// activityOf returns the activity of every tracked volume, the longest idle first
+func (zd *ZfsDriver) activityOf(now time.Time) []VolumeActivity {
+	res := []VolumeActivity{}
+	for _, name := range zd.db.Keys(activityBucket) {
+		var rec activityRecord
+		m, ok, err := zd.getMapping(name)
+		if !ok || err != nil {
+			continue
+		}
+		if ok, err := zd.db.Get(activityBucket, name, &rec); !ok || err != nil {
+			continue
+		}
+		a := VolumeActivity{Volume: name, Dataset: m.Dataset, Class: volumeClass(m.Options), IdleSince: rec.Since,
+			IdleSeconds: now.Sub(rec.Since).Seconds(), Mounted: len(zd.mounted(name)) > 0}
+		if rec.Active {
+			t := rec.Since
+			a.LastActive = &t
+		}
+		res = append(res, a)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].IdleSince.Before(res[j].IdleSince) })
+	return res
+}
+
+// lastActive returns when IO was last seen on the volume name
+func (zd *ZfsDriver) lastActive(name string) (time.Time, bool) {
+	var rec activityRecord
+	if ok, err := zd.db.Get(activityBucket, name, &rec); !ok || err != nil || !rec.Active {
+		return time.Time{}, false
+	}
+	return rec.Since, true
+}
+
+// IdleVolumes returns the volumes idle for at least min, the longest idle
+// first, as candidates for archival or removal
+func (zd *ZfsDriver) IdleVolumes(min time.Duration) []VolumeActivity {
+	now := time.Now()
+	res := []VolumeActivity{}
+	for _, a := range zd.activityOf(now) {
+		if now.Sub(a.IdleSince) >= min {
+			res = append(res, a)
+		}
+	}
+	return res
+}
@@ -0,0 +1,141 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdoptResult is the mapping recorded for an adopted dataset
+type AdoptResult struct {
+	Volume  string            `json:"volume"`
+	Dataset string            `json:"dataset"`
+	Options map[string]string `json:"options"`
+}
+
+// adoptedOptions returns the create options equivalent to the current state
+// of ds: its locally set properties, its backup tier, its storage class and,
+// for clones, the volume and snapshot it was cloned from. The mountpoint is left out, it is
+// managed by the plugin.
+func (zd *ZfsDriver) adoptedOptions(ds string) (map[string]string, error) {
+	out, err := zd.zfs("adopt", "get", "-H", "-p", "-s", "local", "-o", "property,value", "all", ds)
+	if err != nil {
+		return nil, err
+	}
+	opts := make(map[string]string)
+	for _, f := range zfsout.Records(out, 2) {
+		switch {
+		case f[0] == propBackup:
+			opts[OptBackup] = f[1]
+		case f[0] == propClass:
+			opts[OptClass] = f[1]
+		case f[0] == "mountpoint", strings.HasPrefix(f[0], userPropPrefix):
+		default:
+			opts[f[0]] = f[1]
+		}
+	}
+
+	out, err = zd.zfs("adopt", "get", "-H", "-o", "value", "origin", ds)
+	if err != nil {
+		return nil, err
+	}
+	if origin := strings.TrimSpace(string(out)); origin != "-" && strings.Contains(origin, "@") {
+		i := strings.Index(origin, "@")
+		from := origin[:i]
+		if n, ok := zd.volumeNames()[from]; ok {
+			from = n
+		}
+		opts[OptFrom] = from
+		opts[OptSnapshot] = origin[i+1:]
+	}
+	return opts, nil
+}
+
+// Adopt records an existing dataset below a root dataset as the volume name,
+// with the create options synthesized from its properties, so policies and
+// checks based on the options apply to it like to a volume the plugin
+// created. name defaults to the dataset, the name docker already sees for
+// unmapped datasets. Adopting a volume again refreshes the options read from
+// its properties and keeps the plugin options it was created with.
+func (zd *ZfsDriver) Adopt(name, ds string) (_ *AdoptResult, err error) {
+	defer observe("adopt", &err)
+	log.WithFields(log.Fields{"volume": name, "dataset": ds}).Debug("Adopt")
+	if name == "" {
+		name = ds
+	}
+	if _, ok := zd.rootOf(ds); !ok {
+		return nil, policyErrorf("dataset %s is not below a root dataset of the plugin", ds)
+	}
+	if !zd.datasetExists(ds) {
+		return nil, fmt.Errorf("dataset %s: %w", ds, ErrNotFound)
+	}
+	if err := zd.requireOwned(ds); err != nil {
+		return nil, err
+	}
+	if n, ok := zd.volumeNames()[ds]; ok && n != name {
+		return nil, policyErrorf("dataset %s is already the volume %s", ds, n)
+	}
+	opts, err := zd.adoptedOptions(ds)
+	if err != nil {
+		return nil, err
+	}
+	id, err := zd.identify("adopt", ds)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zd.db.Update(func(tx *state.Tx) error {
+		var m mapping
+		found, err := tx.Get(mappingBucket, name, &m)
+		if err != nil {
+			return err
+		}
+		if found && m.Dataset != ds {
+			return policyErrorf("volume %s already exists as dataset %s", name, m.Dataset)
+		}
+		for k, v := range m.Options {
+			if isPluginOption(k) && k != OptBackup {
+				opts[k] = v
+			}
+		}
+		return tx.Put(mappingBucket, name, &mapping{Dataset: ds, Options: opts, GUID: id.guid, ZfsGUID: id.native})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := zd.register(name, ds); err != nil {
+		log.WithError(err).WithField("volume", name).Error("Failed to register adopted volume")
+	}
+	log.WithFields(log.Fields{"volume": name, "dataset": ds, "options": opts}).Info("Adopted dataset")
+	return &AdoptResult{Volume: name, Dataset: ds, Options: opts}, nil
+}
+
+// AdoptUnmapped adopts every leaf dataset below the root datasets which no
+// volume maps to yet, under its dataset name, so volumes created before the
+// mapping store existed get their options recorded
+func (zd *ZfsDriver) AdoptUnmapped() {
+	names := zd.volumeNames()
+	hidden := zd.inactiveBranches()
+	delegated := zd.delegatedDatasets()
+	for _, rds := range zd.rds {
+		dsl, err := zd.listDatasets(rds)
+		if err != nil {
+			log.WithError(err).WithField("dataset", rds).Error("Failed to list datasets to adopt")
+			continue
+		}
+		sort.Strings(dsl)
+		for i, ds := range dsl {
+			leaf := i == len(dsl)-1 || !strings.HasPrefix(dsl[i+1], ds+"/")
+			if _, ok := names[ds]; ok || hidden[ds] || !leaf || inDelegated(ds, delegated) {
+				continue
+			}
+			if _, err := zd.Adopt(ds, ds); err != nil {
+				log.WithError(err).WithField("dataset", ds).Error("Failed to adopt dataset")
+			}
+		}
+	}
+}
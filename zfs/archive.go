@@ -0,0 +1,263 @@
+package zfsdriver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// ArchiveStub is recorded in the mapping of an archived volume in place of
+// its dataset, which was sent to File and destroyed
+type ArchiveStub struct {
+	File     string    `json:"file"`
+	Snapshot string    `json:"snapshot"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Time     time.Time `json:"time"`
+}
+
+// ArchiveResult is the outcome of archiving or restoring a volume
+type ArchiveResult struct {
+	Volume  string `json:"volume"`
+	Dataset string `json:"dataset"`
+	ArchiveStub
+	Duration string `json:"duration"`
+}
+
+func (m *mapping) archived() bool {
+	return m != nil && m.Archive != nil
+}
+
+// archivedError tells how to get an archived volume back
+func archivedError(name string, stub *ArchiveStub) error {
+	return policyErrorf("volume %s is archived to %s, restore it first with: docker-zfs-plugin restore-archive %s", name, stub.File, name)
+}
+
+// archiveFile returns the file in the archive directory a volume is sent to,
+// the volume name is escaped as it may contain slashes
+func (zd *ZfsDriver) archiveFile(name, stamp string) string {
+	return filepath.Join(zd.archiveDir, url.PathEscape(name)+"@"+stamp+".zfs")
+}
+
+// requireNoClones refuses to archive a dataset whose snapshots have clones,
+// they would be destroyed with it
+func (zd *ZfsDriver) requireNoClones(name, ds string) error {
+	out, err := zd.zfs("archive", "get", "-H", "-o", "value", "-r", "-t", "snapshot", "clones", ds)
+	if err != nil {
+		return err
+	}
+	for _, c := range zfsout.Lines(out) {
+		if !zfsout.Unset(c) {
+			return policyErrorf("volume %s has snapshots cloned by %s, it can not be archived", name, c)
+		}
+	}
+	return nil
+}
+
+// Archive sends an unmounted volume with all its snapshots to a file in the
+// archive directory, destroys its dataset and leaves a stub in its mapping.
+// Until it is restored, using the volume fails with an error telling how to
+// restore it. The bytes written are reported to progress out of the
+// estimated size of the stream.
+func (zd *ZfsDriver) Archive(ctx context.Context, name string, progress Progress) (_ *ArchiveResult, err error) {
+	defer observe("archive", &err)
+	log.WithField("volume", name).Debug("Archive")
+	if zd.archiveDir == "" {
+		return nil, policyErrorf("archiving is disabled, start the plugin with --archive-dir")
+	}
+	if _, err := zd.resolveWritable(name); err != nil {
+		return nil, err
+	}
+	ds, err := zd.removable(name)
+	if err != nil {
+		return nil, err
+	}
+	m, ok, err := zd.getMapping(name)
+	if err != nil {
+		return nil, err
+	}
+	if ok && m.Options[OptMirror] != "" {
+		return nil, policyErrorf("volume %s is a mirror of %s, remove it instead", name, m.Options[OptMirror])
+	}
+	if dss, ok := zd.branchDatasets(name); ok && len(dss) > 1 {
+		return nil, policyErrorf("volume %s has branches, delete them before archiving it", name)
+	}
+	if err := zd.requireNoClones(name, ds); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	stamp := start.UTC().Format("20060102T150405Z")
+	res := &ArchiveResult{Volume: name, Dataset: ds, ArchiveStub: ArchiveStub{
+		File: zd.archiveFile(name, stamp), Snapshot: ds + "@archive-" + stamp, Time: start}}
+	if err := zd.snapshot("archive", res.Snapshot); err != nil {
+		return nil, err
+	}
+	if err := zd.sendToFile(ctx, &res.ArchiveStub, progress); err != nil {
+		zd.destroyArchiveSnapshot(res.Snapshot)
+		return nil, err
+	}
+
+	err = zd.db.Update(func(tx *state.Tx) error {
+		var cur mapping
+		if _, err := tx.Get(mappingBucket, name, &cur); err != nil {
+			return err
+		}
+		if cur.Dataset == "" {
+			cur.Dataset = ds
+		}
+		stub := res.ArchiveStub
+		cur.Archive = &stub
+		return tx.Put(mappingBucket, name, &cur)
+	})
+	if err != nil {
+		zd.destroyArchiveSnapshot(res.Snapshot)
+		return nil, fmt.Errorf("failed to record archive of volume %s, it is kept and %s may be deleted: %w", name, res.File, err)
+	}
+	if err := zd.destroyDataset(ds); err != nil {
+		zd.dropArchiveStub(name, ok, m)
+		zd.destroyArchiveSnapshot(res.Snapshot)
+		return nil, fmt.Errorf("failed to destroy archived dataset %s, the volume is kept and %s may be deleted: %w", ds, res.File, err)
+	}
+	zd.deregister(name)
+	res.Duration = time.Since(start).String()
+	log.WithFields(log.Fields{"volume": name, "file": res.File, "size": res.Size}).Info("Archived volume")
+	zd.events.Publish(events.Event{Type: events.VolumeArchive, Volume: name, Dataset: ds,
+		Details: map[string]string{"action": "archive", "file": res.File}})
+	return res, nil
+}
+
+// sendToFile sends the snapshot of stub to a temporary file next to its file
+// and renames it into place once it is synced, recording its size and hash
+func (zd *ZfsDriver) sendToFile(ctx context.Context, stub *ArchiveStub, progress Progress) error {
+	if err := os.MkdirAll(zd.archiveDir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(zd.archiveDir, filepath.Base(stub.File)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	count := countingWriter{total: zd.sendSize(ctx, stub.Snapshot), progress: progress}
+	err = zd.runner.stream(ctx, "archive", io.MultiWriter(f, h, &count), "zfs", "send", "-R", "-L", "-e", "-c", stub.Snapshot)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send %s to %s: %w", stub.Snapshot, stub.File, err)
+	}
+	stub.Size, stub.SHA256 = count.n, hex.EncodeToString(h.Sum(nil))
+	return os.Rename(f.Name(), stub.File)
+}
+
+// dropArchiveStub puts back the mapping of name as it was before archiving
+func (zd *ZfsDriver) dropArchiveStub(name string, mapped bool, m *mapping) {
+	var err error
+	if mapped {
+		err = zd.db.Put(mappingBucket, name, m)
+	} else {
+		err = zd.db.Delete(mappingBucket, name)
+	}
+	if err != nil {
+		log.WithError(err).WithField("volume", name).Error("Failed to drop archive stub")
+	}
+}
+
+func (zd *ZfsDriver) destroyArchiveSnapshot(snap string) {
+	if _, err := zd.zfs("archive", "destroy", snap); err != nil {
+		log.WithError(err).WithField("snapshot", snap).Warn("Failed to destroy archive snapshot")
+	}
+}
+
+// RestoreArchive receives an archived volume from its file into its former
+// dataset, checking the file against the hash recorded when it was written,
+// and drops the stub. The file is kept. The bytes read are reported to
+// progress out of the size of the file.
+func (zd *ZfsDriver) RestoreArchive(ctx context.Context, name string, progress Progress) (_ *ArchiveResult, err error) {
+	defer observe("restore-archive", &err)
+	log.WithField("volume", name).Debug("RestoreArchive")
+	m, ok, err := zd.getMapping(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !m.archived() {
+		return nil, policyErrorf("volume %s is not archived", name)
+	}
+	if err := zd.requireOwned(m.Dataset); err != nil {
+		return nil, err
+	}
+	if zd.datasetExists(m.Dataset) {
+		return nil, policyErrorf("dataset %s of archived volume %s exists, move it away first", m.Dataset, name)
+	}
+	if err := zd.createParents(m.Dataset); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(m.Archive.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	res := &ArchiveResult{Volume: name, Dataset: m.Dataset, ArchiveStub: *m.Archive}
+	h := sha256.New()
+	count := countingWriter{total: m.Archive.Size, progress: progress}
+	in := io.TeeReader(f, io.MultiWriter(h, &count))
+	if err := zd.runner.receive(ctx, "archive", in, "zfs", "receive", m.Dataset); err != nil {
+		return nil, fmt.Errorf("failed to receive %s into %s: %w", m.Archive.File, m.Dataset, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != m.Archive.SHA256 || count.n != m.Archive.Size {
+		if err := zd.destroyDataset(m.Dataset); err != nil {
+			log.WithError(err).WithField("dataset", m.Dataset).Error("Failed to destroy dataset received from corrupt archive")
+		}
+		return nil, fmt.Errorf("archive %s of volume %s is corrupt, read %d bytes hashing to %s", m.Archive.File, name, count.n, sum)
+	}
+	zd.destroyArchiveSnapshot(m.Archive.Snapshot)
+
+	m.Archive, m.ZfsGUID = nil, ""
+	if err := zd.db.Put(mappingBucket, name, m); err != nil {
+		return nil, fmt.Errorf("failed to drop archive stub of volume %s: %w", name, err)
+	}
+	if err := zd.register(name, m.Dataset); err != nil {
+		log.WithError(err).WithField("volume", name).Error("Failed to register restored volume")
+	}
+	res.Duration = time.Since(start).String()
+	log.WithFields(log.Fields{"volume": name, "file": res.File}).Info("Restored archived volume")
+	zd.events.Publish(events.Event{Type: events.VolumeArchive, Volume: name, Dataset: m.Dataset,
+		Details: map[string]string{"action": "restore", "file": res.File}})
+	return res, nil
+}
+
+// archivedVolumes returns the archived volumes, which List does not find
+// below the root datasets as their datasets are gone
+func (zd *ZfsDriver) archivedVolumes() []*volume.Volume {
+	var vols []*volume.Volume
+	for _, name := range zd.db.Keys(mappingBucket) {
+		if m, ok, err := zd.getMapping(name); ok && err == nil && m.archived() {
+			vols = append(vols, archivedVolume(name, m.Archive))
+		}
+	}
+	return vols
+}
+
+func archivedVolume(name string, stub *ArchiveStub) *volume.Volume {
+	return &volume.Volume{Name: name, CreatedAt: stub.Time.Format(time.RFC3339), Status: map[string]interface{}{
+		"archived": stub.File, "archive_size": stub.Size, "archive_sha256": stub.SHA256}}
+}
@@ -0,0 +1,76 @@
+package zfsdriver
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const arcstatsPath = "/proc/spl/kstat/zfs/arcstats"
+
+var (
+	arcSize = metrics.NewGaugeVec("zfs_plugin_arc_size_bytes",
+		"Current size of the ARC", "type")
+	arcHits = metrics.NewGaugeVec("zfs_plugin_arc_hits_total",
+		"ARC hits since the module was loaded", "type")
+	arcMisses = metrics.NewGaugeVec("zfs_plugin_arc_misses_total",
+		"ARC misses since the module was loaded", "type")
+	arcHitRatio = metrics.NewGaugeVec("zfs_plugin_arc_hit_ratio",
+		"Ratio of ARC hits to lookups since the module was loaded")
+)
+
+func init() {
+	metrics.MustRegister(arcSize, arcHits, arcMisses, arcHitRatio)
+	metrics.RegisterCollector(collectArcstats)
+}
+
+// ReadArcstats returns the raw values of /proc/spl/kstat/zfs/arcstats
+func ReadArcstats() (map[string]uint64, error) {
+	f, err := os.Open(arcstatsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats := make(map[string]uint64)
+	sc := bufio.NewScanner(f)
+	// the first two lines are the kstat header and the column names
+	for i := 0; sc.Scan(); i++ {
+		if i < 2 {
+			continue
+		}
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats[fields[0]] = v
+	}
+	return stats, sc.Err()
+}
+
+func collectArcstats() {
+	st, err := ReadArcstats()
+	if err != nil {
+		log.WithError(err).Debug("Failed to read arcstats")
+		return
+	}
+	arcSize.Set(float64(st["size"]), "current")
+	arcSize.Set(float64(st["c"]), "target")
+	arcSize.Set(float64(st["c_min"]), "min")
+	arcSize.Set(float64(st["c_max"]), "max")
+	arcHits.Set(float64(st["hits"]), "all")
+	arcMisses.Set(float64(st["misses"]), "all")
+	arcHits.Set(float64(st["demand_data_hits"]), "demand_data")
+	arcMisses.Set(float64(st["demand_data_misses"]), "demand_data")
+	if lookups := st["hits"] + st["misses"]; lookups > 0 {
+		arcHitRatio.Set(float64(st["hits"]) / float64(lookups))
+	}
+}
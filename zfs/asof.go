@@ -0,0 +1,85 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshotInfo is a snapshot and its creation time
+type snapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// listSnapshots returns the snapshots of a dataset ordered by creation
+func (zd *ZfsDriver) listSnapshots(op, ds string) ([]snapshotInfo, error) {
+	out, err := zd.zfs(op, "list", "-H", "-p", "-t", "snapshot", "-d", "1", "-s", "creation", "-o", "name,creation", ds)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []snapshotInfo
+	for _, f := range zfsout.Records(out, 2) {
+		if ts, ok := zfsout.Time(f[1]); ok {
+			snaps = append(snaps, snapshotInfo{Name: f[0], Created: ts})
+		}
+	}
+	return snaps, nil
+}
+
+// createAsOf creates dataset as a read only clone of the latest snapshot of
+// the from volume taken at or before asof
+func (zd *ZfsDriver) createAsOf(dataset, from, asof string, props map[string]string) error {
+	if from == "" {
+		return policyErrorf("option %s requires option %s naming the source volume", OptAsOf, OptFrom)
+	}
+	t, err := time.Parse(time.RFC3339, asof)
+	if err != nil {
+		return policyErrorf("invalid %s time %q, expected RFC3339: %v", OptAsOf, asof, err)
+	}
+	src, err := zd.resolveExisting(from)
+	if err != nil {
+		return err
+	}
+	snaps, err := zd.listSnapshots("create", src)
+	if err != nil {
+		return err
+	}
+	var snap *snapshotInfo
+	for i := range snaps {
+		if snaps[i].Created.After(t) {
+			break
+		}
+		snap = &snaps[i]
+	}
+	if snap == nil {
+		return fmt.Errorf("no snapshot of volume %s at or before %s: %w", from, t.Format(time.RFC3339), ErrNotFound)
+	}
+
+	log.WithFields(log.Fields{"snapshot": snap.Name, "created": snap.Created, "dataset": dataset}).Info("Creating time travel clone")
+	return zd.cloneSnapshot(snap.Name, dataset, true, props)
+}
+
+// cloneSnapshot creates dataset as a clone of snapshot with props set
+func (zd *ZfsDriver) cloneSnapshot(snapshot, dataset string, readonly bool, props map[string]string) error {
+	if err := zd.createParents(dataset); err != nil {
+		return err
+	}
+	args := []string{"clone"}
+	if readonly {
+		args = append(args, "-o", "readonly=on")
+	}
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-o", fmt.Sprintf("%s=%s", k, props[k]))
+	}
+	_, err := zd.zfs("create", append(args, snapshot, dataset)...)
+	return err
+}
@@ -0,0 +1,66 @@
+package zfsdriver
+
+import (
+	"context"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+)
+
+// propBackup is the user property holding the backup tier of a volume, so
+// external backup tooling can select datasets by it as well
+const propBackup = userPropPrefix + "backup"
+
+// backupPrefix starts the names of the backup snapshots of every tier
+const backupPrefix = "backup-"
+
+// Backup tiers selectable with -o backup=<tier>
+const (
+	BackupNone   = "none"
+	BackupDaily  = "daily"
+	BackupHourly = "hourly"
+)
+
+const (
+	day  = 24 * time.Hour
+	week = 7 * day
+)
+
+// backupPolicies are the snapshot policies of the backup tiers. Both share
+// a prefix, so changing the tier thins the existing backups by the new one.
+var backupPolicies = map[string]snapshotPolicy{
+	BackupHourly: {Prefix: backupPrefix, Interval: time.Hour, Keep: []retention{
+		{Within: 2 * day, Every: time.Hour},
+		{Within: 2 * week, Every: day},
+		{Within: 8 * week, Every: week},
+	}},
+	BackupDaily: {Prefix: backupPrefix, Interval: day, Keep: []retention{
+		{Within: 2 * week, Every: day},
+		{Within: 8 * week, Every: week},
+	}},
+}
+
+func validateBackup(v string) error {
+	if _, ok := backupPolicies[v]; !ok && v != BackupNone {
+		return policyErrorf("invalid %s %q, expected none, daily or hourly", OptBackup, v)
+	}
+	return nil
+}
+
+// backupTiers returns the backup tier of every dataset below the root
+// datasets which has one
+func (zd *ZfsDriver) backupTiers(ctx context.Context) (map[string]string, error) {
+	tiers := make(map[string]string)
+	for _, rds := range zd.rds {
+		out, err := zd.runner.run(ctx, "schedule", "zfs", "get", "-H", "-p", "-r", "-t", "filesystem", "-o", "name,value", propBackup, rds)
+		if err != nil {
+			return nil, err
+		}
+		for ds, tier := range zfsout.Pairs(out) {
+			if !zfsout.Unset(tier) {
+				tiers[ds] = tier
+			}
+		}
+	}
+	return tiers, nil
+}
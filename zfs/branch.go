@@ -0,0 +1,259 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	branchBucket = "branches"
+	// MainBranch is the branch holding a volume's original dataset
+	MainBranch = "main"
+)
+
+var branchName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// Branches are the named clones of a volume and which one the volume currently uses
+type Branches struct {
+	Current  string            `json:"current"`
+	Datasets map[string]string `json:"datasets"`
+}
+
+// branchState serializes the changes to branches. Their zfs commands run
+// outside the state transaction, so they do not hold up other volumes.
+type branchState struct {
+	mu sync.Mutex
+}
+
+func (zd *ZfsDriver) getBranches(tx *state.Tx, volume, ds string) (*Branches, error) {
+	br := &Branches{}
+	ok, err := tx.Get(branchBucket, volume, br)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		br = &Branches{Current: MainBranch, Datasets: map[string]string{MainBranch: ds}}
+	}
+	return br, nil
+}
+
+// readBranches is getBranches outside a transaction
+func (zd *ZfsDriver) readBranches(volume, ds string) (*Branches, error) {
+	br := &Branches{}
+	ok, err := zd.db.Get(branchBucket, volume, br)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		br = &Branches{Current: MainBranch, Datasets: map[string]string{MainBranch: ds}}
+	}
+	return br, nil
+}
+
+// ListBranches returns the branches of a volume
+func (zd *ZfsDriver) ListBranches(volume string) (_ *Branches, err error) {
+	defer observe("branch", &err)
+	ds, err := zd.resolveExisting(volume)
+	if err != nil {
+		return nil, err
+	}
+	return zd.readBranches(volume, ds)
+}
+
+// CreateBranch clones a snapshot of the from branch, or the current branch if
+// from is empty, as a new branch of the volume
+func (zd *ZfsDriver) CreateBranch(volume, branch, from string) (_ *Branches, err error) {
+	defer observe("branch", &err)
+	log.WithFields(log.Fields{"volume": volume, "branch": branch, "from": from}).Debug("CreateBranch")
+	if !branchName.MatchString(branch) {
+		return nil, policyErrorf("invalid branch name %q", branch)
+	}
+	ds, err := zd.resolveWritable(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	zd.branches.mu.Lock()
+	defer zd.branches.mu.Unlock()
+	br, err := zd.readBranches(volume, ds)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := br.Datasets[branch]; ok {
+		return nil, policyErrorf("branch %s of volume %s already exists", branch, volume)
+	}
+	if from == "" {
+		from = br.Current
+	}
+	src, ok := br.Datasets[from]
+	if !ok {
+		return nil, fmt.Errorf("branch %s of volume %s: %w", from, volume, ErrNotFound)
+	}
+	snap := fmt.Sprintf("%s@branch-%s", src, branch)
+	target := fmt.Sprintf("%s.%s", br.Datasets[MainBranch], branch)
+	if err := zd.snapshot("branch", snap); err != nil {
+		return nil, err
+	}
+	if _, err := zd.zfs("branch", "clone", snap, target); err != nil {
+		_, _ = zd.zfs("branch", "destroy", snap)
+		return nil, err
+	}
+	err = zd.db.Update(func(tx *state.Tx) error {
+		if br, err = zd.getBranches(tx, volume, ds); err != nil {
+			return err
+		}
+		br.Datasets[branch] = target
+		return tx.Put(branchBucket, volume, br)
+	})
+	if err != nil {
+		_, _ = zd.zfs("branch", "destroy", target)
+		_, _ = zd.zfs("branch", "destroy", snap)
+		return nil, fmt.Errorf("failed to record branch %s of volume %s: %w", branch, volume, err)
+	}
+	zd.events.Publish(events.Event{Type: events.VolumeBranch, Volume: volume, Dataset: br.Datasets[branch],
+		Details: map[string]string{"branch": branch, "action": "create"}})
+	return br, nil
+}
+
+// Checkout switches the dataset backing an unmounted volume to another branch
+func (zd *ZfsDriver) Checkout(volume, branch string) (_ *Branches, err error) {
+	defer observe("branch", &err)
+	log.WithFields(log.Fields{"volume": volume, "branch": branch}).Debug("Checkout")
+	if ids := zd.mounted(volume); len(ids) > 0 {
+		return nil, policyErrorf("volume %s is mounted by %d container(s)", volume, len(ids))
+	}
+	ds, err := zd.resolveWritable(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	zd.branches.mu.Lock()
+	defer zd.branches.mu.Unlock()
+	var br *Branches
+	err = zd.db.Update(func(tx *state.Tx) error {
+		if br, err = zd.getBranches(tx, volume, ds); err != nil {
+			return err
+		}
+		target, ok := br.Datasets[branch]
+		if !ok {
+			return fmt.Errorf("branch %s of volume %s: %w", branch, volume, ErrNotFound)
+		}
+		m := mapping{}
+		if _, err := tx.Get(mappingBucket, volume, &m); err != nil {
+			return err
+		}
+		// the guids of the branch are recorded by the next reconciliation
+		m.Dataset, m.GUID, m.ZfsGUID = target, "", ""
+		br.Current = branch
+		if err := tx.Put(mappingBucket, volume, &m); err != nil {
+			return err
+		}
+		return tx.Put(branchBucket, volume, br)
+	})
+	if err != nil {
+		return nil, err
+	}
+	zd.events.Publish(events.Event{Type: events.VolumeBranch, Volume: volume, Dataset: br.Datasets[branch],
+		Details: map[string]string{"branch": branch, "action": "checkout"}})
+	return br, nil
+}
+
+// DeleteBranch destroys a branch which is not checked out. If the current
+// branch was cloned from it, the current branch is promoted first so it
+// keeps the shared history. The main branch is never deleted, the names of
+// the other branches are derived from it.
+func (zd *ZfsDriver) DeleteBranch(volume, branch string) (_ *Branches, err error) {
+	defer observe("branch", &err)
+	log.WithFields(log.Fields{"volume": volume, "branch": branch}).Debug("DeleteBranch")
+	if branch == MainBranch {
+		return nil, policyErrorf("branch %s of volume %s can not be deleted", MainBranch, volume)
+	}
+	ds, err := zd.resolveWritable(volume)
+	if err != nil {
+		return nil, err
+	}
+
+	zd.branches.mu.Lock()
+	defer zd.branches.mu.Unlock()
+	br, err := zd.readBranches(volume, ds)
+	if err != nil {
+		return nil, err
+	}
+	target, ok := br.Datasets[branch]
+	if !ok {
+		return nil, fmt.Errorf("branch %s of volume %s: %w", branch, volume, ErrNotFound)
+	}
+	if branch == br.Current {
+		return nil, policyErrorf("branch %s is checked out, check out another branch first", branch)
+	}
+	cur := br.Datasets[br.Current]
+	origin, err := zd.getProperty("branch", cur, "origin")
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(origin, target+"@") {
+		if _, err := zd.zfs("branch", "promote", cur); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := zd.zfs("branch", "destroy", "-r", target); err != nil {
+		return nil, err
+	}
+	err = zd.db.Update(func(tx *state.Tx) error {
+		if br, err = zd.getBranches(tx, volume, ds); err != nil {
+			return err
+		}
+		delete(br.Datasets, branch)
+		if len(br.Datasets) == 1 {
+			tx.Delete(branchBucket, volume)
+			return nil
+		}
+		return tx.Put(branchBucket, volume, br)
+	})
+	if err != nil {
+		return nil, err
+	}
+	zd.events.Publish(events.Event{Type: events.VolumeBranch, Volume: volume, Dataset: target,
+		Details: map[string]string{"branch": branch, "action": "delete"}})
+	return br, nil
+}
+
+// branchDatasets returns all branch datasets of a volume, and whether it has any
+func (zd *ZfsDriver) branchDatasets(volume string) ([]string, bool) {
+	var br Branches
+	ok, err := zd.db.Get(branchBucket, volume, &br)
+	if !ok || err != nil {
+		return nil, false
+	}
+	var dss []string
+	for _, ds := range br.Datasets {
+		dss = append(dss, ds)
+	}
+	sort.Strings(dss)
+	return dss, true
+}
+
+// inactiveBranches returns the datasets of branches which are not checked
+// out, these are not listed as volumes
+func (zd *ZfsDriver) inactiveBranches() map[string]bool {
+	hidden := make(map[string]bool)
+	for _, v := range zd.db.Keys(branchBucket) {
+		var br Branches
+		if ok, err := zd.db.Get(branchBucket, v, &br); !ok || err != nil {
+			continue
+		}
+		for name, ds := range br.Datasets {
+			if name != br.Current {
+				hidden[ds] = true
+			}
+		}
+	}
+	return hidden
+}
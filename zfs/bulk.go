@@ -0,0 +1,215 @@
+package zfsdriver
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/namecodec"
+)
+
+// Bulk operations
+const (
+	// BulkSnapshot takes a snapshot of the same name of every volume
+	BulkSnapshot = "snapshot"
+	// BulkSetProperty sets the same properties on every volume
+	BulkSetProperty = "set-property"
+	// BulkBackup takes a backup snapshot of every volume now, which is
+	// thinned with the scheduled backups of the volume's tier. Volumes
+	// without a backup tier fail, nothing would ever thin their backups.
+	BulkBackup = "backup"
+)
+
+// Selector selects volumes by compose project, labels, storage class and dataset prefix.
+// A volume is selected if it matches every criterion given.
+type Selector struct {
+	// Project is the compose project, the first level of the volume name
+	Project string `json:"project,omitempty"`
+	// Labels must all be set on the volume with -o label.<key>=<value>
+	Labels map[string]string `json:"labels,omitempty"`
+	// Class is the storage class of the volume
+	Class string `json:"class,omitempty"`
+	// Prefix is a dataset the volume's dataset is or is below
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (sel Selector) empty() bool {
+	return sel.Project == "" && len(sel.Labels) == 0 && sel.Class == "" && sel.Prefix == ""
+}
+
+func (sel Selector) matches(c namecodec.Codec, name string, m *mapping) bool {
+	if sel.Project != "" {
+		if parts, ok := c.Parts(name); !ok || parts[0] != sel.Project {
+			return false
+		}
+	}
+	for k, v := range sel.Labels {
+		if got, ok := m.Options[OptLabelPrefix+k]; !ok || got != v {
+			return false
+		}
+	}
+	if sel.Class != "" && volumeClass(m.Options) != sel.Class {
+		return false
+	}
+	p := strings.TrimSuffix(sel.Prefix, "/")
+	return p == "" || m.Dataset == p || strings.HasPrefix(m.Dataset, p+"/")
+}
+
+// BulkRequest is an operation applied to every selected volume
+type BulkRequest struct {
+	Selector   Selector          `json:"selector"`
+	Operation  string            `json:"operation"`
+	Snapshot   string            `json:"snapshot,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	DryRun     bool              `json:"dry_run,omitempty"`
+}
+
+// BulkResult is the outcome of a bulk operation on one volume
+type BulkResult struct {
+	Volume string `json:"volume"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BulkReport is the consolidated outcome of a bulk operation
+type BulkReport struct {
+	Operation string       `json:"operation"`
+	Selected  int          `json:"selected"`
+	Failed    int          `json:"failed"`
+	DryRun    bool         `json:"dry_run,omitempty"`
+	Results   []BulkResult `json:"results"`
+}
+
+// Select returns the names of the volumes matching sel, sorted. Only
+// volumes created by the plugin are selected, replicas are never selected
+// and an empty selector is refused.
+func (zd *ZfsDriver) Select(sel Selector) ([]string, error) {
+	if sel.empty() {
+		return nil, policyErrorf("empty selector, give a project, labels, a class or a dataset prefix")
+	}
+	var names []string
+	for _, name := range zd.db.Keys(mappingBucket) {
+		m, ok, err := zd.getMapping(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !m.replica() && sel.matches(zd.codec, name, m) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ValidateBulk checks the operation and selector of req without applying
+// it, for callers which run it later
+func (zd *ZfsDriver) ValidateBulk(req BulkRequest) error {
+	if _, err := zd.bulkOperation(req); err != nil {
+		return err
+	}
+	if req.Selector.empty() {
+		return policyErrorf("empty selector, give a project, labels, a class or a dataset prefix")
+	}
+	return nil
+}
+
+// Bulk applies req to every selected volume, at most BulkParallelism at a
+// time. Failures are reported per volume and do not stop the others. With
+// DryRun only the selected volumes are reported. The finished volumes are
+// reported to progress, volumes not started before ctx is canceled fail with
+// its error.
+func (zd *ZfsDriver) Bulk(ctx context.Context, req BulkRequest, progress Progress) (*BulkReport, error) {
+	op, err := zd.bulkOperation(req)
+	if err != nil {
+		return nil, err
+	}
+	names, err := zd.Select(req.Selector)
+	if err != nil {
+		return nil, err
+	}
+	rep := &BulkReport{Operation: req.Operation, Selected: len(names), DryRun: req.DryRun, Results: make([]BulkResult, len(names))}
+	for i, name := range names {
+		rep.Results[i].Volume = name
+	}
+	if req.DryRun {
+		return rep, nil
+	}
+
+	n := zd.bulk
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := int64(0)
+	for i := range rep.Results {
+		sem <- struct{}{}
+		if err := ctx.Err(); err != nil {
+			<-sem
+			rep.Results[i].Error = err.Error()
+			continue
+		}
+		wg.Add(1)
+		go func(r *BulkResult) {
+			defer func() { <-sem; wg.Done() }()
+			if err := op(r.Volume); err != nil {
+				r.Error = err.Error()
+			}
+			mu.Lock()
+			done++
+			progress.report(done, int64(len(rep.Results)))
+			mu.Unlock()
+		}(&rep.Results[i])
+	}
+	wg.Wait()
+	for _, r := range rep.Results {
+		if r.Error != "" {
+			rep.Failed++
+		}
+	}
+	return rep, nil
+}
+
+// bulkOperation validates req and returns the function applying it to a volume
+func (zd *ZfsDriver) bulkOperation(req BulkRequest) (func(name string) error, error) {
+	switch req.Operation {
+	case BulkSnapshot:
+		if !snapshotName.MatchString(req.Snapshot) {
+			return nil, policyErrorf("invalid snapshot name %q", req.Snapshot)
+		}
+		return func(name string) error {
+			_, err := zd.CreateSnapshot(name, req.Snapshot)
+			return err
+		}, nil
+	case BulkSetProperty:
+		if len(req.Properties) == 0 {
+			return nil, policyErrorf("no properties given")
+		}
+		if err := validateProperties(req.Properties); err != nil {
+			return nil, err
+		}
+		return func(name string) error {
+			return zd.SetProperties(name, req.Properties)
+		}, nil
+	case BulkBackup:
+		snap := backupPolicies[BackupDaily].Prefix + time.Now().UTC().Format("20060102T150405Z")
+		return func(name string) error {
+			ds, err := zd.resolveWritable(name)
+			if err != nil {
+				return err
+			}
+			tier, err := zd.getProperty("bulk", ds, propBackup)
+			if err != nil {
+				return err
+			}
+			if _, ok := backupPolicies[tier]; !ok {
+				return policyErrorf("volume %s has no backup tier, its backups would never be thinned", name)
+			}
+			_, err = zd.CreateSnapshot(name, snap)
+			return err
+		}, nil
+	}
+	return nil, policyErrorf("unknown bulk operation %q, expected %s, %s or %s", req.Operation, BulkSnapshot, BulkSetProperty, BulkBackup)
+}
@@ -0,0 +1,74 @@
+package zfsdriver
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// volumeCache holds the local volumes last listed or inspected, so List and
+// Get can still be answered while zfs is unavailable
+type volumeCache struct {
+	mu   sync.Mutex
+	vols map[string]*volume.Volume
+}
+
+// put records the result of inspecting a volume
+func (c *volumeCache) put(v *volume.Volume) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.vols == nil {
+		c.vols = make(map[string]*volume.Volume)
+	}
+	c.vols[v.Name] = v
+}
+
+// replace records the result of listing all local volumes, keeping what is
+// known from inspecting them
+func (c *volumeCache) replace(vols []*volume.Volume) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := make(map[string]*volume.Volume, len(vols))
+	for _, v := range vols {
+		if old, ok := c.vols[v.Name]; ok && old.Mountpoint == v.Mountpoint {
+			next[v.Name] = old
+			continue
+		}
+		next[v.Name] = v
+	}
+	c.vols = next
+}
+
+// stale returns a copy of the cached volume name marked with why it is stale
+func (c *volumeCache) stale(name, reason string) (*volume.Volume, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.vols[name]
+	if !ok {
+		return nil, false
+	}
+	return staleCopy(v, reason), true
+}
+
+// staleList returns copies of all cached volumes marked with why they are stale
+func (c *volumeCache) staleList(reason string) []*volume.Volume {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vols := make([]*volume.Volume, 0, len(c.vols))
+	for _, v := range c.vols {
+		vols = append(vols, staleCopy(v, reason))
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].Name < vols[j].Name })
+	return vols
+}
+
+func staleCopy(v *volume.Volume, reason string) *volume.Volume {
+	c := *v
+	c.Status = make(map[string]interface{}, len(v.Status)+1)
+	for k, s := range v.Status {
+		c.Status[k] = s
+	}
+	c.Status["stale"] = "zfs is unavailable, " + reason + ", this is the last known state"
+	return &c
+}
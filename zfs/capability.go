@@ -0,0 +1,82 @@
+package zfsdriver
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+)
+
+// supportsProperty returns false if the installed zfs does not know property
+func (zd *ZfsDriver) supportsProperty(dataset, property string) (bool, error) {
+	pool := strings.SplitN(dataset, "/", 2)[0]
+	_, err := zd.zfs("feature", "get", "-H", "-o", "value", property, pool)
+	var cerr *CommandError
+	if errors.As(err, &cerr) && strings.Contains(cerr.Stderr, "invalid property") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// kernelFilesystem returns true if the running kernel supports filesystem fs
+func kernelFilesystem(fs string) bool {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == fs {
+			return true
+		}
+	}
+	return false
+}
+
+// checksums are the selectable checksum algorithms and the pool feature they need
+var checksums = map[string]string{
+	"on":        "",
+	"fletcher2": "",
+	"fletcher4": "",
+	"sha256":    "",
+	"sha512":    "sha512",
+	"skein":     "skein",
+	"edonr":     "edonr",
+	"blake3":    "blake3",
+}
+
+// checkCapabilities fails with a policy error if props need support the
+// host's kernel or zfs is missing
+func (zd *ZfsDriver) checkCapabilities(dataset string, props map[string]string) error {
+	if v, ok := props["overlay"]; ok {
+		if v != "on" && v != "off" {
+			return policyErrorf("invalid overlay value %q, expected on or off", v)
+		}
+		if v == "on" {
+			ok, err := zd.supportsProperty(dataset, "overlay")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return policyErrorf("overlay requires OpenZFS 2.2 or later")
+			}
+			if !kernelFilesystem("overlay") {
+				return policyErrorf("overlay=on requires a kernel with overlayfs support")
+			}
+		}
+	}
+	if v, ok := props["checksum"]; ok {
+		feature, ok := checksums[v]
+		if !ok {
+			return policyErrorf("invalid checksum %q", v)
+		}
+		if feature != "" {
+			if err := zd.requireFeature(dataset, feature); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package zfsdriver
+
+import (
+	"context"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+)
+
+// PoolCapacity is the size and free space of a pool in bytes
+type PoolCapacity struct {
+	Size uint64 `json:"size"`
+	Free uint64 `json:"free"`
+}
+
+// PoolCapacities returns the capacity of the configured pools
+func (zd *ZfsDriver) PoolCapacities(ctx context.Context) (map[string]PoolCapacity, error) {
+	out, err := zd.runner.run(ctx, "capacity", "zpool", append([]string{"list", "-Hp", "-o", "name,size,free"}, zd.Pools()...)...)
+	if err != nil {
+		return nil, err
+	}
+	caps := make(map[string]PoolCapacity)
+	for _, f := range zfsout.Records(out, 3) {
+		size, _ := zfsout.Uint(f[1])
+		free, _ := zfsout.Uint(f[2])
+		caps[f[0]] = PoolCapacity{Size: size, Free: free}
+	}
+	return caps, nil
+}
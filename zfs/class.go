@@ -0,0 +1,34 @@
+package zfsdriver
+
+import "regexp"
+
+// propClass is the user property holding the storage class of a volume, so
+// it survives a lost mapping and external tooling can select datasets by it
+const propClass = userPropPrefix + "class"
+
+var className = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+func validateClass(v string) error {
+	if !className.MatchString(v) {
+		return policyErrorf("invalid %s %q, expected lower case letters, digits, _, . and -", OptClass, v)
+	}
+	return nil
+}
+
+// volumeClass returns the storage class of a volume created with opts, its
+// class option or else the profile it was created with
+func volumeClass(opts map[string]string) string {
+	if c := opts[OptClass]; c != "" {
+		return c
+	}
+	return opts[OptProfile]
+}
+
+// classOf returns the storage class of the volume name, empty if it has none
+func (zd *ZfsDriver) classOf(name string) string {
+	m, ok, err := zd.getMapping(name)
+	if !ok || err != nil {
+		return ""
+	}
+	return volumeClass(m.Options)
+}
@@ -0,0 +1,319 @@
+package zfsdriver
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+var complianceViolation = metrics.NewGaugeVec("zfs_plugin_compliance_violation",
+	"1 if a volume property violates its create option or a site policy at the last audit", "volume", "property", "source")
+
+func init() {
+	metrics.MustRegister(complianceViolation)
+}
+
+// Sources of compliance violations
+const (
+	// ComplianceOption is drift from a property given at create
+	ComplianceOption = "option"
+	// CompliancePolicy is a violation of a site policy rule
+	CompliancePolicy = "policy"
+)
+
+// ComplianceRule is a site policy on a property of every volume, either
+// property=value or property!=value
+type ComplianceRule struct {
+	Property string
+	Value    string
+	Forbid   bool
+}
+
+func (r ComplianceRule) String() string {
+	if r.Forbid {
+		return r.Property + "!=" + r.Value
+	}
+	return r.Property + "=" + r.Value
+}
+
+// ParseComplianceRule parses property=value or property!=value
+func ParseComplianceRule(s string) (ComplianceRule, error) {
+	i := strings.Index(s, "=")
+	if i < 1 || i == len(s)-1 {
+		return ComplianceRule{}, fmt.Errorf("invalid compliance rule %q, expected property=value or property!=value", s)
+	}
+	r := ComplianceRule{Property: s[:i], Value: s[i+1:]}
+	if strings.HasSuffix(r.Property, "!") {
+		r.Property, r.Forbid = strings.TrimSuffix(r.Property, "!"), true
+	}
+	if r.Property == "" || strings.ContainsAny(r.Property, " \t,") {
+		return ComplianceRule{}, fmt.Errorf("invalid compliance rule %q, expected property=value or property!=value", s)
+	}
+	return r, nil
+}
+
+// ComplianceConfig configures the periodic compliance audit
+type ComplianceConfig struct {
+	Interval time.Duration
+	Rules    []ComplianceRule
+	// Remediate sets drifted properties back to their create option or the
+	// value a rule requires. A forbidden value set locally is inherited.
+	Remediate bool
+}
+
+// ComplianceViolation is a volume property which differs from its create
+// option or violates a policy rule
+type ComplianceViolation struct {
+	Volume   string `json:"volume"`
+	Dataset  string `json:"dataset"`
+	Property string `json:"property"`
+	Source   string `json:"source"`
+	// Rule is what the property should be, such as compression=lz4 or sync!=disabled
+	Rule       string `json:"rule"`
+	Got        string `json:"got"`
+	Remediated bool   `json:"remediated,omitempty"`
+}
+
+// ComplianceReport is the result of an audit
+type ComplianceReport struct {
+	Time       time.Time             `json:"time"`
+	Violations []ComplianceViolation `json:"violations"`
+}
+
+type complianceState struct {
+	mu     sync.Mutex
+	cfg    ComplianceConfig
+	last   *ComplianceReport
+	failed map[string]bool
+}
+
+// sizeSuffix matches sizes with a unit as given to zfs, such as 10G or 1.5T
+var sizeSuffix = regexp.MustCompile(`^(?i)([0-9]+(?:\.[0-9]+)?)([KMGTPEZ])B?$`)
+
+// normalizeValue makes a property value comparable to its parsable zfs form,
+// sizes are converted to bytes
+func normalizeValue(v string) string {
+	m := sizeSuffix.FindStringSubmatch(v)
+	if m == nil {
+		return strings.ToLower(v)
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	n *= math.Pow(1024, float64(strings.Index("KMGTPEZ", strings.ToUpper(m[2]))+1))
+	return strconv.FormatUint(uint64(n), 10)
+}
+
+// sameValue reports whether the parsable value got is the value want, a
+// size of none is 0 in parsable form
+func sameValue(got, want string) bool {
+	got, want = normalizeValue(got), normalizeValue(want)
+	return got == want || (want == "none" && got == "0")
+}
+
+// auditProperties returns the values and sources of props of every dataset
+// below the root datasets
+func (zd *ZfsDriver) auditProperties(ctx context.Context, props []string) map[string]map[string]zfsout.Property {
+	got := make(map[string]map[string]zfsout.Property)
+	for _, rds := range zd.rds {
+		out, err := zd.runner.run(ctx, "compliance", "zfs", "get", "-H", "-p", "-r", "-t", "filesystem",
+			"-o", "name,property,value,source", strings.Join(props, ","), rds)
+		if err != nil {
+			log.WithError(err).WithField("dataset", rds).Error("Failed to get properties to audit")
+			continue
+		}
+		for ds, props := range zfsout.Properties(out) {
+			got[ds] = props
+		}
+	}
+	return got
+}
+
+// AuditCompliance compares every mapped volume with the zfs properties it
+// was created with and the policy rules. Rules do not apply to a property a
+// volume created with force-unsafe sets itself. Mirror volumes are audited
+// against rules only and never remediated, their properties belong to their
+// source. Replicas are outside the root datasets and not audited.
+func (zd *ZfsDriver) AuditCompliance(ctx context.Context, rules []ComplianceRule, remediate bool) (_ *ComplianceReport, err error) {
+	defer observe("compliance", &err)
+	type audited struct {
+		name string
+		m    *mapping
+	}
+	var vols []audited
+	want := make(map[string]bool)
+	for _, r := range rules {
+		want[r.Property] = true
+	}
+	for _, name := range zd.db.Keys(mappingBucket) {
+		m, ok, err := zd.getMapping(name)
+		if !ok || err != nil {
+			continue
+		}
+		vols = append(vols, audited{name, m})
+		for k := range m.Options {
+			if !isPluginOption(k) && k != "mountpoint" {
+				want[k] = true
+			}
+		}
+	}
+	report := &ComplianceReport{Time: time.Now(), Violations: []ComplianceViolation{}}
+	if len(want) == 0 {
+		return report, nil
+	}
+	props := make([]string, 0, len(want))
+	for k := range want {
+		props = append(props, k)
+	}
+	sort.Strings(props)
+	got := zd.auditProperties(ctx, props)
+
+	for _, v := range vols {
+		cur, ok := got[v.m.Dataset]
+		if !ok {
+			continue
+		}
+		readOnly := v.m.Options[OptMirror] != ""
+		var found []ComplianceViolation
+		keys := make([]string, 0, len(v.m.Options))
+		for k := range v.m.Options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if !readOnly {
+			for _, k := range keys {
+				val := v.m.Options[k]
+				if isPluginOption(k) || k == "mountpoint" {
+					continue
+				}
+				if p, ok := cur[k]; ok && !sameValue(p.Value, val) {
+					found = append(found, ComplianceViolation{Volume: v.name, Dataset: v.m.Dataset, Property: k,
+						Source: ComplianceOption, Rule: k + "=" + val, Got: p.Value})
+				}
+			}
+		}
+		for _, r := range rules {
+			if _, own := v.m.Options[r.Property]; own && acceptsUnsafe(v.m.Options, r.Property) {
+				continue
+			}
+			p, ok := cur[r.Property]
+			if !ok || sameValue(p.Value, r.Value) != r.Forbid {
+				continue
+			}
+			found = append(found, ComplianceViolation{Volume: v.name, Dataset: v.m.Dataset, Property: r.Property,
+				Source: CompliancePolicy, Rule: r.String(), Got: p.Value})
+		}
+		for i := range found {
+			if remediate && !readOnly {
+				found[i].Remediated = zd.remediate(&found[i], cur[found[i].Property].Source)
+			}
+		}
+		report.Violations = append(report.Violations, found...)
+	}
+	zd.recordCompliance(report)
+	return report, nil
+}
+
+// remediate sets the property of a violation back to what its rule requires
+func (zd *ZfsDriver) remediate(v *ComplianceViolation, source string) bool {
+	l := log.WithFields(log.Fields{"volume": v.Volume, "property": v.Property, "rule": v.Rule, "got": v.Got})
+	var err error
+	if i := strings.Index(v.Rule, "!="); i >= 0 {
+		if source != "local" {
+			l.Warn("Not remediating compliance violation, the forbidden value is inherited")
+			return false
+		}
+		if _, err = zd.zfs("compliance", "inherit", v.Property, v.Dataset); err == nil {
+			var now string
+			if now, err = zd.getExactProperty("compliance", v.Dataset, v.Property); err == nil && sameValue(now, v.Rule[i+2:]) {
+				err = fmt.Errorf("the inherited value is %s", now)
+			}
+		}
+	} else {
+		_, err = zd.zfs("compliance", "set", v.Rule, v.Dataset)
+	}
+	if err != nil {
+		l.WithError(err).Error("Failed to remediate compliance violation")
+		return false
+	}
+	l.Info("Remediated compliance violation")
+	return true
+}
+
+// recordCompliance keeps report for the API and publishes an event for every
+// new violation and for volumes which no longer have any
+func (zd *ZfsDriver) recordCompliance(report *ComplianceReport) {
+	cs := &zd.compliance
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	complianceViolation.Reset()
+	failed := make(map[string]bool)
+	vols := make(map[string]bool)
+	for _, v := range report.Violations {
+		details := map[string]string{"property": v.Property, "source": v.Source, "rule": v.Rule, "got": v.Got}
+		if v.Remediated {
+			details["remediated"] = "true"
+			zd.events.Publish(events.Event{Type: events.VolumeNonCompliant, Volume: v.Volume, Dataset: v.Dataset, Details: details})
+			continue
+		}
+		complianceViolation.Set(1, v.Volume, v.Property, v.Source)
+		key := v.Volume + "\x00" + v.Rule
+		failed[key], vols[v.Volume] = true, true
+		if cs.failed[key] {
+			continue
+		}
+		log.WithFields(log.Fields{"volume": v.Volume, "property": v.Property, "rule": v.Rule, "got": v.Got}).Warn("Volume violates compliance rule")
+		zd.events.Publish(events.Event{Type: events.VolumeNonCompliant, Volume: v.Volume, Dataset: v.Dataset, Details: details})
+	}
+	done := make(map[string]bool)
+	for key := range cs.failed {
+		vol := key[:strings.Index(key, "\x00")]
+		if !vols[vol] && !done[vol] {
+			done[vol] = true
+			log.WithField("volume", vol).Info("Volume is compliant again")
+			zd.events.Publish(events.Event{Type: events.VolumeCompliant, Volume: vol})
+		}
+	}
+	cs.failed = failed
+	cs.last = report
+}
+
+// MonitorCompliance audits the volumes every interval until ctx is canceled
+func (zd *ZfsDriver) MonitorCompliance(ctx context.Context, cfg ComplianceConfig) {
+	zd.compliance.mu.Lock()
+	zd.compliance.cfg = cfg
+	zd.compliance.mu.Unlock()
+	t := time.NewTicker(cfg.Interval)
+	defer t.Stop()
+	for {
+		if _, err := zd.AuditCompliance(ctx, cfg.Rules, cfg.Remediate); err != nil {
+			log.WithError(err).Error("Failed to audit compliance")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Compliance returns the report of the last audit, nil before the first.
+// With audit it runs an audit with the configured rules first.
+func (zd *ZfsDriver) Compliance(ctx context.Context, audit bool) (*ComplianceReport, error) {
+	zd.compliance.mu.Lock()
+	cfg, last := zd.compliance.cfg, zd.compliance.last
+	zd.compliance.mu.Unlock()
+	if !audit {
+		return last, nil
+	}
+	return zd.AuditCompliance(ctx, cfg.Rules, cfg.Remediate)
+}
@@ -0,0 +1,150 @@
+package zfsdriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+)
+
+func (zd *ZfsDriver) zfs(op string, args ...string) ([]byte, error) {
+	return zd.runner.run(context.Background(), op, "zfs", args...)
+}
+
+func (zd *ZfsDriver) datasetExists(name string) bool {
+	_, err := zd.zfs("exists", "list", "-H", "-o", "name", "-t", "filesystem", name)
+	return err == nil
+}
+
+func (zd *ZfsDriver) createDataset(name string, recursive bool, properties map[string]string) error {
+	args := []string{"create"}
+	if recursive {
+		args = append(args, "-p")
+	}
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-o", fmt.Sprintf("%s=%s", k, properties[k]))
+	}
+	_, err := zd.zfs("create", append(args, name)...)
+	return err
+}
+
+func (zd *ZfsDriver) destroyDataset(name string) error {
+	_, err := zd.zfs("destroy", "destroy", "-r", name)
+	return err
+}
+
+// listDatasets returns the filesystems below root, excluding root itself
+func (zd *ZfsDriver) listDatasets(root string) ([]string, error) {
+	var dss []string
+	if zd.json.zfs {
+		out, err := zd.zfs("list", "list", "-r", "-j", "-p", "-o", "name", "-t", "filesystem", root)
+		if err != nil {
+			return nil, err
+		}
+		listed, err := zfsout.Datasets(out)
+		if err == nil {
+			for _, ds := range listed {
+				if ds.Name != root {
+					dss = append(dss, ds.Name)
+				}
+			}
+			return dss, nil
+		}
+		jsonFallback("zfs list", err)
+	}
+	out, err := zd.zfs("list", "list", "-r", "-H", "-o", "name", "-t", "filesystem", root)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range zfsout.Lines(out) {
+		if l != root {
+			dss = append(dss, l)
+		}
+	}
+	return dss, nil
+}
+
+func (zd *ZfsDriver) getProperty(op, name, property string) (string, error) {
+	return zd.property(op, name, property, false)
+}
+
+func (zd *ZfsDriver) getExactProperty(op, name, property string) (string, error) {
+	return zd.property(op, name, property, true)
+}
+
+func (zd *ZfsDriver) property(op, name, property string, exact bool) (string, error) {
+	args := []string{"get", "-H", "-o", "value"}
+	if exact {
+		args = append(args, "-p")
+	}
+	out, err := zd.zfs(op, append(args, property, name)...)
+	if err != nil {
+		if isNotExist(err) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// getProperties returns the parsable values of several properties at once
+func (zd *ZfsDriver) getProperties(op, name string, properties ...string) (map[string]string, error) {
+	out, err := zd.zfs(op, "get", "-Hp", "-o", "property,value", strings.Join(properties, ","), name)
+	if err != nil {
+		if isNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return zfsout.Pairs(out), nil
+}
+
+func (zd *ZfsDriver) getMountpoint(op, name string) (string, error) {
+	return zd.getProperty(op, name, "mountpoint")
+}
+
+func (zd *ZfsDriver) getCreation(op, name string) (time.Time, error) {
+	uts, err := zd.getExactProperty(op, name, "creation")
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, ok := zfsout.Time(uts)
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid creation time %q of %s", uts, name)
+	}
+	return t, nil
+}
+
+func isNotExist(err error) bool {
+	var ce *CommandError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	var ee *exec.ExitError
+	return errors.As(ce.Err, &ee) && strings.Contains(ce.Stderr, "does not exist")
+}
+
+// snapshot atomically creates all snapshots, given as dataset@name
+func (zd *ZfsDriver) snapshot(op string, snapshots ...string) error {
+	_, err := zd.zfs(op, append([]string{"snapshot"}, snapshots...)...)
+	return err
+}
+
+// createParents creates the missing ancestors of dataset
+func (zd *ZfsDriver) createParents(dataset string) error {
+	i := strings.LastIndex(dataset, "/")
+	if i < 0 || zd.datasetExists(dataset[:i]) {
+		return nil
+	}
+	return zd.createDataset(dataset[:i], true, nil)
+}
@@ -0,0 +1,180 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// delegatedChild is the child dataset of a volume created with delegate=true
+// which is handed to a container. It is zoned, so the host does not mount it
+// and the container manages the datasets below it.
+const delegatedChild = "delegated"
+
+// Delegation records the user namespace a volume's delegated dataset is
+// attached to with zfs zone
+type Delegation struct {
+	Dataset string `json:"dataset"`
+	PID     int    `json:"pid"`
+	// Namespace is the user namespace of PID when it was delegated, such as
+	// user:[4026532520], which tells a reused pid from the original one
+	Namespace string    `json:"namespace"`
+	Time      time.Time `json:"time"`
+}
+
+func delegatedDataset(ds string) string {
+	return ds + "/" + delegatedChild
+}
+
+func userNamespace(pid int) string {
+	return "/proc/" + strconv.Itoa(pid) + "/ns/user"
+}
+
+// live reports whether the namespace of d still exists, zfs drops the
+// delegation with it
+func (d *Delegation) live() bool {
+	ns, err := os.Readlink(userNamespace(d.PID))
+	return err == nil && ns == d.Namespace
+}
+
+// createDelegated creates the zoned child of the volume dataset ds. zfs
+// zone came with OpenZFS 2.2, like the overlay property which is checked
+// for it.
+func (zd *ZfsDriver) createDelegated(ds string) error {
+	ok, err := zd.supportsProperty(ds, "overlay")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return policyErrorf("option %s requires OpenZFS 2.2 or later", OptDelegate)
+	}
+	return zd.createDataset(delegatedDataset(ds), false, map[string]string{"zoned": "on"})
+}
+
+// delegatedDatasets returns the delegated datasets of every volume, they
+// and the datasets created below them are not volumes
+func (zd *ZfsDriver) delegatedDatasets() map[string]bool {
+	dss := make(map[string]bool)
+	for _, name := range zd.db.Keys(mappingBucket) {
+		if m, ok, err := zd.getMapping(name); ok && err == nil && m.Options[OptDelegate] == "true" {
+			dss[delegatedDataset(m.Dataset)] = true
+		}
+	}
+	return dss
+}
+
+// inDelegated reports whether ds is one of delegated or below it
+func inDelegated(ds string, delegated map[string]bool) bool {
+	for {
+		if delegated[ds] {
+			return true
+		}
+		i := strings.LastIndex(ds, "/")
+		if i < 0 {
+			return false
+		}
+		ds = ds[:i]
+	}
+}
+
+// Delegate attaches the delegated dataset of the volume name to the user
+// namespace of the process pid, such as the init process of a container, so
+// zfs run in the container can create, mount and destroy datasets below it
+func (zd *ZfsDriver) Delegate(name string, pid int) (_ *Delegation, err error) {
+	defer observe("delegate", &err)
+	log.WithFields(log.Fields{"volume": name, "pid": pid}).Debug("Delegate")
+	m, ok, err := zd.getMapping(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || m.Options[OptDelegate] != "true" {
+		return nil, policyErrorf("volume %s was not created with %s=true", name, OptDelegate)
+	}
+	if m.archived() {
+		return nil, archivedError(name, m.Archive)
+	}
+	if err := zd.requireOwned(m.Dataset); err != nil {
+		return nil, err
+	}
+	if m.Delegation != nil && m.Delegation.live() {
+		return nil, policyErrorf("volume %s is delegated to pid %d, revoke it first", name, m.Delegation.PID)
+	}
+	if pid <= 1 {
+		return nil, policyErrorf("invalid pid %d, expected a process in the container's user namespace", pid)
+	}
+	ns, err := os.Readlink(userNamespace(pid))
+	if err != nil {
+		return nil, policyErrorf("no user namespace of pid %d: %v", pid, err)
+	}
+	if host, err := os.Readlink(userNamespace(os.Getpid())); err == nil && host == ns {
+		return nil, policyErrorf("pid %d is in the plugin's own user namespace, delegate to a container with user namespace remapping", pid)
+	}
+	d := &Delegation{Dataset: delegatedDataset(m.Dataset), PID: pid, Namespace: ns, Time: time.Now()}
+	if _, err := zd.zfs("delegate", "zone", userNamespace(pid), d.Dataset); err != nil {
+		return nil, err
+	}
+	if err := zd.setDelegation(name, d); err != nil {
+		zd.unzone(d)
+		return nil, fmt.Errorf("failed to record delegation of volume %s: %w", name, err)
+	}
+	log.WithFields(log.Fields{"volume": name, "dataset": d.Dataset, "pid": pid, "namespace": ns}).Info("Delegated dataset")
+	zd.events.Publish(events.Event{Type: events.VolumeDelegate, Volume: name, Dataset: d.Dataset,
+		Details: map[string]string{"action": "delegate", "pid": strconv.Itoa(pid), "namespace": ns}})
+	return d, nil
+}
+
+// Revoke detaches the delegated dataset of the volume name from the user
+// namespace it was delegated to. A delegation whose namespace is gone has
+// already ended and is only forgotten.
+func (zd *ZfsDriver) Revoke(name string) (err error) {
+	defer observe("delegate", &err)
+	m, ok, err := zd.getMapping(name)
+	if err != nil {
+		return err
+	}
+	if !ok || m.Delegation == nil {
+		return policyErrorf("volume %s is not delegated", name)
+	}
+	if err := zd.requireOwned(m.Dataset); err != nil {
+		return err
+	}
+	return zd.revoke(name, m.Delegation)
+}
+
+func (zd *ZfsDriver) revoke(name string, d *Delegation) error {
+	if d.live() {
+		if _, err := zd.zfs("delegate", "unzone", userNamespace(d.PID), d.Dataset); err != nil {
+			return fmt.Errorf("failed to revoke delegation of %s to pid %d: %w", d.Dataset, d.PID, err)
+		}
+	}
+	if err := zd.setDelegation(name, nil); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"volume": name, "dataset": d.Dataset, "pid": d.PID}).Info("Revoked delegated dataset")
+	zd.events.Publish(events.Event{Type: events.VolumeDelegate, Volume: name, Dataset: d.Dataset,
+		Details: map[string]string{"action": "revoke", "pid": strconv.Itoa(d.PID), "namespace": d.Namespace}})
+	return nil
+}
+
+func (zd *ZfsDriver) unzone(d *Delegation) {
+	if _, err := zd.zfs("delegate", "unzone", userNamespace(d.PID), d.Dataset); err != nil {
+		log.WithError(err).WithField("dataset", d.Dataset).Error("Failed to undo delegation")
+	}
+}
+
+func (zd *ZfsDriver) setDelegation(name string, d *Delegation) error {
+	return zd.db.Update(func(tx *state.Tx) error {
+		var m mapping
+		if ok, err := tx.Get(mappingBucket, name, &m); err != nil || !ok {
+			return err
+		}
+		m.Delegation = d
+		return tx.Put(mappingBucket, name, &m)
+	})
+}
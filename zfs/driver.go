@@ -1,206 +1,649 @@
 package zfsdriver
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
-	"github.com/clinta/go-zfs"
+	"github.com/TrilliumIT/docker-zfs-plugin/credentials"
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/namecodec"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
 	"github.com/docker/go-plugins-helpers/volume"
 	log "github.com/sirupsen/logrus"
 )
 
-//ZfsDriver implements the plugin helpers volume.Driver interface for zfs
+// Config holds the driver settings
+type Config struct {
+	//Datasets are the root datasets volumes are created in
+	Datasets []string
+	//MaxConcurrentOps limits the number of zfs commands executing at once, 0 is unlimited
+	MaxConcurrentOps int
+	//MaxQueuedOps limits the number of zfs commands waiting for a worker, 0 is unlimited
+	MaxQueuedOps int
+	//Backpressure is the behavior when the queue is full, reject or delay
+	Backpressure string
+	//BackpressureDelay is how long an operation waits for room in a full queue in delay mode
+	BackpressureDelay time.Duration
+	//SlowOpThreshold is the duration after which a zfs operation is logged as slow, 0 disables
+	SlowOpThreshold time.Duration
+	//CommandTimeout aborts zfs commands running longer than this, 0 disables
+	CommandTimeout time.Duration
+	//MaxConcurrentStreams limits the zfs sends and receives executing at once, apart from MaxConcurrentOps, 0 is unlimited
+	MaxConcurrentStreams int
+	//StreamTimeout aborts zfs sends and receives running longer than this, 0 disables
+	StreamTimeout time.Duration
+	//OpTimeouts override CommandTimeout per operation, such as get or destroy, 0 disables the timeout of an operation
+	OpTimeouts map[string]time.Duration
+	//LogSampleInterval limits repeated debug logs of List, Get and Path to one per interval, 0 disables
+	LogSampleInterval time.Duration
+	//Events receives volume lifecycle events, may be nil
+	Events *events.Bus
+	//State persists volume mappings and mounts
+	State *state.DB
+	//MountTemplate is applied to the mountpoints of new volumes, may be nil
+	MountTemplate *MountTemplate
+	//DefaultProperties are set on new volumes unless given with -o
+	DefaultProperties map[string]string
+	//UnsafeSyncAllow are volume name patterns allowed sync=disabled without force-unsafe
+	UnsafeSyncAllow []string
+	//Locker locks mounted volumes across a cluster, may be nil
+	Locker Locker
+	//Scope is reported to docker, local or global
+	Scope string
+	//Registry records the node hosting each volume of global scope, may be nil
+	Registry Registry
+	//Containers is asked before a volume is removed whether containers still reference it, may be nil
+	Containers ContainerLister
+	//MirrorSSH is the command and arguments used to reach the source hosts of mirror volumes, mirrors are disabled if it is empty
+	MirrorSSH []string
+	//Credentials resolves the credentials jobs reference by name, such as the ssh keys of mirror sources
+	Credentials *credentials.Store
+	//CommandPrefix is prepended to every zfs and zpool command, such as sudo -n, so the plugin can run unprivileged
+	CommandPrefix []string
+	//RootProperties are expected on every root dataset, drift is reported at startup
+	RootProperties map[string]string
+	//EnforceRootProperties sets the differing RootProperties instead of only reporting them
+	EnforceRootProperties bool
+	//VerifyMounts checks that a mountpoint is the mount of its dataset before returning it
+	VerifyMounts bool
+	//VerifyWritable also requires mountpoints of writable datasets to be writable
+	VerifyWritable bool
+	//Faults injects random delays and failures into zfs commands for testing, nil disables it
+	Faults *Faults
+	//Prewarm bounds the cache priming of volumes created with prewarm=true
+	Prewarm PrewarmConfig
+	//BulkParallelism is how many volumes a bulk operation works on at once, 0 or less is one at a time
+	BulkParallelism int
+	//NameDelimiter separates the levels of volume names nested as datasets, _ if empty
+	NameDelimiter string
+	//NameDepth is the most levels a volume name is nested into, 2 if 0
+	NameDepth int
+	//ReplicaDatasets are where datasets are received from other hosts, their leaf datasets are registered as read only volumes
+	ReplicaDatasets []string
+	//ReplicaSuffix is appended to the names of replica volumes, DefaultReplicaSuffix if empty
+	ReplicaSuffix string
+	//ArchiveDir is where archived volumes are sent to, archiving is disabled if it is empty
+	ArchiveDir string
+	//RemoveBackup sends volumes to ArchiveDir before Remove destroys them, unless created with remove-backup=false
+	RemoveBackup bool
+	//RemoveBackupTimeout bounds the backup of a volume before it is removed, 0 is unbounded
+	RemoveBackupTimeout time.Duration
+	//HistoryDir keeps the event history of every volume, a file per volume, history is not recorded if it is empty
+	HistoryDir string
+	//NoJSONOutput parses the text output of zfs and zpool even if they print JSON
+	NoJSONOutput bool
+	//SelfTest builds a driver only to run SelfTest, which leaves the state and
+	//the root dataset properties alone instead of reconciling them at startup
+	SelfTest bool
+}
+
+// ZfsDriver implements the plugin helpers volume.Driver interface for zfs
 type ZfsDriver struct {
 	volume.Driver
-	rds []*zfs.Dataset //root dataset
+	rds                 []string //root dataset
+	runner              *runner
+	sampler             *logSampler
+	events              *events.Bus
+	db                  *state.DB
+	template            *MountTemplate
+	defaults            map[string]string
+	unsafeSync          []string
+	locker              Locker
+	scope               string
+	registry            Registry
+	containers          ContainerLister
+	mirrorSSH           []string
+	credentials         *credentials.Store
+	prewarmCfg          PrewarmConfig
+	cache               volumeCache
+	drift               []PropertyDrift
+	verify              bool
+	writable            bool
+	bulk                int
+	codec               namecodec.Codec
+	replicaRoots        []string
+	replicaSuffix       string
+	archiveDir          string
+	removeBackup        bool
+	removeBackupTimeout time.Duration
+	json                jsonOutput
+	health              healthState
+	identity            identityState
+	activity            activityState
+	compliance          complianceState
+	quiesce             quiesceState
+	mirrors             mirrorState
+	branches            branchState
+	history             historyState
 }
 
-//NewZfsDriver returns the plugin driver object
-func NewZfsDriver(dss ...string) (*ZfsDriver, error) {
+// NewZfsDriver returns the plugin driver object
+func NewZfsDriver(cfg Config) (*ZfsDriver, error) {
 	log.Debug("Creating new ZfsDriver.")
-	zd := &ZfsDriver{}
-	if len(dss) < 1 {
+	if len(cfg.Datasets) < 1 {
 		return nil, fmt.Errorf("No datasets specified")
 	}
-	for _, ds := range dss {
-		if !zfs.DatasetExists(ds) {
-			_, err := zfs.CreateDatasetRecursive(ds, make(map[string]string))
+	if cfg.State == nil {
+		return nil, fmt.Errorf("No state database specified")
+	}
+	r, err := newRunner(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkPrefix(context.Background(), strings.SplitN(cfg.Datasets[0], "/", 2)[0]); err != nil {
+		return nil, err
+	}
+	zd := &ZfsDriver{
+		runner:              r,
+		sampler:             newLogSampler(cfg.LogSampleInterval),
+		events:              cfg.Events,
+		db:                  cfg.State,
+		template:            cfg.MountTemplate,
+		defaults:            cfg.DefaultProperties,
+		unsafeSync:          cfg.UnsafeSyncAllow,
+		locker:              cfg.Locker,
+		scope:               cfg.Scope,
+		registry:            cfg.Registry,
+		containers:          cfg.Containers,
+		mirrorSSH:           cfg.MirrorSSH,
+		credentials:         cfg.Credentials,
+		prewarmCfg:          cfg.Prewarm,
+		verify:              cfg.VerifyMounts,
+		writable:            cfg.VerifyWritable,
+		bulk:                cfg.BulkParallelism,
+		codec:               namecodec.Codec{Delimiter: cfg.NameDelimiter, Depth: cfg.NameDepth},
+		replicaRoots:        cfg.ReplicaDatasets,
+		replicaSuffix:       cfg.ReplicaSuffix,
+		archiveDir:          cfg.ArchiveDir,
+		removeBackup:        cfg.RemoveBackup,
+		removeBackupTimeout: cfg.RemoveBackupTimeout,
+		history:             historyState{dir: cfg.HistoryDir},
+	}
+	if zd.removeBackup && zd.archiveDir == "" {
+		return nil, fmt.Errorf("backups before remove are sent to the archive directory, which is not set")
+	}
+	if zd.replicaSuffix == "" {
+		zd.replicaSuffix = DefaultReplicaSuffix
+	}
+	if err := zd.codec.Validate(); err != nil {
+		return nil, err
+	}
+	if zd.scope == "" {
+		zd.scope = "local"
+	}
+	if !cfg.NoJSONOutput {
+		zd.detectJSON(context.Background(), strings.SplitN(cfg.Datasets[0], "/", 2)[0])
+	}
+	zd.health.pools = make(map[string]string)
+	for _, ds := range cfg.Datasets {
+		if !zd.datasetExists(ds) {
+			err := zd.createDataset(ds, true, cfg.RootProperties)
 			if err != nil {
 				log.Error("Failed to create root dataset.")
 				return nil, err
 			}
 		}
-		rds, err := zfs.GetDataset(ds)
-		if err != nil {
-			log.Error("Failed to get root dataset.")
-			return nil, err
-		}
-		zd.rds = append(zd.rds, rds)
+		zd.rds = append(zd.rds, ds)
+	}
+	if zd.drift, err = zd.checkRootProperties(cfg.RootProperties, cfg.EnforceRootProperties && !cfg.SelfTest); err != nil {
+		return nil, fmt.Errorf("failed to check root dataset properties: %w", err)
+	}
+	if cfg.SelfTest {
+		return zd, nil
 	}
+	zd.relock()
+	zd.syncRegistry()
+	zd.syncReplicas()
+	zd.reconcileIdentities()
+	//writes held by a group snapshot when the plugin stopped are let through
+	zd.releaseWrites()
+	//faults are only injected once the driver is up, so they can not fail the startup
+	r.faults = newInjector(cfg.Faults)
 
 	return zd, nil
 }
 
-//Create creates a new zfs dataset for a volume
-func (zd *ZfsDriver) Create(req *volume.CreateRequest) error {
+// Pools returns the names of the pools holding the root datasets
+func (zd *ZfsDriver) Pools() []string {
+	var pools []string
+	seen := make(map[string]bool)
+	for _, rds := range zd.rds {
+		p := strings.SplitN(rds, "/", 2)[0]
+		if !seen[p] {
+			seen[p] = true
+			pools = append(pools, p)
+		}
+	}
+	return pools
+}
+
+// Create creates a new zfs dataset for a volume
+func (zd *ZfsDriver) Create(req *volume.CreateRequest) (err error) {
+	defer zd.observeVolume("create", req.Name, time.Now(), &err)
 	log.WithField("Request", req).Debug("Create")
 
-	// Parse the volume name to extract project name if it exists
-	// Docker Compose volumes are named: projectname_volumename
+	// Docker Compose volumes are named projectname_volumename and nested per
+	// project, which allows efficient recursive snapshots per project
 	volumeName := req.Name
-	datasetName := volumeName
-	
-	// Check if this looks like a docker-compose volume (contains underscore)
-	if strings.Contains(volumeName, "_") {
-		parts := strings.SplitN(volumeName, "_", 2)
-		if len(parts) == 2 {
-			// Assume first part is project name, second is actual volume name
-			projectName := parts[0]
-			actualVolumeName := parts[1]
-			
-			// Create hierarchical structure for docker-compose projects
-			// This allows efficient recursive snapshots per project
-			if len(zd.rds) > 0 {
-				// Use the first root dataset as base
-				rootDS := zd.rds[0].Name
-				datasetName = fmt.Sprintf("%s/%s/%s", rootDS, projectName, actualVolumeName)
-				log.WithFields(log.Fields{
-					"project": projectName,
-					"volume": actualVolumeName,
-					"dataset": datasetName,
-				}).Info("Creating hierarchical dataset for docker-compose volume")
-			}
-		}
+	datasetName := zd.naming(zd.rds[0]).Dataset(volumeName)
+	if parts, ok := zd.codec.Parts(volumeName); ok {
+		log.WithFields(log.Fields{
+			"project": parts[0],
+			"volume":  parts[len(parts)-1],
+			"dataset": datasetName,
+		}).Info("Creating hierarchical dataset for docker-compose volume")
 	}
 
-	if zfs.DatasetExists(datasetName) {
-		return fmt.Errorf("volume already exists: %s", datasetName)
+	if err = zd.requireOwned(datasetName); err != nil {
+		return err
+	}
+	if _, ok, _ := zd.getMapping(volumeName); ok || zd.datasetExists(datasetName) {
+		return policyErrorf("volume already exists: %s", datasetName)
+	}
+	if e, rErr := zd.remoteEntry(volumeName); rErr != nil || e != nil {
+		if rErr != nil {
+			return rErr
+		}
+		return policyErrorf("volume %s already exists on node %s", volumeName, e.Node)
 	}
 
-	// CreateDatasetRecursive will create parent datasets if needed
-	_, err := zfs.CreateDatasetRecursive(datasetName, req.Options)
+	options, prof, err := expandProfile(req.Options)
+	if err != nil {
+		return err
+	}
+	props, opts := splitOptions(options)
+	if tier, ok := opts[OptBackup]; ok {
+		props[propBackup] = tier
+	}
+	if class := volumeClass(opts); class != "" {
+		props[propClass] = class
+	}
+	for k, v := range zd.defaults {
+		if _, ok := props[k]; !ok {
+			props[k] = v
+		}
+	}
+	if err = validateOptions(opts); err != nil {
+		return err
+	}
+	if err = validateProperties(props); err != nil {
+		return err
+	}
+	if err = zd.guardUnsafe(volumeName, props, opts); err != nil {
+		return err
+	}
+	if err = zd.checkCapabilities(datasetName, props); err != nil {
+		return err
+	}
+	if usesProjects(props, opts) {
+		if err = zd.requireFeature(datasetName, "project_quota"); err != nil {
+			return err
+		}
+	}
+	//the first stream of a mirror can take hours, it is received in the background
+	if _, ok := opts[OptMirror]; ok {
+		return zd.createMirror(volumeName, datasetName, options, props)
+	}
+	if asof, ok := opts[OptAsOf]; ok {
+		err = zd.createAsOf(datasetName, opts[OptFrom], asof, props)
+	} else if from, ok := opts[OptFrom]; ok {
+		err = zd.createClone(datasetName, from, opts[OptSnapshot], props)
+	} else {
+		zd.template.templateProperties(props)
+		// CreateDatasetRecursive will create parent datasets if needed
+		err = zd.createDataset(datasetName, true, props)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create dataset %s: %w", datasetName, err)
 	}
-	
+	defer func() {
+		if err == nil {
+			return
+		}
+		if dErr := zd.destroyDataset(datasetName); dErr != nil {
+			log.WithError(dErr).WithField("dataset", datasetName).Error("Failed to clean up dataset of failed create")
+		}
+	}()
+	if !copied(opts) {
+		if err = zd.applyTemplate(datasetName); err != nil {
+			return fmt.Errorf("failed to apply mount template to %s: %w", datasetName, err)
+		}
+		if err = zd.applyProfile(datasetName, prof); err != nil {
+			return fmt.Errorf("failed to apply profile to %s: %w", datasetName, err)
+		}
+	}
+	if id, ok := opts[OptProject]; ok {
+		if err = zd.setProject(datasetName, id); err != nil {
+			return fmt.Errorf("failed to set project of %s: %w", datasetName, err)
+		}
+	}
+	if opts[OptDelegate] == "true" {
+		if err = zd.createDelegated(datasetName); err != nil {
+			return fmt.Errorf("failed to create delegated dataset of %s: %w", datasetName, err)
+		}
+	}
+	if err = zd.register(volumeName, datasetName); err != nil {
+		return fmt.Errorf("failed to register volume %s: %w", volumeName, err)
+	}
+	id, gErr := zd.identify("create", datasetName)
+	if gErr != nil {
+		log.WithError(gErr).WithField("dataset", datasetName).Warn("Failed to set dataset guid")
+	}
+	if err = zd.db.Put(mappingBucket, volumeName, &mapping{Dataset: datasetName, Options: options, GUID: id.guid, ZfsGUID: id.native}); err != nil {
+		zd.deregister(volumeName)
+		return fmt.Errorf("failed to record dataset of volume %s: %w", volumeName, err)
+	}
+
 	log.WithField("dataset", datasetName).Info("Successfully created hierarchical dataset")
+	zd.events.Publish(events.Event{Type: events.VolumeCreate, Volume: req.Name, Dataset: datasetName})
 	return nil
 }
 
-//List returns a list of zfs volumes on this host
-func (zd *ZfsDriver) List() (*volume.ListResponse, error) {
-	log.Debug("List")
+// List returns a list of zfs volumes on this host
+func (zd *ZfsDriver) List() (_ *volume.ListResponse, err error) {
+	defer observe("list", &err)
+	zd.sampler.debug("List", log.NewEntry(log.StandardLogger()), "List")
 	var vols []*volume.Volume
+	names := zd.volumeNames()
+	hidden := zd.inactiveBranches()
+	delegated := zd.delegatedDatasets()
 
 	for _, rds := range zd.rds {
-		dsl, err := rds.DatasetList()
+		dsl, err := zd.listDatasets(rds)
+		if errors.Is(err, ErrUnavailable) {
+			return &volume.ListResponse{Volumes: append(zd.cache.staleList(zd.Unavailable()), zd.remoteVolumes()...)}, nil
+		}
 		if err != nil {
 			return nil, err
 		}
 		for _, ds := range dsl {
+			if hidden[ds] || inDelegated(ds, delegated) {
+				continue
+			}
 			//TODO: rewrite this to utilize zd.getVolume() when
 			//upstream go-zfs is rewritten to cache properties
 			var mp string
-			mp, err = ds.GetMountpoint()
+			mp, err = zd.getMountpoint("list", ds)
 			if err != nil {
-				log.WithField("name", ds.Name).Error("Failed to get mountpoint from dataset")
+				log.WithField("name", ds).Error("Failed to get mountpoint from dataset")
 				continue
 			}
-			vols = append(vols, &volume.Volume{Name: ds.Name, Mountpoint: mp})
+			name := ds
+			if n, ok := names[ds]; ok {
+				name = n
+			}
+			v := &volume.Volume{Name: name, Mountpoint: mp}
+			if class := zd.classOf(name); class != "" {
+				v.Status = map[string]interface{}{"class": class}
+			}
+			vols = append(vols, v)
 		}
 	}
 
+	vols = append(vols, zd.replicaVolumes()...)
+	vols = append(vols, zd.archivedVolumes()...)
+	vols = append(vols, zd.receivingVolumes()...)
+	zd.cache.replace(vols)
+	vols = append(vols, zd.remoteVolumes()...)
+
 	return &volume.ListResponse{Volumes: vols}, nil
 }
 
-//Get returns the volume.Volume{} object for the requested volume
-//nolint: dupl
-func (zd *ZfsDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
-	log.WithField("Request", req).Debug("Get")
+// Get returns the volume.Volume{} object for the requested volume
+// nolint: dupl
+func (zd *ZfsDriver) Get(req *volume.GetRequest) (_ *volume.GetResponse, err error) {
+	defer zd.observeVolume("get", req.Name, time.Now(), &err)
+	zd.sampler.debug("Get "+req.Name, log.WithField("Request", req), "Get")
+	if m, ok, _ := zd.getMapping(req.Name); ok && m.archived() {
+		return &volume.GetResponse{Volume: archivedVolume(req.Name, m.Archive)}, nil
+	} else if m.receiving() {
+		return &volume.GetResponse{Volume: receivingVolume(req.Name, m)}, nil
+	}
 
-	v, err := zd.getVolume(req.Name)
+	ds, err := zd.resolve(req.Name)
 	if err != nil {
 		return nil, err
 	}
 
-	return &volume.GetResponse{Volume: v}, nil
-}
-
-func (zd *ZfsDriver) getVolume(name string) (*volume.Volume, error) {
-	ds, err := zfs.GetDataset(name)
+	v, err := zd.getVolume(req.Name, ds)
+	if isNotExist(err) {
+		if to, ok := zd.relocate(req.Name); ok {
+			v, err = zd.getVolume(req.Name, to)
+		}
+	}
+	if errors.Is(err, ErrUnavailable) {
+		if c, ok := zd.cache.stale(req.Name, zd.Unavailable()); ok {
+			return &volume.GetResponse{Volume: c}, nil
+		}
+	}
 	if err != nil {
-		return nil, err
+		if v, err = zd.remoteVolume(req.Name, err); err != nil {
+			return nil, err
+		}
 	}
 
-	mp, err := ds.GetMountpoint()
+	return &volume.GetResponse{Volume: v}, nil
+}
+
+func (zd *ZfsDriver) getVolume(name, ds string) (*volume.Volume, error) {
+	mp, err := zd.getMountpoint("get", ds)
 	if err != nil {
 		return nil, err
 	}
 
-	ts, err := ds.GetCreation()
+	v := &volume.Volume{Name: name, Mountpoint: mp}
+	ts, err := zd.getCreation("get", ds)
 	if err != nil {
 		log.WithError(err).Error("Failed to get creation property from zfs dataset")
-		return &volume.Volume{Name: name, Mountpoint: mp}, nil
+		return v, nil
 	}
+	v.CreatedAt = ts.Format(time.RFC3339)
 
-	return &volume.Volume{Name: name, Mountpoint: mp, CreatedAt: ts.Format(time.RFC3339)}, nil
+	if v.Status, err = zd.status(name, ds); err != nil {
+		log.WithError(err).Error("Failed to get status of zfs dataset")
+	}
+	zd.cache.put(v)
+	return v, nil
 }
 
-func (zd *ZfsDriver) getMP(name string) (string, error) {
-	ds, err := zfs.GetDataset(name)
+func (zd *ZfsDriver) getMP(op, name string) (string, error) {
+	ds, err := zd.resolve(name)
 	if err != nil {
 		return "", err
 	}
-
-	return ds.GetMountpoint()
+	return zd.getMountpoint(op, ds)
 }
 
-//Remove destroys a zfs dataset for a volume
-func (zd *ZfsDriver) Remove(req *volume.RemoveRequest) error {
+// Remove destroys a zfs dataset for a volume
+func (zd *ZfsDriver) Remove(req *volume.RemoveRequest) (err error) {
+	defer zd.observeVolume("remove", req.Name, time.Now(), &err)
 	log.WithField("Request", req).Debug("Remove")
+	//an archived volume only has its stub left, its archive file is kept
+	if m, ok, _ := zd.getMapping(req.Name); ok && m.archived() {
+		if err := zd.db.Delete(mappingBucket, req.Name); err != nil {
+			return err
+		}
+		zd.events.Publish(events.Event{Type: events.VolumeRemove, Volume: req.Name, Dataset: m.Dataset,
+			Details: map[string]string{"archive": m.Archive.File}})
+		return nil
+	}
+	//a mirror which is not received yet only has its mapping
+	if m, ok, _ := zd.getMapping(req.Name); ok && m.receiving() {
+		return zd.removeReceiving(req.Name, m)
+	}
 
-	ds, err := zfs.GetDataset(req.Name)
+	ds, err := zd.removable(req.Name)
 	if err != nil {
 		return err
 	}
+	//a final backup is written before anything is destroyed, a failed backup keeps the volume
+	var backups []string
+	targets := zd.removeTargets(req.Name, ds)
+	if m, _, _ := zd.getMapping(req.Name); zd.backsUpOnRemove(m) {
+		ctx, cancel := zd.removeBackupContext()
+		backups, err = zd.backupBeforeRemove(ctx, req.Name, targets)
+		cancel()
+		if err != nil {
+			zd.events.Publish(events.Event{Type: events.VolumeBackupFailed, Volume: req.Name, Dataset: ds,
+				Details: map[string]string{"backup": "remove", "error": err.Error()}})
+			return fmt.Errorf("failed to back up volume %s before removing it, it is kept: %w", req.Name, err)
+		}
+	}
+	if m, ok, _ := zd.getMapping(req.Name); ok && m.Options[OptMirror] != "" {
+		zd.releaseMirror(context.Background(), ds, m.Options[OptMirror], m.Options[OptMirrorCredential])
+	}
+	//the delegated dataset is taken back from its container before it is destroyed
+	if m, ok, _ := zd.getMapping(req.Name); ok && m.Delegation != nil {
+		if err := zd.revoke(req.Name, m.Delegation); err != nil {
+			return err
+		}
+	}
 
-	return ds.Destroy()
+	if err := zd.destroyTargets(targets); err != nil {
+		return err
+	}
+	if _, ok := zd.branchDatasets(req.Name); ok {
+		if err := zd.db.Delete(branchBucket, req.Name); err != nil {
+			return err
+		}
+	}
+	if err := zd.db.Delete(mappingBucket, req.Name); err != nil {
+		return err
+	}
+	zd.deregister(req.Name)
+	var details map[string]string
+	if len(backups) > 0 {
+		details = map[string]string{"backup": strings.Join(backups, ",")}
+	}
+	zd.events.Publish(events.Event{Type: events.VolumeRemove, Volume: req.Name, Dataset: ds, Details: details})
+	return nil
 }
 
-//Path returns the mountpoint of a volume
-//nolint: dupl
-func (zd *ZfsDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
-	log.WithField("Request", req).Debug("Path")
+// removable returns the dataset of a volume after checking it may be removed
+func (zd *ZfsDriver) removable(name string) (string, error) {
+	if zd.isReplica(name) {
+		return "", policyErrorf("volume %s is a replica, it is unregistered once its dataset is destroyed", name)
+	}
+	ds, err := zd.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if !zd.datasetExists(ds) {
+		return "", zd.remoteError(name, ErrNotFound)
+	}
+	if err := zd.requireOwned(ds); err != nil {
+		return "", err
+	}
+	if err := zd.checkUnused(name); err != nil {
+		return "", err
+	}
+	targets := zd.removeTargets(name, ds)
+	if err := zd.requireUnheld(name, targets); err != nil {
+		return "", err
+	}
+	if err := zd.requireNoForeignClones(name, targets); err != nil {
+		return "", err
+	}
+	return ds, nil
+}
+
+// Path returns the mountpoint of a volume
+// nolint: dupl
+func (zd *ZfsDriver) Path(req *volume.PathRequest) (_ *volume.PathResponse, err error) {
+	defer zd.observeVolume("path", req.Name, time.Now(), &err)
+	zd.sampler.debug("Path "+req.Name, log.WithField("Request", req), "Path")
 
-	mp, err := zd.getMP(req.Name)
+	mp, err := zd.getMP("path", req.Name)
 	if err != nil {
-		return nil, err
+		return nil, zd.remoteError(req.Name, err)
 	}
 
 	return &volume.PathResponse{Mountpoint: mp}, nil
 }
 
-//Mount returns the mountpoint of the zfs volume
-//nolint: dupl
-func (zd *ZfsDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
+// Mount returns the mountpoint of the zfs volume
+// nolint: dupl
+func (zd *ZfsDriver) Mount(req *volume.MountRequest) (_ *volume.MountResponse, err error) {
+	defer zd.observeVolume("mount", req.Name, time.Now(), &err)
 	log.WithField("Request", req).Debug("Mount")
-	mp, err := zd.getMP(req.Name)
+	ds, err := zd.resolve(req.Name)
 	if err != nil {
 		return nil, err
 	}
+	if err := zd.requireOwned(ds); err != nil {
+		return nil, err
+	}
+	if zd.isReplica(req.Name) {
+		if err := zd.prepareReplica(ds); err != nil {
+			return nil, err
+		}
+	}
+	mp, err := zd.getMountpoint("mount", ds)
+	if err != nil {
+		return nil, zd.remoteError(req.Name, err)
+	}
+	if zd.verify {
+		if err := zd.verifyMountpoint(ds, mp, zd.writable); err != nil {
+			return nil, err
+		}
+	}
+	if err := zd.lockVolume(req.Name); err != nil {
+		return nil, err
+	}
+	first := len(zd.mounted(req.Name)) == 0
+	if err := zd.addMount(req.Name, req.ID); err != nil {
+		zd.unlockVolume(req.Name)
+		return nil, err
+	}
+	if m, ok, _ := zd.getMapping(req.Name); first && ok && m.Options[OptPrewarm] == "true" {
+		zd.prewarm(req.Name, mp)
+	}
 
+	zd.events.Publish(events.Event{Type: events.VolumeMount, Volume: req.Name, Dataset: ds,
+		Details: map[string]string{"id": req.ID, "mountpoint": mp}})
 	return &volume.MountResponse{Mountpoint: mp}, nil
 }
 
-//Unmount does nothing because a zfs dataset need not be unmounted
-func (zd *ZfsDriver) Unmount(req *volume.UnmountRequest) error {
+// Unmount only records that the container released the volume, because a
+// zfs dataset need not be unmounted
+func (zd *ZfsDriver) Unmount(req *volume.UnmountRequest) (err error) {
+	defer zd.observeVolume("unmount", req.Name, time.Now(), &err)
 	log.WithField("Request", req).Debug("Unmount")
+	if err := zd.removeMount(req.Name, req.ID); err != nil {
+		return err
+	}
+	zd.unlockVolume(req.Name)
+	zd.events.Publish(events.Event{Type: events.VolumeUnmount, Volume: req.Name,
+		Details: map[string]string{"id": req.ID}})
 	return nil
 }
 
-//Capabilities sets the scope to local as this is a local only driver
+// Capabilities reports the configured scope, local unless a volume registry
+// makes volumes visible on every node
 func (zd *ZfsDriver) Capabilities() *volume.CapabilitiesResponse {
 	log.Debug("Capabilities")
-	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "local"}}
+	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: zd.scope}}
 }
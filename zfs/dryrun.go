@@ -0,0 +1,71 @@
+package zfsdriver
+
+import (
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// DestroyPlan is what a destructive operation would destroy, as reported by
+// zfs destroy -n, for reviewing a change before running it
+type DestroyPlan struct {
+	Operation    string   `json:"operation"`
+	Destroy      []string `json:"destroy"`
+	ReclaimBytes uint64   `json:"reclaim_bytes"`
+}
+
+// planDestroy adds what zfs destroy with flags would destroy of each target
+// to the plan, without destroying anything
+func (zd *ZfsDriver) planDestroy(plan *DestroyPlan, flags []string, targets ...string) error {
+	for _, t := range targets {
+		args := append(append([]string{"destroy", "-nvp"}, flags...), t)
+		out, err := zd.zfs("dry-run", args...)
+		if err != nil {
+			return err
+		}
+		for _, f := range zfsout.Records(out, 2) {
+			switch f[0] {
+			case "destroy":
+				plan.Destroy = append(plan.Destroy, f[1])
+			case "reclaim":
+				n, _ := zfsout.Uint(f[1])
+				plan.ReclaimBytes += n
+			}
+		}
+	}
+	return nil
+}
+
+// RemovePlan returns the datasets and snapshots removing a volume would
+// destroy, after the same checks Remove makes
+func (zd *ZfsDriver) RemovePlan(name string) (_ *DestroyPlan, err error) {
+	defer observe("remove", &err)
+	log.WithField("volume", name).Debug("RemovePlan")
+	ds, err := zd.removable(name)
+	if err != nil {
+		return nil, err
+	}
+	plan := &DestroyPlan{Operation: "remove"}
+	if err := zd.planDestroy(plan, []string{"-r"}, zd.removeTargets(name, ds)...); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// DeleteSnapshotPlan returns what deleting a snapshot of a volume would
+// destroy, it fails like DeleteSnapshot if the snapshot has dependent clones
+func (zd *ZfsDriver) DeleteSnapshotPlan(volume, name string) (_ *DestroyPlan, err error) {
+	defer observe("snapshot", &err)
+	log.WithFields(log.Fields{"volume": volume, "snapshot": name}).Debug("DeleteSnapshotPlan")
+	if !snapshotName.MatchString(name) {
+		return nil, policyErrorf("invalid snapshot name %q", name)
+	}
+	ds, err := zd.resolveExisting(volume)
+	if err != nil {
+		return nil, err
+	}
+	plan := &DestroyPlan{Operation: "delete-snapshot"}
+	if err := zd.planDestroy(plan, nil, ds+"@"+name); err != nil {
+		return nil, snapshotDestroyError(err, volume, name)
+	}
+	return plan, nil
+}
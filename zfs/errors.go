@@ -0,0 +1,85 @@
+package zfsdriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+)
+
+// Error categories, used as the category label of the errors metric
+const (
+	ErrCategoryExec        = "exec"
+	ErrCategoryTimeout     = "timeout"
+	ErrCategoryBusy        = "busy"
+	ErrCategoryNotFound    = "not-found"
+	ErrCategoryUnavailable = "unavailable"
+	ErrCategorySuspended   = "pool-suspended"
+	ErrCategoryPolicy      = "policy-rejected"
+	ErrCategoryInternal    = "internal"
+)
+
+var (
+	// ErrNotFound is returned when a volume's dataset does not exist
+	ErrNotFound = errors.New("dataset not found")
+	// ErrTimeout is returned when a zfs command exceeds its timeout
+	ErrTimeout = errors.New("zfs command timed out")
+	// ErrUnavailable is returned when the zfs tools or kernel module are missing
+	ErrUnavailable = errors.New("zfs is unavailable")
+	// ErrPoolSuspended is returned without running a zfs command on a suspended
+	// pool, which would hang until the pool is cleared
+	ErrPoolSuspended = errors.New("pool suspended")
+)
+
+var opErrors = metrics.NewCounterVec("zfs_plugin_errors_total",
+	"Failed operations by operation and error category", "op", "category")
+
+func init() {
+	metrics.MustRegister(opErrors)
+}
+
+// PolicyError is returned when a request is refused by plugin policy, for
+// example an invalid or disallowed option
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+func policyErrorf(format string, args ...interface{}) error {
+	return &PolicyError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// ErrorCategory classifies an error returned by the driver
+func ErrorCategory(err error) string {
+	var pe *PolicyError
+	var ce *CommandError
+	switch {
+	case errors.Is(err, ErrBusy):
+		return ErrCategoryBusy
+	case errors.Is(err, ErrUnavailable):
+		return ErrCategoryUnavailable
+	case errors.Is(err, ErrPoolSuspended):
+		return ErrCategorySuspended
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return ErrCategoryTimeout
+	case errors.Is(err, ErrNotFound), isNotExist(err):
+		return ErrCategoryNotFound
+	case errors.As(err, &pe):
+		return ErrCategoryPolicy
+	case errors.As(err, &ce):
+		return ErrCategoryExec
+	}
+	return ErrCategoryInternal
+}
+
+// observe counts a failed operation, it is deferred with the address of
+// the operation's error result
+func observe(op string, err *error) {
+	if *err != nil {
+		opErrors.Inc(op, ErrorCategory(*err))
+	}
+}
@@ -0,0 +1,468 @@
+package zfsdriver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// Backpressure modes applied when the operation queue is full
+const (
+	BackpressureReject = "reject"
+	BackpressureDelay  = "delay"
+)
+
+// ErrBusy is returned when an operation is refused because too many zfs
+// operations are already queued
+var ErrBusy = errors.New("too many queued zfs operations, try again later")
+
+var (
+	opsInflight = metrics.NewGaugeVec("zfs_plugin_ops_inflight",
+		"Number of zfs commands currently executing")
+	opsQueued = metrics.NewGaugeVec("zfs_plugin_ops_queued",
+		"Number of zfs commands waiting for a free worker")
+	opsRejected = metrics.NewCounterVec("zfs_plugin_ops_rejected_total",
+		"Number of zfs operations rejected because the queue was full", "op")
+	streamsInflight = metrics.NewGaugeVec("zfs_plugin_streams_inflight",
+		"Number of zfs sends and receives currently executing")
+	zfsAvailable = metrics.NewGaugeVec("zfs_plugin_zfs_available",
+		"1 if the last zfs command could run, 0 if the zfs tools or kernel module are missing")
+)
+
+func init() {
+	metrics.MustRegister(opsInflight, opsQueued, opsRejected, streamsInflight, zfsAvailable)
+	opsInflight.Set(0)
+	streamsInflight.Set(0)
+	opsQueued.Set(0)
+	zfsAvailable.Set(1)
+}
+
+// CommandError is returned when a zfs or zpool command fails
+type CommandError struct {
+	Cmd    []string
+	Stderr string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	msg := strings.TrimSpace(e.Stderr)
+	if msg == "" {
+		msg = e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", strings.Join(e.Cmd, " "), msg)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// runner executes zfs commands on a bounded number of workers
+type runner struct {
+	maxQueued     int
+	backpressure  string
+	delay         time.Duration
+	slowOp        time.Duration
+	timeout       time.Duration
+	streamTimeout time.Duration
+	opTimeouts    map[string]time.Duration
+	prefix        []string
+	faults        *injector
+
+	slots chan struct{}
+	// streams are the slots of sends and receives, which run for a long time
+	// and would otherwise keep the slots of short commands taken
+	streams chan struct{}
+
+	mu      sync.Mutex
+	queued  int
+	dequeue chan struct{} // closed and replaced whenever a queued operation leaves the queue
+	// unavailable is why the last zfs command could not run, empty while zfs works
+	unavailable string
+	// suspended are the pools zpool reports as suspended
+	suspended map[string]bool
+}
+
+func newRunner(cfg *Config) (*runner, error) {
+	switch cfg.Backpressure {
+	case "":
+		cfg.Backpressure = BackpressureReject
+	case BackpressureReject, BackpressureDelay:
+	default:
+		return nil, fmt.Errorf("invalid backpressure mode %q", cfg.Backpressure)
+	}
+	r := &runner{
+		maxQueued:     cfg.MaxQueuedOps,
+		backpressure:  cfg.Backpressure,
+		delay:         cfg.BackpressureDelay,
+		slowOp:        cfg.SlowOpThreshold,
+		timeout:       cfg.CommandTimeout,
+		streamTimeout: cfg.StreamTimeout,
+		opTimeouts:    cfg.OpTimeouts,
+		prefix:        cfg.CommandPrefix,
+		dequeue:       make(chan struct{}),
+	}
+	if cfg.MaxConcurrentOps > 0 {
+		r.slots = make(chan struct{}, cfg.MaxConcurrentOps)
+	}
+	if cfg.MaxConcurrentStreams > 0 {
+		r.streams = make(chan struct{}, cfg.MaxConcurrentStreams)
+	}
+	return r, nil
+}
+
+// commandOps are the sorted names of the operations zfs commands are run
+// as, which a timeout can be set for
+var commandOps = []string{
+	"adopt", "archive", "branch", "bulk", "capacity", "compliance", "create", "delegate",
+	"destroy", "dry-run", "exists", "feature", "get", "health", "hold", "identity",
+	"inspect", "list", "migrate", "mirror", "mount", "mountcheck", "path", "quiesce",
+	"reap", "remove", "schedule", "selftest", "set", "snapshot", "startup", "swap",
+	"usage", "verify",
+}
+
+func commandOp(op string) bool {
+	i := sort.SearchStrings(commandOps, op)
+	return i < len(commandOps) && commandOps[i] == op
+}
+
+// ParseOpTimeouts parses op=duration pairs overriding the command timeout of
+// the operation op, 0 disables the timeout of the operation
+func ParseOpTimeouts(pairs []string) (map[string]time.Duration, error) {
+	ts := make(map[string]time.Duration, len(pairs))
+	for _, p := range pairs {
+		i := strings.Index(p, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid operation timeout %q, expected op=duration", p)
+		}
+		if !commandOp(p[:i]) {
+			return nil, fmt.Errorf("unknown operation %q in timeout %q, expected one of %s", p[:i], p, strings.Join(commandOps, ", "))
+		}
+		d, err := time.ParseDuration(p[i+1:])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid operation timeout %q, expected op=duration", p)
+		}
+		ts[p[:i]] = d
+	}
+	return ts, nil
+}
+
+// timeoutFor returns the command timeout of the operation op, def unless it
+// is overridden
+func (r *runner) timeoutFor(op string, def time.Duration) time.Duration {
+	if d, ok := r.opTimeouts[op]; ok {
+		return d
+	}
+	return def
+}
+
+// run executes cmd with args as part of the operation op and returns its stdout
+func (r *runner) run(ctx context.Context, op, cmd string, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := r.exec(ctx, op, nil, &out, r.timeoutFor(op, r.timeout), false, r.prefix, cmd, args)
+	return out.Bytes(), err
+}
+
+// runRemote executes zfs with args on host over the ssh command ssh, limited
+// and timed like run. The command prefix applies on host, where zfs runs,
+// and not to ssh, which keeps using the plugin's own keys.
+func (r *runner) runRemote(ctx context.Context, op string, ssh []string, host string, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := r.exec(ctx, op, nil, &out, r.timeoutFor(op, r.timeout), false, nil, ssh[0], r.remoteArgs(ssh, host, args))
+	return out.Bytes(), err
+}
+
+// remoteArgs returns the arguments of ssh running zfs with args on host
+func (r *runner) remoteArgs(ssh []string, host string, args []string) []string {
+	a := append(append([]string{}, ssh[1:]...), host)
+	return append(append(append(a, r.prefix...), "zfs"), args...)
+}
+
+// stream executes cmd like run but copies its stdout to w. Streams such as
+// zfs send run on their own slots, not those of short commands, and have
+// the stream timeout unless it is overridden for op.
+func (r *runner) stream(ctx context.Context, op string, w io.Writer, cmd string, args ...string) error {
+	return r.exec(ctx, op, nil, w, r.timeoutFor(op, r.streamTimeout), true, r.prefix, cmd, args)
+}
+
+// receive executes cmd reading its stdin from in, such as a zfs receive of a
+// stream. Like stream, it runs on the stream slots with the stream timeout.
+func (r *runner) receive(ctx context.Context, op string, in io.Reader, cmd string, args ...string) error {
+	return r.exec(ctx, op, in, nil, r.timeoutFor(op, r.streamTimeout), true, r.prefix, cmd, args)
+}
+
+func (r *runner) exec(ctx context.Context, op string, stdin io.Reader, stdout io.Writer, timeout time.Duration, stream bool, prefix []string, cmd string, args []string) error {
+	if cmd == "zfs" {
+		if pool := r.suspendedPool(args); pool != "" {
+			return fmt.Errorf("%w: %s, clear it with zpool clear once its devices are back", ErrPoolSuspended, pool)
+		}
+	}
+	start := time.Now()
+	acquire := r.acquire
+	if stream {
+		acquire = r.acquireStream
+	}
+	release, err := acquire(ctx, op)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	zfsCmd := cmd == "zfs" || cmd == "zpool"
+	if zfsCmd {
+		if err := r.faults.before(ctx, cmd, args); err != nil {
+			return err
+		}
+	}
+	var stderr bytes.Buffer
+	argv := prefixed(prefix, cmd, args)
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	// errors are recognized by their message, which must not be translated
+	c.Env = zfsout.CLocale(os.Environ())
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = &stderr
+	execStart := time.Now()
+	err = c.Run()
+	r.logSlow(op, start, execStart, cmd, args)
+	if zfsCmd {
+		reason := unavailableReason(cmd, err, stderr.String())
+		r.setUnavailable(reason)
+		if reason != "" {
+			return fmt.Errorf("%w: %s", ErrUnavailable, reason)
+		}
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w after %s: %s", ErrTimeout, time.Since(execStart), strings.Join(append([]string{cmd}, args...), " "))
+	}
+	if err != nil {
+		return &CommandError{Cmd: append([]string{cmd}, args...), Stderr: stderr.String(), Err: err}
+	}
+	if zfsCmd {
+		return r.faults.after(cmd, args)
+	}
+	return nil
+}
+
+func (r *runner) logSlow(op string, start, execStart time.Time, cmd string, args []string) {
+	d := time.Since(start)
+	if r.slowOp <= 0 || d < r.slowOp {
+		return
+	}
+	log.WithFields(log.Fields{
+		"op":       op,
+		"dataset":  datasetArg(args),
+		"duration": d.String(),
+		"queued":   execStart.Sub(start).String(),
+		"command":  strings.Join(append([]string{cmd}, args...), " "),
+	}).Warn("Slow zfs operation")
+}
+
+// prefixed returns cmd and args run through the command prefix, such as sudo
+func prefixed(prefix []string, cmd string, args []string) []string {
+	return append(append(append([]string{}, prefix...), cmd), args...)
+}
+
+// checkPrefix verifies at startup that zfs and zpool can be run through the
+// command prefix without prompting, so a misconfigured wrapper fails early
+func (r *runner) checkPrefix(ctx context.Context, pool string) error {
+	if len(r.prefix) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(r.prefix[0]); err != nil {
+		return fmt.Errorf("invalid command prefix %q: %w", strings.Join(r.prefix, " "), err)
+	}
+	if _, err := r.run(ctx, "startup", "zpool", "list", "-H", "-o", "name", pool); err != nil {
+		return fmt.Errorf("command prefix %q can not run zpool: %w", strings.Join(r.prefix, " "), err)
+	}
+	if _, err := r.run(ctx, "startup", "zfs", "list", "-H", "-o", "name", "-d", "0", pool); err != nil {
+		return fmt.Errorf("command prefix %q can not run zfs: %w", strings.Join(r.prefix, " "), err)
+	}
+	return nil
+}
+
+// unavailableReason explains a failure to run cmd at all because the tools
+// or the kernel module are missing, it returns an empty string otherwise
+func unavailableReason(cmd string, err error, stderr string) string {
+	var ee *exec.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &ee):
+		return fmt.Sprintf("%s is not installed", ee.Name)
+	case errors.Is(err, os.ErrNotExist), strings.Contains(stderr, "command not found"):
+		return fmt.Sprintf("%s is not installed", cmd)
+	case strings.Contains(stderr, "modules are not loaded"), strings.Contains(stderr, "/dev/zfs"),
+		strings.Contains(stderr, "Failed to initialize the libzfs library"):
+		return "the zfs kernel module is not loaded"
+	}
+	return ""
+}
+
+func (r *runner) setUnavailable(reason string) {
+	r.mu.Lock()
+	prev := r.unavailable
+	r.unavailable = reason
+	r.mu.Unlock()
+	if reason == prev {
+		return
+	}
+	if reason != "" {
+		zfsAvailable.Set(0)
+		log.WithField("reason", reason).Error("zfs is unavailable, answering from cache")
+	} else {
+		zfsAvailable.Set(1)
+		log.Info("zfs is available again")
+	}
+}
+
+// suspendedPool returns the suspended pool of any dataset in args
+func (r *runner) suspendedPool(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.suspended) == 0 {
+		return ""
+	}
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			continue
+		}
+		if pool := strings.FieldsFunc(a, func(c rune) bool { return c == '/' || c == '@' }); len(pool) > 0 && r.suspended[pool[0]] {
+			return pool[0]
+		}
+	}
+	return ""
+}
+
+func (r *runner) setSuspended(pools map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.suspended = pools
+}
+
+// SuspendedPools returns the pools operations currently fail fast on
+func (zd *ZfsDriver) SuspendedPools() []string {
+	zd.runner.mu.Lock()
+	defer zd.runner.mu.Unlock()
+	var pools []string
+	for p := range zd.runner.suspended {
+		pools = append(pools, p)
+	}
+	sort.Strings(pools)
+	return pools
+}
+
+// Unavailable returns why zfs commands can not run, or an empty string
+func (zd *ZfsDriver) Unavailable() string {
+	zd.runner.mu.Lock()
+	defer zd.runner.mu.Unlock()
+	return zd.runner.unavailable
+}
+
+// datasetArg returns the dataset a command operates on, which is its last
+// non-flag argument
+func datasetArg(args []string) string {
+	for i := len(args) - 1; i > 0; i-- {
+		if !strings.HasPrefix(args[i], "-") {
+			return args[i]
+		}
+	}
+	return ""
+}
+
+func (r *runner) acquire(ctx context.Context, op string) (func(), error) {
+	if r.slots == nil {
+		opsInflight.Add(1)
+		return func() { opsInflight.Add(-1) }, nil
+	}
+	if err := r.enqueue(ctx, op); err != nil {
+		return nil, err
+	}
+	select {
+	case r.slots <- struct{}{}:
+	case <-ctx.Done():
+		r.leave()
+		return nil, ctx.Err()
+	}
+	r.leave()
+	opsInflight.Add(1)
+	return func() {
+		<-r.slots
+		opsInflight.Add(-1)
+	}, nil
+}
+
+// acquireStream waits for a stream slot. Streams are started by jobs and
+// background work, which may wait, so they are not subject to backpressure.
+func (r *runner) acquireStream(ctx context.Context, op string) (func(), error) {
+	if r.streams != nil {
+		select {
+		case r.streams <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	streamsInflight.Add(1)
+	return func() {
+		if r.streams != nil {
+			<-r.streams
+		}
+		streamsInflight.Add(-1)
+	}, nil
+}
+
+func (r *runner) enqueue(ctx context.Context, op string) error {
+	var deadline <-chan time.Time
+	for {
+		r.mu.Lock()
+		if r.maxQueued <= 0 || r.queued < r.maxQueued {
+			r.queued++
+			opsQueued.Set(float64(r.queued))
+			r.mu.Unlock()
+			return nil
+		}
+		wait := r.dequeue
+		r.mu.Unlock()
+
+		if r.backpressure != BackpressureDelay {
+			opsRejected.Inc(op)
+			return ErrBusy
+		}
+		if deadline == nil {
+			deadline = time.After(r.delay)
+		}
+		select {
+		case <-wait:
+		case <-deadline:
+			opsRejected.Inc(op)
+			return ErrBusy
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *runner) leave() {
+	r.mu.Lock()
+	r.queued--
+	opsQueued.Set(float64(r.queued))
+	close(r.dequeue)
+	r.dequeue = make(chan struct{})
+	r.mu.Unlock()
+}
@@ -0,0 +1,140 @@
+package zfsdriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Faults configures the injection of storage errors into zfs commands, for
+// testing how orchestration tooling copes with them. Probabilities are
+// between 0 and 1 and apply to every zfs and zpool command.
+type Faults struct {
+	// Delay is the probability of sleeping up to MaxDelay before a command
+	Delay    float64
+	MaxDelay time.Duration
+	// Busy is the probability of failing a command as if the dataset was busy
+	Busy float64
+	// Partial is the probability of running a command and then reporting it failed
+	Partial float64
+}
+
+// errInjected is the cause of every injected failure
+var errInjected = errors.New("injected fault")
+
+var faultsInjected = metrics.NewCounterVec("zfs_plugin_faults_injected_total",
+	"Faults injected into zfs commands by kind", "kind")
+
+func init() {
+	metrics.MustRegister(faultsInjected)
+}
+
+// ParseFaults parses a comma separated fault specification such as
+// delay=0.1:2s,busy=0.05,partial=0.01
+func ParseFaults(spec string) (*Faults, error) {
+	f := &Faults{}
+	for _, kv := range strings.Split(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid fault %q, expected kind=probability", kv)
+		}
+		kind, v := kv[:i], kv[i+1:]
+		if kind == "delay" {
+			j := strings.Index(v, ":")
+			if j < 0 {
+				return nil, fmt.Errorf("invalid delay fault %q, expected delay=probability:duration", kv)
+			}
+			d, err := time.ParseDuration(v[j+1:])
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid delay duration in fault %q", kv)
+			}
+			f.MaxDelay, v = d, v[:j]
+		}
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("invalid probability in fault %q, expected a number between 0 and 1", kv)
+		}
+		switch kind {
+		case "delay":
+			f.Delay = p
+		case "busy":
+			f.Busy = p
+		case "partial":
+			f.Partial = p
+		default:
+			return nil, fmt.Errorf("unknown fault %q, expected delay, busy or partial", kind)
+		}
+	}
+	return f, nil
+}
+
+// injector decides which faults hit a command
+type injector struct {
+	faults Faults
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newInjector(f *Faults) *injector {
+	if f == nil {
+		return nil
+	}
+	log.WithField("faults", *f).Warn("Fault injection is enabled, zfs commands will fail at random")
+	return &injector{faults: *f, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (in *injector) roll(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.rnd.Float64() < p
+}
+
+// before runs ahead of a command, it may delay it or fail it without running it
+func (in *injector) before(ctx context.Context, cmd string, args []string) error {
+	if in == nil {
+		return nil
+	}
+	if in.roll(in.faults.Delay) {
+		in.mu.Lock()
+		d := time.Duration(in.rnd.Int63n(int64(in.faults.MaxDelay)))
+		in.mu.Unlock()
+		faultsInjected.Inc("delay")
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if in.roll(in.faults.Busy) {
+		faultsInjected.Inc("busy")
+		return &CommandError{Cmd: append([]string{cmd}, args...),
+			Stderr: fmt.Sprintf("cannot open '%s': dataset is busy", datasetArg(args)), Err: errInjected}
+	}
+	return nil
+}
+
+// after runs once a command succeeded, it may report it failed anyway
+func (in *injector) after(cmd string, args []string) error {
+	if in == nil || !in.roll(in.faults.Partial) {
+		return nil
+	}
+	faultsInjected.Inc("partial")
+	return &CommandError{Cmd: append([]string{cmd}, args...),
+		Stderr: "connection to the zfs kernel module lost after the command ran", Err: errInjected}
+}
@@ -0,0 +1,248 @@
+package zfsdriver
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	volumeUsageBucket = "usage-volumes"
+	poolUsageBucket   = "usage-pools"
+)
+
+// usageInterval is how often the usage of volumes and pools is sampled
+const usageInterval = time.Hour
+
+// forecastWindow is the history the growth rate is fitted to
+const forecastWindow = week
+
+// usageRetention keeps hourly samples for two days and daily ones for a month,
+// bounding the history to about 80 samples per volume
+var usageRetention = []retention{
+	{Within: 2 * day, Every: time.Hour},
+	{Within: 30 * day, Every: day},
+}
+
+var daysUntilFull = metrics.NewGaugeVec("zfs_plugin_volume_days_until_full",
+	"Forecast days until a growing volume reaches its quota or the pool is full.", "volume")
+
+var poolDaysUntilFull = metrics.NewGaugeVec("zfs_plugin_pool_days_until_full",
+	"Forecast days until a growing pool is full.", "pool")
+
+func init() {
+	metrics.MustRegister(daysUntilFull, poolDaysUntilFull)
+}
+
+// usageSample is the space used and still available at one time
+type usageSample struct {
+	Time      time.Time `json:"t"`
+	Used      uint64    `json:"u"`
+	Available uint64    `json:"a"`
+}
+
+// Forecast is the growth of a volume or pool fitted to its usage history
+type Forecast struct {
+	Name      string `json:"name"`
+	Used      uint64 `json:"used"`
+	Available uint64 `json:"available"`
+	// GrowthPerDay is the fitted growth in bytes per day, negative when shrinking
+	GrowthPerDay float64 `json:"growth_per_day"`
+	// DaysUntilFull is when the available space runs out at the current
+	// growth, absent if the usage is not growing or the history is too short
+	DaysUntilFull *float64 `json:"days_until_full,omitempty"`
+	Samples       int      `json:"samples"`
+}
+
+// CapacityForecast is the forecast of every volume and pool with a usage history
+type CapacityForecast struct {
+	Volumes []Forecast `json:"volumes"`
+	Pools   []Forecast `json:"pools"`
+}
+
+// Forecast returns the growth forecasts from the recorded usage history
+func (zd *ZfsDriver) Forecast() (*CapacityForecast, error) {
+	vs, err := forecasts(zd.db, volumeUsageBucket, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	ps, err := forecasts(zd.db, poolUsageBucket, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &CapacityForecast{Volumes: vs, Pools: ps}, nil
+}
+
+func forecasts(db *state.DB, bucket string, now time.Time) ([]Forecast, error) {
+	fs := []Forecast{}
+	for _, k := range db.Keys(bucket) {
+		var h []usageSample
+		if _, err := db.Get(bucket, k, &h); err != nil {
+			return nil, err
+		}
+		if len(h) > 0 {
+			fs = append(fs, forecast(k, h, now))
+		}
+	}
+	return fs, nil
+}
+
+// forecast fits a line to the samples within forecastWindow by least squares.
+// At least two samples an hour apart are needed for a growth rate.
+func forecast(name string, h []usageSample, now time.Time) Forecast {
+	last := h[len(h)-1]
+	f := Forecast{Name: name, Used: last.Used, Available: last.Available, Samples: len(h)}
+	var xs, ys []float64
+	var first time.Time
+	for _, s := range h {
+		if now.Sub(s.Time) > forecastWindow {
+			continue
+		}
+		if first.IsZero() {
+			first = s.Time
+		}
+		xs = append(xs, s.Time.Sub(first).Hours()/24)
+		ys = append(ys, float64(s.Used))
+	}
+	if len(xs) < 2 || last.Time.Sub(first) < time.Hour {
+		return f
+	}
+	var mx, my float64
+	for i := range xs {
+		mx += xs[i]
+		my += ys[i]
+	}
+	mx /= float64(len(xs))
+	my /= float64(len(ys))
+	var num, den float64
+	for i := range xs {
+		num += (xs[i] - mx) * (ys[i] - my)
+		den += (xs[i] - mx) * (xs[i] - mx)
+	}
+	f.GrowthPerDay = num / den
+	if f.GrowthPerDay > 0 {
+		d := float64(last.Available) / f.GrowthPerDay
+		f.DaysUntilFull = &d
+	}
+	return f
+}
+
+// recordUsage appends a usage sample of every volume and pool to its history,
+// thins the histories and updates the forecast metrics
+func (zd *ZfsDriver) recordUsage(ctx context.Context, now time.Time) {
+	vols, err := zd.volumeUsage(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to sample volume usage")
+		return
+	}
+	caps, err := zd.PoolCapacities(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to sample pool usage")
+		return
+	}
+	pools := make(map[string]usageSample, len(caps))
+	for p, c := range caps {
+		pools[p] = usageSample{Used: c.Size - c.Free, Available: c.Free}
+	}
+	err = zd.db.Update(func(tx *state.Tx) error {
+		if err := appendUsage(tx, volumeUsageBucket, vols, now); err != nil {
+			return err
+		}
+		return appendUsage(tx, poolUsageBucket, pools, now)
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to record usage history")
+		return
+	}
+
+	fc, err := zd.Forecast()
+	if err != nil {
+		log.WithError(err).Error("Failed to forecast usage")
+		return
+	}
+	daysUntilFull.Reset()
+	for _, f := range fc.Volumes {
+		if f.DaysUntilFull != nil {
+			daysUntilFull.Set(*f.DaysUntilFull, f.Name)
+		}
+	}
+	poolDaysUntilFull.Reset()
+	for _, f := range fc.Pools {
+		if f.DaysUntilFull != nil {
+			poolDaysUntilFull.Set(*f.DaysUntilFull, f.Name)
+		}
+	}
+}
+
+// appendUsage adds the samples to the histories in bucket and drops the
+// histories of names without a sample, such as removed volumes
+func appendUsage(tx *state.Tx, bucket string, samples map[string]usageSample, now time.Time) error {
+	for _, k := range tx.Keys(bucket) {
+		if _, ok := samples[k]; !ok {
+			tx.Delete(bucket, k)
+		}
+	}
+	for k, s := range samples {
+		var h []usageSample
+		if _, err := tx.Get(bucket, k, &h); err != nil {
+			return err
+		}
+		s.Time = now
+		h = thinUsage(append(h, s), now)
+		if err := tx.Put(bucket, k, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// thinUsage keeps the oldest sample of every usageRetention window
+func thinUsage(h []usageSample, now time.Time) []usageSample {
+	sort.Slice(h, func(i, j int) bool { return h[i].Time.Before(h[j].Time) })
+	kept := make([]bool, len(h))
+	for _, r := range usageRetention {
+		windows := make(map[int64]bool)
+		for i, s := range h {
+			w := s.Time.UnixNano() / int64(r.Every)
+			if now.Sub(s.Time) <= r.Within && !windows[w] {
+				windows[w] = true
+				kept[i] = true
+			}
+		}
+	}
+	var out []usageSample
+	for i, s := range h {
+		if kept[i] || i == len(h)-1 {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// volumeUsage returns the used and available space of every mapped volume
+func (zd *ZfsDriver) volumeUsage(ctx context.Context) (map[string]usageSample, error) {
+	stats := make(map[string]usageSample)
+	for _, rds := range zd.rds {
+		out, err := zd.runner.run(ctx, "usage", "zfs", "list", "-Hp", "-r", "-t", "filesystem", "-o", "name,used,available", rds)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zfsout.Records(out, 3) {
+			used, _ := zfsout.Uint(f[1])
+			avail, _ := zfsout.Uint(f[2])
+			stats[f[0]] = usageSample{Used: used, Available: avail}
+		}
+	}
+	vols := make(map[string]usageSample)
+	for ds, name := range zd.volumeNames() {
+		if s, ok := stats[ds]; ok {
+			vols[name] = s
+		}
+	}
+	return vols, nil
+}
@@ -0,0 +1,163 @@
+package zfsdriver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthConfig configures the background health monitor
+type HealthConfig struct {
+	Interval time.Duration
+	// QuotaThreshold is the fraction of its quota a volume may use before an alert is raised
+	QuotaThreshold float64
+	// QuotaAction is taken when a volume fills its quota, unless the volume
+	// has its own quota-action. An empty action disables it.
+	QuotaAction QuotaAction
+	// MountCheck verifies the mounts of mounted volumes, MountRepair mounts
+	// datasets that are found unmounted again
+	MountCheck  bool
+	MountRepair bool
+}
+
+type healthState struct {
+	mu        sync.Mutex
+	pools     map[string]string
+	overQuota map[string]bool
+	fullQuota map[string]bool
+	// status is the last pool status, refreshed by the monitor
+	status     []PoolStatus
+	statusTime time.Time
+	// fenced are the multihost pools owned by another node, ownerChecked
+	// is when the ownership of each pool was last checked
+	fenced       map[string]*MultihostStatus
+	ownerChecked map[string]time.Time
+	// mountIssues are the inconsistent mounts found by the last mount check
+	mountIssues map[string]string
+}
+
+// MonitorHealth polls pool health and volume quota usage, publishing events
+// when a pool degrades or recovers and when a volume nears its quota, and
+// remediates volumes which fill their quota
+func (zd *ZfsDriver) MonitorHealth(ctx context.Context, cfg HealthConfig) {
+	t := time.NewTicker(cfg.Interval)
+	defer t.Stop()
+	for {
+		zd.checkPools(ctx)
+		zd.checkVdevs(ctx)
+		if cfg.QuotaThreshold > 0 || cfg.QuotaAction.Action != "" {
+			zd.checkQuotas(ctx, cfg)
+		}
+		if cfg.MountCheck {
+			zd.checkMounts(ctx, cfg.MountRepair)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (zd *ZfsDriver) checkPools(ctx context.Context) {
+	out, err := zd.runner.run(ctx, "health", "zpool", append([]string{"list", "-H", "-p", "-o", "name,health"}, zd.Pools()...)...)
+	if err != nil {
+		log.WithError(err).Error("Failed to get pool health")
+		return
+	}
+	hs := &zd.health
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	suspended := make(map[string]bool)
+	defer zd.runner.setSuspended(suspended)
+	for pool, health := range zfsout.Pairs(out) {
+		if health == "SUSPENDED" {
+			suspended[pool] = true
+		}
+		prev, known := hs.pools[pool]
+		hs.pools[pool] = health
+		if known && prev == health {
+			continue
+		}
+		if health != "ONLINE" {
+			log.WithFields(log.Fields{"pool": pool, "health": health}).Error("Pool is not healthy")
+			zd.events.Publish(events.Event{Type: events.PoolDegraded,
+				Details: map[string]string{"pool": pool, "health": health, "previous": prev}})
+		} else if known {
+			log.WithField("pool", pool).Info("Pool recovered")
+			zd.events.Publish(events.Event{Type: events.PoolRecovered,
+				Details: map[string]string{"pool": pool, "health": health, "previous": prev}})
+		}
+	}
+}
+
+func (zd *ZfsDriver) checkQuotas(ctx context.Context, cfg HealthConfig) {
+	zd.health.mu.Lock()
+	prev, prevFull := zd.health.overQuota, zd.health.fullQuota
+	zd.health.mu.Unlock()
+	over, full := make(map[string]bool), make(map[string]bool)
+	names := zd.volumeNames()
+	for _, rds := range zd.rds {
+		out, err := zd.runner.run(ctx, "health", "zfs", "get", "-H", "-p", "-r", "-t", "filesystem",
+			"-o", "name,property,value", "used,quota", rds)
+		if err != nil {
+			log.WithError(err).WithField("dataset", rds).Error("Failed to get quota usage")
+			continue
+		}
+		used := make(map[string]uint64)
+		quota := make(map[string]uint64)
+		for _, f := range zfsout.Records(out, 3) {
+			if f[0] == rds {
+				continue
+			}
+			v, ok := zfsout.Uint(f[2])
+			if !ok {
+				continue
+			}
+			if f[1] == "used" {
+				used[f[0]] = v
+			} else {
+				quota[f[0]] = v
+			}
+		}
+		for ds, q := range quota {
+			if q == 0 {
+				continue
+			}
+			name := ds
+			if n, ok := names[ds]; ok {
+				name = n
+			}
+			if float64(used[ds]) >= quotaFull*float64(q) {
+				a := zd.quotaActionOf(name, cfg.QuotaAction)
+				if a.Action != "" && !prevFull[ds] {
+					zd.remediateQuota(name, ds, used[ds], q, a)
+				}
+				full[ds] = true
+			}
+			if cfg.QuotaThreshold <= 0 || float64(used[ds]) < cfg.QuotaThreshold*float64(q) {
+				continue
+			}
+			over[ds] = true
+			if prev[ds] {
+				continue
+			}
+			log.WithFields(log.Fields{"dataset": ds, "used": used[ds], "quota": q}).Warn("Volume is running out of quota")
+			zd.events.Publish(events.Event{Type: events.VolumeQuotaExhausted, Volume: name, Dataset: ds,
+				Details: map[string]string{
+					"used":    strconv.FormatUint(used[ds], 10),
+					"quota":   strconv.FormatUint(q, 10),
+					"percent": fmt.Sprintf("%.1f", 100*float64(used[ds])/float64(q)),
+				}})
+		}
+	}
+	zd.health.mu.Lock()
+	zd.health.overQuota, zd.health.fullQuota = over, full
+	zd.health.mu.Unlock()
+}
@@ -0,0 +1,251 @@
+package zfsdriver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// historyBucket held the histories in the state file before they moved to
+// their own files, it is emptied into them at startup
+const historyBucket = "history"
+
+// historyLimit bounds the events kept per volume, the oldest are dropped
+const historyLimit = 100
+
+// historyInStatus is how many of the latest events docker volume inspect shows
+const historyInStatus = 5
+
+// historyRetention is how long the history of a removed volume is kept, so
+// what happened to it can still be looked up
+const historyRetention = 30 * day
+
+// historyState is where the volume histories are kept, a file per volume
+// in dir. They are not in the state file, which is rewritten whole on every
+// change and replicated to consul.
+type historyState struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func (h *historyState) file(name string) string {
+	return filepath.Join(h.dir, url.PathEscape(name)+".json")
+}
+
+// read returns the history of the volume name, empty if it has none
+func (h *historyState) read(name string) ([]events.Event, error) {
+	if h.dir == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(h.file(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var es []events.Event
+	if err := json.Unmarshal(b, &es); err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+// write replaces the history of the volume name with es, the latest
+// historyLimit of them
+func (h *historyState) write(name string, es []events.Event) error {
+	if len(es) > historyLimit {
+		es = es[len(es)-historyLimit:]
+	}
+	b, err := json.Marshal(es)
+	if err != nil {
+		return err
+	}
+	path := h.file(name)
+	tmp, err := ioutil.TempFile(h.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RecordHistory records the events of every volume in its history until ctx
+// is done. Events published while a history is written are recorded with
+// the next write.
+func (zd *ZfsDriver) RecordHistory(ctx context.Context) {
+	if zd.events == nil || zd.history.dir == "" {
+		return
+	}
+	if err := os.MkdirAll(zd.history.dir, 0700); err != nil {
+		log.WithError(err).Error("Failed to create the volume history directory, history is not recorded")
+		return
+	}
+	zd.migrateHistory()
+	ch, cancel := zd.events.SubscribeDurable()
+	defer cancel()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	zd.pruneHistory(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-prune.C:
+			zd.pruneHistory(now)
+		case e := <-ch:
+			batch := []events.Event{e}
+			for len(ch) > 0 {
+				batch = append(batch, <-ch)
+			}
+			if err := zd.appendHistory(batch); err != nil {
+				log.WithError(err).Error("Failed to record volume history")
+			}
+		}
+	}
+}
+
+// migrateHistory moves the histories kept in the state file by earlier
+// versions to their files
+func (zd *ZfsDriver) migrateHistory() {
+	names := zd.db.Keys(historyBucket)
+	if len(names) == 0 {
+		return
+	}
+	zd.history.mu.Lock()
+	defer zd.history.mu.Unlock()
+	err := zd.db.Update(func(tx *state.Tx) error {
+		for _, v := range names {
+			var h []events.Event
+			if _, err := tx.Get(historyBucket, v, &h); err != nil {
+				return err
+			}
+			if err := zd.history.write(v, h); err != nil {
+				return err
+			}
+			tx.Delete(historyBucket, v)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to move volume histories out of the state file")
+	}
+}
+
+// appendHistory adds the volume events of batch to the histories of their
+// volumes, a swap to the histories of both volumes. A volume created under
+// the name of a removed one starts a new history.
+func (zd *ZfsDriver) appendHistory(batch []events.Event) error {
+	byVolume := make(map[string][]events.Event)
+	reset := make(map[string]bool)
+	for _, e := range batch {
+		if e.Volume == "" {
+			continue
+		}
+		vols := []string{e.Volume}
+		if e.Type == events.VolumeSwap && e.Details["other"] != "" {
+			vols = append(vols, e.Details["other"])
+		}
+		if e.Type == events.VolumeCreate {
+			byVolume[e.Volume], reset[e.Volume] = nil, true
+		}
+		e.Volume = ""
+		for _, v := range vols {
+			byVolume[v] = append(byVolume[v], e)
+		}
+	}
+	zd.history.mu.Lock()
+	defer zd.history.mu.Unlock()
+	for v, es := range byVolume {
+		var h []events.Event
+		if !reset[v] {
+			var err error
+			if h, err = zd.history.read(v); err != nil {
+				return err
+			}
+		}
+		if err := zd.history.write(v, append(h, es...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneHistory drops the histories of volumes removed before historyRetention
+func (zd *ZfsDriver) pruneHistory(now time.Time) {
+	zd.history.mu.Lock()
+	defer zd.history.mu.Unlock()
+	fis, err := ioutil.ReadDir(zd.history.dir)
+	if err != nil {
+		log.WithError(err).Error("Failed to prune volume histories")
+		return
+	}
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		h, err := zd.history.read(name)
+		if err != nil {
+			log.WithError(err).WithField("volume", name).Warn("Failed to read volume history")
+			continue
+		}
+		if len(h) > 0 {
+			last := h[len(h)-1]
+			if last.Type != events.VolumeRemove || now.Sub(last.Time) <= historyRetention {
+				continue
+			}
+		}
+		if err := os.Remove(zd.history.file(name)); err != nil {
+			log.WithError(err).WithField("volume", name).Warn("Failed to drop volume history")
+		}
+	}
+}
+
+// History returns the recorded events of the volume name, the oldest first.
+// The history of a removed volume is kept for a while, so it is returned
+// without checking that the volume exists.
+func (zd *ZfsDriver) History(name string) ([]events.Event, error) {
+	h, err := zd.history.read(name)
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		h = []events.Event{}
+	}
+	return h, nil
+}
+
+// latestHistory returns the historyInStatus latest events of name, the
+// latest first
+func (zd *ZfsDriver) latestHistory(name string) []events.Event {
+	h, err := zd.history.read(name)
+	if err != nil || len(h) == 0 {
+		return nil
+	}
+	latest := make([]events.Event, 0, historyInStatus)
+	for i := len(h) - 1; i >= 0 && len(latest) < historyInStatus; i-- {
+		latest = append(latest, h[i])
+	}
+	return latest
+}
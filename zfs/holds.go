@@ -0,0 +1,185 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// Hold tags the plugin places itself, holds placed through the management
+// API may use any tag. All plugin holds are prefixed with userPropPrefix, so
+// holds of other tools are never released by the plugin.
+const (
+	// HoldReplication keeps the incremental base of a mirror volume
+	HoldReplication = "replication"
+	// HoldLegal is the conventional tag of snapshots under legal retention
+	HoldLegal = "legal"
+)
+
+// Hold is a zfs hold of the plugin on a snapshot of a volume
+type Hold struct {
+	Snapshot string    `json:"snapshot"`
+	Tag      string    `json:"tag"`
+	Created  time.Time `json:"created"`
+}
+
+// holds returns every hold on the snapshots of ds, with their full tags
+func (zd *ZfsDriver) holds(op, ds string) ([]Hold, error) {
+	out, err := zd.zfs(op, "list", "-Hp", "-t", "snapshot", "-d", "1", "-o", "name,userrefs", ds)
+	if err != nil {
+		return nil, err
+	}
+	var held []string
+	for _, f := range zfsout.Records(out, 2) {
+		if n, ok := zfsout.Uint(f[1]); ok && n > 0 {
+			held = append(held, f[0])
+		}
+	}
+	if len(held) == 0 {
+		return nil, nil
+	}
+	out, err = zd.zfs(op, append([]string{"holds", "-Hp"}, held...)...)
+	if err != nil {
+		return nil, err
+	}
+	var hs []Hold
+	for _, f := range zfsout.Records(out, 3) {
+		ts, _ := zfsout.Time(f[2])
+		hs = append(hs, Hold{Snapshot: f[0][strings.Index(f[0], "@")+1:], Tag: f[1], Created: ts})
+	}
+	return hs, nil
+}
+
+// heldSnapshots returns the short names of the snapshots of ds with any hold
+func (zd *ZfsDriver) heldSnapshots(op, ds string) (map[string]bool, error) {
+	hs, err := zd.holds(op, ds)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string]bool, len(hs))
+	for _, h := range hs {
+		held[h.Snapshot] = true
+	}
+	return held, nil
+}
+
+// ListHolds returns the holds of the plugin on the snapshots of a volume
+func (zd *ZfsDriver) ListHolds(volume string) (_ []Hold, err error) {
+	defer observe("hold", &err)
+	ds, err := zd.resolveExisting(volume)
+	if err != nil {
+		return nil, err
+	}
+	hs, err := zd.holds("hold", ds)
+	if err != nil {
+		return nil, err
+	}
+	own := []Hold{}
+	for _, h := range hs {
+		if strings.HasPrefix(h.Tag, userPropPrefix) {
+			h.Tag = strings.TrimPrefix(h.Tag, userPropPrefix)
+			own = append(own, h)
+		}
+	}
+	return own, nil
+}
+
+// HoldSnapshot places a hold with tag on a snapshot of a volume, which keeps
+// the snapshot and its volume from being destroyed until it is released
+func (zd *ZfsDriver) HoldSnapshot(volume, snapshot, tag string) (err error) {
+	defer observe("hold", &err)
+	log.WithFields(log.Fields{"volume": volume, "snapshot": snapshot, "tag": tag}).Debug("HoldSnapshot")
+	ds, err := zd.holdTarget(volume, snapshot, tag)
+	if err != nil {
+		return err
+	}
+	if _, err := zd.zfs("hold", "hold", userPropPrefix+tag, ds+"@"+snapshot); err != nil {
+		if isNotExist(err) {
+			return fmt.Errorf("snapshot %s of volume %s: %w", snapshot, volume, ErrNotFound)
+		}
+		if strings.Contains(err.Error(), "tag already exists") {
+			return policyErrorf("snapshot %s of volume %s is already held with tag %s", snapshot, volume, tag)
+		}
+		return err
+	}
+	return nil
+}
+
+// ReleaseHold removes the hold with tag from a snapshot of a volume
+func (zd *ZfsDriver) ReleaseHold(volume, snapshot, tag string) (err error) {
+	defer observe("hold", &err)
+	log.WithFields(log.Fields{"volume": volume, "snapshot": snapshot, "tag": tag}).Debug("ReleaseHold")
+	ds, err := zd.holdTarget(volume, snapshot, tag)
+	if err != nil {
+		return err
+	}
+	if _, err := zd.zfs("hold", "release", userPropPrefix+tag, ds+"@"+snapshot); err != nil {
+		if isNotExist(err) || strings.Contains(err.Error(), "no such tag") {
+			return fmt.Errorf("hold %s on snapshot %s of volume %s: %w", tag, snapshot, volume, ErrNotFound)
+		}
+		return err
+	}
+	return nil
+}
+
+func (zd *ZfsDriver) holdTarget(volume, snapshot, tag string) (string, error) {
+	if !snapshotName.MatchString(snapshot) {
+		return "", policyErrorf("invalid snapshot name %q", snapshot)
+	}
+	if !snapshotName.MatchString(tag) {
+		return "", policyErrorf("invalid hold tag %q", tag)
+	}
+	ds, err := zd.resolveExisting(volume)
+	if err != nil {
+		return "", err
+	}
+	return ds, zd.requireOwned(ds)
+}
+
+// requireUnheld refuses to destroy targets, the datasets removing the volume
+// name destroys, while any snapshot of them or their descendants is held,
+// other than by the plugin's own replication holds. All are checked before
+// any of them is destroyed.
+func (zd *ZfsDriver) requireUnheld(name string, targets []string) error {
+	out, err := zd.zfs("hold", append([]string{"list", "-Hp", "-r", "-t", "snapshot", "-o", "name,userrefs"}, targets...)...)
+	if err != nil {
+		return err
+	}
+	var held []string
+	for _, f := range zfsout.Records(out, 2) {
+		if n, ok := zfsout.Uint(f[1]); ok && n > 0 {
+			held = append(held, f[0])
+		}
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	out, err = zd.zfs("hold", append([]string{"holds", "-Hp"}, held...)...)
+	if err != nil {
+		return err
+	}
+	for _, f := range zfsout.Records(out, 3) {
+		if f[1] != userPropPrefix+HoldReplication {
+			return policyErrorf("snapshot %s of volume %s is held with tag %s, release it first", f[0], name, strings.TrimPrefix(f[1], userPropPrefix))
+		}
+	}
+	return nil
+}
+
+// moveHold places the plugin hold tag on snapshot to of ds and releases it
+// from snapshot from, either may be empty
+func (zd *ZfsDriver) moveHold(op, ds, tag, from, to string) {
+	if to != "" {
+		if _, err := zd.zfs(op, "hold", userPropPrefix+tag, ds+"@"+to); err != nil {
+			log.WithError(err).WithField("snapshot", ds+"@"+to).Error("Failed to hold snapshot")
+		}
+	}
+	if from != "" && from != to {
+		if _, err := zd.zfs(op, "release", userPropPrefix+tag, ds+"@"+from); err != nil && !strings.Contains(err.Error(), "no such tag") {
+			log.WithError(err).WithField("snapshot", ds+"@"+from).Error("Failed to release snapshot hold")
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package zfsdriver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// propGUID is the user property holding a random id the plugin sets on the
+// dataset of every mapped volume. It moves with the dataset when it is
+// renamed or sent with its properties outside the plugin, so the mapping can
+// follow it. Values inherited by children do not count.
+const propGUID = userPropPrefix + "guid"
+
+// RenameConflict is a volume whose dataset is gone while several datasets
+// carry its guid, none with its native guid, so the plugin can not tell
+// which one it moved to
+type RenameConflict struct {
+	Volume     string   `json:"volume"`
+	Dataset    string   `json:"dataset"`
+	GUID       string   `json:"guid"`
+	Candidates []string `json:"candidates"`
+}
+
+type identityState struct {
+	mu        sync.Mutex
+	conflicts []RenameConflict
+}
+
+func newGUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// datasetIdentity is the guid user property of a dataset, empty if it has
+// none set locally or received, and its native zfs guid. The native guid
+// survives renames but not a send and receive, the user property survives
+// both but may be copied.
+type datasetIdentity struct {
+	guid, native string
+}
+
+// identify returns the identity of ds, setting a new guid if it has none
+func (zd *ZfsDriver) identify(op, ds string) (datasetIdentity, error) {
+	out, err := zd.zfs(op, "get", "-H", "-p", "-o", "property,value,source", "guid,"+propGUID, ds)
+	if err != nil {
+		return datasetIdentity{}, err
+	}
+	var id datasetIdentity
+	for _, f := range zfsout.Records(out, 3) {
+		id.set(f)
+	}
+	if id.guid == "" {
+		g := newGUID()
+		if _, err := zd.zfs(op, "set", propGUID+"="+g, ds); err != nil {
+			return id, err
+		}
+		id.guid = g
+	}
+	return id, nil
+}
+
+// set records a property,value,source line of zfs get
+func (id *datasetIdentity) set(f []string) {
+	if len(f) != 3 {
+		return
+	}
+	switch {
+	case f[0] == "guid":
+		id.native = f[1]
+	case f[0] == propGUID && (f[2] == "local" || f[2] == "received"):
+		id.guid = f[1]
+	}
+}
+
+// datasetIdentities returns the identity of every dataset below the root
+// datasets
+func (zd *ZfsDriver) datasetIdentities(op string) (map[string]datasetIdentity, error) {
+	ids := make(map[string]datasetIdentity)
+	for _, rds := range zd.rds {
+		out, err := zd.zfs(op, "get", "-H", "-p", "-r", "-t", "filesystem", "-o", "name,property,value,source", "guid,"+propGUID, rds)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zfsout.Records(out, 4) {
+			if f[0] == rds {
+				continue
+			}
+			id := ids[f[0]]
+			id.set(f[1:])
+			ids[f[0]] = id
+		}
+	}
+	return ids, nil
+}
+
+// movedTo returns the unmapped datasets the dataset of m may have moved to:
+// the one with its native guid if there is one, otherwise those carrying
+// its guid
+func movedTo(ids map[string]datasetIdentity, names map[string]string, m *mapping) []string {
+	var cands []string
+	for _, native := range []bool{true, false} {
+		for ds, id := range ids {
+			if _, mapped := names[ds]; mapped {
+				continue
+			}
+			if (native && m.ZfsGUID != "" && id.native == m.ZfsGUID) || (!native && m.GUID != "" && id.guid == m.GUID) {
+				cands = append(cands, ds)
+			}
+		}
+		if len(cands) > 0 {
+			break
+		}
+	}
+	sort.Strings(cands)
+	return cands
+}
+
+// followRename points the mapping of name from dataset from, which is gone
+// or now a different dataset, to the dataset to it moved to
+func (zd *ZfsDriver) followRename(name, from, to string, id datasetIdentity) bool {
+	err := zd.db.Update(func(tx *state.Tx) error {
+		var m mapping
+		if ok, err := tx.Get(mappingBucket, name, &m); err != nil || !ok || m.Dataset != from {
+			return err
+		}
+		m.Dataset, m.ZfsGUID = to, id.native
+		if id.guid != "" {
+			m.GUID = id.guid
+		}
+		return tx.Put(mappingBucket, name, &m)
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"volume": name, "from": from, "to": to}).Error("Failed to follow renamed dataset")
+		return false
+	}
+	log.WithFields(log.Fields{"volume": name, "from": from, "to": to}).Warn("Dataset of volume was moved outside the plugin, following it")
+	if err := zd.register(name, to); err != nil {
+		log.WithError(err).WithField("volume", name).Error("Failed to update the registry after following a rename")
+	}
+	zd.events.Publish(events.Event{Type: events.VolumeRename, Volume: name, Dataset: to, Details: map[string]string{"from": from}})
+	return true
+}
+
+// reconcileIdentities sets a guid on the datasets of mapped volumes which
+// have none and records the guids in their mapping. A volume whose dataset
+// is gone, or whose dataset name now holds a dataset with another native
+// guid while its own is found elsewhere, follows the dataset it moved to.
+// If several datasets carry its guid the conflict is reported until it is
+// resolved by hand. A dataset name holding a dataset with a new native guid,
+// such as one restored by a receive, keeps its volume.
+func (zd *ZfsDriver) reconcileIdentities() {
+	ids, err := zd.datasetIdentities("identity")
+	if err != nil {
+		log.WithError(err).Error("Failed to list dataset guids")
+		return
+	}
+	names := zd.volumeNames()
+	conflicts := []RenameConflict{}
+	for _, name := range zd.db.Keys(mappingBucket) {
+		m, ok, err := zd.getMapping(name)
+		if !ok || err != nil || m.replica() || m.archived() || m.receiving() {
+			continue
+		}
+		if _, below := zd.rootOf(m.Dataset); !below {
+			continue
+		}
+		id, exists := ids[m.Dataset]
+		if !exists || (m.ZfsGUID != "" && id.native != m.ZfsGUID) {
+			moved := m
+			if exists {
+				moved = &mapping{ZfsGUID: m.ZfsGUID}
+			}
+			cands := movedTo(ids, names, moved)
+			switch {
+			case len(cands) == 1:
+				if zd.followRename(name, m.Dataset, cands[0], ids[cands[0]]) {
+					delete(names, m.Dataset)
+					names[cands[0]] = name
+				}
+				continue
+			case len(cands) > 1:
+				conflicts = append(conflicts, RenameConflict{Volume: name, Dataset: m.Dataset, GUID: m.GUID, Candidates: cands})
+				continue
+			case !exists:
+				continue
+			}
+		}
+		if id.guid == "" {
+			if id, err = zd.identify("identity", m.Dataset); err != nil {
+				log.WithError(err).WithField("dataset", m.Dataset).Error("Failed to set dataset guid")
+				continue
+			}
+		}
+		if id.guid != m.GUID || id.native != m.ZfsGUID {
+			zd.recordIdentity(name, m.Dataset, id)
+		}
+	}
+	for _, c := range conflicts {
+		log.WithFields(log.Fields{"volume": c.Volume, "dataset": c.Dataset, "candidates": c.Candidates}).Error("Dataset of volume is gone and several datasets carry its guid")
+	}
+	zd.identity.mu.Lock()
+	zd.identity.conflicts = conflicts
+	zd.identity.mu.Unlock()
+}
+
+// recordIdentity records the guids of ds in the mapping of name if it still
+// maps to ds
+func (zd *ZfsDriver) recordIdentity(name, ds string, id datasetIdentity) {
+	err := zd.db.Update(func(tx *state.Tx) error {
+		var m mapping
+		if ok, err := tx.Get(mappingBucket, name, &m); err != nil || !ok || m.Dataset != ds {
+			return err
+		}
+		m.GUID, m.ZfsGUID = id.guid, id.native
+		return tx.Put(mappingBucket, name, &m)
+	})
+	if err != nil {
+		log.WithError(err).WithField("volume", name).Error("Failed to record dataset guid")
+	}
+}
+
+// relocate looks for the dataset the vanished dataset of volume name moved
+// to and follows it, it returns the new dataset
+func (zd *ZfsDriver) relocate(name string) (string, bool) {
+	m, ok, err := zd.getMapping(name)
+	if !ok || err != nil || (m.GUID == "" && m.ZfsGUID == "") || m.replica() || m.archived() {
+		return "", false
+	}
+	ids, err := zd.datasetIdentities("identity")
+	if err != nil {
+		return "", false
+	}
+	if _, exists := ids[m.Dataset]; exists {
+		return "", false
+	}
+	cands := movedTo(ids, zd.volumeNames(), m)
+	if len(cands) != 1 || !zd.followRename(name, m.Dataset, cands[0], ids[cands[0]]) {
+		return "", false
+	}
+	return cands[0], true
+}
+
+// RenameConflicts returns the volumes whose dataset vanished with several
+// datasets carrying its guid, as of the last reconciliation
+func (zd *ZfsDriver) RenameConflicts() []RenameConflict {
+	zd.identity.mu.Lock()
+	defer zd.identity.mu.Unlock()
+	return zd.identity.conflicts
+}
@@ -0,0 +1,54 @@
+package zfsdriver
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ImportPools imports the pools of datasets which are not imported yet, for
+// taking over shared disk pools on failover. It runs before the driver
+// exists, so it does not go through the command runner, but it uses the same
+// command prefix. With force the pools are imported even if they were last
+// imported by another host, as a crashed leader leaves them. That is only
+// safe while a lease keeps the other host from using them, multihost pools
+// still refuse the import while their mmp shows them in use.
+func ImportPools(ctx context.Context, datasets, prefix []string, force bool) error {
+	seen := make(map[string]bool)
+	for _, ds := range datasets {
+		pool := strings.SplitN(ds, "/", 2)[0]
+		if seen[pool] {
+			continue
+		}
+		seen[pool] = true
+		list := prefixed(prefix, "zpool", []string{"list", "-H", "-o", "name", pool})
+		if exec.CommandContext(ctx, list[0], list[1:]...).Run() == nil {
+			continue
+		}
+		log.WithField("pool", pool).Info("Importing pool")
+		args := []string{"import", pool}
+		if force {
+			args = []string{"import", "-f", pool}
+		}
+		imp := prefixed(prefix, "zpool", args)
+		if out, err := exec.CommandContext(ctx, imp[0], imp[1:]...).CombinedOutput(); err != nil {
+			return &CommandError{Cmd: append([]string{"zpool"}, args...), Stderr: string(out), Err: err}
+		}
+	}
+	return nil
+}
+
+// ExportPools exports pools once the lease guarding them is lost, so this
+// node stops writing to them before another node imports them
+func ExportPools(ctx context.Context, pools, prefix []string) {
+	for _, pool := range pools {
+		exp := prefixed(prefix, "zpool", []string{"export", pool})
+		if out, err := exec.CommandContext(ctx, exp[0], exp[1:]...).CombinedOutput(); err != nil {
+			log.WithError(err).WithFields(log.Fields{"pool": pool, "stderr": strings.TrimSpace(string(out))}).Error("Failed to export pool after losing the lease")
+			continue
+		}
+		log.WithField("pool", pool).Info("Exported pool after losing the lease")
+	}
+}
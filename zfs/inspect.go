@@ -0,0 +1,212 @@
+package zfsdriver
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// usageProperties are always read by an inspection, they make up the usage
+// of every volume
+var usageProperties = []string{"copies", "used", "logicalused", "referenced", "usedbysnapshots", "available", "quota", "mountpoint"}
+
+// InspectRequest selects the volumes InspectVolumes reports on, those named
+// in Volumes and those matching Selector. If both are empty every volume is
+// reported. Properties limits the zfs properties reported, all by default.
+type InspectRequest struct {
+	Volumes    []string `json:"volumes,omitempty"`
+	Selector   Selector `json:"selector"`
+	Properties []string `json:"properties,omitempty"`
+}
+
+// InspectProperty is a zfs property of an inspected volume and its source
+type InspectProperty struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// VolumeUsage is the space used by a volume. The usable sizes divide
+// available and quota by copies, which every block is stored as.
+type VolumeUsage struct {
+	Copies          uint64 `json:"copies"`
+	Used            uint64 `json:"used"`
+	LogicalUsed     uint64 `json:"logicalused"`
+	Referenced      uint64 `json:"referenced"`
+	UsedBySnapshots uint64 `json:"usedbysnapshots"`
+	Available       uint64 `json:"available"`
+	Quota           uint64 `json:"quota"`
+	UsableAvailable uint64 `json:"usable_available"`
+	UsableQuota     uint64 `json:"usable_quota,omitempty"`
+}
+
+// VolumeMount is where a volume is mounted and by which containers
+type VolumeMount struct {
+	Mountpoint string `json:"mountpoint"`
+	// Issue tells what is wrong with the mount, empty if the dataset is
+	// mounted on its mountpoint
+	Issue      string   `json:"issue,omitempty"`
+	Containers []string `json:"containers"`
+}
+
+// VolumeDetails is what an inspection reports about one volume, Error is set
+// instead if its details could not be read
+type VolumeDetails struct {
+	Volume     string                     `json:"volume"`
+	Dataset    string                     `json:"dataset,omitempty"`
+	Class      string                     `json:"class,omitempty"`
+	Properties map[string]InspectProperty `json:"properties,omitempty"`
+	Usage      *VolumeUsage               `json:"usage,omitempty"`
+	Snapshots  []Snapshot                 `json:"snapshots,omitempty"`
+	Mount      *VolumeMount               `json:"mount,omitempty"`
+	Error      string                     `json:"error,omitempty"`
+}
+
+// InspectReport is the outcome of an inspection, ordered by volume name
+type InspectReport struct {
+	Selected int             `json:"selected"`
+	Volumes  []VolumeDetails `json:"volumes"`
+}
+
+// InspectVolumes reports the properties, usage, snapshots and mount of many
+// volumes at once. Instead of running zfs for every volume like docker
+// volume inspect, it reads the properties and snapshots of everything below
+// each root dataset with one command each and picks out the selected volumes.
+func (zd *ZfsDriver) InspectVolumes(ctx context.Context, req InspectRequest) (_ *InspectReport, err error) {
+	defer observe("inspect", &err)
+	names, err := zd.inspected(req)
+	if err != nil {
+		return nil, err
+	}
+	props := "all"
+	if len(req.Properties) > 0 {
+		for _, p := range req.Properties {
+			if p == "" || strings.Contains(p, ",") {
+				return nil, policyErrorf("invalid property %q", p)
+			}
+		}
+		props = strings.Join(append(append([]string{}, usageProperties...), req.Properties...), ",")
+	}
+	got := make(map[string]map[string]zfsout.Property)
+	snaps := make(map[string][]snapshotInfo)
+	for _, rds := range zd.rds {
+		out, err := zd.runner.run(ctx, "inspect", "zfs", "get", "-H", "-p", "-r", "-t", "filesystem",
+			"-o", "name,property,value,source", props, rds)
+		if err != nil {
+			return nil, err
+		}
+		for ds, ps := range zfsout.Properties(out) {
+			got[ds] = ps
+		}
+		out, err = zd.runner.run(ctx, "inspect", "zfs", "list", "-H", "-p", "-r", "-t", "snapshot", "-s", "creation", "-o", "name,creation", rds)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zfsout.Records(out, 2) {
+			if ts, ok := zfsout.Time(f[1]); ok {
+				ds := f[0][:strings.Index(f[0], "@")]
+				snaps[ds] = append(snaps[ds], snapshotInfo{Name: f[0], Created: ts})
+			}
+		}
+	}
+	ms, err := readMountinfo()
+	if err != nil {
+		log.WithError(err).Warn("Failed to read mounts of inspected volumes")
+	}
+
+	rep := &InspectReport{Selected: len(names), Volumes: make([]VolumeDetails, 0, len(names))}
+	for _, name := range names {
+		rep.Volumes = append(rep.Volumes, zd.volumeDetails(name, req.Properties, got, snaps, ms))
+	}
+	return rep, nil
+}
+
+// inspected returns the names of the volumes req selects
+func (zd *ZfsDriver) inspected(req InspectRequest) ([]string, error) {
+	selected := make(map[string]bool)
+	for _, name := range req.Volumes {
+		selected[name] = true
+	}
+	if !req.Selector.empty() {
+		names, err := zd.Select(req.Selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			selected[name] = true
+		}
+	} else if len(req.Volumes) == 0 {
+		for _, name := range zd.db.Keys(mappingBucket) {
+			if m, ok, err := zd.getMapping(name); ok && err == nil && !m.replica() && !m.archived() {
+				selected[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (zd *ZfsDriver) volumeDetails(name string, want []string, got map[string]map[string]zfsout.Property, snaps map[string][]snapshotInfo, ms []mountEntry) VolumeDetails {
+	d := VolumeDetails{Volume: name, Class: zd.classOf(name)}
+	if m, ok, _ := zd.getMapping(name); ok && m.archived() {
+		d.Error = archivedError(name, m.Archive).Error()
+		return d
+	}
+	ds, err := zd.resolve(name)
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Dataset = ds
+	ps, ok := got[ds]
+	if !ok {
+		d.Error = zd.remoteError(name, ErrNotFound).Error()
+		return d
+	}
+
+	d.Properties = make(map[string]InspectProperty)
+	if len(want) == 0 {
+		for k, p := range ps {
+			d.Properties[k] = InspectProperty{Value: p.Value, Source: p.Source}
+		}
+	}
+	for _, k := range want {
+		if p, ok := ps[k]; ok {
+			d.Properties[k] = InspectProperty{Value: p.Value, Source: p.Source}
+		}
+	}
+
+	n := func(k string) uint64 {
+		v, _ := zfsout.Uint(ps[k].Value)
+		return v
+	}
+	u := &VolumeUsage{Copies: n("copies"), Used: n("used"), LogicalUsed: n("logicalused"), Referenced: n("referenced"),
+		UsedBySnapshots: n("usedbysnapshots"), Available: n("available"), Quota: n("quota")}
+	if u.Copies == 0 {
+		u.Copies = 1
+	}
+	u.UsableAvailable = u.Available / u.Copies
+	u.UsableQuota = u.Quota / u.Copies
+	d.Usage = u
+
+	d.Snapshots = make([]Snapshot, 0, len(snaps[ds]))
+	for _, si := range snaps[ds] {
+		d.Snapshots = append(d.Snapshots, Snapshot{Volume: name, Name: si.Name[strings.Index(si.Name, "@")+1:], Dataset: ds, Created: si.Created})
+	}
+
+	mnt := &VolumeMount{Mountpoint: ps["mountpoint"].Value, Containers: zd.mounted(name)}
+	if mnt.Containers == nil {
+		mnt.Containers = []string{}
+	}
+	if ms != nil {
+		mnt.Issue = checkMount(ds, mnt.Mountpoint, ms)
+	}
+	d.Mount = mnt
+	return d
+}
@@ -0,0 +1,27 @@
+package zfsdriver
+
+import (
+	"context"
+	"strings"
+)
+
+// ContainerLister lists the containers of a container engine which reference a volume
+type ContainerLister interface {
+	VolumeContainers(ctx context.Context, volume string) ([]string, error)
+}
+
+// checkUnused fails with a policy error naming the containers which still
+// reference a volume, running or stopped
+func (zd *ZfsDriver) checkUnused(name string) error {
+	if zd.containers == nil {
+		return nil
+	}
+	cs, err := zd.containers.VolumeContainers(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	if len(cs) > 0 {
+		return policyErrorf("volume %s is referenced by containers %s", name, strings.Join(cs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package zfsdriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	poolOps = metrics.NewGaugeVec("zfs_plugin_pool_ops_per_second",
+		"Operations per second on the pool over the last iostat interval", "pool", "direction")
+	poolBandwidth = metrics.NewGaugeVec("zfs_plugin_pool_bandwidth_bytes_per_second",
+		"Bandwidth of the pool over the last iostat interval", "pool", "direction")
+	poolWait = metrics.NewGaugeVec("zfs_plugin_pool_wait_seconds",
+		"Average IO latency of the pool over the last iostat interval", "pool", "direction", "queue")
+	poolSpace = metrics.NewGaugeVec("zfs_plugin_pool_space_bytes",
+		"Allocated and free space of the pool", "pool", "type")
+)
+
+func init() {
+	metrics.MustRegister(poolOps, poolBandwidth, poolWait, poolSpace)
+}
+
+// PoolIostat is a zpool iostat sample for a single pool
+type PoolIostat struct {
+	Pool           string    `json:"pool"`
+	Time           time.Time `json:"time"`
+	Alloc          uint64    `json:"alloc"`
+	Free           uint64    `json:"free"`
+	ReadOps        float64   `json:"read_ops"`
+	WriteOps       float64   `json:"write_ops"`
+	ReadBytes      float64   `json:"read_bytes"`
+	WriteBytes     float64   `json:"write_bytes"`
+	TotalReadWait  float64   `json:"total_read_wait_ns"`
+	TotalWriteWait float64   `json:"total_write_wait_ns"`
+	DiskReadWait   float64   `json:"disk_read_wait_ns"`
+	DiskWriteWait  float64   `json:"disk_write_wait_ns"`
+}
+
+// IostatCollector periodically samples zpool iostat for a set of pools
+type IostatCollector struct {
+	pools    []string
+	interval time.Duration
+	prefix   []string
+
+	mu     sync.RWMutex
+	latest []PoolIostat
+}
+
+// NewIostatCollector returns a collector sampling the pools every interval,
+// running zpool through the command prefix if one is given
+func NewIostatCollector(pools []string, interval time.Duration, prefix []string) *IostatCollector {
+	return &IostatCollector{pools: pools, interval: interval, prefix: prefix}
+}
+
+// Run samples iostat until the context is canceled
+func (ic *IostatCollector) Run(ctx context.Context) {
+	for {
+		stats, err := ic.sample(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to collect zpool iostat")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(ic.interval):
+			}
+			continue
+		}
+		ic.mu.Lock()
+		ic.latest = stats
+		ic.mu.Unlock()
+		updatePoolMetrics(stats)
+	}
+}
+
+// Latest returns the most recent sample for each pool
+func (ic *IostatCollector) Latest() []PoolIostat {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+	return append([]PoolIostat(nil), ic.latest...)
+}
+
+// sample blocks for one interval and returns the stats gathered over it
+func (ic *IostatCollector) sample(ctx context.Context) ([]PoolIostat, error) {
+	secs := int(ic.interval / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	args := append([]string{"iostat", "-H", "-p", "-y", "-l"}, ic.pools...)
+	args = append(args, strconv.Itoa(secs), "1")
+	argv := prefixed(ic.prefix, "zpool", args)
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	c.Env = zfsout.CLocale(os.Environ())
+	out, err := c.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseIostat(out, time.Now())
+}
+
+// parseIostat parses zpool iostat -H -p -l, which prints more latency
+// columns in later OpenZFS versions after the ones read here
+func parseIostat(out []byte, ts time.Time) ([]PoolIostat, error) {
+	rs := zfsout.RecordsAtLeast(out, 11)
+	if len(rs) == 0 && len(zfsout.Lines(out)) > 0 {
+		return nil, fmt.Errorf("unexpected zpool iostat output: %q", out)
+	}
+	stats := make([]PoolIostat, 0, len(rs))
+	for _, f := range rs {
+		st := PoolIostat{Pool: f[0], Time: ts}
+		st.Alloc, _ = zfsout.Uint(f[1])
+		st.Free, _ = zfsout.Uint(f[2])
+		for i, v := range []*float64{
+			&st.ReadOps, &st.WriteOps, &st.ReadBytes, &st.WriteBytes,
+			&st.TotalReadWait, &st.TotalWriteWait, &st.DiskReadWait, &st.DiskWriteWait,
+		} {
+			// zpool prints "-" for latencies without any io in the interval
+			*v, _ = strconv.ParseFloat(f[i+3], 64)
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+func updatePoolMetrics(stats []PoolIostat) {
+	for _, g := range []*metrics.GaugeVec{poolOps, poolBandwidth, poolWait, poolSpace} {
+		g.Reset()
+	}
+	for _, st := range stats {
+		poolOps.Set(st.ReadOps, st.Pool, "read")
+		poolOps.Set(st.WriteOps, st.Pool, "write")
+		poolBandwidth.Set(st.ReadBytes, st.Pool, "read")
+		poolBandwidth.Set(st.WriteBytes, st.Pool, "write")
+		poolWait.Set(st.TotalReadWait/1e9, st.Pool, "read", "total")
+		poolWait.Set(st.TotalWriteWait/1e9, st.Pool, "write", "total")
+		poolWait.Set(st.DiskReadWait/1e9, st.Pool, "read", "disk")
+		poolWait.Set(st.DiskWriteWait/1e9, st.Pool, "write", "disk")
+		poolSpace.Set(float64(st.Alloc), st.Pool, "alloc")
+		poolSpace.Set(float64(st.Free), st.Pool, "free")
+	}
+}
@@ -0,0 +1,37 @@
+package zfsdriver
+
+import (
+	"context"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// jsonOutput records whether zfs list and zpool status print JSON with -j,
+// which OpenZFS 2.3 added. Where they do, it is parsed instead of the text
+// output, which changes between versions.
+type jsonOutput struct {
+	zfs, zpool bool
+}
+
+// detectJSON checks at startup whether zfs and zpool of pool print JSON
+// which parses
+func (zd *ZfsDriver) detectJSON(ctx context.Context, pool string) {
+	out, err := zd.runner.run(ctx, "startup", "zfs", "list", "-j", "-p", "-d", "0", "-o", "name", pool)
+	if err == nil {
+		_, err = zfsout.Datasets(out)
+	}
+	zd.json.zfs = err == nil
+	out, err = zd.runner.run(ctx, "startup", "zpool", "status", "-j", "-p", pool)
+	if err == nil {
+		_, err = zfsout.Pools(out)
+	}
+	zd.json.zpool = err == nil
+	log.WithFields(log.Fields{"zfs": zd.json.zfs, "zpool": zd.json.zpool}).Info("Detected JSON output of zfs and zpool")
+}
+
+// jsonFallback logs that the JSON output of cmd did not parse and its text
+// output is parsed instead
+func jsonFallback(cmd string, err error) {
+	log.WithError(err).WithField("command", cmd).Warn("Failed to parse JSON output, parsing the text output instead")
+}
@@ -0,0 +1,154 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/namecodec"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dataset layouts of compose volumes
+const (
+	// LayoutHierarchical nests project_volume as root/project/volume
+	LayoutHierarchical = "hierarchical"
+	// LayoutFlat keeps project_volume as root/project_volume
+	LayoutFlat = "flat"
+)
+
+// LayoutMove is the result of moving a volume's dataset to another layout
+type LayoutMove struct {
+	Volume string `json:"volume"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Moved  bool   `json:"moved"`
+	Error  string `json:"error,omitempty"`
+}
+
+// naming returns the codec of volume names below root
+func (zd *ZfsDriver) naming(root string) namecodec.Codec {
+	c := zd.codec
+	c.Root = root
+	return c
+}
+
+// rootOf returns the root dataset ds is below
+func (zd *ZfsDriver) rootOf(ds string) (string, bool) {
+	for _, rds := range zd.rds {
+		if strings.HasPrefix(ds, rds+"/") {
+			return rds, true
+		}
+	}
+	return "", false
+}
+
+// layoutTarget returns where ds belongs in layout, below the same root so
+// zfs rename stays within the pool
+func layoutTarget(c namecodec.Codec, ds, layout string) (string, error) {
+	root := c.Root
+	rel := strings.TrimPrefix(ds, root+"/")
+	switch layout {
+	case LayoutHierarchical:
+		if _, ok := c.Volume(ds); ok {
+			return ds, nil
+		}
+		if _, ok := c.Parts(rel); !ok || strings.Contains(rel, "/") {
+			return "", policyErrorf("dataset %s is not a name of several levels", ds)
+		}
+		return c.Dataset(rel), nil
+	case LayoutFlat:
+		if !strings.Contains(rel, "/") {
+			return ds, nil
+		}
+		name, ok := c.Volume(ds)
+		if !ok {
+			return "", policyErrorf("dataset %s is not nested by its name", ds)
+		}
+		return root + "/" + name, nil
+	}
+	return "", policyErrorf("invalid layout %q, expected %s or %s", layout, LayoutHierarchical, LayoutFlat)
+}
+
+// MigrateLayout renames the datasets of unmounted volumes into layout and
+// records their new datasets, the volume names stay the same. With dryRun
+// only the moves are computed. Every volume gets a result, failures do not
+// stop the others.
+func (zd *ZfsDriver) MigrateLayout(names []string, layout string, dryRun bool) []LayoutMove {
+	res := make([]LayoutMove, 0, len(names))
+	for _, name := range names {
+		m := LayoutMove{Volume: name}
+		if err := zd.migrateLayout(&m, layout, dryRun); err != nil {
+			m.Error = err.Error()
+			opErrors.Inc("migrate", ErrorCategory(err))
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func (zd *ZfsDriver) migrateLayout(m *LayoutMove, layout string, dryRun bool) error {
+	ds, err := zd.resolveExisting(m.Volume)
+	if err != nil {
+		return err
+	}
+	m.From = ds
+	root, ok := zd.rootOf(ds)
+	if !ok {
+		return policyErrorf("dataset %s is not below a root dataset of the plugin", ds)
+	}
+	if m.To, err = layoutTarget(zd.naming(root), ds, layout); err != nil || m.To == ds {
+		return err
+	}
+	if err := zd.requireOwned(ds); err != nil {
+		return err
+	}
+	if ids := zd.mounted(m.Volume); len(ids) > 0 {
+		return policyErrorf("volume %s is mounted by %d container(s)", m.Volume, len(ids))
+	}
+	if _, ok := zd.branchDatasets(m.Volume); ok {
+		return policyErrorf("volume %s has branches, delete them first", m.Volume)
+	}
+	if zd.datasetExists(m.To) {
+		return policyErrorf("dataset %s already exists", m.To)
+	}
+	if dryRun {
+		return nil
+	}
+	// unmapped volumes are adopted as they move, their options are read
+	// before the rename while the dataset is still where they were set
+	var adopted map[string]string
+	if _, ok, _ := zd.getMapping(m.Volume); !ok {
+		if adopted, err = zd.adoptedOptions(ds); err != nil {
+			return err
+		}
+	}
+
+	if _, err := zd.zfs("migrate", "rename", "-p", ds, m.To); err != nil {
+		return err
+	}
+	err = zd.db.Update(func(tx *state.Tx) error {
+		mp := mapping{}
+		found, err := tx.Get(mappingBucket, m.Volume, &mp)
+		if err != nil {
+			return err
+		}
+		if !found {
+			mp.Options = adopted
+		}
+		mp.Dataset = m.To
+		return tx.Put(mappingBucket, m.Volume, &mp)
+	})
+	if err != nil {
+		if _, rErr := zd.zfs("migrate", "rename", m.To, ds); rErr != nil {
+			log.WithError(rErr).WithFields(log.Fields{"from": m.To, "to": ds}).Error("Failed to rename dataset back after failing to record it")
+		}
+		return fmt.Errorf("failed to record dataset of volume %s: %w", m.Volume, err)
+	}
+	if err := zd.register(m.Volume, m.To); err != nil {
+		log.WithError(err).WithField("volume", m.Volume).Error("Failed to update the registry after moving a volume")
+	}
+	m.Moved = true
+	log.WithFields(log.Fields{"volume": m.Volume, "from": ds, "to": m.To}).Info("Moved volume to new layout")
+	return nil
+}
@@ -0,0 +1,81 @@
+package zfsdriver
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Locker grants a node exclusive use of a volume across a cluster sharing pools
+type Locker interface {
+	// Lock takes the lock of volume, it returns the node holding it if that is another node
+	Lock(ctx context.Context, volume string) (string, error)
+	Unlock(ctx context.Context, volume string) error
+	// Holder returns the node holding the lock of volume, empty if it is free
+	Holder(ctx context.Context, volume string) (string, error)
+	// Node is the name of this node
+	Node() string
+}
+
+// readOnly returns true if the volume cannot be written, so it need not be
+// locked. Mirrors and replicas are received read only, without the option.
+func (zd *ZfsDriver) readOnly(name string) bool {
+	m, ok, err := zd.getMapping(name)
+	if !ok || err != nil {
+		return false
+	}
+	_, asof := m.Options[OptAsOf]
+	return asof || m.Options["readonly"] == "on" || m.Options[OptMirror] != "" || m.replica()
+}
+
+// lockVolume takes the cluster lock of a volume on its first mount on this node
+func (zd *ZfsDriver) lockVolume(name string) error {
+	if zd.locker == nil || zd.readOnly(name) || len(zd.mounted(name)) > 0 {
+		return nil
+	}
+	holder, err := zd.locker.Lock(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	if holder != "" {
+		return policyErrorf("volume %s is in use on node %s", name, holder)
+	}
+	return nil
+}
+
+// unlockVolume releases the cluster lock of a volume once it is no longer mounted
+func (zd *ZfsDriver) unlockVolume(name string) {
+	if zd.locker == nil || len(zd.mounted(name)) > 0 {
+		return
+	}
+	if err := zd.locker.Unlock(context.Background(), name); err != nil {
+		log.WithError(err).WithField("volume", name).Error("Failed to release volume lock")
+	}
+}
+
+// relock takes the locks of the volumes recorded as mounted, after a restart
+func (zd *ZfsDriver) relock() {
+	if zd.locker == nil {
+		return
+	}
+	for _, name := range zd.db.Keys(mountBucket) {
+		if zd.readOnly(name) {
+			continue
+		}
+		holder, err := zd.locker.Lock(context.Background(), name)
+		if err != nil {
+			log.WithError(err).WithField("volume", name).Error("Failed to lock mounted volume")
+		} else if holder != "" {
+			log.WithFields(log.Fields{"volume": name, "holder": holder}).Error("Mounted volume is locked by another node")
+		}
+	}
+}
+
+// lockStatus describes the cluster lock of a volume for its status
+func (zd *ZfsDriver) lockStatus(name string) map[string]interface{} {
+	holder, err := zd.locker.Holder(context.Background(), name)
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	return map[string]interface{}{"holder": holder, "held": holder != "" && holder == zd.locker.Node()}
+}
@@ -0,0 +1,71 @@
+package zfsdriver
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logSampler deduplicates the debug logs of the read only calls docker polls
+// frequently. Each distinct message is logged at most once per interval, with
+// the number of suppressed repeats attached.
+type logSampler struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*sampled
+}
+
+type sampled struct {
+	last       time.Time
+	suppressed int
+}
+
+const maxSampledKeys = 1024
+
+func newLogSampler(interval time.Duration) *logSampler {
+	return &logSampler{interval: interval, seen: make(map[string]*sampled)}
+}
+
+// debug logs msg on entry unless the same key was logged within the interval
+func (ls *logSampler) debug(key string, entry *log.Entry, msg string) {
+	if ls.interval <= 0 {
+		entry.Debug(msg)
+		return
+	}
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+
+	now := time.Now()
+	ls.mu.Lock()
+	s, ok := ls.seen[key]
+	if ok && now.Sub(s.last) < ls.interval {
+		s.suppressed++
+		ls.mu.Unlock()
+		return
+	}
+	suppressed := 0
+	if ok {
+		suppressed = s.suppressed
+	}
+	if len(ls.seen) >= maxSampledKeys {
+		ls.prune(now)
+	}
+	ls.seen[key] = &sampled{last: now}
+	ls.mu.Unlock()
+
+	if suppressed > 0 {
+		entry = entry.WithField("suppressed", suppressed)
+	}
+	entry.Debug(msg)
+}
+
+func (ls *logSampler) prune(now time.Time) {
+	for k, s := range ls.seen {
+		if now.Sub(s.last) >= ls.interval {
+			delete(ls.seen, k)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package zfsdriver
+
+import (
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+)
+
+const (
+	mappingBucket = "volumes"
+	mountBucket   = "mounts"
+)
+
+// mapping records the dataset backing a volume and the options it was created with
+type mapping struct {
+	Dataset string            `json:"dataset"`
+	Options map[string]string `json:"options,omitempty"`
+	// GUID is the propGUID of the dataset and ZfsGUID its native guid,
+	// which find the dataset after it was moved outside the plugin
+	GUID    string `json:"guid,omitempty"`
+	ZfsGUID string `json:"zfs_guid,omitempty"`
+	// Archive is set once the dataset was sent to a file and destroyed
+	Archive *ArchiveStub `json:"archive,omitempty"`
+	// Delegation is set while the delegated dataset of a volume created with
+	// delegate=true is zoned into a user namespace
+	Delegation *Delegation `json:"delegation,omitempty"`
+	// Receiving is set until the first stream of a mirror volume is received
+	Receiving *mirrorReceive `json:"receiving,omitempty"`
+}
+
+func (zd *ZfsDriver) getMapping(name string) (*mapping, bool, error) {
+	var m mapping
+	ok, err := zd.db.Get(mappingBucket, name, &m)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	return &m, true, nil
+}
+
+// resolve returns the dataset backing the volume name. Volumes without a
+// mapping are named by their fully qualified dataset name. Archived volumes
+// have no dataset until they are restored, mirrors until they are received.
+func (zd *ZfsDriver) resolve(name string) (string, error) {
+	m, ok, err := zd.getMapping(name)
+	if err != nil {
+		return "", err
+	}
+	if m.archived() {
+		return "", archivedError(name, m.Archive)
+	}
+	if m.receiving() {
+		return "", receivingError(name, m)
+	}
+	if ok {
+		return m.Dataset, nil
+	}
+	return name, nil
+}
+
+// volumeNames returns the volume name for every mapped dataset
+func (zd *ZfsDriver) volumeNames() map[string]string {
+	names := make(map[string]string)
+	for _, name := range zd.db.Keys(mappingBucket) {
+		m, ok, err := zd.getMapping(name)
+		if ok && err == nil {
+			names[m.Dataset] = name
+		}
+	}
+	return names
+}
+
+// mounted returns the ids of the containers a volume is mounted by
+func (zd *ZfsDriver) mounted(name string) []string {
+	var ids []string
+	_, _ = zd.db.Get(mountBucket, name, &ids)
+	return ids
+}
+
+func (zd *ZfsDriver) addMount(name, id string) error {
+	return zd.db.Update(func(tx *state.Tx) error {
+		var ids []string
+		if _, err := tx.Get(mountBucket, name, &ids); err != nil {
+			return err
+		}
+		for _, i := range ids {
+			if i == id {
+				return nil
+			}
+		}
+		return tx.Put(mountBucket, name, append(ids, id))
+	})
+}
+
+func (zd *ZfsDriver) removeMount(name, id string) error {
+	return zd.db.Update(func(tx *state.Tx) error {
+		var ids []string
+		if _, err := tx.Get(mountBucket, name, &ids); err != nil {
+			return err
+		}
+		keep := ids[:0]
+		for _, i := range ids {
+			if i != id {
+				keep = append(keep, i)
+			}
+		}
+		if len(keep) == 0 {
+			tx.Delete(mountBucket, name)
+			return nil
+		}
+		return tx.Put(mountBucket, name, keep)
+	})
+}
@@ -0,0 +1,464 @@
+package zfsdriver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/credentials"
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMirrorInterval = 5 * time.Minute
+	minMirrorInterval     = time.Minute
+)
+
+// mirrorSource is host:dataset, restricted to characters which pass through
+// the remote shell of ssh unquoted
+var mirrorSource = regexp.MustCompile(`^([A-Za-z0-9_.@-]+):([A-Za-z0-9_.:/-]+)$`)
+
+var mirrorSynced = metrics.NewGaugeVec("zfs_plugin_mirror_last_sync_timestamp_seconds",
+	"Unix time of the last successful update of a mirror volume", "volume")
+
+func init() {
+	metrics.MustRegister(mirrorSynced)
+}
+
+func parseMirror(v string) (host, dataset string, err error) {
+	m := mirrorSource.FindStringSubmatch(v)
+	if m == nil || strings.HasPrefix(m[1], "-") || strings.HasPrefix(m[2], "-") {
+		return "", "", policyErrorf("invalid %s %q, expected host:dataset", OptMirror, v)
+	}
+	return m[1], m[2], nil
+}
+
+func parseMirrorInterval(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultMirrorInterval, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < minMirrorInterval {
+		return 0, policyErrorf("invalid %s %q, expected a duration of at least %s", OptMirrorInterval, v, minMirrorInterval)
+	}
+	return d, nil
+}
+
+const mirrorStamp = "20060102T150405Z"
+
+// mirrorTag prefixes the snapshots taken for a new mirror dataset ds. It is
+// unique to this host and dataset, so mirrors of the same source elsewhere
+// keep their own incremental base. Existing mirrors keep the tag of their
+// snapshots, even when they were taken over by another host.
+func mirrorTag(ds string) string {
+	host, _ := os.Hostname()
+	sum := sha1.Sum([]byte(host + ":" + ds))
+	return "mirror-" + hex.EncodeToString(sum[:6]) + "-"
+}
+
+// mirrorRemote is the source host of a mirror volume and the ssh command
+// reaching it
+type mirrorRemote struct {
+	host string
+	ssh  []string
+}
+
+// mirrorRemote returns the remote of host, authenticated with the ssh key
+// credential if it is not empty. The arguments of the key are placed right
+// after the command, so --mirror-ssh must be an ssh command.
+func (zd *ZfsDriver) mirrorRemote(host, credential string) (mirrorRemote, error) {
+	r := mirrorRemote{host: host, ssh: zd.mirrorSSH}
+	if credential == "" {
+		return r, nil
+	}
+	if zd.credentials == nil {
+		return r, policyErrorf("credential %s can not be used, no credential store is configured", credential)
+	}
+	args, err := zd.credentials.SSHArgs(credential)
+	if errors.Is(err, credentials.ErrNotFound) {
+		return r, policyErrorf("unknown credential %s", credential)
+	}
+	if err != nil {
+		return r, err
+	}
+	r.ssh = append(append([]string{zd.mirrorSSH[0]}, args...), zd.mirrorSSH[1:]...)
+	return r, nil
+}
+
+// remoteCommand returns zfs with args run on the remote host over ssh
+func (zd *ZfsDriver) remoteCommand(ctx context.Context, r mirrorRemote, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, r.ssh[0], zd.runner.remoteArgs(r.ssh, r.host, args)...)
+}
+
+// remoteZfs runs zfs with args on the remote through the command runner
+func (zd *ZfsDriver) remoteZfs(ctx context.Context, r mirrorRemote, args ...string) ([]byte, error) {
+	return zd.runner.runRemote(ctx, "mirror", r.ssh, r.host, args...)
+}
+
+// mirrorReceive is the first stream of a mirror volume, which is received in
+// the background as it can take hours, while docker waits for a create only
+// briefly
+type mirrorReceive struct {
+	// Properties are set on the dataset by the receive
+	Properties map[string]string `json:"properties,omitempty"`
+	Since      time.Time         `json:"since"`
+	// Error is why the last attempt failed, the scheduler tries again after
+	// the mirror interval
+	Error string `json:"error,omitempty"`
+}
+
+func (m *mapping) receiving() bool {
+	return m != nil && m.Receiving != nil
+}
+
+func receivingError(name string, m *mapping) error {
+	msg := fmt.Sprintf("mirror volume %s is still being received from %s", name, m.Options[OptMirror])
+	if m.Receiving.Error != "" {
+		msg += ", the last attempt failed: " + m.Receiving.Error
+	}
+	return policyErrorf("%s", msg)
+}
+
+func receivingVolume(name string, m *mapping) *volume.Volume {
+	st := map[string]interface{}{"receiving": m.Options[OptMirror]}
+	if m.Receiving.Error != "" {
+		st["receive_error"] = m.Receiving.Error
+	}
+	return &volume.Volume{Name: name, CreatedAt: m.Receiving.Since.Format(time.RFC3339), Status: st}
+}
+
+// receivingVolumes returns the mirror volumes whose first stream is not
+// received yet, which List does not find as they have no dataset
+func (zd *ZfsDriver) receivingVolumes() []*volume.Volume {
+	var vols []*volume.Volume
+	for _, name := range zd.db.Keys(mappingBucket) {
+		if m, ok, err := zd.getMapping(name); ok && err == nil && m.receiving() {
+			vols = append(vols, receivingVolume(name, m))
+		}
+	}
+	return vols
+}
+
+// mirrorState tracks the first streams of mirrors being received, so they
+// are received once at a time by either Create or the scheduler
+type mirrorState struct {
+	mu        sync.Mutex
+	receiving map[string]bool
+}
+
+func (ms *mirrorState) begin(name string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.receiving[name] {
+		return false
+	}
+	if ms.receiving == nil {
+		ms.receiving = make(map[string]bool)
+	}
+	ms.receiving[name] = true
+	return true
+}
+
+func (ms *mirrorState) end(name string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.receiving, name)
+}
+
+func (ms *mirrorState) busy(name string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.receiving[name]
+}
+
+// createMirror records the mirror volume name backed by ds and receives its
+// first stream in the background. Until then the volume is listed, but can
+// not be mounted.
+func (zd *ZfsDriver) createMirror(name, ds string, options, props map[string]string) error {
+	if len(zd.mirrorSSH) == 0 {
+		return policyErrorf("mirror volumes are not enabled, start the plugin with --mirror-ssh")
+	}
+	host, _, err := parseMirror(options[OptMirror])
+	if err != nil {
+		return err
+	}
+	if _, err := zd.mirrorRemote(host, options[OptMirrorCredential]); err != nil {
+		return err
+	}
+	if err := zd.register(name, ds); err != nil {
+		return fmt.Errorf("failed to register volume %s: %w", name, err)
+	}
+	m := &mapping{Dataset: ds, Options: options, Receiving: &mirrorReceive{Properties: props, Since: time.Now()}}
+	if err := zd.db.Put(mappingBucket, name, m); err != nil {
+		zd.deregister(name)
+		return fmt.Errorf("failed to record dataset of volume %s: %w", name, err)
+	}
+	log.WithFields(log.Fields{"volume": name, "source": options[OptMirror]}).Info("Receiving mirror volume in the background")
+	zd.events.Publish(events.Event{Type: events.VolumeCreate, Volume: name, Dataset: ds,
+		Details: map[string]string{"mirror": options[OptMirror]}})
+	go func() {
+		if err := zd.receiveMirror(context.Background(), name); err != nil {
+			log.WithError(err).WithField("volume", name).Error("Failed to receive mirror volume, it is tried again after its interval")
+		}
+	}()
+	return nil
+}
+
+// receiveMirror receives the first stream of the mirror volume name, unless
+// it is received already or being received, and records its dataset
+func (zd *ZfsDriver) receiveMirror(ctx context.Context, name string) error {
+	if !zd.mirrors.begin(name) {
+		return nil
+	}
+	defer zd.mirrors.end(name)
+	m, ok, err := zd.getMapping(name)
+	if err != nil || !ok || !m.receiving() {
+		return err
+	}
+	rErr := zd.syncMirror(ctx, name, m.Dataset, m.Options[OptMirror], m.Options[OptMirrorCredential], m.Receiving.Properties)
+	if rErr == nil {
+		if id, ok := m.Options[OptProject]; ok {
+			rErr = zd.setProject(m.Dataset, id)
+		}
+	}
+	var id datasetIdentity
+	if rErr == nil {
+		var gErr error
+		if id, gErr = zd.identify("create", m.Dataset); gErr != nil {
+			log.WithError(gErr).WithField("dataset", m.Dataset).Warn("Failed to set dataset guid")
+		}
+	}
+	err = zd.db.Update(func(tx *state.Tx) error {
+		var cur mapping
+		if ok, err := tx.Get(mappingBucket, name, &cur); err != nil || !ok || !cur.receiving() {
+			return err
+		}
+		if rErr != nil {
+			cur.Receiving.Error = rErr.Error()
+		} else {
+			cur.Receiving, cur.GUID, cur.ZfsGUID = nil, id.guid, id.native
+		}
+		return tx.Put(mappingBucket, name, &cur)
+	})
+	if rErr != nil {
+		return rErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record received mirror volume %s: %w", name, err)
+	}
+	log.WithFields(log.Fields{"volume": name, "dataset": m.Dataset}).Info("Received mirror volume")
+	return nil
+}
+
+// syncMirror updates the mirror volume name backed by ds from source with an
+// incremental stream from the newest mirror snapshot both sides have, over
+// ssh with the ssh key credential if it is not empty. If ds does not exist
+// yet it is created read only with props by a full stream.
+// The newest local mirror snapshot is held, so it is not destroyed while it
+// is the base of the next update.
+func (zd *ZfsDriver) syncMirror(ctx context.Context, name, ds, source, credential string, props map[string]string) error {
+	if len(zd.mirrorSSH) == 0 {
+		return policyErrorf("mirror volumes are not enabled, start the plugin with --mirror-ssh")
+	}
+	host, src, err := parseMirror(source)
+	if err != nil {
+		return err
+	}
+	r, err := zd.mirrorRemote(host, credential)
+	if err != nil {
+		return err
+	}
+	tag := mirrorTag(ds)
+	var base string
+	if zd.datasetExists(ds) {
+		if base, err = zd.mirrorBase(ds); err != nil {
+			return err
+		}
+		if base == "" {
+			return fmt.Errorf("mirror dataset %s has no snapshot to update from", ds)
+		}
+		tag = base[:len(base)-len(mirrorStamp)]
+	} else if err := zd.createParents(ds); err != nil {
+		return err
+	}
+
+	snap := tag + time.Now().UTC().Format(mirrorStamp)
+	if _, err := zd.remoteZfs(ctx, r, "snapshot", src+"@"+snap); err != nil {
+		return err
+	}
+	send := []string{"send"}
+	if base != "" {
+		send = append(send, "-i", "@"+base)
+	}
+	send = append(send, src+"@"+snap)
+	recv := []string{"receive"}
+	if base == "" {
+		recv = append(recv, "-o", "readonly=on")
+		keys := make([]string, 0, len(props))
+		for k := range props {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			recv = append(recv, "-o", fmt.Sprintf("%s=%s", k, props[k]))
+		}
+	} else {
+		recv = append(recv, "-F")
+	}
+	if err := zd.pipeFromRemote(ctx, r, send, append(recv, ds)); err != nil {
+		if _, dErr := zd.remoteZfs(ctx, r, "destroy", src+"@"+snap); dErr != nil {
+			log.WithError(dErr).WithField("snapshot", r.host+":"+src+"@"+snap).Error("Failed to destroy mirror snapshot")
+		}
+		return fmt.Errorf("failed to update mirror %s from %s: %w", ds, source, err)
+	}
+	zd.moveHold("mirror", ds, HoldReplication, base, snap)
+	zd.pruneMirror(ctx, r, src, ds, tag, snap)
+	mirrorSynced.Set(float64(time.Now().Unix()), name)
+	log.WithFields(log.Fields{"volume": name, "source": source, "snapshot": snap, "incremental": base != ""}).Debug("Updated mirror volume")
+	return nil
+}
+
+// mirrorBase returns the newest mirror snapshot of ds
+func (zd *ZfsDriver) mirrorBase(ds string) (string, error) {
+	snaps, err := zd.listSnapshots("mirror", ds)
+	if err != nil {
+		return "", err
+	}
+	var base string
+	for _, sn := range snaps {
+		if n := sn.Name[strings.Index(sn.Name, "@")+1:]; strings.HasPrefix(n, "mirror-") && len(n) > len(mirrorStamp) {
+			base = n
+		}
+	}
+	return base, nil
+}
+
+// releaseMirror releases the hold on the base of a removed mirror dataset ds
+// and destroys the snapshots it left on its source
+func (zd *ZfsDriver) releaseMirror(ctx context.Context, ds, source, credential string) {
+	base, err := zd.mirrorBase(ds)
+	if err != nil || base == "" {
+		return
+	}
+	zd.moveHold("mirror", ds, HoldReplication, base, "")
+	host, src, err := parseMirror(source)
+	if err != nil || len(zd.mirrorSSH) == 0 {
+		return
+	}
+	r, err := zd.mirrorRemote(host, credential)
+	if err != nil {
+		log.WithError(err).WithField("source", source).Error("Failed to reach mirror source")
+		return
+	}
+	zd.pruneMirror(ctx, r, src, ds, base[:len(base)-len(mirrorStamp)], "")
+}
+
+// pipeFromRemote runs zfs send on the remote and receives its stream
+// locally. The send ends with the receive, which is bounded like the other
+// streams, so it does not take a stream slot of its own.
+func (zd *ZfsDriver) pipeFromRemote(ctx context.Context, r mirrorRemote, send, recv []string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := zd.remoteCommand(ctx, r, send...)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	rErr := zd.runner.receive(ctx, "mirror", out, "zfs", recv...)
+	if rErr != nil {
+		cancel()
+	}
+	sErr := c.Wait()
+	if rErr != nil {
+		return rErr
+	}
+	if sErr != nil {
+		return &CommandError{Cmd: c.Args, Stderr: stderr.String(), Err: sErr}
+	}
+	return nil
+}
+
+// pruneMirror destroys the snapshots with tag of the mirror ds other than
+// keep on both sides, keep may be empty to destroy all of them on the source
+func (zd *ZfsDriver) pruneMirror(ctx context.Context, r mirrorRemote, src, ds, tag, keep string) {
+	out, err := zd.remoteZfs(ctx, r, "list", "-H", "-t", "snapshot", "-d", "1", "-o", "name", src)
+	if err != nil {
+		log.WithError(err).WithField("source", r.host+":"+src).Error("Failed to list mirror snapshots")
+	} else if old := taggedSnapshots(zfsout.Lines(out), tag, keep); len(old) > 0 {
+		if _, err := zd.remoteZfs(ctx, r, "destroy", src+"@"+strings.Join(old, ",")); err != nil {
+			log.WithError(err).WithField("source", r.host+":"+src).Error("Failed to prune mirror snapshots")
+		}
+	}
+	if keep == "" {
+		return
+	}
+	snaps, err := zd.listSnapshots("mirror", ds)
+	if err != nil {
+		log.WithError(err).WithField("dataset", ds).Error("Failed to list mirror snapshots")
+		return
+	}
+	names := make([]string, len(snaps))
+	for i, sn := range snaps {
+		names[i] = sn.Name
+	}
+	if old := taggedSnapshots(names, tag, keep); len(old) > 0 {
+		if _, err := zd.runner.run(ctx, "mirror", "zfs", "destroy", ds+"@"+strings.Join(old, ",")); err != nil {
+			log.WithError(err).WithField("dataset", ds).Error("Failed to prune mirror snapshots")
+		}
+	}
+}
+
+// taggedSnapshots returns the short names of the dataset@name snapshots
+// starting with tag, except keep
+func taggedSnapshots(snaps []string, tag, keep string) []string {
+	var names []string
+	for _, s := range snaps {
+		i := strings.Index(s, "@")
+		if i < 0 {
+			continue
+		}
+		if n := strings.TrimSpace(s[i+1:]); strings.HasPrefix(n, tag) && n != keep {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// removeReceiving forgets the mirror volume name whose first stream is not
+// received yet, it can not be removed while the stream is received
+func (zd *ZfsDriver) removeReceiving(name string, m *mapping) error {
+	if zd.mirrors.busy(name) {
+		return policyErrorf("mirror volume %s is being received from %s, remove it once that finished", name, m.Options[OptMirror])
+	}
+	if zd.datasetExists(m.Dataset) {
+		if err := zd.destroyDataset(m.Dataset); err != nil {
+			return err
+		}
+	}
+	if err := zd.db.Delete(mappingBucket, name); err != nil {
+		return err
+	}
+	zd.deregister(name)
+	zd.events.Publish(events.Event{Type: events.VolumeRemove, Volume: name, Dataset: m.Dataset})
+	return nil
+}
@@ -0,0 +1,149 @@
+package zfsdriver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ownershipMaxAge is how long the ownership of a pool is trusted before a
+// change to it checks again, whether or not the health monitor runs
+const ownershipMaxAge = time.Minute
+
+// MultihostStatus describes multihost protection of a pool
+type MultihostStatus struct {
+	Enabled bool `json:"enabled"`
+	// HostID of this node and PoolHostID and PoolHost of the node which last imported the pool
+	HostID     uint32 `json:"hostid"`
+	PoolHostID uint32 `json:"pool_hostid"`
+	PoolHost   string `json:"pool_host,omitempty"`
+	// Owned is false if another node owns the pool, the plugin then refuses to modify it
+	Owned bool `json:"owned"`
+}
+
+// localHostID returns the hostid zfs uses for multihost protection, 0 if none is set
+func localHostID() uint32 {
+	b, err := ioutil.ReadFile("/etc/hostid")
+	if err != nil || len(b) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b[:4])
+}
+
+// multihost returns the multihost status of pool, nil if multihost is off
+func (zd *ZfsDriver) multihost(ctx context.Context, pool string) (*MultihostStatus, error) {
+	out, err := zd.runner.run(ctx, "health", "zpool", "get", "-H", "-o", "value", "multihost", pool)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(out)) != "on" {
+		return nil, nil
+	}
+	mh := &MultihostStatus{Enabled: true, HostID: localHostID()}
+	out, err = zd.runner.run(ctx, "health", "zdb", "-C", pool)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range strings.Split(string(out), "\n") {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, "hostid: ") && mh.PoolHostID == 0 {
+			id, _ := strconv.ParseUint(strings.TrimPrefix(l, "hostid: "), 10, 32)
+			mh.PoolHostID = uint32(id)
+		}
+		if strings.HasPrefix(l, "hostname: ") && mh.PoolHost == "" {
+			mh.PoolHost = strings.Trim(strings.TrimPrefix(l, "hostname: "), "'")
+		}
+	}
+	// without a hostid multihost cannot tell nodes apart, so nothing is owned
+	mh.Owned = mh.HostID != 0 && mh.HostID == mh.PoolHostID
+	return mh, nil
+}
+
+// updateFences records the multihost pools owned by another node
+func (zd *ZfsDriver) updateFences(pools []PoolStatus) {
+	fenced := make(map[string]*MultihostStatus)
+	for _, p := range pools {
+		if p.Multihost != nil && !p.Multihost.Owned {
+			fenced[p.Name] = p.Multihost
+		}
+	}
+	now := time.Now()
+	zd.health.mu.Lock()
+	defer zd.health.mu.Unlock()
+	for pool, mh := range fenced {
+		if zd.health.fenced[pool] == nil {
+			log.WithFields(log.Fields{"pool": pool, "hostid": mh.HostID, "pool_hostid": mh.PoolHostID, "pool_host": mh.PoolHost}).
+				Error("Multihost pool is owned by another node, refusing to modify it")
+		}
+	}
+	zd.health.fenced = fenced
+	if zd.health.ownerChecked == nil {
+		zd.health.ownerChecked = make(map[string]time.Time)
+	}
+	for _, p := range pools {
+		zd.health.ownerChecked[p.Name] = now
+	}
+}
+
+// checkOwner reads the multihost status of pool now, for a change to it
+// before the health monitor checked it or long after
+func (zd *ZfsDriver) checkOwner(pool string) (*MultihostStatus, error) {
+	mh, err := zd.multihost(context.Background(), pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the owner of pool %s: %w", pool, err)
+	}
+	if mh != nil && mh.Owned {
+		mh = nil
+	}
+	zd.health.mu.Lock()
+	defer zd.health.mu.Unlock()
+	if zd.health.fenced == nil {
+		zd.health.fenced = make(map[string]*MultihostStatus)
+	}
+	if zd.health.ownerChecked == nil {
+		zd.health.ownerChecked = make(map[string]time.Time)
+	}
+	if mh != nil {
+		zd.health.fenced[pool] = mh
+	} else {
+		delete(zd.health.fenced, pool)
+	}
+	zd.health.ownerChecked[pool] = time.Now()
+	return mh, nil
+}
+
+// requireOwned fails with a policy error if the pool of dataset is owned by
+// another node. Every change to a dataset checks it, a pool whose ownership
+// was not checked for ownershipMaxAge is checked first.
+func (zd *ZfsDriver) requireOwned(dataset string) error {
+	pool := strings.SplitN(dataset, "/", 2)[0]
+	zd.health.mu.Lock()
+	mh, checked := zd.health.fenced[pool], zd.health.ownerChecked[pool]
+	zd.health.mu.Unlock()
+	if time.Since(checked) > ownershipMaxAge {
+		var err error
+		if mh, err = zd.checkOwner(pool); err != nil {
+			return err
+		}
+	}
+	if mh == nil {
+		return nil
+	}
+	if mh.HostID == 0 {
+		return policyErrorf("pool %s has multihost enabled but this node has no hostid", pool)
+	}
+	return policyErrorf("pool %s is owned by %s", pool, ownerName(mh))
+}
+
+func ownerName(mh *MultihostStatus) string {
+	if mh.PoolHost != "" {
+		return fmt.Sprintf("%s (hostid %08x)", mh.PoolHost, mh.PoolHostID)
+	}
+	return fmt.Sprintf("hostid %08x", mh.PoolHostID)
+}
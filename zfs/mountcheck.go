@@ -0,0 +1,214 @@
+package zfsdriver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var mountIssues = metrics.NewGaugeVec("zfs_plugin_mount_issues",
+	"Number of mounted volumes whose mountpoint is missing, unmounted or shadowed")
+
+func init() {
+	metrics.MustRegister(mountIssues)
+	mountIssues.Set(0)
+}
+
+// mountEntry is a line of /proc/self/mountinfo
+type mountEntry struct {
+	Dev    uint64
+	Point  string
+	FSType string
+	Source string
+}
+
+// readMountinfo returns the mounts of this mount namespace in mount order
+func readMountinfo() ([]mountEntry, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ms []mountEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		sep := -1
+		for i, v := range f {
+			if v == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(f) < 5 || sep < 0 || len(f) < sep+3 {
+			continue
+		}
+		ms = append(ms, mountEntry{Dev: parseDev(f[2]), Point: unescapeMountinfo(f[4]), FSType: f[sep+1], Source: unescapeMountinfo(f[sep+2])})
+	}
+	return ms, s.Err()
+}
+
+// parseDev returns the device number of a major:minor pair as stat reports
+// it in st_dev
+func parseDev(s string) uint64 {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return 0
+	}
+	major, _ := strconv.ParseUint(s[:i], 10, 32)
+	minor, _ := strconv.ParseUint(s[i+1:], 10, 32)
+	return (minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32
+}
+
+// unescapeMountinfo decodes the octal escapes mountinfo uses for spaces and such
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// checkMount returns a description of what is wrong with the mount of a
+// volume's dataset, or an empty string if it is mounted where it should be
+func checkMount(ds, mp string, ms []mountEntry) string {
+	if _, err := os.Stat(mp); err != nil {
+		return fmt.Sprintf("mountpoint %s is missing", mp)
+	}
+	var top *mountEntry
+	for i := range ms {
+		if ms[i].Point == mp {
+			top = &ms[i]
+		}
+	}
+	if top == nil {
+		return fmt.Sprintf("dataset is not mounted on %s", mp)
+	}
+	if top.FSType != "zfs" || top.Source != ds {
+		return fmt.Sprintf("mountpoint %s is shadowed by %s %s", mp, top.FSType, top.Source)
+	}
+	return ""
+}
+
+// verifyMountpoint checks before a mountpoint is handed to docker that it
+// exists, is the mount of ds and, with writable set, can be written to unless
+// the dataset is read only
+func (zd *ZfsDriver) verifyMountpoint(ds, mp string, writable bool) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(mp, &st); err != nil {
+		return fmt.Errorf("mountpoint %s of dataset %s is not usable: %w", mp, ds, err)
+	}
+	ms, err := readMountinfo()
+	if err != nil {
+		return err
+	}
+	if issue := checkMount(ds, mp, ms); issue != "" {
+		return fmt.Errorf("refusing to mount dataset %s: %s, a failed unmount or mount may have left a bare directory behind", ds, issue)
+	}
+	var dev uint64
+	for _, m := range ms {
+		if m.Point == mp {
+			dev = m.Dev
+		}
+	}
+	if uint64(st.Dev) != dev {
+		return fmt.Errorf("refusing to mount dataset %s: %s is on device %d, not the dataset's device %d", ds, mp, st.Dev, dev)
+	}
+	if !writable {
+		return nil
+	}
+	if ro, err := zd.getProperty("mount", ds, "readonly"); err != nil || ro == "on" {
+		return err
+	}
+	if err := syscall.Access(mp, 2); err != nil {
+		return fmt.Errorf("mountpoint %s of dataset %s is not writable: %w", mp, ds, err)
+	}
+	return nil
+}
+
+// mountIssuesOf verifies that every mounted volume's dataset is mounted on its
+// mountpoint and not shadowed by another mount. With repair set, unmounted
+// datasets are mounted again. It returns nil if the mounts could not be read.
+func (zd *ZfsDriver) mountIssuesOf(ctx context.Context, repair bool) map[string]string {
+	ms, err := readMountinfo()
+	if err != nil {
+		log.WithError(err).Error("Failed to read mountinfo")
+		return nil
+	}
+	issues := make(map[string]string)
+	for _, name := range zd.db.Keys(mountBucket) {
+		if ctx.Err() != nil {
+			return nil
+		}
+		ds, err := zd.resolve(name)
+		if err != nil {
+			continue
+		}
+		mp, err := zd.getMountpoint("mountcheck", ds)
+		if err != nil {
+			issues[name] = err.Error()
+			continue
+		}
+		issue := checkMount(ds, mp, ms)
+		if issue != "" && repair && !strings.Contains(issue, "shadowed") {
+			log.WithFields(log.Fields{"volume": name, "dataset": ds, "issue": issue}).Warn("Remounting volume")
+			if _, err := zd.runner.run(ctx, "mountcheck", "zfs", "mount", ds); err != nil {
+				issue += ", remount failed: " + err.Error()
+			} else if ms, err = readMountinfo(); err == nil {
+				issue = checkMount(ds, mp, ms)
+			}
+		}
+		if issue != "" {
+			issues[name] = issue
+		}
+	}
+	return issues
+}
+
+// checkMounts records the mount issues of mounted volumes for the health
+// endpoint, logging each new one
+func (zd *ZfsDriver) checkMounts(ctx context.Context, repair bool) {
+	issues := zd.mountIssuesOf(ctx, repair)
+	if issues == nil {
+		return
+	}
+	zd.health.mu.Lock()
+	prev := zd.health.mountIssues
+	zd.health.mountIssues = issues
+	zd.health.mu.Unlock()
+	mountIssues.Set(float64(len(issues)))
+	for name, issue := range issues {
+		if prev[name] != issue {
+			log.WithFields(log.Fields{"volume": name, "issue": issue}).Error("Volume mount is inconsistent")
+		}
+	}
+	for name := range prev {
+		if _, ok := issues[name]; !ok {
+			log.WithField("volume", name).Info("Volume mount is consistent again")
+		}
+	}
+}
+
+// MountIssues returns the problems found by the last mount check by volume
+func (zd *ZfsDriver) MountIssues() map[string]string {
+	zd.health.mu.Lock()
+	defer zd.health.mu.Unlock()
+	return zd.health.mountIssues
+}
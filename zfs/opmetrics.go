@@ -0,0 +1,52 @@
+package zfsdriver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+)
+
+var (
+	volumeOps = metrics.NewCounterVec("zfs_plugin_volume_operations_total",
+		"Docker volume operations by operation, compose project, pool and result", "op", "project", "pool", "result")
+	volumeOpSeconds = metrics.NewCounterVec("zfs_plugin_volume_operation_seconds_total",
+		"Time spent in docker volume operations by operation, compose project and pool", "op", "project", "pool")
+)
+
+func init() {
+	metrics.MustRegister(volumeOps, volumeOpSeconds)
+}
+
+// observeVolume records an operation on the volume name started at start
+// with its compose project and pool, like observe it counts failures by
+// category. The project is the first level of the name, empty for names
+// with a single level.
+func (zd *ZfsDriver) observeVolume(op, name string, start time.Time, err *error) {
+	observe(op, err)
+	project := ""
+	if parts, ok := zd.codec.Parts(name); ok {
+		project = parts[0]
+	}
+	pool := zd.poolOf(name)
+	result := "ok"
+	if *err != nil {
+		result = ErrorCategory(*err)
+	}
+	volumeOps.Inc(op, project, pool, result)
+	volumeOpSeconds.Add(time.Since(start).Seconds(), op, project, pool)
+}
+
+// poolOf returns the pool of the volume name. Names without a mapping are
+// either a dataset in the legacy naming or a volume that is not created yet
+// or already removed, which lives in the pool of the first root dataset.
+func (zd *ZfsDriver) poolOf(name string) string {
+	ds := name
+	if m, ok, err := zd.getMapping(name); ok && err == nil {
+		ds = m.Dataset
+	}
+	if !strings.Contains(ds, "/") {
+		ds = zd.rds[0]
+	}
+	return strings.SplitN(ds, "/", 2)[0]
+}
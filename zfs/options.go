@@ -0,0 +1,197 @@
+package zfsdriver
+
+import "strings"
+
+// Options consumed by the plugin itself, all other options passed to
+// docker volume create are set as zfs properties on the dataset
+const (
+	// OptFrom names an existing volume the new volume is cloned from
+	OptFrom = "from"
+	// OptSnapshot names the snapshot of the from volume to clone, a new
+	// snapshot is taken if it is not given
+	OptSnapshot = "snapshot"
+	// OptAsOf creates a read only view of the from volume as of an RFC3339 time
+	OptAsOf = "asof"
+	// OptCDP enables continuous data protection snapshots at the given interval
+	OptCDP = "cdp"
+	// OptProject sets the default project id of the volume's mountpoint
+	OptProject = "project"
+	// OptProfile selects a built in set of defaults
+	OptProfile = "profile"
+	// OptClass is the storage class of the volume, a label of its intent such
+	// as fast or archive. It defaults to the profile.
+	OptClass = "class"
+	// OptTTL removes the volume once it is older than the given duration,
+	// had no IO for as long and is unused
+	OptTTL = "ttl"
+	// OptQuotaAction is what the health monitor does when the volume fills
+	// its quota, overriding --quota-action
+	OptQuotaAction = "quota-action"
+	// OptForceUnsafe accepts settings which risk losing data, such as sync=disabled
+	OptForceUnsafe = "force-unsafe"
+	// OptMirror makes the volume a read only mirror of a dataset on another
+	// host, given as host:dataset
+	OptMirror = "mirror"
+	// OptMirrorInterval is how often a mirror volume is updated from its source
+	OptMirrorInterval = "mirror-interval"
+	// OptMirrorCredential names the ssh key credential used to reach the
+	// source host of a mirror volume
+	OptMirrorCredential = "mirror-credential"
+	// OptPrewarm reads the volume into the cache when it is first mounted
+	OptPrewarm = "prewarm"
+	// OptBackup selects the backup tier of the volume: none, daily or hourly
+	OptBackup = "backup"
+	// OptDelegate creates a zoned child dataset which can be delegated to the
+	// user namespace of a container, which then manages the datasets below it
+	OptDelegate = "delegate"
+	// OptRemoveBackup overrides whether removing the volume first sends it to
+	// the archive directory, which --backup-on-remove enables for all volumes
+	OptRemoveBackup = "remove-backup"
+	// OptLabelPrefix prefixes the labels of a volume, label.<key>=<value>,
+	// which bulk operations select volumes by
+	OptLabelPrefix = "label."
+)
+
+var pluginOptions = map[string]bool{
+	OptFrom:             true,
+	OptSnapshot:         true,
+	OptAsOf:             true,
+	OptCDP:              true,
+	OptProject:          true,
+	OptProfile:          true,
+	OptClass:            true,
+	OptTTL:              true,
+	OptQuotaAction:      true,
+	OptForceUnsafe:      true,
+	OptMirror:           true,
+	OptMirrorInterval:   true,
+	OptMirrorCredential: true,
+	OptPrewarm:          true,
+	OptBackup:           true,
+	OptDelegate:         true,
+	OptRemoveBackup:     true,
+	optReplica:          true,
+}
+
+// isPluginOption reports whether k is consumed by the plugin rather than set as a zfs property
+func isPluginOption(k string) bool {
+	return pluginOptions[k] || strings.HasPrefix(k, OptLabelPrefix)
+}
+
+// splitOptions separates plugin options from zfs properties
+func splitOptions(opts map[string]string) (props, plugin map[string]string) {
+	props = make(map[string]string)
+	plugin = make(map[string]string)
+	for k, v := range opts {
+		if isPluginOption(k) {
+			plugin[k] = v
+		} else {
+			props[k] = v
+		}
+	}
+	return props, plugin
+}
+
+// validateOptions checks the plugin options of a create request
+func validateOptions(opts map[string]string) error {
+	_, from := opts[OptFrom]
+	_, asof := opts[OptAsOf]
+	snap, snapshot := opts[OptSnapshot]
+	if snapshot && !from {
+		return policyErrorf("option %s requires option %s", OptSnapshot, OptFrom)
+	}
+	if snapshot && asof {
+		return policyErrorf("options %s and %s are mutually exclusive", OptSnapshot, OptAsOf)
+	}
+	if snapshot && !snapshotName.MatchString(snap) {
+		return policyErrorf("invalid snapshot name %q", snap)
+	}
+	if v, ok := opts[OptProject]; ok && !projectID.MatchString(v) {
+		return policyErrorf("invalid %s %q, expected a numeric project id", OptProject, v)
+	}
+	if v, ok := opts[OptCDP]; ok {
+		if _, err := parseCDP(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts[OptForceUnsafe]; ok && v != "true" && v != "false" {
+		return policyErrorf("invalid %s %q, expected true or false", OptForceUnsafe, v)
+	}
+	if v, ok := opts[OptPrewarm]; ok && v != "true" && v != "false" {
+		return policyErrorf("invalid %s %q, expected true or false", OptPrewarm, v)
+	}
+	if v, ok := opts[OptDelegate]; ok {
+		if v != "true" && v != "false" {
+			return policyErrorf("invalid %s %q, expected true or false", OptDelegate, v)
+		}
+		if _, mirror := opts[OptMirror]; v == "true" && (mirror || asof) {
+			return policyErrorf("option %s can not be combined with %s or %s", OptDelegate, OptMirror, OptAsOf)
+		}
+	}
+	if v, ok := opts[OptRemoveBackup]; ok && v != "true" && v != "false" {
+		return policyErrorf("invalid %s %q, expected true or false", OptRemoveBackup, v)
+	}
+	if v, ok := opts[OptBackup]; ok {
+		if err := validateBackup(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts[OptMirror]; ok {
+		if from || asof {
+			return policyErrorf("option %s can not be combined with %s or %s", OptMirror, OptFrom, OptAsOf)
+		}
+		// every receive rolls a mirror back to its source, destroying local snapshots
+		_, backup := opts[OptBackup]
+		if _, cdp := opts[OptCDP]; backup || cdp {
+			return policyErrorf("option %s can not be combined with %s or %s, snapshot the source instead", OptMirror, OptBackup, OptCDP)
+		}
+		if _, _, err := parseMirror(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts[OptMirrorInterval]; ok {
+		if _, mirror := opts[OptMirror]; !mirror {
+			return policyErrorf("option %s requires option %s", OptMirrorInterval, OptMirror)
+		}
+		if _, err := parseMirrorInterval(v); err != nil {
+			return err
+		}
+	}
+	if _, ok := opts[OptMirrorCredential]; ok {
+		if _, mirror := opts[OptMirror]; !mirror {
+			return policyErrorf("option %s requires option %s", OptMirrorCredential, OptMirror)
+		}
+	}
+	if v, ok := opts[OptClass]; ok {
+		if err := validateClass(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts[OptQuotaAction]; ok {
+		if _, err := ParseQuotaAction(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := opts[OptTTL]; ok {
+		if _, err := parseTTL(v); err != nil {
+			return err
+		}
+	}
+	if _, ok := opts[optReplica]; ok {
+		return policyErrorf("option %s is set by the plugin for received datasets", optReplica)
+	}
+	for k := range opts {
+		if k == OptLabelPrefix {
+			return policyErrorf("label option %q has no key", k)
+		}
+	}
+	return nil
+}
+
+// copied reports whether the volume is created from the data of another
+// dataset, which already carries its own ownership and contents
+func copied(opts map[string]string) bool {
+	_, from := opts[OptFrom]
+	_, mirror := opts[OptMirror]
+	return from || mirror
+}
@@ -0,0 +1,95 @@
+package zfsdriver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// PrewarmConfig bounds the cache priming of volumes created with prewarm=true,
+// zero values are unlimited
+type PrewarmConfig struct {
+	// MaxBytes is the most data read from a volume
+	MaxBytes int64
+	// Rate limits the reads in bytes per second
+	Rate int64
+	// Timeout limits how long the mount is delayed
+	Timeout time.Duration
+}
+
+var prewarmBytes = metrics.NewCounterVec("zfs_plugin_prewarm_bytes_total",
+	"Bytes read to prime the cache of mounted volumes")
+
+func init() {
+	metrics.MustRegister(prewarmBytes)
+}
+
+// errPrewarmDone stops the walk once MaxBytes have been read
+var errPrewarmDone = errors.New("prewarm limit reached")
+
+// prewarm reads the files below mp to pull them into the ARC before the
+// container starts. Unreadable files are skipped, it never fails the mount.
+func (zd *ZfsDriver) prewarm(name, mp string) {
+	cfg := zd.prewarmCfg
+	ctx := context.Background()
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	var total int64
+	buf := make([]byte, 1<<20)
+	read := func(p string) error {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		for {
+			chunk := buf
+			if cfg.MaxBytes > 0 && cfg.MaxBytes-total < int64(len(chunk)) {
+				chunk = buf[:cfg.MaxBytes-total]
+			}
+			n, err := f.Read(chunk)
+			total += int64(n)
+			if cfg.MaxBytes > 0 && total >= cfg.MaxBytes {
+				return errPrewarmDone
+			}
+			if cfg.Rate > 0 {
+				due := time.Duration(float64(total) / float64(cfg.Rate) * float64(time.Second))
+				if wait := due - time.Since(start); wait > 0 {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-time.After(wait):
+					}
+				}
+			}
+			if err != nil {
+				return nil
+			}
+		}
+	}
+	err := filepath.Walk(mp, func(p string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		return read(p)
+	})
+	prewarmBytes.Add(float64(total))
+	l := log.WithFields(log.Fields{"volume": name, "bytes": total, "duration": time.Since(start).String()})
+	if err != nil && err != errPrewarmDone {
+		l.WithError(err).Info("Stopped priming volume cache")
+		return
+	}
+	l.Debug("Primed volume cache")
+}
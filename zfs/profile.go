@@ -0,0 +1,85 @@
+package zfsdriver
+
+import (
+	"os"
+	"time"
+)
+
+// profile is a named set of defaults for docker volume create
+type profile struct {
+	// Options are added to the create request unless given explicitly
+	Options map[string]string
+	// Mode of the new mountpoint, 0 leaves it to the mount template
+	Mode os.FileMode
+	// Unsafe are the properties the profile sets to values which risk
+	// losing data, accepted for its volumes without -o force-unsafe
+	Unsafe map[string]bool
+}
+
+// profiles are the built in profiles selectable with -o profile=<name>
+var profiles = map[string]profile{
+	// scratch is a fast world writable /tmp like volume for build pipelines.
+	// sync=disabled is only safe because scratch data is disposable, so the
+	// volume always expires with a ttl.
+	"scratch": {
+		Options: map[string]string{
+			"sync":    "disabled",
+			"setuid":  "off",
+			"devices": "off",
+			OptTTL:    "24h",
+			OptBackup: BackupNone,
+		},
+		Mode:   os.ModeSticky | 0777,
+		Unsafe: map[string]bool{"sync": true},
+	},
+	// staging holds large sequential backup streams which are read once, so
+	// only metadata is cached and the blocks do not evict hot data from the
+	// ARC and L2ARC. logbias=throughput keeps synchronous writes off the slog.
+	"staging": {
+		Options: map[string]string{
+			"primarycache":   "metadata",
+			"secondarycache": "none",
+			"logbias":        "throughput",
+		},
+	},
+}
+
+// expandProfile returns opts with the defaults of the selected profile added
+func expandProfile(opts map[string]string) (map[string]string, *profile, error) {
+	name, ok := opts[OptProfile]
+	if !ok {
+		return opts, nil, nil
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return nil, nil, policyErrorf("unknown %s %q", OptProfile, name)
+	}
+	out := make(map[string]string, len(opts)+len(p.Options))
+	for k, v := range p.Options {
+		out[k] = v
+	}
+	for k, v := range opts {
+		out[k] = v
+	}
+	return out, &p, nil
+}
+
+func parseTTL(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, policyErrorf("invalid %s %q, expected a positive duration", OptTTL, v)
+	}
+	return d, nil
+}
+
+// applyProfile sets the mode of a new volume's mountpoint
+func (zd *ZfsDriver) applyProfile(dataset string, p *profile) error {
+	if p == nil || p.Mode == 0 {
+		return nil
+	}
+	mp, err := zd.getMountpoint("create", dataset)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(mp, p.Mode)
+}
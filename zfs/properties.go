@@ -0,0 +1,212 @@
+package zfsdriver
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	sizeValue  = regexp.MustCompile(`^(?i)(none|[0-9]+(\.[0-9]+)?[KMGTPEZ]?B?)$`)
+	countValue = regexp.MustCompile(`^(none|[0-9]+)$`)
+	// a user or group name, numeric id, name@domain or windows SID
+	principal = regexp.MustCompile(`^([0-9]+|[A-Za-z_][A-Za-z0-9_.-]*\$?(@[A-Za-z0-9.-]+)?|S-1(-[0-9]+)+)$`)
+	projectID = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// quotaPrefixes are the per principal quota properties and whether their
+// values are object counts rather than sizes
+var quotaPrefixes = map[string]bool{
+	"userquota@":     false,
+	"groupquota@":    false,
+	"userobjquota@":  true,
+	"groupobjquota@": true,
+}
+
+// cacheValues are the values of primarycache and secondarycache
+var cacheValues = map[string]bool{"all": true, "metadata": true, "none": true}
+
+// projectPrefixes are the per project quota properties, projects are always numeric
+var projectPrefixes = map[string]bool{
+	"projectquota@":    false,
+	"projectobjquota@": true,
+}
+
+// validateProperties checks the zfs properties of a create or update request
+func validateProperties(props map[string]string) error {
+	for k, v := range props {
+		if err := validateProperty(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateProperty(k, v string) error {
+	if k == "copies" && v != "1" && v != "2" && v != "3" {
+		return policyErrorf("invalid copies value %q, expected 1, 2 or 3", v)
+	}
+	if k == propBackup {
+		return validateBackup(v)
+	}
+	if (k == "primarycache" || k == "secondarycache") && !cacheValues[v] {
+		return policyErrorf("invalid %s value %q, expected all, metadata or none", k, v)
+	}
+	for prefix, counts := range quotaPrefixes {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if who := strings.TrimPrefix(k, prefix); !principal.MatchString(who) {
+			return policyErrorf("invalid user or group %q in %s", who, k)
+		}
+		return validateQuotaValue(k, v, counts)
+	}
+	for prefix, counts := range projectPrefixes {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if id := strings.TrimPrefix(k, prefix); !projectID.MatchString(id) {
+			return policyErrorf("invalid project id %q in %s, expected a number", id, k)
+		}
+		return validateQuotaValue(k, v, counts)
+	}
+	return nil
+}
+
+func validateQuotaValue(k, v string, counts bool) error {
+	if counts && !countValue.MatchString(v) {
+		return policyErrorf("invalid %s value %q, expected an object count or none", k, v)
+	}
+	if !counts && !sizeValue.MatchString(v) {
+		return policyErrorf("invalid %s value %q, expected a size or none", k, v)
+	}
+	return nil
+}
+
+// usesProjects returns true if props or opts need the project_quota pool feature
+func usesProjects(props, opts map[string]string) bool {
+	if _, ok := opts[OptProject]; ok {
+		return true
+	}
+	for k := range props {
+		for prefix := range projectPrefixes {
+			if strings.HasPrefix(k, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// poolFeature returns the state of a pool feature: disabled, enabled or active
+func (zd *ZfsDriver) poolFeature(pool, feature string) (string, error) {
+	out, err := zd.runner.run(context.Background(), "feature", "zpool", "get", "-H", "-o", "value", "feature@"+feature, pool)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// requireFeature fails with a policy error unless feature is enabled on the pool of dataset
+func (zd *ZfsDriver) requireFeature(dataset, feature string) error {
+	pool := strings.SplitN(dataset, "/", 2)[0]
+	st, err := zd.poolFeature(pool, feature)
+	if err != nil {
+		return err
+	}
+	if st != "enabled" && st != "active" {
+		return policyErrorf("pool %s does not have the %s feature enabled", pool, feature)
+	}
+	return nil
+}
+
+// setProject sets the default project of a volume's mountpoint, files
+// created below it inherit the project id
+func (zd *ZfsDriver) setProject(dataset, id string) error {
+	mp, err := zd.getMountpoint("create", dataset)
+	if err != nil {
+		return err
+	}
+	_, err = zd.zfs("create", "project", "-s", "-p", id, mp)
+	return err
+}
+
+// SetProperties validates and sets zfs properties on a volume's dataset and
+// records them with the volume's options
+func (zd *ZfsDriver) SetProperties(name string, props map[string]string) (err error) {
+	defer observe("set", &err)
+	log.WithFields(log.Fields{"volume": name, "properties": props}).Debug("SetProperties")
+	if len(props) == 0 {
+		return policyErrorf("no properties given")
+	}
+	for k := range props {
+		if isPluginOption(k) {
+			return policyErrorf("%s is a create option and cannot be changed", k)
+		}
+	}
+	if err := validateProperties(props); err != nil {
+		return err
+	}
+	ds, err := zd.resolveWritable(name)
+	if err != nil {
+		return err
+	}
+	m, _, err := zd.getMapping(name)
+	if err != nil {
+		return err
+	}
+	var opts map[string]string
+	if m != nil {
+		opts = m.Options
+	}
+	if err := zd.guardUnsafe(name, props, opts); err != nil {
+		return err
+	}
+	if err := zd.checkCapabilities(ds, props); err != nil {
+		return err
+	}
+	if usesProjects(props, nil) {
+		if err := zd.requireFeature(ds, "project_quota"); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := []string{"set"}
+	for _, k := range keys {
+		args = append(args, fmt.Sprintf("%s=%s", k, props[k]))
+	}
+	if _, err := zd.zfs("set", append(args, ds)...); err != nil {
+		return err
+	}
+	if _, ok := props["sync"]; ok && !syncDisabled(props) {
+		if _, err := zd.zfs("set", "inherit", propWarning, ds); err != nil {
+			return err
+		}
+	}
+
+	return zd.db.Update(func(tx *state.Tx) error {
+		m := mapping{Dataset: ds}
+		if _, err := tx.Get(mappingBucket, name, &m); err != nil {
+			return err
+		}
+		if m.Options == nil {
+			m.Options = make(map[string]string)
+		}
+		for k, v := range props {
+			if k != propWarning {
+				m.Options[k] = v
+			}
+		}
+		return tx.Put(mappingBucket, name, &m)
+	})
+}
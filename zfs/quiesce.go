@@ -0,0 +1,202 @@
+package zfsdriver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// quiesceBucket holds the readonly property of every dataset whose writes
+// are held, so a crash while they are held does not leave them read only
+const quiesceBucket = "quiesce"
+
+// Quiesce modes, how writes are held while a group of volumes is snapshotted
+const (
+	// QuiesceReadonly sets readonly=on on the volumes after syncing them, so
+	// new writes fail until the snapshot is taken
+	QuiesceReadonly = "readonly"
+	// QuiesceSync only syncs the volumes, writes in flight between the sync
+	// and the snapshot are in it or not like after a crash
+	QuiesceSync = "sync"
+)
+
+type quiesceState struct {
+	mu sync.Mutex
+}
+
+// QuiesceRequest names the volumes snapshotted together by QuiesceSnapshot,
+// those in Volumes and those matching Selector
+type QuiesceRequest struct {
+	Volumes  []string `json:"volumes,omitempty"`
+	Selector Selector `json:"selector"`
+	Snapshot string   `json:"snapshot"`
+	// Mode is QuiesceReadonly if empty
+	Mode string `json:"mode,omitempty"`
+}
+
+// QuiesceResult is the outcome of a quiesced snapshot, Held is how long
+// writes to the volumes were held
+type QuiesceResult struct {
+	Snapshot  string     `json:"snapshot"`
+	Mode      string     `json:"mode"`
+	Snapshots []Snapshot `json:"snapshots"`
+	Held      string     `json:"held"`
+}
+
+// heldReadonly is the readonly property of a dataset before its writes were held
+type heldReadonly struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// QuiesceSnapshot takes the snapshot req names of a group of volumes, such
+// as the database and the upload volumes of one application, so they can
+// be restored to the same point. The volumes are synced and their writes
+// held, then all snapshots are taken with one zfs snapshot, which creates
+// them in the same transaction group, and the writes are let through again.
+// The volumes must be on one pool.
+func (zd *ZfsDriver) QuiesceSnapshot(ctx context.Context, req QuiesceRequest) (_ *QuiesceResult, err error) {
+	defer observe("quiesce", &err)
+	log.WithField("request", req).Debug("QuiesceSnapshot")
+	if !snapshotName.MatchString(req.Snapshot) {
+		return nil, policyErrorf("invalid snapshot name %q", req.Snapshot)
+	}
+	mode := req.Mode
+	if mode == "" {
+		mode = QuiesceReadonly
+	}
+	if mode != QuiesceReadonly && mode != QuiesceSync {
+		return nil, policyErrorf("invalid quiesce mode %q, expected %s or %s", mode, QuiesceReadonly, QuiesceSync)
+	}
+	names := append([]string{}, req.Volumes...)
+	if !req.Selector.empty() {
+		sel, err := zd.Select(req.Selector)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, sel...)
+	}
+	seen := make(map[string]bool)
+	var vols, dss, snaps []string
+	pool := ""
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ds, err := zd.resolveWritable(name)
+		if err != nil {
+			return nil, err
+		}
+		if p := strings.SplitN(ds, "/", 2)[0]; pool == "" {
+			pool = p
+		} else if p != pool {
+			return nil, policyErrorf("volumes %s and %s are on pools %s and %s, a group snapshot needs them on one pool", vols[0], name, pool, p)
+		}
+		if zd.snapshotExists(ds + "@" + req.Snapshot) {
+			return nil, policyErrorf("snapshot %s of volume %s already exists", req.Snapshot, name)
+		}
+		vols, dss, snaps = append(vols, name), append(dss, ds), append(snaps, ds+"@"+req.Snapshot)
+	}
+	if len(vols) == 0 {
+		return nil, policyErrorf("no volumes given, name them or give a selector")
+	}
+
+	zd.quiesce.mu.Lock()
+	defer zd.quiesce.mu.Unlock()
+	// sync flushes dirty pages, such as writes through mmap, into the datasets
+	syscall.Sync()
+	start := time.Now()
+	if mode == QuiesceReadonly {
+		if err := zd.holdWrites(ctx, dss); err != nil {
+			return nil, err
+		}
+		defer zd.releaseWrites()
+		// writes which were in flight when readonly was set are flushed too
+		syscall.Sync()
+	}
+	if err := zd.snapshot("quiesce", snaps...); err != nil {
+		return nil, err
+	}
+	held := time.Since(start)
+
+	res := &QuiesceResult{Snapshot: req.Snapshot, Mode: mode, Held: held.String(), Snapshots: make([]Snapshot, len(vols))}
+	created, err := zd.getCreation("quiesce", snaps[0])
+	if err != nil {
+		created = time.Now()
+	}
+	for i, name := range vols {
+		res.Snapshots[i] = Snapshot{Volume: name, Name: req.Snapshot, Dataset: dss[i], Created: created}
+		zd.events.Publish(events.Event{Type: events.VolumeSnapshot, Volume: name, Dataset: dss[i],
+			Details: map[string]string{"snapshot": snaps[i], "policy": "quiesce", "group": strings.Join(vols, ",")}})
+	}
+	log.WithFields(log.Fields{"volumes": vols, "snapshot": req.Snapshot, "mode": mode, "held": held}).Info("Took quiesced group snapshot")
+	return res, nil
+}
+
+// holdWrites records the readonly property of dss and sets it on. On error
+// the datasets already set are released again.
+func (zd *ZfsDriver) holdWrites(ctx context.Context, dss []string) error {
+	out, err := zd.runner.run(ctx, "quiesce", "zfs", append([]string{"get", "-H", "-p", "-o", "name,value,source", "readonly"}, dss...)...)
+	if err != nil {
+		return err
+	}
+	prev := make(map[string]heldReadonly)
+	for _, r := range zfsout.Records(out, 3) {
+		prev[r[0]] = heldReadonly{Value: r[1], Source: r[2]}
+	}
+	err = zd.db.Update(func(tx *state.Tx) error {
+		for ds, p := range prev {
+			if err := tx.Put(quiesceBucket, ds, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record readonly property before holding writes: %w", err)
+	}
+	for _, ds := range dss {
+		if _, err := zd.zfs("quiesce", "set", "readonly=on", ds); err != nil {
+			zd.releaseWrites()
+			return fmt.Errorf("failed to hold writes to %s: %w", ds, err)
+		}
+	}
+	return nil
+}
+
+// releaseWrites puts back the readonly property of every dataset whose
+// writes are held. It runs at startup as well, for writes held when the
+// plugin stopped.
+func (zd *ZfsDriver) releaseWrites() {
+	for _, ds := range zd.db.Keys(quiesceBucket) {
+		var p heldReadonly
+		if ok, err := zd.db.Get(quiesceBucket, ds, &p); !ok || err != nil {
+			continue
+		}
+		var err error
+		switch p.Source {
+		case "local":
+			_, err = zd.zfs("quiesce", "set", "readonly="+p.Value, ds)
+		case "received":
+			_, err = zd.zfs("quiesce", "inherit", "-S", "readonly", ds)
+		default:
+			_, err = zd.zfs("quiesce", "inherit", "readonly", ds)
+		}
+		if err != nil && zd.datasetExists(ds) {
+			log.WithError(err).WithField("dataset", ds).Error("Failed to release held writes, set readonly back by hand")
+			continue
+		}
+		if err := zd.db.Delete(quiesceBucket, ds); err != nil {
+			log.WithError(err).WithField("dataset", ds).Error("Failed to forget released dataset")
+		}
+	}
+}
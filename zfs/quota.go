@@ -0,0 +1,148 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions taken when a volume fills its quota
+const (
+	// QuotaNotify only publishes an event
+	QuotaNotify = "notify"
+	// QuotaFreeze sets the volume read only, so applications fail on a read
+	// only file system instead of a full one, and operators are notified
+	QuotaFreeze = "freeze"
+	// QuotaGrow raises the quota by a percentage up to a cap
+	QuotaGrow = "grow"
+)
+
+// quotaFull is the fraction of its quota at which a volume counts as full,
+// zfs refuses writes shortly before the quota is reached
+const quotaFull = 0.99
+
+// QuotaAction is what the health monitor does when a volume fills its quota:
+// notify, freeze, grow:<percent>% or grow:<percent>%:<max size>
+type QuotaAction struct {
+	Action string
+	// Percent is how much a quota grows by, Max the largest quota it grows
+	// to in bytes, 0 is unlimited
+	Percent float64
+	Max     uint64
+}
+
+func (a QuotaAction) String() string {
+	if a.Action != QuotaGrow {
+		return a.Action
+	}
+	s := fmt.Sprintf("%s:%g%%", a.Action, a.Percent)
+	if a.Max > 0 {
+		s += ":" + strconv.FormatUint(a.Max, 10)
+	}
+	return s
+}
+
+// ParseQuotaAction parses notify, freeze, grow:<percent>% or
+// grow:<percent>%:<max size>
+func ParseQuotaAction(v string) (QuotaAction, error) {
+	f := strings.Split(v, ":")
+	switch {
+	case len(f) == 1 && (f[0] == QuotaNotify || f[0] == QuotaFreeze):
+		return QuotaAction{Action: f[0]}, nil
+	case f[0] == QuotaGrow && (len(f) == 2 || len(f) == 3) && strings.HasSuffix(f[1], "%"):
+		a := QuotaAction{Action: QuotaGrow}
+		var err error
+		if a.Percent, err = strconv.ParseFloat(strings.TrimSuffix(f[1], "%"), 64); err != nil || a.Percent <= 0 {
+			break
+		}
+		if len(f) == 3 {
+			if a.Max, err = strconv.ParseUint(normalizeValue(f[2]), 10, 64); err != nil || a.Max == 0 {
+				break
+			}
+		}
+		return a, nil
+	}
+	return QuotaAction{}, policyErrorf("invalid %s %q, expected notify, freeze or grow:<percent>%%[:<max size>]", OptQuotaAction, v)
+}
+
+// quotaActionOf returns the action for the volume name, its quota-action
+// option or else def
+func (zd *ZfsDriver) quotaActionOf(name string, def QuotaAction) QuotaAction {
+	m, ok, err := zd.getMapping(name)
+	if !ok || err != nil {
+		return def
+	}
+	if m.Options[OptMirror] != "" {
+		return QuotaAction{Action: QuotaNotify}
+	}
+	if v, ok := m.Options[OptQuotaAction]; ok {
+		if a, err := ParseQuotaAction(v); err == nil {
+			return a
+		}
+	}
+	return def
+}
+
+// remediateQuota takes the quota action for the full volume name and
+// publishes what was done
+func (zd *ZfsDriver) remediateQuota(name, ds string, used, quota uint64, a QuotaAction) {
+	l := log.WithFields(log.Fields{"volume": name, "dataset": ds, "used": used, "quota": quota, "action": a.String()})
+	details := map[string]string{
+		"used":   strconv.FormatUint(used, 10),
+		"quota":  strconv.FormatUint(quota, 10),
+		"action": a.Action,
+	}
+	var err error
+	switch a.Action {
+	case QuotaGrow:
+		grown := uint64(float64(quota) * (1 + a.Percent/100))
+		if a.Max > 0 && grown > a.Max {
+			grown = a.Max
+		}
+		if grown <= quota {
+			details["action"] = QuotaNotify
+			details["reason"] = "quota is at its cap"
+			l.Warn("Volume filled its quota, which is at its cap")
+			break
+		}
+		if err = zd.setQuota(name, ds, grown); err == nil {
+			details["new_quota"] = strconv.FormatUint(grown, 10)
+			l.WithField("new_quota", grown).Warn("Volume filled its quota, grew it")
+		}
+	case QuotaFreeze:
+		if _, err = zd.zfs("health", "set", "readonly=on", ds); err == nil {
+			l.Warn("Volume filled its quota, set it read only")
+		}
+	default:
+		l.Warn("Volume filled its quota")
+	}
+	if err != nil {
+		l.WithError(err).Error("Failed to remediate full quota")
+		details["error"] = err.Error()
+	}
+	zd.events.Publish(events.Event{Type: events.VolumeQuotaFull, Volume: name, Dataset: ds, Details: details})
+}
+
+// setQuota sets the quota of ds and records it in the mapping of name if it
+// was created with one, so compliance audits do not report the change
+func (zd *ZfsDriver) setQuota(name, ds string, quota uint64) error {
+	q := strconv.FormatUint(quota, 10)
+	if _, err := zd.zfs("health", "set", "quota="+q, ds); err != nil {
+		return err
+	}
+	return zd.db.Update(func(tx *state.Tx) error {
+		var m mapping
+		if ok, err := tx.Get(mappingBucket, name, &m); err != nil || !ok || m.Dataset != ds {
+			return err
+		}
+		if _, ok := m.Options["quota"]; !ok {
+			return nil
+		}
+		m.Options["quota"] = q
+		return tx.Put(mappingBucket, name, &m)
+	})
+}
@@ -0,0 +1,135 @@
+package zfsdriver
+
+import (
+	"context"
+	"errors"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// RegistryEntry records the node hosting a volume
+type RegistryEntry struct {
+	Node    string `json:"node"`
+	Dataset string `json:"dataset"`
+}
+
+// Registry is a cluster wide record of the node hosting each volume, so
+// volumes of global scope answer Get and List consistently on every node
+type Registry interface {
+	// Register records e unless another node registered the volume first,
+	// it returns that node then
+	Register(ctx context.Context, volume string, e RegistryEntry) (string, error)
+	Deregister(ctx context.Context, volume string) error
+	// Lookup returns nil if the volume is not registered
+	Lookup(ctx context.Context, volume string) (*RegistryEntry, error)
+	List(ctx context.Context) (map[string]RegistryEntry, error)
+	// Node is the name of this node
+	Node() string
+}
+
+// remoteEntry returns the registry entry of a volume hosted on another node
+func (zd *ZfsDriver) remoteEntry(name string) (*RegistryEntry, error) {
+	if zd.registry == nil {
+		return nil, nil
+	}
+	e, err := zd.registry.Lookup(context.Background(), name)
+	if err != nil || e == nil || e.Node == zd.registry.Node() {
+		return nil, err
+	}
+	return e, nil
+}
+
+// remoteVolume returns a volume hosted on another node, or err if there is none
+func (zd *ZfsDriver) remoteVolume(name string, err error) (*volume.Volume, error) {
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	e, rErr := zd.remoteEntry(name)
+	if rErr != nil {
+		return nil, rErr
+	}
+	if e == nil {
+		return nil, err
+	}
+	return &volume.Volume{Name: name, Status: map[string]interface{}{"node": e.Node, "dataset": e.Dataset}}, nil
+}
+
+// remoteError turns a not found error for a volume hosted on another node
+// into a policy error naming the node
+func (zd *ZfsDriver) remoteError(name string, err error) error {
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if e, rErr := zd.remoteEntry(name); rErr == nil && e != nil {
+		return policyErrorf("volume %s is hosted on node %s", name, e.Node)
+	}
+	return err
+}
+
+// remoteVolumes returns the volumes registered by other nodes
+func (zd *ZfsDriver) remoteVolumes() []*volume.Volume {
+	if zd.registry == nil {
+		return nil
+	}
+	entries, err := zd.registry.List(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Failed to list the volume registry")
+		return nil
+	}
+	var vols []*volume.Volume
+	for name, e := range entries {
+		if e.Node != zd.registry.Node() {
+			vols = append(vols, &volume.Volume{Name: name, Status: map[string]interface{}{"node": e.Node, "dataset": e.Dataset}})
+		}
+	}
+	return vols
+}
+
+// register records a local volume in the registry
+func (zd *ZfsDriver) register(name, dataset string) error {
+	if zd.registry == nil {
+		return nil
+	}
+	holder, err := zd.registry.Register(context.Background(), name, RegistryEntry{Node: zd.registry.Node(), Dataset: dataset})
+	if err != nil {
+		return err
+	}
+	if holder != "" {
+		return policyErrorf("volume %s already exists on node %s", name, holder)
+	}
+	return nil
+}
+
+func (zd *ZfsDriver) deregister(name string) {
+	if zd.registry == nil {
+		return
+	}
+	if err := zd.registry.Deregister(context.Background(), name); err != nil {
+		log.WithError(err).WithField("volume", name).Error("Failed to remove volume from the registry")
+	}
+}
+
+// syncRegistry registers the local volumes, for volumes created before the
+// registry was enabled or while it was unreachable
+func (zd *ZfsDriver) syncRegistry() {
+	if zd.registry == nil {
+		return
+	}
+	for _, name := range zd.db.Keys(mappingBucket) {
+		m, ok, err := zd.getMapping(name)
+		if !ok || err != nil {
+			continue
+		}
+		if e, err := zd.registry.Lookup(context.Background(), name); err != nil {
+			log.WithError(err).Error("Failed to sync the volume registry")
+			return
+		} else if e != nil && e.Node != zd.registry.Node() {
+			log.WithFields(log.Fields{"volume": name, "node": e.Node}).Warn("Volume is registered by another node")
+			continue
+		}
+		if err := zd.register(name, m.Dataset); err != nil {
+			log.WithError(err).WithField("volume", name).Error("Failed to register volume")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package zfsdriver
+
+import (
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+)
+
+// removeTargets returns the datasets removing the volume name destroys, its
+// dataset ds and the datasets of its other branches
+func (zd *ZfsDriver) removeTargets(name, ds string) []string {
+	targets := []string{ds}
+	if dss, ok := zd.branchDatasets(name); ok {
+		for _, b := range dss {
+			if b != ds && zd.datasetExists(b) {
+				targets = append(targets, b)
+			}
+		}
+	}
+	return targets
+}
+
+// within reports whether ds is one of dss or below one of them
+func within(ds string, dss []string) bool {
+	for _, d := range dss {
+		if ds == d || strings.HasPrefix(ds, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// requireNoForeignClones refuses to remove the volume name while snapshots
+// of targets are cloned by datasets which are not destroyed with it, such
+// as volumes created with -o from=. Destroying them would need zfs destroy
+// -R, which would take those volumes along.
+func (zd *ZfsDriver) requireNoForeignClones(name string, targets []string) error {
+	out, err := zd.zfs("remove", append([]string{"get", "-H", "-o", "name,value", "-r", "-t", "snapshot", "clones"}, targets...)...)
+	if err != nil {
+		return err
+	}
+	var names map[string]string
+	for _, f := range zfsout.Records(out, 2) {
+		if zfsout.Unset(f[1]) {
+			continue
+		}
+		for _, c := range strings.Split(f[1], ",") {
+			if within(c, targets) {
+				continue
+			}
+			if names == nil {
+				names = zd.volumeNames()
+			}
+			if v, ok := names[c]; ok {
+				return policyErrorf("snapshot %s of volume %s is the origin of volume %s, remove that volume first", f[0], name, v)
+			}
+			return policyErrorf("snapshot %s of volume %s is the origin of dataset %s, destroy or promote it first", f[0], name, c)
+		}
+	}
+	return nil
+}
+
+// destroyTargets destroys targets with their descendants and snapshots,
+// clones among them before the datasets they were cloned from, as zfs
+// destroy -r refuses to destroy snapshots with clones
+func (zd *ZfsDriver) destroyTargets(targets []string) error {
+	origins := make(map[string][]string)
+	if out, err := zd.zfs("remove", append([]string{"get", "-H", "-o", "name,value", "-r", "-t", "filesystem", "origin"}, targets...)...); err == nil {
+		for _, f := range zfsout.Records(out, 2) {
+			if zfsout.Unset(f[1]) {
+				continue
+			}
+			for _, t := range targets {
+				if f[0] == t || strings.HasPrefix(f[0], t+"/") {
+					origins[t] = append(origins[t], f[1])
+				}
+			}
+		}
+	}
+	pending := append([]string{}, targets...)
+	for len(pending) > 0 {
+		var next, ready []string
+		for _, d := range pending {
+			if clonedBy(d, pending, origins) {
+				next = append(next, d)
+			} else {
+				ready = append(ready, d)
+			}
+		}
+		// a cycle can not happen, but destroying in order still reports why
+		if len(ready) == 0 {
+			ready, next = next[:1], next[1:]
+		}
+		for _, d := range ready {
+			if err := zd.destroyDataset(d); err != nil {
+				return err
+			}
+		}
+		pending = next
+	}
+	return nil
+}
+
+// clonedBy reports whether another dataset of pending is a clone of a
+// snapshot of d or of its descendants
+func clonedBy(d string, pending []string, origins map[string][]string) bool {
+	for _, p := range pending {
+		if p == d {
+			continue
+		}
+		for _, o := range origins[p] {
+			if strings.HasPrefix(o, d+"@") || strings.HasPrefix(o, d+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package zfsdriver
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backsUpOnRemove reports whether removing a volume first sends its datasets
+// to the archive directory. The remove-backup option of the volume overrides
+// the site policy, mirrors are copies of a dataset kept elsewhere and are not
+// backed up unless asked to.
+func (zd *ZfsDriver) backsUpOnRemove(m *mapping) bool {
+	if m == nil {
+		return zd.removeBackup
+	}
+	if v, ok := m.Options[OptRemoveBackup]; ok {
+		return v == "true"
+	}
+	return zd.removeBackup && m.Options[OptMirror] == ""
+}
+
+// removeBackupContext bounds a backup before Remove by the remove backup
+// timeout, docker gives up on a remove long before a large volume is sent
+func (zd *ZfsDriver) removeBackupContext() (context.Context, context.CancelFunc) {
+	if zd.removeBackupTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), zd.removeBackupTimeout)
+}
+
+// backupBeforeRemove sends each of dss, the checked out dataset of the
+// volume name first and then its other branches, with all their snapshots to
+// a file in the archive directory and returns the files. The snapshots taken
+// are destroyed with the datasets. If a backup fails they are destroyed
+// right away, and the files already written are deleted.
+func (zd *ZfsDriver) backupBeforeRemove(ctx context.Context, name string, dss []string) ([]string, error) {
+	if zd.archiveDir == "" {
+		return nil, policyErrorf("volume %s is backed up before it is removed, start the plugin with --archive-dir", name)
+	}
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	var files, snaps []string
+	for i, ds := range dss {
+		file := name
+		if i > 0 {
+			file += "/" + path.Base(ds)
+		}
+		stub := ArchiveStub{File: zd.archiveFile(file, "removed-"+stamp), Snapshot: ds + "@removed-" + stamp}
+		if err := zd.snapshot("remove", stub.Snapshot); err != nil {
+			zd.dropRemoveBackups(snaps, files)
+			return nil, err
+		}
+		snaps = append(snaps, stub.Snapshot)
+		if err := zd.sendToFile(ctx, &stub, nil); err != nil {
+			zd.dropRemoveBackups(snaps, files)
+			return nil, err
+		}
+		log.WithFields(log.Fields{"volume": name, "dataset": ds, "file": stub.File, "size": stub.Size, "sha256": stub.SHA256}).
+			Info("Backed up dataset before removing it")
+		files = append(files, stub.File)
+	}
+	return files, nil
+}
+
+func (zd *ZfsDriver) dropRemoveBackups(snaps, files []string) {
+	for _, s := range snaps {
+		zd.destroyArchiveSnapshot(s)
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			log.WithError(err).WithField("file", f).Error("Failed to delete the backup of a volume which is kept")
+		}
+	}
+}
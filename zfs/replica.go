@@ -0,0 +1,161 @@
+package zfsdriver
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/namecodec"
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// optReplica marks the mapping of a received dataset registered as a read
+// only volume. It is recorded by the plugin and can not be given on create.
+const optReplica = "replica"
+
+// DefaultReplicaSuffix is appended to the names of replica volumes, so they
+// do not collide with the volumes they are replicas of
+const DefaultReplicaSuffix = "-replica"
+
+func (m *mapping) replica() bool {
+	return m != nil && m.Options[optReplica] == "true"
+}
+
+func (zd *ZfsDriver) isReplica(name string) bool {
+	m, ok, err := zd.getMapping(name)
+	return ok && err == nil && m.replica()
+}
+
+// resolveWritable resolves a volume like resolveExisting for an operation
+// which changes the dataset or its snapshots, which replicas refuse because
+// it would break the next receive. The pool must be owned by this node.
+func (zd *ZfsDriver) resolveWritable(name string) (string, error) {
+	if zd.isReplica(name) {
+		return "", policyErrorf("volume %s is a read only replica", name)
+	}
+	ds, err := zd.resolveExisting(name)
+	if err != nil {
+		return "", err
+	}
+	if err := zd.requireOwned(ds); err != nil {
+		return "", err
+	}
+	return ds, nil
+}
+
+// replicaName returns the volume name of the dataset ds received below root.
+// Its levels below root are joined with the name delimiter, so a replica of
+// a whole root dataset gets the names of the source volumes plus the suffix.
+func (zd *ZfsDriver) replicaName(root, ds string) string {
+	delim := zd.codec.Delimiter
+	if delim == "" {
+		delim = namecodec.DefaultDelimiter
+	}
+	return strings.Replace(strings.TrimPrefix(ds, root+"/"), "/", delim, -1) + zd.replicaSuffix
+}
+
+// syncReplicas registers every leaf dataset below the replica roots as a read
+// only volume and drops the registrations of replicas which no longer exist
+// and are not mounted. Datasets whose volume name is taken are skipped.
+func (zd *ZfsDriver) syncReplicas() {
+	if len(zd.replicaRoots) == 0 {
+		return
+	}
+	registered := make(map[string]string)
+	for _, name := range zd.db.Keys(mappingBucket) {
+		if m, ok, err := zd.getMapping(name); ok && err == nil && m.replica() {
+			registered[m.Dataset] = name
+		}
+	}
+	for _, root := range zd.replicaRoots {
+		dsl, err := zd.listDatasets(root)
+		if err != nil {
+			log.WithError(err).WithField("dataset", root).Error("Failed to list replicated datasets")
+			for ds := range registered {
+				if strings.HasPrefix(ds, root+"/") {
+					delete(registered, ds)
+				}
+			}
+			continue
+		}
+		sort.Strings(dsl)
+		for i, ds := range dsl {
+			if i < len(dsl)-1 && strings.HasPrefix(dsl[i+1], ds+"/") {
+				continue
+			}
+			if _, ok := registered[ds]; ok {
+				delete(registered, ds)
+				continue
+			}
+			name := zd.replicaName(root, ds)
+			if _, ok, _ := zd.getMapping(name); ok {
+				log.WithFields(log.Fields{"volume": name, "dataset": ds}).Warn("Not registering replica, the volume name is taken")
+				continue
+			}
+			if err := zd.db.Put(mappingBucket, name, &mapping{Dataset: ds, Options: map[string]string{optReplica: "true"}}); err != nil {
+				log.WithError(err).WithField("dataset", ds).Error("Failed to register replica")
+				continue
+			}
+			log.WithFields(log.Fields{"volume": name, "dataset": ds}).Info("Registered replica as read only volume")
+			zd.events.Publish(events.Event{Type: events.VolumeCreate, Volume: name, Dataset: ds, Details: map[string]string{"replica": "true"}})
+		}
+	}
+	for ds, name := range registered {
+		if len(zd.mounted(name)) > 0 {
+			continue
+		}
+		if err := zd.db.Delete(mappingBucket, name); err != nil {
+			log.WithError(err).WithField("volume", name).Error("Failed to drop registration of vanished replica")
+			continue
+		}
+		log.WithFields(log.Fields{"volume": name, "dataset": ds}).Info("Dropped registration of vanished replica")
+		zd.events.Publish(events.Event{Type: events.VolumeRemove, Volume: name, Dataset: ds, Details: map[string]string{"replica": "true"}})
+	}
+}
+
+// replicaVolumes returns the registered replicas, which List does not find
+// below the root datasets
+func (zd *ZfsDriver) replicaVolumes() []*volume.Volume {
+	var vols []*volume.Volume
+	for _, name := range zd.db.Keys(mappingBucket) {
+		m, ok, err := zd.getMapping(name)
+		if !ok || err != nil || !m.replica() {
+			continue
+		}
+		if _, below := zd.rootOf(m.Dataset); below {
+			continue
+		}
+		mp, err := zd.getMountpoint("list", m.Dataset)
+		if err != nil {
+			log.WithError(err).WithField("name", m.Dataset).Error("Failed to get mountpoint from dataset")
+			continue
+		}
+		vols = append(vols, &volume.Volume{Name: name, Mountpoint: mp})
+	}
+	return vols
+}
+
+// prepareReplica makes sure the received dataset ds is read only and mounted
+// before a container uses it. readonly does not hinder later receives.
+func (zd *ZfsDriver) prepareReplica(ds string) error {
+	ro, err := zd.getProperty("mount", ds, "readonly")
+	if err != nil {
+		return err
+	}
+	if ro != "on" {
+		if _, err := zd.zfs("mount", "set", "readonly=on", ds); err != nil {
+			return err
+		}
+	}
+	mounted, err := zd.getProperty("mount", ds, "mounted")
+	if err != nil {
+		return err
+	}
+	if mounted != "yes" {
+		if _, err := zd.zfs("mount", "mount", ds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package zfsdriver
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+var rootPropertyDrift = metrics.NewGaugeVec("zfs_plugin_root_property_drift",
+	"1 if a root dataset property differs from its configured value", "dataset", "property")
+
+func init() {
+	metrics.MustRegister(rootPropertyDrift)
+}
+
+// PropertyDrift is a root dataset property which differs from its configured value
+type PropertyDrift struct {
+	Dataset  string `json:"dataset"`
+	Property string `json:"property"`
+	Want     string `json:"want"`
+	Got      string `json:"got"`
+}
+
+// checkRootProperties compares the root datasets with the configured root
+// properties, setting the differing ones if enforce is true. It returns the
+// drift which remains.
+func (zd *ZfsDriver) checkRootProperties(want map[string]string, enforce bool) ([]PropertyDrift, error) {
+	if len(want) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var drift []PropertyDrift
+	for _, ds := range zd.rds {
+		out, err := zd.zfs("startup", "get", "-H", "-p", "-o", "property,value", strings.Join(keys, ","), ds)
+		if err != nil {
+			return nil, err
+		}
+		got := zfsout.Pairs(out)
+		for _, k := range keys {
+			if sameValue(got[k], want[k]) {
+				rootPropertyDrift.Set(0, ds, k)
+				continue
+			}
+			d := PropertyDrift{Dataset: ds, Property: k, Want: want[k], Got: got[k]}
+			l := log.WithFields(log.Fields{"dataset": ds, "property": k, "want": d.Want, "got": d.Got})
+			if enforce {
+				_, err := zd.zfs("startup", "set", k+"="+want[k], ds)
+				if err == nil {
+					l.Info("Set root dataset property")
+					rootPropertyDrift.Set(0, ds, k)
+					continue
+				}
+				l.WithError(err).Error("Failed to set root dataset property")
+			} else {
+				l.Warn("Root dataset property differs from its configured value")
+			}
+			rootPropertyDrift.Set(1, ds, k)
+			drift = append(drift, d)
+		}
+	}
+	return drift, nil
+}
+
+// PropertyDrift returns the root dataset properties which differ from their
+// configured values since startup
+func (zd *ZfsDriver) PropertyDrift() []PropertyDrift {
+	return zd.drift
+}
@@ -0,0 +1,376 @@
+package zfsdriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// retention keeps one snapshot per Every for snapshots younger than Within,
+// or all of them if Every is 0
+type retention struct {
+	Within time.Duration
+	Every  time.Duration
+}
+
+// snapshotPolicy describes the automatic snapshots of a volume
+type snapshotPolicy struct {
+	Prefix   string
+	Interval time.Duration
+	Keep     []retention
+}
+
+// cdpRetention thins continuous data protection snapshots aggressively,
+// keeping everything from the last hour, hourly for a day and daily for a week
+var cdpRetention = []retention{
+	{Within: time.Hour},
+	{Within: 24 * time.Hour, Every: time.Hour},
+	{Within: 7 * 24 * time.Hour, Every: 24 * time.Hour},
+}
+
+const minCDPInterval = 10 * time.Second
+
+// reapInterval is how often volumes are checked for an expired ttl
+const reapInterval = time.Minute
+
+func parseCDP(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < minCDPInterval {
+		return 0, policyErrorf("invalid %s interval %q, expected a duration of at least %s", OptCDP, v, minCDPInterval)
+	}
+	return d, nil
+}
+
+// policies returns the automatic snapshot policies of a volume from its
+// options and backup tier
+func policies(opts map[string]string, tier string) []snapshotPolicy {
+	var ps []snapshotPolicy
+	if p, ok := backupPolicies[tier]; ok {
+		ps = append(ps, p)
+	}
+	if v, ok := opts[OptCDP]; ok {
+		if d, err := parseCDP(v); err == nil {
+			ps = append(ps, snapshotPolicy{Prefix: "cdp-", Interval: d, Keep: cdpRetention})
+		}
+	}
+	return ps
+}
+
+// Scheduler takes the automatic snapshots of all volumes
+type Scheduler struct {
+	zd   *ZfsDriver
+	tick time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time // volume/prefix to time of the last snapshot
+
+	lastReap time.Time
+	syncing  map[string]bool // mirror volumes being updated
+
+	tiers     map[string]string // dataset to backup tier, refreshed every reapInterval
+	lastTiers time.Time
+
+	lastUsage time.Time
+}
+
+// NewScheduler returns a scheduler checking for due snapshots every tick
+func (zd *ZfsDriver) NewScheduler(tick time.Duration) *Scheduler {
+	return &Scheduler{zd: zd, tick: tick, last: make(map[string]time.Time), syncing: make(map[string]bool)}
+}
+
+// Run takes due snapshots until ctx is canceled
+func (s *Scheduler) Run(ctx context.Context) {
+	t := time.NewTicker(s.tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.round(ctx, now)
+		}
+	}
+}
+
+type dueSnapshot struct {
+	volume  string
+	dataset string
+	policy  snapshotPolicy
+}
+
+// round snapshots all due volumes in a single zfs snapshot command, so they
+// are created in the same transaction group, then thins old snapshots
+func (s *Scheduler) round(ctx context.Context, now time.Time) {
+	if now.Sub(s.lastReap) >= reapInterval {
+		s.lastReap = now
+		s.zd.sampleActivity(now)
+		s.reap(now)
+		s.zd.syncReplicas()
+		s.zd.reconcileIdentities()
+	}
+	set, err := s.zd.Schedules()
+	if err != nil {
+		log.WithError(err).Error("Failed to load snapshot schedules")
+		set = &ScheduleSet{}
+	}
+	s.syncMirrors(ctx, now, set.Schedules)
+	if now.Sub(s.lastUsage) >= usageInterval {
+		s.lastUsage = now
+		s.zd.recordUsage(ctx, now)
+	}
+	if now.Sub(s.lastTiers) >= reapInterval {
+		if tiers, err := s.zd.backupTiers(ctx); err != nil {
+			log.WithError(err).Error("Failed to get backup tiers")
+		} else {
+			s.tiers, s.lastTiers = tiers, now
+		}
+	}
+
+	var candidates []dueSnapshot
+	for _, v := range s.zd.db.Keys(mappingBucket) {
+		m, ok, err := s.zd.getMapping(v)
+		// the next receive of a mirror would destroy snapshots taken of it
+		if !ok || err != nil || m.replica() || m.archived() || m.receiving() || m.Options[OptMirror] != "" {
+			continue
+		}
+		for _, p := range append(policies(m.Options, s.tiers[m.Dataset]), s.zd.scheduledPolicies(set.Schedules, v, m)...) {
+			candidates = append(candidates, dueSnapshot{volume: v, dataset: m.Dataset, policy: p})
+		}
+	}
+	// the newest snapshots of policies not seen yet are listed without
+	// holding the lock, a failed listing is retried next round
+	s.mu.Lock()
+	var unseen []dueSnapshot
+	for _, c := range candidates {
+		if _, ok := s.last[c.volume+"/"+c.policy.Prefix]; !ok {
+			unseen = append(unseen, c)
+		}
+	}
+	s.mu.Unlock()
+	found := s.newest(unseen)
+
+	var due []dueSnapshot
+	s.mu.Lock()
+	for _, c := range candidates {
+		key := c.volume + "/" + c.policy.Prefix
+		last, ok := s.last[key]
+		if !ok {
+			if last, ok = found[key]; !ok {
+				continue
+			}
+			s.last[key] = last
+		}
+		if now.Sub(last) >= c.policy.Interval {
+			due = append(due, c)
+		}
+	}
+	s.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	stamp := now.UTC().Format("20060102T150405Z")
+	snaps := make([]string, len(due))
+	for i, d := range due {
+		snaps[i] = fmt.Sprintf("%s@%s%s", d.dataset, d.policy.Prefix, stamp)
+	}
+	if _, err := s.zd.runner.run(ctx, "schedule", "zfs", append([]string{"snapshot"}, snaps...)...); err != nil {
+		log.WithError(err).WithField("snapshots", len(snaps)).Error("Failed to take scheduled snapshots")
+		for i, d := range due {
+			if d.policy.Prefix == backupPrefix {
+				s.zd.events.Publish(events.Event{Type: events.VolumeBackupFailed, Volume: d.volume, Dataset: d.dataset,
+					Details: map[string]string{"snapshot": snaps[i], "backup": "scheduled", "error": err.Error()}})
+			}
+		}
+		return
+	}
+
+	s.mu.Lock()
+	for _, d := range due {
+		s.last[d.volume+"/"+d.policy.Prefix] = now
+	}
+	s.mu.Unlock()
+
+	for i, d := range due {
+		s.zd.events.Publish(events.Event{Type: events.VolumeSnapshot, Volume: d.volume, Dataset: d.dataset,
+			Details: map[string]string{"snapshot": snaps[i], "policy": strings.TrimSuffix(d.policy.Prefix, "-")}})
+		s.thin(ctx, d, now)
+	}
+}
+
+// newest returns when the newest snapshot of each policy of unseen was
+// taken by volume/prefix, so a restart does not snapshot every volume again
+// straight away. Policies whose snapshots could not be listed are left out.
+func (s *Scheduler) newest(unseen []dueSnapshot) map[string]time.Time {
+	found := make(map[string]time.Time, len(unseen))
+	listed := make(map[string][]snapshotInfo)
+	for _, d := range unseen {
+		snaps, ok := listed[d.dataset]
+		if !ok {
+			var err error
+			if snaps, err = s.zd.listSnapshots("schedule", d.dataset); err != nil {
+				log.WithError(err).WithField("dataset", d.dataset).Warn("Failed to list snapshots for scheduling, retrying next round")
+				continue
+			}
+			listed[d.dataset] = snaps
+		}
+		var t time.Time
+		for _, sn := range snaps {
+			if strings.HasPrefix(sn.Name[strings.Index(sn.Name, "@")+1:], d.policy.Prefix) {
+				t = sn.Created
+			}
+		}
+		found[d.volume+"/"+d.policy.Prefix] = t
+	}
+	return found
+}
+
+// thin destroys the snapshots of the policy which fall outside its
+// retention, except those with a hold
+func (s *Scheduler) thin(ctx context.Context, d dueSnapshot, now time.Time) {
+	snaps, err := s.zd.listSnapshots("schedule", d.dataset)
+	if err != nil {
+		log.WithError(err).WithField("dataset", d.dataset).Error("Failed to list snapshots for thinning")
+		return
+	}
+	var own []snapshotInfo
+	for _, sn := range snaps {
+		if strings.HasPrefix(sn.Name[strings.Index(sn.Name, "@")+1:], d.policy.Prefix) {
+			own = append(own, sn)
+		}
+	}
+	held, err := s.zd.heldSnapshots("schedule", d.dataset)
+	if err != nil {
+		log.WithError(err).WithField("dataset", d.dataset).Error("Failed to list held snapshots for thinning")
+		return
+	}
+	var expired []snapshotInfo
+	for _, sn := range expiredSnapshots(own, d.policy.Keep, now) {
+		if !held[sn.Name[strings.Index(sn.Name, "@")+1:]] {
+			expired = append(expired, sn)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	names := make([]string, len(expired))
+	for i, sn := range expired {
+		names[i] = sn.Name[strings.Index(sn.Name, "@")+1:]
+	}
+	if _, err := s.zd.runner.run(ctx, "schedule", "zfs", "destroy", d.dataset+"@"+strings.Join(names, ",")); err != nil {
+		log.WithError(err).WithField("dataset", d.dataset).Error("Failed to thin snapshots")
+		return
+	}
+	log.WithFields(log.Fields{"dataset": d.dataset, "destroyed": len(names)}).Debug("Thinned snapshots")
+}
+
+// expiredSnapshots returns the snapshots not kept by any retention tier. Each
+// tier keeps the oldest snapshot of every Every sized window, so the kept
+// snapshots stay stable as time passes.
+func expiredSnapshots(snaps []snapshotInfo, keep []retention, now time.Time) []snapshotInfo {
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Created.Before(snaps[j].Created) })
+	kept := make(map[string]bool)
+	for _, r := range keep {
+		windows := make(map[int64]bool)
+		for _, sn := range snaps {
+			if now.Sub(sn.Created) > r.Within {
+				continue
+			}
+			if r.Every == 0 {
+				kept[sn.Name] = true
+				continue
+			}
+			w := sn.Created.UnixNano() / int64(r.Every)
+			if !windows[w] {
+				windows[w] = true
+				kept[sn.Name] = true
+			}
+		}
+	}
+	var expired []snapshotInfo
+	for _, sn := range snaps {
+		if !kept[sn.Name] {
+			expired = append(expired, sn)
+		}
+	}
+	return expired
+}
+
+// syncMirrors starts the due updates of mirror volumes in the background, so
+// long transfers do not hold up snapshots, at the interval declared by their
+// schedules or their mirror-interval option. Mirrors whose first stream failed
+// are received again. A volume is only updated by one
+// transfer at a time and failed updates are retried after the interval.
+func (s *Scheduler) syncMirrors(ctx context.Context, now time.Time, scheds []Schedule) {
+	for _, v := range s.zd.db.Keys(mappingBucket) {
+		m, ok, err := s.zd.getMapping(v)
+		if !ok || err != nil || m.Options[OptMirror] == "" {
+			continue
+		}
+		iv, err := s.zd.scheduledMirrorInterval(scheds, v, m)
+		if err != nil {
+			continue
+		}
+		key := v + "/mirror"
+		s.mu.Lock()
+		if s.syncing[v] || now.Sub(s.last[key]) < iv {
+			s.mu.Unlock()
+			continue
+		}
+		s.syncing[v] = true
+		s.last[key] = now
+		s.mu.Unlock()
+		go func(v string, m *mapping) {
+			var err error
+			if m.receiving() {
+				err = s.zd.receiveMirror(ctx, v)
+			} else {
+				err = s.zd.syncMirror(ctx, v, m.Dataset, m.Options[OptMirror], m.Options[OptMirrorCredential], nil)
+			}
+			if err != nil {
+				log.WithError(err).WithField("volume", v).Error("Failed to update mirror volume")
+			}
+			s.mu.Lock()
+			delete(s.syncing, v)
+			s.mu.Unlock()
+		}(v, m)
+	}
+}
+
+// reap removes the unused volumes which are older than their ttl and had no
+// IO for as long
+func (s *Scheduler) reap(now time.Time) {
+	for _, v := range s.zd.db.Keys(mappingBucket) {
+		m, ok, err := s.zd.getMapping(v)
+		if !ok || err != nil {
+			continue
+		}
+		ttl, err := parseTTL(m.Options[OptTTL])
+		if err != nil {
+			continue
+		}
+		created, err := s.zd.getCreation("reap", m.Dataset)
+		if err != nil || now.Sub(created) < ttl {
+			continue
+		}
+		if last, ok := s.zd.lastActive(v); ok && now.Sub(last) < ttl {
+			continue
+		}
+		if ids := s.zd.mounted(v); len(ids) > 0 {
+			log.WithFields(log.Fields{"volume": v, "mounts": len(ids)}).Debug("Not removing expired volume in use")
+			continue
+		}
+		if err := s.zd.Remove(&volume.RemoveRequest{Name: v}); err != nil {
+			log.WithError(err).WithField("volume", v).Error("Failed to remove expired volume")
+			continue
+		}
+		log.WithFields(log.Fields{"volume": v, "ttl": ttl}).Info("Removed expired volume")
+	}
+}
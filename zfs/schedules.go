@@ -0,0 +1,356 @@
+package zfsdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/namecodec"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+const scheduleBucket = "schedules"
+
+// reservedPrefixes are the snapshot prefixes of the plugin's own policies
+// and operations, which declared schedules can not use, as thinning their
+// snapshots would break mirrors, branches and backups
+var reservedPrefixes = map[string]bool{
+	"backup": true, "cdp": true, "archive": true, "verify": true, "swap": true,
+	"mirror": true, "branch": true, "removed": true, "quiesce": true,
+}
+
+// ScheduleRetention keeps one snapshot per Every for snapshots younger than
+// Within, or all of them if Every is empty
+type ScheduleRetention struct {
+	Within string `json:"within"`
+	Every  string `json:"every,omitempty"`
+}
+
+// ScheduleSnapshots are snapshots taken every Interval, named by Prefix
+// and thinned by Keep
+type ScheduleSnapshots struct {
+	Prefix   string              `json:"prefix"`
+	Interval string              `json:"interval"`
+	Keep     []ScheduleRetention `json:"keep"`
+}
+
+// ScheduleReplication sets how often the mirror volumes a schedule applies
+// to are updated from their source, overriding their mirror-interval option
+type ScheduleReplication struct {
+	MirrorInterval string `json:"mirror_interval"`
+}
+
+// Schedule applies snapshot policies to the volumes named in Volumes and to
+// those its selector matches, such as the volumes of a compose project or
+// with a label. Snapshots apply to volumes which are not mirrors, the
+// replication interval to mirrors.
+type Schedule struct {
+	Name        string               `json:"name"`
+	Selector    Selector             `json:"selector,omitempty"`
+	Volumes     []string             `json:"volumes,omitempty"`
+	Snapshots   []ScheduleSnapshots  `json:"snapshots"`
+	Replication *ScheduleReplication `json:"replication,omitempty"`
+}
+
+// ScheduleSet is the declarative document of every schedule
+type ScheduleSet struct {
+	Schedules []Schedule `json:"schedules"`
+}
+
+// Changes of a schedule when a set is applied
+const (
+	ScheduleAdded     = "added"
+	ScheduleChanged   = "changed"
+	ScheduleRemoved   = "removed"
+	ScheduleUnchanged = "unchanged"
+)
+
+// ScheduleChange is what applying a set does to one schedule, and the
+// volumes it currently applies to
+type ScheduleChange struct {
+	Schedule string   `json:"schedule"`
+	Change   string   `json:"change"`
+	Volumes  []string `json:"volumes,omitempty"`
+}
+
+// ScheduleReport is the outcome of applying a set
+type ScheduleReport struct {
+	DryRun  bool             `json:"dry_run,omitempty"`
+	Changes []ScheduleChange `json:"changes"`
+}
+
+func parseRetentionDuration(v, field, schedule string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, policyErrorf("schedule %s: invalid %s %q, expected a positive duration", schedule, field, v)
+	}
+	return d, nil
+}
+
+// policies returns the snapshot policies of sc
+func (sc *Schedule) policies() ([]snapshotPolicy, error) {
+	var ps []snapshotPolicy
+	for _, sn := range sc.Snapshots {
+		if !snapshotName.MatchString(sn.Prefix) || strings.Contains(sn.Prefix, "@") {
+			return nil, policyErrorf("schedule %s: invalid snapshot prefix %q", sc.Name, sn.Prefix)
+		}
+		if reservedPrefixes[sn.Prefix] {
+			return nil, policyErrorf("schedule %s: snapshot prefix %s is used by the plugin", sc.Name, sn.Prefix)
+		}
+		d, err := time.ParseDuration(sn.Interval)
+		if err != nil || d < minCDPInterval {
+			return nil, policyErrorf("schedule %s: invalid interval %q, expected a duration of at least %s", sc.Name, sn.Interval, minCDPInterval)
+		}
+		if len(sn.Keep) == 0 {
+			return nil, policyErrorf("schedule %s: snapshots %s need a retention", sc.Name, sn.Prefix)
+		}
+		p := snapshotPolicy{Prefix: sn.Prefix + "-", Interval: d}
+		for _, k := range sn.Keep {
+			var r retention
+			if r.Within, err = parseRetentionDuration(k.Within, "within", sc.Name); err != nil {
+				return nil, err
+			}
+			if k.Every != "" {
+				if r.Every, err = parseRetentionDuration(k.Every, "every", sc.Name); err != nil {
+					return nil, err
+				}
+			}
+			p.Keep = append(p.Keep, r)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// matches reports whether sc applies to the volume name
+func (sc *Schedule) matches(c namecodec.Codec, name string, m *mapping) bool {
+	for _, v := range sc.Volumes {
+		if v == name {
+			return true
+		}
+	}
+	return !sc.Selector.empty() && sc.Selector.matches(c, name, m)
+}
+
+// validate checks every schedule of set and that snapshot prefixes and
+// schedule names are unique, since a prefix owns the snapshots it thins
+func (set *ScheduleSet) validate() error {
+	names := make(map[string]bool)
+	prefixes := make(map[string]string)
+	for i := range set.Schedules {
+		sc := &set.Schedules[i]
+		if !snapshotName.MatchString(sc.Name) {
+			return policyErrorf("invalid schedule name %q", sc.Name)
+		}
+		if names[sc.Name] {
+			return policyErrorf("schedule %s is declared twice", sc.Name)
+		}
+		names[sc.Name] = true
+		if sc.Selector.empty() && len(sc.Volumes) == 0 {
+			return policyErrorf("schedule %s selects no volumes, give volumes or a selector", sc.Name)
+		}
+		if len(sc.Snapshots) == 0 && sc.Replication == nil {
+			return policyErrorf("schedule %s declares no snapshots or replication", sc.Name)
+		}
+		if _, err := sc.policies(); err != nil {
+			return err
+		}
+		if _, err := sc.mirrorInterval(); err != nil {
+			return err
+		}
+		for _, sn := range sc.Snapshots {
+			if other, ok := prefixes[sn.Prefix]; ok {
+				return policyErrorf("snapshot prefix %s is used by schedules %s and %s", sn.Prefix, other, sc.Name)
+			}
+			prefixes[sn.Prefix] = sc.Name
+		}
+	}
+	return nil
+}
+
+// Schedules returns the declared schedules sorted by name, in the form
+// ApplySchedules accepts
+func (zd *ZfsDriver) Schedules() (*ScheduleSet, error) {
+	set := &ScheduleSet{Schedules: []Schedule{}}
+	for _, name := range zd.db.Keys(scheduleBucket) {
+		var sc Schedule
+		if ok, err := zd.db.Get(scheduleBucket, name, &sc); err != nil {
+			return nil, err
+		} else if ok {
+			set.Schedules = append(set.Schedules, sc)
+		}
+	}
+	sort.Slice(set.Schedules, func(i, j int) bool { return set.Schedules[i].Name < set.Schedules[j].Name })
+	return set, nil
+}
+
+// ApplySchedules makes set the declared schedules, adding, replacing and
+// removing schedules so applying the same set again changes nothing. The
+// snapshots of removed schedules are kept. With dryRun only the changes are
+// reported.
+func (zd *ZfsDriver) ApplySchedules(set *ScheduleSet, dryRun bool) (_ *ScheduleReport, err error) {
+	defer observe("schedules", &err)
+	if err := set.validate(); err != nil {
+		return nil, err
+	}
+	for i := range set.Schedules {
+		set.Schedules[i].normalize()
+	}
+	report := &ScheduleReport{DryRun: dryRun, Changes: []ScheduleChange{}}
+	err = zd.db.Update(func(tx *state.Tx) error {
+		want := make(map[string]bool)
+		for _, sc := range set.Schedules {
+			want[sc.Name] = true
+			var cur Schedule
+			found, err := tx.Get(scheduleBucket, sc.Name, &cur)
+			if err != nil {
+				return err
+			}
+			c := ScheduleChange{Schedule: sc.Name, Change: ScheduleUnchanged}
+			switch {
+			case !found:
+				c.Change = ScheduleAdded
+			case !sameSchedule(&cur, &sc):
+				c.Change = ScheduleChanged
+			}
+			report.Changes = append(report.Changes, c)
+			if c.Change != ScheduleUnchanged && !dryRun {
+				if err := tx.Put(scheduleBucket, sc.Name, &sc); err != nil {
+					return err
+				}
+			}
+		}
+		for _, name := range tx.Keys(scheduleBucket) {
+			if want[name] {
+				continue
+			}
+			report.Changes = append(report.Changes, ScheduleChange{Schedule: name, Change: ScheduleRemoved})
+			if !dryRun {
+				tx.Delete(scheduleBucket, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(report.Changes, func(i, j int) bool { return report.Changes[i].Schedule < report.Changes[j].Schedule })
+	for i, c := range report.Changes {
+		for j := range set.Schedules {
+			if set.Schedules[j].Name == c.Schedule {
+				report.Changes[i].Volumes = zd.scheduledVolumes(&set.Schedules[j])
+			}
+		}
+		if c.Change != ScheduleUnchanged {
+			log.WithFields(log.Fields{"schedule": c.Schedule, "change": c.Change, "dry_run": dryRun}).Info("Applied snapshot schedule")
+		}
+	}
+	return report, nil
+}
+
+// normalize sorts the lists of sc whose order does not matter, so a file
+// whose volumes or retentions were reordered stores the same schedule
+func (sc *Schedule) normalize() {
+	sort.Strings(sc.Volumes)
+	sort.Slice(sc.Snapshots, func(i, j int) bool { return sc.Snapshots[i].Prefix < sc.Snapshots[j].Prefix })
+	for _, sn := range sc.Snapshots {
+		keep := sn.Keep
+		sort.Slice(keep, func(i, j int) bool {
+			if keep[i].Within != keep[j].Within {
+				return keep[i].Within < keep[j].Within
+			}
+			return keep[i].Every < keep[j].Every
+		})
+	}
+}
+
+// sameSchedule compares schedules by their stored form, so empty and
+// missing lists are the same. Stored schedules from before lists were
+// sorted are normalized first.
+func sameSchedule(a, b *Schedule) bool {
+	a.normalize()
+	b.normalize()
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// mirrorInterval returns the replication interval sc declares, 0 if it
+// declares none
+func (sc *Schedule) mirrorInterval() (time.Duration, error) {
+	if sc.Replication == nil {
+		return 0, nil
+	}
+	if sc.Replication.MirrorInterval == "" {
+		return 0, policyErrorf("schedule %s: replication needs a mirror_interval", sc.Name)
+	}
+	d, err := parseMirrorInterval(sc.Replication.MirrorInterval)
+	if err != nil {
+		return 0, policyErrorf("schedule %s: %v", sc.Name, err)
+	}
+	return d, nil
+}
+
+// scheduledVolumes returns the volumes sc applies to, sorted: those it
+// snapshots and the mirrors whose replication it sets
+func (zd *ZfsDriver) scheduledVolumes(sc *Schedule) []string {
+	var names []string
+	for _, name := range zd.db.Keys(mappingBucket) {
+		m, ok, err := zd.getMapping(name)
+		if !ok || err != nil || m.replica() || m.archived() || !sc.matches(zd.codec, name, m) {
+			continue
+		}
+		if mirror := m.Options[OptMirror] != ""; (mirror && sc.Replication != nil) || (!mirror && len(sc.Snapshots) > 0) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scheduledMirrorInterval returns how often the mirror volume name is
+// updated, the shortest interval of the schedules applying to it or else
+// its mirror-interval option
+func (zd *ZfsDriver) scheduledMirrorInterval(scheds []Schedule, name string, m *mapping) (time.Duration, error) {
+	var iv time.Duration
+	for i := range scheds {
+		sc := &scheds[i]
+		if sc.Replication == nil || !sc.matches(zd.codec, name, m) {
+			continue
+		}
+		d, err := sc.mirrorInterval()
+		if err != nil {
+			log.WithError(err).WithField("schedule", sc.Name).Error("Invalid stored replication schedule")
+			continue
+		}
+		if iv == 0 || d < iv {
+			iv = d
+		}
+	}
+	if iv > 0 {
+		return iv, nil
+	}
+	return parseMirrorInterval(m.Options[OptMirrorInterval])
+}
+
+// scheduledPolicies returns the snapshot policies scheds declare for the
+// volume name
+func (zd *ZfsDriver) scheduledPolicies(scheds []Schedule, name string, m *mapping) []snapshotPolicy {
+	var ps []snapshotPolicy
+	for i := range scheds {
+		sc := &scheds[i]
+		if !sc.matches(zd.codec, name, m) {
+			continue
+		}
+		p, err := sc.policies()
+		if err != nil {
+			log.WithError(err).WithField("schedule", sc.Name).Error("Invalid stored snapshot schedule")
+			continue
+		}
+		ps = append(ps, p...)
+	}
+	return ps
+}
@@ -0,0 +1,212 @@
+package zfsdriver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Capabilities the self test checks besides the storage path itself
+const (
+	SelfTestEncryption = "encryption"
+	SelfTestZstd       = "zstd"
+	SelfTestDelegation = "delegation"
+)
+
+var selfTestCapabilities = []string{SelfTestEncryption, SelfTestZstd, SelfTestDelegation}
+
+// SelfTestCheck is the outcome of one step of the self test on a root dataset
+type SelfTestCheck struct {
+	Dataset string `json:"dataset"`
+	Check   string `json:"check"`
+	// Capability is set for optional features, they only fail the self test
+	// if they are required
+	Capability bool   `json:"capability,omitempty"`
+	Passed     bool   `json:"passed"`
+	Error      string `json:"error,omitempty"`
+	Duration   string `json:"duration"`
+}
+
+// SelfTestReport is the outcome of the self test, Passed is false if any
+// step of the storage path or a required capability failed
+type SelfTestReport struct {
+	Passed bool            `json:"passed"`
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+func (r *SelfTestReport) check(rds, name string, capability bool, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	c := SelfTestCheck{Dataset: rds, Check: name, Capability: capability, Passed: err == nil, Duration: time.Since(start).String()}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+	return err
+}
+
+// SelfTest creates, mounts, writes, snapshots and destroys a temporary
+// dataset under each root dataset and checks that volumes can be encrypted,
+// compressed with zstd and delegated. The capabilities in require fail the
+// self test like the storage path does, the others are only reported.
+func (zd *ZfsDriver) SelfTest(ctx context.Context, require []string) (_ *SelfTestReport, err error) {
+	defer observe("self-test", &err)
+	known := make(map[string]bool)
+	for _, c := range selfTestCapabilities {
+		known[c] = true
+	}
+	required := make(map[string]bool)
+	for _, c := range require {
+		if !known[c] {
+			return nil, fmt.Errorf("unknown self test capability %q, expected one of %s", c, strings.Join(selfTestCapabilities, ", "))
+		}
+		required[c] = true
+	}
+	report := &SelfTestReport{Checks: []SelfTestCheck{}}
+	for _, rds := range zd.rds {
+		zd.selfTest(ctx, report, rds)
+	}
+	report.Passed = true
+	for _, c := range report.Checks {
+		if !c.Passed && (!c.Capability || required[c.Check]) {
+			report.Passed = false
+		}
+	}
+	return report, nil
+}
+
+func (zd *ZfsDriver) selfTest(ctx context.Context, r *SelfTestReport, rds string) {
+	ds := rds + "/docker-zfs-plugin-selftest-" + newGUID()[:8]
+	log.WithField("dataset", ds).Info("Running self test")
+	if r.check(rds, "create", false, func() error { return zd.createDataset(ds, false, nil) }) != nil {
+		return
+	}
+	defer func() {
+		_ = r.check(rds, "destroy", false, func() error {
+			if err := zd.destroyDataset(ds); err != nil {
+				return err
+			}
+			if zd.datasetExists(ds) {
+				return fmt.Errorf("dataset %s still exists after destroying it", ds)
+			}
+			return nil
+		})
+	}()
+
+	var mp string
+	mounted := r.check(rds, "mount", false, func() error {
+		var err error
+		if mp, err = zd.getMountpoint("selftest", ds); err != nil {
+			return err
+		}
+		if mounted, err := zd.getProperty("selftest", ds, "mounted"); err != nil {
+			return err
+		} else if mounted != "yes" {
+			if _, err := zd.runner.run(ctx, "selftest", "zfs", "mount", ds); err != nil {
+				return err
+			}
+		}
+		ms, err := readMountinfo()
+		if err != nil {
+			return err
+		}
+		if issue := checkMount(ds, mp, ms); issue != "" {
+			return fmt.Errorf("%s", issue)
+		}
+		return nil
+	}) == nil
+	if mounted {
+		_ = r.check(rds, "write", false, func() error { return selfTestWrite(mp) })
+	}
+	_ = r.check(rds, "snapshot", false, func() error {
+		if err := zd.snapshot("selftest", ds+"@selftest"); err != nil {
+			return err
+		}
+		if _, err := zd.zfs("selftest", "list", "-H", "-o", "name", "-t", "snapshot", ds+"@selftest"); err != nil {
+			return fmt.Errorf("snapshot is not listed: %w", err)
+		}
+		return nil
+	})
+
+	_ = r.check(rds, SelfTestEncryption, true, func() error { return zd.selfTestEncryption(ds + "/encryption") })
+	_ = r.check(rds, SelfTestZstd, true, func() error {
+		return zd.createDataset(ds+"/zstd", false, map[string]string{"compression": "zstd"})
+	})
+	_ = r.check(rds, SelfTestDelegation, true, func() error {
+		pool := strings.SplitN(rds, "/", 2)[0]
+		out, err := zd.runner.run(ctx, "selftest", "zpool", "get", "-H", "-p", "-o", "value", "delegation", pool)
+		if err != nil {
+			return err
+		}
+		if v := strings.TrimSpace(string(out)); v != "on" {
+			return fmt.Errorf("delegation is %s on pool %s", v, pool)
+		}
+		_, err = zd.zfs("selftest", "allow", "-e", "snapshot", ds)
+		return err
+	})
+}
+
+// selfTestWrite writes a file to mp, syncs it and reads it back
+func selfTestWrite(mp string) error {
+	data := make([]byte, 64<<10)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	file := filepath.Join(mp, "selftest")
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read back %d bytes from %s which differ from the %d written", len(got), file, len(data))
+	}
+	return nil
+}
+
+// selfTestEncryption creates the encrypted dataset ds with a random key in a
+// temporary file
+func (zd *ZfsDriver) selfTestEncryption(ds string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "docker-zfs-plugin-selftest-key")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = fmt.Fprintf(f, "%x", key)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return zd.createDataset(ds, false, map[string]string{
+		"encryption":  "on",
+		"keyformat":   "hex",
+		"keylocation": "file://" + f.Name(),
+	})
+}
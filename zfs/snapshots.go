@@ -0,0 +1,121 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	log "github.com/sirupsen/logrus"
+)
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]*$`)
+
+// Snapshot is a snapshot of a volume
+type Snapshot struct {
+	Volume  string    `json:"volume"`
+	Name    string    `json:"name"`
+	Dataset string    `json:"dataset"`
+	Created time.Time `json:"created"`
+}
+
+// ListSnapshots returns the snapshots of a volume ordered by creation
+func (zd *ZfsDriver) ListSnapshots(volume string) (_ []Snapshot, err error) {
+	defer observe("snapshot", &err)
+	ds, err := zd.resolveExisting(volume)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := zd.listSnapshots("snapshot", ds)
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]Snapshot, 0, len(infos))
+	for _, si := range infos {
+		snaps = append(snaps, Snapshot{Volume: volume, Name: si.Name[strings.Index(si.Name, "@")+1:], Dataset: ds, Created: si.Created})
+	}
+	return snaps, nil
+}
+
+// CreateSnapshot takes a named snapshot of a volume
+func (zd *ZfsDriver) CreateSnapshot(volume, name string) (_ *Snapshot, err error) {
+	defer observe("snapshot", &err)
+	log.WithFields(log.Fields{"volume": volume, "snapshot": name}).Debug("CreateSnapshot")
+	if !snapshotName.MatchString(name) {
+		return nil, policyErrorf("invalid snapshot name %q", name)
+	}
+	ds, err := zd.resolveWritable(volume)
+	if err != nil {
+		return nil, err
+	}
+	if err := zd.snapshot("snapshot", ds+"@"+name); err != nil {
+		if strings.Contains(err.Error(), "dataset already exists") {
+			return nil, policyErrorf("snapshot %s of volume %s already exists", name, volume)
+		}
+		return nil, err
+	}
+	created, err := zd.getCreation("snapshot", ds+"@"+name)
+	if err != nil {
+		created = time.Now()
+	}
+	zd.events.Publish(events.Event{Type: events.VolumeSnapshot, Volume: volume, Dataset: ds,
+		Details: map[string]string{"snapshot": ds + "@" + name, "policy": "manual"}})
+	return &Snapshot{Volume: volume, Name: name, Dataset: ds, Created: created}, nil
+}
+
+// DeleteSnapshot destroys a snapshot of a volume, snapshots other volumes
+// were cloned from cannot be destroyed
+func (zd *ZfsDriver) DeleteSnapshot(volume, name string) (err error) {
+	defer observe("snapshot", &err)
+	log.WithFields(log.Fields{"volume": volume, "snapshot": name}).Debug("DeleteSnapshot")
+	if !snapshotName.MatchString(name) {
+		return policyErrorf("invalid snapshot name %q", name)
+	}
+	ds, err := zd.resolveWritable(volume)
+	if err != nil {
+		return err
+	}
+	if _, err := zd.zfs("snapshot", "destroy", ds+"@"+name); err != nil {
+		return snapshotDestroyError(err, volume, name)
+	}
+	return nil
+}
+
+// snapshotDestroyError explains why destroying snapshot name of volume failed
+func snapshotDestroyError(err error, volume, name string) error {
+	if isNotExist(err) {
+		return fmt.Errorf("snapshot %s of volume %s: %w", name, volume, ErrNotFound)
+	}
+	if strings.Contains(err.Error(), "dependent clones") {
+		return policyErrorf("snapshot %s of volume %s has dependent clones", name, volume)
+	}
+	if strings.Contains(err.Error(), "dataset is busy") {
+		return policyErrorf("snapshot %s of volume %s is held or in use", name, volume)
+	}
+	return err
+}
+
+// createClone creates dataset as a writable clone of a snapshot of the from
+// volume. Without a snapshot name the current state of from is snapshotted.
+func (zd *ZfsDriver) createClone(dataset, from, snapshot string, props map[string]string) error {
+	src, err := zd.resolveExisting(from)
+	if err != nil {
+		return err
+	}
+	if snapshot == "" {
+		snapshot = "clone-" + time.Now().UTC().Format("20060102T150405.000000000Z")
+		if err := zd.snapshot("create", src+"@"+snapshot); err != nil {
+			return err
+		}
+	} else if !zd.snapshotExists(src + "@" + snapshot) {
+		return fmt.Errorf("snapshot %s of volume %s: %w", snapshot, from, ErrNotFound)
+	}
+	log.WithFields(log.Fields{"snapshot": src + "@" + snapshot, "dataset": dataset}).Info("Creating clone")
+	return zd.cloneSnapshot(src+"@"+snapshot, dataset, false, props)
+}
+
+func (zd *ZfsDriver) snapshotExists(name string) bool {
+	_, err := zd.zfs("exists", "list", "-H", "-o", "name", "-t", "snapshot", name)
+	return err == nil
+}
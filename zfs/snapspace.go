@@ -0,0 +1,96 @@
+package zfsdriver
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// SnapshotUsage is the space of a single snapshot. Used is the space only
+// this snapshot holds, destroying several snapshots usually frees more than
+// the sum of their Used.
+type SnapshotUsage struct {
+	Name       string    `json:"name"`
+	Created    time.Time `json:"created"`
+	Used       uint64    `json:"used"`
+	Referenced uint64    `json:"referenced"`
+}
+
+// SnapshotSpace attributes the space of a volume held by its snapshots
+type SnapshotSpace struct {
+	Volume          string          `json:"volume"`
+	Dataset         string          `json:"dataset"`
+	UsedBySnapshots uint64          `json:"used_by_snapshots"`
+	Snapshots       []SnapshotUsage `json:"snapshots,omitempty"`
+	// Prune is what destroying the pruning candidates together would free
+	Prune *DestroyPlan `json:"prune,omitempty"`
+}
+
+// SnapshotSpace returns the space held by the snapshots of a volume, in
+// total and per snapshot. If prune names snapshots, the space destroying
+// all of them would free is simulated with zfs destroy -n.
+func (zd *ZfsDriver) SnapshotSpace(volume string, prune []string) (_ *SnapshotSpace, err error) {
+	defer observe("snapshot", &err)
+	log.WithFields(log.Fields{"volume": volume, "prune": prune}).Debug("SnapshotSpace")
+	for _, p := range prune {
+		if !snapshotName.MatchString(p) {
+			return nil, policyErrorf("invalid snapshot name %q", p)
+		}
+	}
+	ds, err := zd.resolveExisting(volume)
+	if err != nil {
+		return nil, err
+	}
+	out, err := zd.zfs("snapshot", "get", "-Hp", "-o", "value", "usedbysnapshots", ds)
+	if err != nil {
+		return nil, err
+	}
+	res := &SnapshotSpace{Volume: volume, Dataset: ds}
+	res.UsedBySnapshots, _ = zfsout.Uint(string(out))
+
+	out, err = zd.zfs("snapshot", "list", "-Hp", "-t", "snapshot", "-d", "1", "-s", "creation", "-o", "name,creation,used,referenced", ds)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zfsout.Records(out, 4) {
+		ts, _ := zfsout.Time(f[1])
+		used, _ := zfsout.Uint(f[2])
+		ref, _ := zfsout.Uint(f[3])
+		res.Snapshots = append(res.Snapshots, SnapshotUsage{Name: f[0][strings.Index(f[0], "@")+1:], Created: ts, Used: used, Referenced: ref})
+	}
+
+	if len(prune) > 0 {
+		res.Prune = &DestroyPlan{Operation: "prune-snapshots"}
+		if err := zd.planDestroy(res.Prune, nil, ds+"@"+strings.Join(prune, ",")); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// SnapshotSpaces returns the space held by snapshots of every volume, the
+// largest first, without the individual snapshots
+func (zd *ZfsDriver) SnapshotSpaces() (_ []SnapshotSpace, err error) {
+	defer observe("snapshot", &err)
+	names := zd.volumeNames()
+	res := []SnapshotSpace{}
+	for _, rds := range zd.rds {
+		out, err := zd.zfs("snapshot", "list", "-Hp", "-r", "-t", "filesystem", "-o", "name,usedbysnapshots", rds)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zfsout.Records(out, 2) {
+			name, ok := names[f[0]]
+			if !ok {
+				continue
+			}
+			used, _ := zfsout.Uint(f[1])
+			res = append(res, SnapshotSpace{Volume: name, Dataset: f[0], UsedBySnapshots: used})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].UsedBySnapshots > res[j].UsedBySnapshots })
+	return res, nil
+}
@@ -0,0 +1,76 @@
+package zfsdriver
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// userPropPrefix namespaces the user properties the plugin sets on datasets
+const userPropPrefix = "docker-zfs-plugin:"
+
+// propWarning holds a warning about a dangerous setting of the dataset
+const propWarning = userPropPrefix + "warning"
+
+// statusProperties are the dataset properties reported in a volume's status
+var statusProperties = []string{propWarning, propClass, "copies", "used", "logicalused", "quota", "available"}
+
+// encryptionProperties are reported for encrypted volumes, zfs before 0.8
+// does not know them
+var encryptionProperties = []string{"encryption", "keystatus", "keylocation", "encryptionroot"}
+
+// status returns the driver specific status of a volume for docker volume inspect
+func (zd *ZfsDriver) status(name, ds string) (map[string]interface{}, error) {
+	props, err := zd.getProperties("get", ds, append(append([]string{}, statusProperties...), encryptionProperties...)...)
+	var cerr *CommandError
+	if errors.As(err, &cerr) && strings.Contains(cerr.Stderr, "invalid property") {
+		props, err = zd.getProperties("get", ds, statusProperties...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := make(map[string]interface{})
+	if w := props[propWarning]; w != "" && w != "-" {
+		st["warning"] = w
+	}
+	if c := zd.classOf(name); c != "" {
+		st["class"] = c
+	} else if c := props[propClass]; c != "" && c != "-" {
+		st["class"] = c
+	}
+
+	// used, quota and available count every copy of a block, so with
+	// copies>1 the data that fits is only a fraction of them
+	copies, err := strconv.ParseUint(props["copies"], 10, 64)
+	if err != nil || copies == 0 {
+		copies = 1
+	}
+	st["copies"] = copies
+	for _, p := range []string{"used", "logicalused", "quota", "available"} {
+		if n, err := strconv.ParseUint(props[p], 10, 64); err == nil {
+			st[p] = n
+		}
+	}
+	if n, ok := st["available"].(uint64); ok {
+		st["usable_available"] = n / copies
+	}
+	if n, ok := st["quota"].(uint64); ok && n > 0 {
+		st["usable_quota"] = n / copies
+	}
+	// keystatus tells whether the key is loaded and the volume can be mounted
+	if e := props["encryption"]; e != "" && e != "off" && e != "-" {
+		for _, p := range encryptionProperties {
+			st[p] = props[p]
+		}
+	}
+	if zd.locker != nil {
+		st["lock"] = zd.lockStatus(name)
+	}
+	if m, ok, _ := zd.getMapping(name); ok && m.Delegation != nil {
+		st["delegation"] = m.Delegation
+	}
+	if h := zd.latestHistory(name); len(h) > 0 {
+		st["history"] = h
+	}
+	return st, nil
+}
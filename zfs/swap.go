@@ -0,0 +1,88 @@
+package zfsdriver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/events"
+	"github.com/TrilliumIT/docker-zfs-plugin/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// SwapResult describes a completed swap
+type SwapResult struct {
+	Snapshots []string          `json:"snapshots"`
+	Datasets  map[string]string `json:"datasets"`
+}
+
+// Swap exchanges the datasets backing volumes a and b, for promoting a
+// dataset prepared offline in a blue/green upgrade. Both volumes must be
+// unmounted. Both datasets are snapshotted in one transaction first, so the
+// previous state can be restored.
+func (zd *ZfsDriver) Swap(a, b string) (_ *SwapResult, err error) {
+	defer observe("swap", &err)
+	log.WithFields(log.Fields{"a": a, "b": b}).Debug("Swap")
+	if a == b {
+		return nil, policyErrorf("cannot swap volume %s with itself", a)
+	}
+	dsA, err := zd.resolveWritable(a)
+	if err != nil {
+		return nil, err
+	}
+	dsB, err := zd.resolveWritable(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range []string{a, b} {
+		if ids := zd.mounted(v); len(ids) > 0 {
+			return nil, policyErrorf("volume %s is mounted by %d container(s)", v, len(ids))
+		}
+	}
+
+	snap := "swap-" + time.Now().UTC().Format("20060102T150405Z")
+	res := &SwapResult{Snapshots: []string{dsA + "@" + snap, dsB + "@" + snap}}
+	if err := zd.snapshot("swap", res.Snapshots...); err != nil {
+		return nil, fmt.Errorf("failed to snapshot volumes before swap: %w", err)
+	}
+
+	err = zd.db.Update(func(tx *state.Tx) error {
+		ma, mb := mapping{Dataset: dsA}, mapping{Dataset: dsB}
+		if _, err := tx.Get(mappingBucket, a, &ma); err != nil {
+			return err
+		}
+		if _, err := tx.Get(mappingBucket, b, &mb); err != nil {
+			return err
+		}
+		ma.Dataset, mb.Dataset = dsB, dsA
+		ma.GUID, mb.GUID = mb.GUID, ma.GUID
+		ma.ZfsGUID, mb.ZfsGUID = mb.ZfsGUID, ma.ZfsGUID
+		if err := tx.Put(mappingBucket, a, &ma); err != nil {
+			return err
+		}
+		return tx.Put(mappingBucket, b, &mb)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res.Datasets = map[string]string{a: dsB, b: dsA}
+	log.WithFields(log.Fields{a: dsB, b: dsA}).Info("Swapped volume datasets")
+	zd.events.Publish(events.Event{Type: events.VolumeSwap, Volume: a, Dataset: dsB,
+		Details: map[string]string{"other": b, "other_dataset": dsA, "snapshot": snap}})
+	return res, nil
+}
+
+// resolveExisting resolves a volume and checks its dataset exists
+func (zd *ZfsDriver) resolveExisting(name string) (string, error) {
+	ds, err := zd.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	if !zd.datasetExists(ds) {
+		if to, ok := zd.relocate(name); ok {
+			return to, nil
+		}
+		return "", fmt.Errorf("volume %s: %w", name, ErrNotFound)
+	}
+	return ds, nil
+}
@@ -0,0 +1,99 @@
+package zfsdriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MountTemplate is applied to the mountpoint of every new volume
+type MountTemplate struct {
+	// Mode of the mountpoint including setuid, setgid and sticky bits, 0 leaves it unchanged
+	Mode os.FileMode
+	// UID and GID own the mountpoint, -1 leaves them unchanged
+	UID int
+	GID int
+	// ACL entries in setfacl syntax, default entries start with d:
+	ACL []string
+}
+
+// ParseMode parses an octal mode such as 2775 into an os.FileMode
+func ParseMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permissions such as 2775", s)
+	}
+	m := os.FileMode(n & 0777)
+	if n&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m, nil
+}
+
+// ParseOwner parses uid:gid, either may be empty to leave it unchanged
+func ParseOwner(s string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if s == "" {
+		return uid, gid, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if parts[0] != "" {
+		if uid, err = strconv.Atoi(parts[0]); err != nil {
+			return -1, -1, fmt.Errorf("invalid uid in owner %q", s)
+		}
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		if gid, err = strconv.Atoi(parts[1]); err != nil {
+			return -1, -1, fmt.Errorf("invalid gid in owner %q", s)
+		}
+	}
+	return uid, gid, nil
+}
+
+// templateProperties adds the properties the template needs to props,
+// posix ACLs must be enabled on the dataset for setfacl to work
+func (t *MountTemplate) templateProperties(props map[string]string) {
+	if t == nil || len(t.ACL) == 0 {
+		return
+	}
+	if _, ok := props["acltype"]; !ok {
+		props["acltype"] = "posixacl"
+	}
+}
+
+// applyTemplate sets ownership, mode and ACLs of a new volume's mountpoint
+func (zd *ZfsDriver) applyTemplate(dataset string) error {
+	t := zd.template
+	if t == nil {
+		return nil
+	}
+	mp, err := zd.getMountpoint("create", dataset)
+	if err != nil {
+		return err
+	}
+	if t.UID >= 0 || t.GID >= 0 {
+		if err := os.Chown(mp, t.UID, t.GID); err != nil {
+			return err
+		}
+	}
+	// chmod after chown, changing the owner clears the setuid and setgid bits
+	if t.Mode != 0 {
+		if err := os.Chmod(mp, t.Mode); err != nil {
+			return err
+		}
+	}
+	if len(t.ACL) > 0 {
+		if _, err := zd.runner.run(context.Background(), "create", "setfacl", "-m", strings.Join(t.ACL, ","), mp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package zfsdriver
+
+import (
+	"path"
+	"strings"
+)
+
+const syncDisabledWarning = "sync=disabled, writes acknowledged in the last few seconds are lost on a crash"
+
+// syncDisabled returns true if props turn off synchronous writes
+func syncDisabled(props map[string]string) bool {
+	return strings.EqualFold(props["sync"], "disabled")
+}
+
+// unsafeAllowed returns true if the volume matches the unsafe sync allowlist
+func (zd *ZfsDriver) unsafeAllowed(name string) bool {
+	for _, pattern := range zd.unsafeSync {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsUnsafe reports whether the options of a volume accept an unsafe
+// value of property, by -o force-unsafe=true or through a profile which sets
+// it, like scratch disabling sync
+func acceptsUnsafe(opts map[string]string, property string) bool {
+	if opts[OptForceUnsafe] == "true" {
+		return true
+	}
+	p, ok := profiles[opts[OptProfile]]
+	return ok && p.Unsafe[property]
+}
+
+// guardUnsafe rejects sync=disabled unless the volume options accept it or
+// the volume is allowlisted, and tags the dataset with a warning when it is
+// accepted
+func (zd *ZfsDriver) guardUnsafe(name string, props, opts map[string]string) error {
+	if !syncDisabled(props) {
+		return nil
+	}
+	if !acceptsUnsafe(opts, "sync") && !zd.unsafeAllowed(name) {
+		return policyErrorf("sync=disabled loses acknowledged writes on a crash, set -o %s=true to accept the risk", OptForceUnsafe)
+	}
+	props[propWarning] = syncDisabledWarning
+	return nil
+}
@@ -0,0 +1,287 @@
+package zfsdriver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/metrics"
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// PoolStatus is the state of a pool and the devices behind it
+type PoolStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	// Status and Action explain a problem of the pool and how to fix it,
+	// ErrorCount counts its data errors. They are only known from the JSON
+	// output of zpool status.
+	Status     string       `json:"status,omitempty"`
+	Action     string       `json:"action,omitempty"`
+	ErrorCount uint64       `json:"error_count,omitempty"`
+	Scan       *ScanStatus  `json:"scan,omitempty"`
+	Vdevs      []VdevStatus `json:"vdevs"`
+	// Multihost is set for pools with multihost protection enabled
+	Multihost *MultihostStatus `json:"multihost,omitempty"`
+}
+
+// ScanStatus describes the last or running scrub or resilver of a pool
+type ScanStatus struct {
+	Function   string  `json:"function"`
+	InProgress bool    `json:"in_progress"`
+	Progress   float64 `json:"progress_percent,omitempty"`
+	Summary    string  `json:"summary"`
+}
+
+// VdevStatus is a row of the config section of zpool status
+type VdevStatus struct {
+	Name     string `json:"name"`
+	Depth    int    `json:"depth"`
+	State    string `json:"state"`
+	Read     uint64 `json:"read_errors"`
+	Write    uint64 `json:"write_errors"`
+	Checksum uint64 `json:"checksum_errors"`
+	Message  string `json:"message,omitempty"`
+}
+
+var scanProgress = regexp.MustCompile(`([0-9.]+)% done`)
+
+var vdevStates = []string{"ONLINE", "DEGRADED", "FAULTED", "OFFLINE", "UNAVAIL", "REMOVED"}
+
+var (
+	vdevState = metrics.NewGaugeVec("zfs_plugin_vdev_state",
+		"1 for the current state of each vdev of the configured pools", "pool", "vdev", "state")
+	vdevErrors = metrics.NewGaugeVec("zfs_plugin_vdev_errors",
+		"Error counts of each vdev of the configured pools", "pool", "vdev", "type")
+	poolScanProgress = metrics.NewGaugeVec("zfs_plugin_pool_scan_progress_percent",
+		"Progress of a running scrub or resilver", "pool", "function")
+)
+
+func init() {
+	metrics.MustRegister(vdevState, vdevErrors, poolScanProgress)
+}
+
+// PoolStatus returns the state of the configured pools and their devices
+func (zd *ZfsDriver) PoolStatus(ctx context.Context) ([]PoolStatus, error) {
+	pools, err := zd.poolStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pools {
+		if pools[i].Multihost, err = zd.multihost(ctx, pools[i].Name); err != nil {
+			return nil, err
+		}
+	}
+	return pools, nil
+}
+
+// poolStatus parses zpool status of the configured pools, from its JSON
+// output where it is supported
+func (zd *ZfsDriver) poolStatus(ctx context.Context) ([]PoolStatus, error) {
+	if zd.json.zpool {
+		out, err := zd.runner.run(ctx, "health", "zpool", append([]string{"status", "-j", "-p"}, zd.Pools()...)...)
+		if err != nil {
+			return nil, err
+		}
+		pools, err := zfsout.Pools(out)
+		if err == nil {
+			return poolStatusJSON(pools), nil
+		}
+		jsonFallback("zpool status", err)
+	}
+	out, err := zd.runner.run(ctx, "health", "zpool", append([]string{"status", "-p", "-P"}, zd.Pools()...)...)
+	if err != nil {
+		return nil, err
+	}
+	return parsePoolStatus(out), nil
+}
+
+func poolStatusJSON(pools []zfsout.Pool) []PoolStatus {
+	ps := make([]PoolStatus, 0, len(pools))
+	for _, p := range pools {
+		st := PoolStatus{Name: p.Name, State: p.State, Status: p.Status, Action: p.Action, Scan: scanStatusJSON(p.Scan)}
+		st.ErrorCount, _ = zfsout.Uint(string(p.ErrorCount))
+		// like the config section of zpool status, the root vdev is at depth
+		// 0 and the devices of logs, caches and spares at depth 1
+		st.Vdevs = appendVdevsJSON(st.Vdevs, p.Vdevs, 0)
+		for _, vs := range []zfsout.Vdevs{p.Logs, p.Cache, p.Spares} {
+			st.Vdevs = appendVdevsJSON(st.Vdevs, vs, 1)
+		}
+		ps = append(ps, st)
+	}
+	return ps
+}
+
+// appendVdevsJSON appends vs and the vdevs below them depth first, leaf
+// vdevs are named by their device path as with zpool status -P
+func appendVdevsJSON(out []VdevStatus, vs zfsout.Vdevs, depth int) []VdevStatus {
+	for _, v := range vs {
+		st := VdevStatus{Name: v.Name, Depth: depth, State: v.State}
+		if v.Path != "" {
+			st.Name = v.Path
+		}
+		st.Read, _ = zfsout.Uint(string(v.ReadErrors))
+		st.Write, _ = zfsout.Uint(string(v.WriteErrors))
+		st.Checksum, _ = zfsout.Uint(string(v.ChecksumErrors))
+		out = appendVdevsJSON(append(out, st), v.Vdevs, depth+1)
+	}
+	return out
+}
+
+func scanStatusJSON(sc *zfsout.Scan) *ScanStatus {
+	if sc == nil || sc.Function == "" {
+		return nil
+	}
+	st := &ScanStatus{Function: strings.ToLower(sc.Function), InProgress: sc.State == "SCANNING"}
+	switch {
+	case st.InProgress:
+		total, _ := zfsout.Uint(string(sc.ToExamine))
+		skipped, _ := zfsout.Uint(string(sc.Skipped))
+		issued, _ := zfsout.Uint(string(sc.Issued))
+		if total > skipped {
+			st.Progress = float64(issued) * 100 / float64(total-skipped)
+		}
+		st.Summary = fmt.Sprintf("%s in progress since %s, %.2f%% done", st.Function, scanTime(sc.StartTime), st.Progress)
+	case sc.State == "FINISHED":
+		st.Summary = fmt.Sprintf("%s finished with %s errors on %s", st.Function, sc.Errors, scanTime(sc.EndTime))
+	default:
+		st.Summary = fmt.Sprintf("%s %s on %s", st.Function, strings.ToLower(sc.State), scanTime(sc.EndTime))
+	}
+	return st
+}
+
+// scanTime formats the start or end of a scan, printed in seconds with -p
+func scanTime(v zfsout.Value) string {
+	if t, ok := zfsout.Time(string(v)); ok {
+		return t.Format(time.RFC3339)
+	}
+	return string(v)
+}
+
+func parsePoolStatus(out []byte) []PoolStatus {
+	var pools []PoolStatus
+	var p *PoolStatus
+	section := ""
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		if i := strings.Index(line, ": "); i >= 0 && !strings.HasPrefix(line, "\t") && strings.TrimSpace(line[:i]) != "" {
+			section = strings.TrimSpace(line[:i])
+			value := strings.TrimSpace(line[i+2:])
+			switch section {
+			case "pool":
+				pools = append(pools, PoolStatus{Name: value})
+				p = &pools[len(pools)-1]
+			case "state":
+				if p != nil {
+					p.State = value
+				}
+			case "scan":
+				if p != nil {
+					p.Scan = &ScanStatus{Summary: value}
+				}
+			}
+			continue
+		}
+		if strings.HasSuffix(trimmed, ":") && !strings.HasPrefix(line, "\t") {
+			section = strings.TrimSuffix(trimmed, ":")
+			continue
+		}
+		if p == nil || trimmed == "" {
+			continue
+		}
+		switch section {
+		case "scan":
+			if p.Scan != nil {
+				p.Scan.Summary += "\n" + trimmed
+			}
+		case "config":
+			f := strings.Fields(trimmed)
+			if len(f) < 2 || f[0] == "NAME" {
+				continue
+			}
+			v := VdevStatus{Name: f[0], State: f[1], Depth: (len(strings.TrimPrefix(line, "\t")) - len(strings.TrimLeft(strings.TrimPrefix(line, "\t"), " "))) / 2}
+			if len(f) >= 5 {
+				v.Read, _ = strconv.ParseUint(f[2], 10, 64)
+				v.Write, _ = strconv.ParseUint(f[3], 10, 64)
+				v.Checksum, _ = strconv.ParseUint(f[4], 10, 64)
+			}
+			if len(f) > 5 {
+				v.Message = strings.Join(f[5:], " ")
+			}
+			p.Vdevs = append(p.Vdevs, v)
+		}
+	}
+	for i := range pools {
+		parseScan(pools[i].Scan)
+	}
+	return pools
+}
+
+func parseScan(sc *ScanStatus) {
+	if sc == nil {
+		return
+	}
+	f := strings.Fields(sc.Summary)
+	if len(f) > 0 {
+		sc.Function = f[0]
+	}
+	sc.InProgress = strings.Contains(sc.Summary, "in progress")
+	if m := scanProgress.FindStringSubmatch(sc.Summary); m != nil {
+		sc.Progress, _ = strconv.ParseFloat(m[1], 64)
+	}
+}
+
+// checkVdevs refreshes the cached pool status and the vdev metrics
+func (zd *ZfsDriver) checkVdevs(ctx context.Context) {
+	pools, err := zd.PoolStatus(ctx)
+	if err != nil {
+		log.WithError(err).Error("Failed to get pool status")
+		return
+	}
+	zd.updateFences(pools)
+	vdevState.Reset()
+	vdevErrors.Reset()
+	poolScanProgress.Reset()
+	for _, p := range pools {
+		for _, v := range p.Vdevs {
+			for _, st := range vdevStates {
+				n := 0.0
+				if v.State == st {
+					n = 1
+				}
+				vdevState.Set(n, p.Name, v.Name, st)
+			}
+			vdevErrors.Set(float64(v.Read), p.Name, v.Name, "read")
+			vdevErrors.Set(float64(v.Write), p.Name, v.Name, "write")
+			vdevErrors.Set(float64(v.Checksum), p.Name, v.Name, "checksum")
+		}
+		if p.Scan != nil && p.Scan.InProgress {
+			poolScanProgress.Set(p.Scan.Progress, p.Name, p.Scan.Function)
+		}
+	}
+	zd.health.mu.Lock()
+	zd.health.status = pools
+	zd.health.statusTime = time.Now()
+	zd.health.mu.Unlock()
+}
+
+// Health returns the pool status cached by the health monitor, or queries it
+// if the monitor has not run yet
+func (zd *ZfsDriver) Health(ctx context.Context) ([]PoolStatus, time.Time, error) {
+	zd.health.mu.Lock()
+	pools, t := zd.health.status, zd.health.statusTime
+	zd.health.mu.Unlock()
+	if pools != nil {
+		return pools, t, nil
+	}
+	pools, err := zd.PoolStatus(ctx)
+	return pools, time.Now(), err
+}
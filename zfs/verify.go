@@ -0,0 +1,131 @@
+package zfsdriver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/TrilliumIT/docker-zfs-plugin/zfsout"
+	log "github.com/sirupsen/logrus"
+)
+
+// VerifyResult is the outcome of verifying the blocks of a volume
+type VerifyResult struct {
+	Volume   string   `json:"volume"`
+	Dataset  string   `json:"dataset"`
+	Snapshot string   `json:"snapshot"`
+	Bytes    int64    `json:"bytes"`
+	Duration string   `json:"duration"`
+	OK       bool     `json:"ok"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Progress receives the completion of a long operation as done of total
+// units, it may be nil
+type Progress func(done, total int64)
+
+func (p Progress) report(done, total int64) {
+	if p != nil {
+		p(done, total)
+	}
+}
+
+// countingWriter discards everything written to it and counts the bytes,
+// reporting them to progress out of total
+type countingWriter struct {
+	n        int64
+	total    int64
+	progress Progress
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	w.progress.report(w.n, w.total)
+	return len(p), nil
+}
+
+// Verify reads every block of a volume by sending a temporary snapshot of it
+// to a discarding sink, which forces zfs to check all their checksums. Read
+// errors and the permanent errors zpool status reports for the dataset are
+// returned in the result. The bytes sent are reported to progress out of
+// the estimated size of the stream.
+func (zd *ZfsDriver) Verify(ctx context.Context, name string, progress Progress) (_ *VerifyResult, err error) {
+	defer observe("verify", &err)
+	log.WithField("volume", name).Debug("Verify")
+	ds, err := zd.resolveExisting(name)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	res := &VerifyResult{Volume: name, Dataset: ds, Snapshot: ds + "@verify-" + start.UTC().Format("20060102T150405Z")}
+	if err := zd.snapshot("verify", res.Snapshot); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if _, err := zd.zfs("verify", "destroy", res.Snapshot); err != nil {
+			log.WithError(err).WithField("snapshot", res.Snapshot).Error("Failed to destroy verify snapshot")
+		}
+	}()
+
+	sink := countingWriter{total: zd.sendSize(ctx, res.Snapshot), progress: progress}
+	err = zd.runner.stream(ctx, "verify", &sink, "zfs", "send", "-L", "-e", "-c", res.Snapshot)
+	res.Bytes = sink.n
+	res.Duration = time.Since(start).String()
+	var cerr *CommandError
+	if errors.As(err, &cerr) && ctx.Err() == nil {
+		res.Errors = append(res.Errors, strings.TrimSpace(cerr.Stderr))
+	} else if err != nil {
+		return nil, err
+	}
+
+	perm, err := zd.permanentErrors(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+	res.Errors = append(res.Errors, perm...)
+	res.OK = len(res.Errors) == 0
+	if !res.OK {
+		log.WithFields(log.Fields{"volume": name, "errors": res.Errors}).Error("Volume failed verification")
+	}
+	return res, nil
+}
+
+// sendSize estimates the size of the verify stream of snapshot, 0 if unknown
+func (zd *ZfsDriver) sendSize(ctx context.Context, snapshot string) int64 {
+	out, err := zd.runner.run(ctx, "verify", "zfs", "send", "-n", "-P", "-L", "-e", "-c", snapshot)
+	if err != nil {
+		return 0
+	}
+	if n, ok := zfsout.Uint(zfsout.Pairs(out)["size"]); ok {
+		return int64(n)
+	}
+	return 0
+}
+
+// permanentErrors returns the files of dataset zpool status lists with
+// permanent errors
+func (zd *ZfsDriver) permanentErrors(ctx context.Context, ds string) ([]string, error) {
+	pool := strings.SplitN(ds, "/", 2)[0]
+	out, err := zd.runner.run(ctx, "verify", "zpool", "status", "-v", pool)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	inList := false
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(l, "errors:") {
+			inList = strings.Contains(l, "Permanent errors")
+			continue
+		}
+		if inList && (l == ds || strings.HasPrefix(l, ds+":") || strings.HasPrefix(l, ds+"@")) {
+			errs = append(errs, "permanent error: "+l)
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,201 @@
+package zfsout
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotJSON is returned for output which is not the JSON of zfs or zpool
+// -j, such as the text printed by versions before OpenZFS 2.3
+var ErrNotJSON = errors.New("not the JSON output of zfs or zpool")
+
+// Value is a value of the JSON output, printed as a string or, with
+// --json-int, as a number. Numbers keep their exact digits.
+type Value string
+
+// UnmarshalJSON accepts strings, numbers and null
+func (v *Value) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = Value(s)
+		return nil
+	}
+	if string(data) == "null" {
+		*v = ""
+		return nil
+	}
+	*v = Value(data)
+	return nil
+}
+
+// UnmarshalJSON decodes a property of zfs list -j or zfs get -j, with its
+// source in the form of the text output, such as local or inherited from
+// <dataset>
+func (p *Property) UnmarshalJSON(data []byte) error {
+	var jp struct {
+		Value  Value `json:"value"`
+		Source struct {
+			Type string `json:"type"`
+			Data string `json:"data"`
+		} `json:"source"`
+	}
+	if err := json.Unmarshal(data, &jp); err != nil {
+		return err
+	}
+	p.Value = string(jp.Value)
+	switch t := strings.ToLower(jp.Source.Type); t {
+	case "", "none":
+		p.Source = "-"
+	case "inherited":
+		p.Source = "inherited from " + jp.Source.Data
+	default:
+		p.Source = t
+	}
+	return nil
+}
+
+// Dataset is a dataset of zfs list -j
+type Dataset struct {
+	Name       string              `json:"name"`
+	Type       string              `json:"type"`
+	Pool       string              `json:"pool"`
+	Properties map[string]Property `json:"properties"`
+}
+
+// Datasets returns the datasets of zfs list -j or zfs get -j in the order
+// they are printed
+func Datasets(out []byte) ([]Dataset, error) {
+	var doc struct {
+		Version  *json.RawMessage `json:"output_version"`
+		Datasets json.RawMessage  `json:"datasets"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil || doc.Version == nil {
+		return nil, ErrNotJSON
+	}
+	var dss []Dataset
+	err := members(doc.Datasets, func(name string, raw json.RawMessage) error {
+		ds := Dataset{Name: name}
+		if err := json.Unmarshal(raw, &ds); err != nil {
+			return fmt.Errorf("dataset %s: %w", name, err)
+		}
+		dss = append(dss, ds)
+		return nil
+	})
+	return dss, err
+}
+
+// Pool is a pool of zpool status -j
+type Pool struct {
+	Name string `json:"name"`
+	// State is the health of the pool, such as ONLINE or DEGRADED
+	State string `json:"state"`
+	// Status and Action explain a problem of the pool and how to fix it
+	Status     string `json:"status"`
+	Action     string `json:"action"`
+	ErrorCount Value  `json:"error_count"`
+	Scan       *Scan  `json:"scan_stats"`
+	// Vdevs holds the root vdev, logs, caches and spares are listed apart
+	Vdevs  Vdevs `json:"vdevs"`
+	Logs   Vdevs `json:"logs"`
+	Cache  Vdevs `json:"l2cache"`
+	Spares Vdevs `json:"spares"`
+}
+
+// Scan is the last or running scrub or resilver of a pool
+type Scan struct {
+	// Function is SCRUB or RESILVER, State SCANNING, FINISHED or CANCELED
+	Function  string `json:"function"`
+	State     string `json:"state"`
+	StartTime Value  `json:"start_time"`
+	EndTime   Value  `json:"end_time"`
+	ToExamine Value  `json:"to_examine"`
+	Examined  Value  `json:"examined"`
+	Skipped   Value  `json:"skipped"`
+	Issued    Value  `json:"issued"`
+	Errors    Value  `json:"errors"`
+}
+
+// Vdev is a device of a pool with the devices below it
+type Vdev struct {
+	Name string `json:"name"`
+	Type string `json:"vdev_type"`
+	// Path is the device node of leaf vdevs
+	Path           string `json:"path"`
+	State          string `json:"state"`
+	ReadErrors     Value  `json:"read_errors"`
+	WriteErrors    Value  `json:"write_errors"`
+	ChecksumErrors Value  `json:"checksum_errors"`
+	Vdevs          Vdevs  `json:"vdevs"`
+}
+
+// Vdevs are the vdevs of an object keyed by name, in the order zpool prints
+// them
+type Vdevs []Vdev
+
+// UnmarshalJSON keeps the order of the vdevs
+func (vs *Vdevs) UnmarshalJSON(data []byte) error {
+	*vs = nil
+	return members(data, func(name string, raw json.RawMessage) error {
+		v := Vdev{Name: name}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("vdev %s: %w", name, err)
+		}
+		*vs = append(*vs, v)
+		return nil
+	})
+}
+
+// Pools returns the pools of zpool status -j in the order they are printed
+func Pools(out []byte) ([]Pool, error) {
+	var doc struct {
+		Version *json.RawMessage `json:"output_version"`
+		Pools   json.RawMessage  `json:"pools"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil || doc.Version == nil {
+		return nil, ErrNotJSON
+	}
+	var pools []Pool
+	err := members(doc.Pools, func(name string, raw json.RawMessage) error {
+		p := Pool{Name: name}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+		pools = append(pools, p)
+		return nil
+	})
+	return pools, err
+}
+
+// members calls fn with the members of the JSON object data in order, as
+// maps lose the order zfs prints datasets and vdevs in. Missing objects and
+// null have no members.
+func members(data []byte, fn func(name string, raw json.RawMessage) error) error {
+	if len(bytes.TrimSpace(data)) == 0 || string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return fmt.Errorf("expected a JSON object, got %.20q", data)
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		if err := fn(t.(string), raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
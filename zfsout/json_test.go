@@ -0,0 +1,121 @@
+package zfsout
+
+import (
+	"reflect"
+	"testing"
+)
+
+const listJSON = `{
+  "output_version": {"command": "zfs list", "vers_major": 0, "vers_minor": 1},
+  "datasets": {
+    "tank/docker": {
+      "name": "tank/docker", "type": "FILESYSTEM", "pool": "tank", "createtxg": "12",
+      "properties": {
+        "used": {"value": "98304", "source": {"type": "NONE", "data": "-"}},
+        "compression": {"value": "lz4", "source": {"type": "INHERITED", "data": "tank"}}
+      }
+    },
+    "tank/docker/b": {
+      "name": "tank/docker/b", "type": "FILESYSTEM", "pool": "tank",
+      "properties": {"quota": {"value": 10737418240, "source": {"type": "LOCAL", "data": "-"}}}
+    },
+    "tank/docker/a": {"name": "tank/docker/a", "type": "FILESYSTEM", "pool": "tank"}
+  }
+}`
+
+func TestDatasets(t *testing.T) {
+	dss, err := Datasets([]byte(listJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ds := range dss {
+		names = append(names, ds.Name)
+	}
+	if want := []string{"tank/docker", "tank/docker/b", "tank/docker/a"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("names = %q, want %q", names, want)
+	}
+	want := map[string]Property{
+		"used":        {Value: "98304", Source: "-"},
+		"compression": {Value: "lz4", Source: "inherited from tank"},
+	}
+	if !reflect.DeepEqual(dss[0].Properties, want) {
+		t.Fatalf("properties = %v, want %v", dss[0].Properties, want)
+	}
+	if p := dss[1].Properties["quota"]; p.Value != "10737418240" || p.Source != "local" {
+		t.Fatalf("quota = %v", p)
+	}
+}
+
+func TestNotJSON(t *testing.T) {
+	for _, out := range []string{"tank/docker\ntank/docker/a\n", `{"datasets": {}}`, ""} {
+		if _, err := Datasets([]byte(out)); err != ErrNotJSON {
+			t.Errorf("Datasets(%q) = %v, want ErrNotJSON", out, err)
+		}
+		if _, err := Pools([]byte(out)); err != ErrNotJSON {
+			t.Errorf("Pools(%q) = %v, want ErrNotJSON", out, err)
+		}
+	}
+}
+
+const statusJSON = `{
+  "output_version": {"command": "zpool status", "vers_major": 0, "vers_minor": 1},
+  "pools": {
+    "tank": {
+      "name": "tank", "state": "DEGRADED",
+      "status": "One or more devices has been removed.",
+      "action": "Online the device using zpool online.",
+      "scan_stats": {"function": "RESILVER", "state": "SCANNING", "to_examine": "1000",
+        "examined": "600", "skipped": "0", "issued": "500", "errors": "0"},
+      "vdevs": {
+        "tank": {"name": "tank", "vdev_type": "root", "state": "DEGRADED",
+          "read_errors": "0", "write_errors": "0", "checksum_errors": "0",
+          "vdevs": {
+            "mirror-0": {"name": "mirror-0", "vdev_type": "mirror", "state": "DEGRADED",
+              "read_errors": "0", "write_errors": "0", "checksum_errors": "0",
+              "vdevs": {
+                "sdb": {"name": "sdb", "vdev_type": "disk", "path": "/dev/sdb1", "state": "ONLINE",
+                  "read_errors": "0", "write_errors": "0", "checksum_errors": "3"},
+                "sda": {"name": "sda", "vdev_type": "disk", "path": "/dev/sda1", "state": "REMOVED",
+                  "read_errors": "1", "write_errors": "2", "checksum_errors": "0"}
+              }
+            }
+          }
+        }
+      },
+      "logs": {"sdc": {"name": "sdc", "vdev_type": "disk", "path": "/dev/sdc1", "state": "ONLINE"}},
+      "error_count": "4"
+    },
+    "backup": {"name": "backup", "state": "ONLINE", "vdevs": {}}
+  }
+}`
+
+func TestPools(t *testing.T) {
+	pools, err := Pools([]byte(statusJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 || pools[0].Name != "tank" || pools[1].Name != "backup" {
+		t.Fatalf("pools = %+v", pools)
+	}
+	p := pools[0]
+	if p.State != "DEGRADED" || p.ErrorCount != "4" || p.Status == "" || p.Action == "" {
+		t.Fatalf("pool = %+v", p)
+	}
+	if p.Scan == nil || p.Scan.Function != "RESILVER" || p.Scan.State != "SCANNING" || p.Scan.Issued != "500" {
+		t.Fatalf("scan = %+v", p.Scan)
+	}
+	mirror := p.Vdevs[0].Vdevs[0]
+	if mirror.Name != "mirror-0" || len(mirror.Vdevs) != 2 {
+		t.Fatalf("mirror = %+v", mirror)
+	}
+	if d := mirror.Vdevs[0]; d.Name != "sdb" || d.Path != "/dev/sdb1" || d.ChecksumErrors != "3" {
+		t.Fatalf("first disk = %+v", d)
+	}
+	if d := mirror.Vdevs[1]; d.State != "REMOVED" || d.ReadErrors != "1" || d.WriteErrors != "2" {
+		t.Fatalf("second disk = %+v", d)
+	}
+	if len(p.Logs) != 1 || p.Logs[0].Path != "/dev/sdc1" {
+		t.Fatalf("logs = %+v", p.Logs)
+	}
+}
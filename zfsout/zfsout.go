@@ -0,0 +1,115 @@
+// Package zfsout parses the scripted output of zfs and zpool, as printed
+// with -H, which separates fields by a single tab and omits headers, and -p,
+// which prints numbers and times in exact, locale independent form. Values
+// may contain spaces but never tabs. OpenZFS 2.3 and later also print JSON
+// with -j, which Datasets and Pools decode.
+package zfsout
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lines returns the non empty lines of out without surrounding whitespace
+func Lines(out []byte) []string {
+	var ls []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+// Records returns the lines of out with exactly n tab separated fields, other
+// lines, such as warnings zfs prints to stdout, are skipped. Only the line
+// ends are trimmed, so empty fields are kept.
+func Records(out []byte, n int) [][]string {
+	return records(out, func(f int) bool { return f == n })
+}
+
+// RecordsAtLeast returns the lines of out with n or more tab separated
+// fields, for output which gained columns in later versions, such as zpool
+// iostat -l
+func RecordsAtLeast(out []byte, n int) [][]string {
+	return records(out, func(f int) bool { return f >= n })
+}
+
+func records(out []byte, fields func(int) bool) [][]string {
+	var rs [][]string
+	for _, l := range strings.Split(string(out), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		if f := strings.Split(l, "\t"); fields(len(f)) {
+			rs = append(rs, f)
+		}
+	}
+	return rs
+}
+
+// Pairs returns the two field records of out as a map from the first field
+// to the second
+func Pairs(out []byte) map[string]string {
+	m := make(map[string]string)
+	for _, r := range Records(out, 2) {
+		m[r[0]] = r[1]
+	}
+	return m
+}
+
+// Property is a value of zfs get with where it comes from, such as local,
+// default, received or inherited from <dataset>
+type Property struct {
+	Value  string
+	Source string
+}
+
+// Properties parses zfs get -H -p -o name,property,value,source into the
+// properties of every dataset
+func Properties(out []byte) map[string]map[string]Property {
+	ps := make(map[string]map[string]Property)
+	for _, r := range Records(out, 4) {
+		if ps[r[0]] == nil {
+			ps[r[0]] = make(map[string]Property)
+		}
+		ps[r[0]][r[1]] = Property{Value: r[2], Source: r[3]}
+	}
+	return ps
+}
+
+// Unset reports whether v is how zfs prints a property without a value
+func Unset(v string) bool {
+	return v == "" || v == "-"
+}
+
+// Uint parses a number printed with -p, false if it is unset or not a number
+func Uint(v string) (uint64, bool) {
+	n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+	return n, err == nil
+}
+
+// Time parses a time printed with -p, in seconds since the epoch
+func Time(v string) (time.Time, bool) {
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0), true
+}
+
+// CLocale returns env with the C locale, so messages and the formats -p does
+// not cover are the same on every host. Other locale variables are dropped,
+// as LC_ALL overrides them anyway.
+func CLocale(env []string) []string {
+	out := make([]string, 0, len(env)+1)
+	for _, e := range env {
+		if strings.HasPrefix(e, "LC_") || strings.HasPrefix(e, "LANG=") || strings.HasPrefix(e, "LANGUAGE=") {
+			continue
+		}
+		out = append(out, e)
+	}
+	return append(out, "LC_ALL=C")
+}
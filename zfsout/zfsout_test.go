@@ -0,0 +1,113 @@
+package zfsout
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLines(t *testing.T) {
+	got := Lines([]byte("tank/a\n\n  tank/b \r\ntank/with space\n"))
+	want := []string{"tank/a", "tank/b", "tank/with space"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Lines = %q, want %q", got, want)
+	}
+	if got := Lines(nil); len(got) != 0 {
+		t.Fatalf("Lines(nil) = %q, want none", got)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	out := []byte("tank/a\t10\t20\n" +
+		"warning: something odd\n" +
+		"tank/b\t\t30\r\n" +
+		"tank/c\t1\n" +
+		"\n")
+	got := Records(out, 3)
+	want := [][]string{{"tank/a", "10", "20"}, {"tank/b", "", "30"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Records = %q, want %q", got, want)
+	}
+}
+
+func TestRecordsAtLeast(t *testing.T) {
+	out := []byte("tank\t1\t2\n" +
+		"warning: something odd\n" +
+		"data\t3\t4\t5\r\n")
+	got := RecordsAtLeast(out, 3)
+	want := [][]string{{"tank", "1", "2"}, {"data", "3", "4", "5"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("RecordsAtLeast = %q, want %q", got, want)
+	}
+}
+
+func TestPairs(t *testing.T) {
+	got := Pairs([]byte("compression\tlz4\nquota\t10737418240\nbad line\n"))
+	want := map[string]string{"compression": "lz4", "quota": "10737418240"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Pairs = %v, want %v", got, want)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	out := []byte("tank/a\tcompression\tlz4\tlocal\n" +
+		"tank/a\tdocker-zfs-plugin:guid\t-\t-\n" +
+		"tank/b\tcompression\toff\tinherited from tank\n")
+	got := Properties(out)
+	want := map[string]map[string]Property{
+		"tank/a": {
+			"compression":            {Value: "lz4", Source: "local"},
+			"docker-zfs-plugin:guid": {Value: "-", Source: "-"},
+		},
+		"tank/b": {"compression": {Value: "off", Source: "inherited from tank"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Properties = %v, want %v", got, want)
+	}
+}
+
+func TestUint(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"10737418240", 10737418240, true},
+		{" 0\n", 0, true},
+		{"-", 0, false},
+		{"none", 0, false},
+		{"10G", 0, false},
+		{"1,024", 0, false},
+	} {
+		got, ok := Uint(c.in)
+		if got != c.want || ok != c.ok {
+			t.Errorf("Uint(%q) = %d, %v, want %d, %v", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestTime(t *testing.T) {
+	got, ok := Time("1700000000")
+	if !ok || !got.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("Time = %v, %v", got, ok)
+	}
+	if _, ok := Time("Tue Nov 14 22:13 2023"); ok {
+		t.Fatal("Time parsed a formatted date")
+	}
+}
+
+func TestUnset(t *testing.T) {
+	for v, want := range map[string]bool{"": true, "-": true, "none": false, "0": false} {
+		if got := Unset(v); got != want {
+			t.Errorf("Unset(%q) = %v, want %v", v, got, want)
+		}
+	}
+}
+
+func TestCLocale(t *testing.T) {
+	got := CLocale([]string{"PATH=/usr/bin", "LANG=de_DE.UTF-8", "LC_NUMERIC=de_DE.UTF-8", "LANGUAGE=de", "HOME=/root"})
+	want := []string{"PATH=/usr/bin", "HOME=/root", "LC_ALL=C"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("CLocale = %q, want %q", got, want)
+	}
+}